@@ -5,6 +5,5 @@ go 1.21
 require (
 	github.com/google/uuid v1.5.0
 	github.com/mattn/go-sqlite3 v1.14.19
-	golang.org/x/crypto v0.17.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// dashboardRefresh is how often `status -watch` redraws
+const dashboardRefresh = 2 * time.Second
+
+// newFlagSet returns the flags of a subcommand. -config is accepted after
+// the subcommand as well as before it.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(configPath, "config", *configPath, "Path to config file (default: ~/.config/gpu-agent/config.json)")
+	return fs
+}
+
+// initCommand runs `gpu-agent init`: it asks for the settings needed to
+// join the pool and writes them to the config file
+func initCommand(args []string) int {
+	fs := newFlagSet("init")
+	fs.Parse(args)
+
+	path := *configPath
+	if path == "" {
+		path = DefaultConfigPath()
+	}
+	in := bufio.NewReader(os.Stdin)
+	ask := func(question, def string) string {
+		if def != "" {
+			fmt.Printf("%s [%s]: ", question, def)
+		} else {
+			fmt.Printf("%s: ", question)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println()
+			os.Exit(1)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+		return def
+	}
+	required := func(question, def string) string {
+		for {
+			if answer := ask(question, def); answer != "" {
+				return answer
+			}
+			fmt.Println("  This is required.")
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if !strings.EqualFold(ask(path+" exists. Overwrite it? (y/N)", "n"), "y") {
+			return 1
+		}
+	}
+
+	fmt.Println("Join this machine to a GPU pool. Your pool admin gives you the server URL and an enrollment token.")
+	hostname, _ := os.Hostname()
+	cfg := &Config{
+		AgentConfig: shared.AgentConfig{
+			ServerURL:       strings.TrimRight(required("Server URL", ""), "/"),
+			EnrollmentToken: required("Enrollment token", ""),
+		},
+		Name: ask("Agent name", hostname),
+	}
+	cfg.LlamaServerPath = ask("llama-server binary", "llama-server")
+	if _, err := exec.LookPath(cfg.LlamaServerPath); err != nil {
+		fmt.Printf("  Warning: %s not found; install llama.cpp before running the agent.\n", cfg.LlamaServerPath)
+	}
+
+	fmt.Println("Models this agent serves. Names must match the server's model registry.")
+	for {
+		name := ask("Model name (empty when done)", "")
+		if name == "" {
+			if len(cfg.Models) > 0 {
+				break
+			}
+			fmt.Println("  At least one model is required.")
+			continue
+		}
+		m := ModelConfig{Name: name, Path: required("  GGUF file", "")}
+		if _, err := os.Stat(m.Path); err != nil {
+			fmt.Printf("  Warning: %v\n", err)
+		}
+		m.Quantization = ask("  Quantization, e.g. Q4_K_M", "")
+		m.MaxContext, _ = strconv.Atoi(ask("  Context length", "4096"))
+		if kind := ask("  Kind (generate or embed)", shared.ModelKindGenerate); kind != shared.ModelKindGenerate {
+			m.Kind = kind
+		}
+		cfg.Models = append(cfg.Models, m)
+	}
+
+	if err := SaveConfig(cfg, path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := LoadConfig(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Wrote %s, but it is not valid: %v\n", path, err)
+		return 1
+	}
+	fmt.Printf("Wrote %s. Check the setup with `gpu-agent doctor`, then start the agent with `gpu-agent run`.\n", path)
+	return 0
+}
+
+// detectCommand runs `gpu-agent detect`: it prints the GPUs the agent
+// would use and which detector found them
+func detectCommand(args []string) int {
+	fs := newFlagSet("detect")
+	asJSON := fs.Bool("json", false, "Print the detection result as JSON")
+	fs.Parse(args)
+
+	d := RunGPUDetection()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(d)
+		return 0
+	}
+
+	fmt.Printf("Detected by %s:\n", d.Detector)
+	for i, gpu := range d.GPUs {
+		used := ""
+		if i == 0 {
+			used = " (used by the agent)"
+		}
+		fmt.Printf("  %s\t%s%s\n", gpu.ID, gpu.String(), used)
+	}
+	for _, name := range []string{detectorLlamaServer, detectorNVIDIASMI, detectorSystemProfiler} {
+		if err, ok := d.Failed[name]; ok {
+			fmt.Printf("%s found nothing: %s\n", name, err)
+		}
+	}
+	return 0
+}
+
+// statusCommand runs `gpu-agent status`: it prints the running agent's
+// status once, as JSON, or as a dashboard redrawn until interrupted
+func statusCommand(args []string) int {
+	fs := newFlagSet("status")
+	addr := fs.String("addr", "", "Status API address (default: status_addr from config)")
+	asJSON := fs.Bool("json", false, "Print the raw status report")
+	watch := fs.Bool("watch", false, "Keep redrawing the status until interrupted")
+	fs.Parse(args)
+
+	client := statusClient(*addr)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !*watch {
+		report, err := fetchStatus(ctx, client)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(report)
+			return 0
+		}
+		printStatus(os.Stdout, report)
+		return 0
+	}
+
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+	for {
+		// Clear the screen and draw from the top
+		fmt.Print("\x1b[H\x1b[2J")
+		report, err := fetchStatus(ctx, client)
+		if err != nil && ctx.Err() == nil {
+			fmt.Println(err)
+		} else if err == nil {
+			printStatus(os.Stdout, report)
+		}
+		fmt.Printf("\nUpdated %s, every %s. Ctrl-C quits; gpu-agent pause, resume and drain control the agent.\n",
+			time.Now().Format("15:04:05"), dashboardRefresh)
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// controlCommand runs `gpu-agent pause`, `resume` or `drain` against the
+// running agent
+func controlCommand(name string, args []string) int {
+	fs := newFlagSet(name)
+	addr := fs.String("addr", "", "Status API address (default: status_addr from config)")
+	fs.Parse(args)
+
+	var report StatusReport
+	_, err := statusClient(*addr).do(context.Background(), http.MethodPost, "/"+name, nil, &report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", name, err)
+		return 1
+	}
+	printStatus(os.Stdout, report)
+	return 0
+}
+
+// statusClient returns a client for the status API at addr, or at the
+// configured address if addr is empty. The config may not be readable by
+// whoever runs the command, in which case the default address is tried.
+func statusClient(addr string) *HeartbeatClient {
+	if addr == "" {
+		addr = defaultStatusAddr
+		if cfg, err := LoadConfig(*configPath); err == nil {
+			addr = cfg.StatusAddr
+		}
+	}
+	return NewHeartbeatClient("http://"+addr, "")
+}
+
+// fetchStatus asks the running agent for its status
+func fetchStatus(ctx context.Context, client *HeartbeatClient) (StatusReport, error) {
+	var report StatusReport
+	_, err := client.do(ctx, http.MethodGet, "/status", nil, &report)
+	var apiErr *APIError
+	if err != nil && !errors.As(err, &apiErr) {
+		return report, fmt.Errorf("agent not reachable at %s, is it running? (%v)", client.serverURL, err)
+	}
+	return report, err
+}
+
+// printStatus writes a status report for people to read
+func printStatus(w io.Writer, r StatusReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	agent := r.Name
+	if r.AgentID != "" {
+		agent += " (" + r.AgentID + ")"
+	}
+	fmt.Fprintf(tw, "Agent\t%s\n", agent)
+	fmt.Fprintf(tw, "Version\t%s\n", r.Version)
+
+	server := r.ServerURL
+	if r.OfflineSec > 0 {
+		server += fmt.Sprintf(" - unreachable for %s", time.Duration(r.OfflineSec)*time.Second)
+	}
+	fmt.Fprintf(tw, "Server\t%s\n", server)
+
+	state := r.State
+	if r.PausedReason != "" {
+		state += " (" + r.PausedReason + ")"
+	}
+	fmt.Fprintf(tw, "State\t%s\n", state)
+
+	for i, gpu := range r.GPUs {
+		line := gpu.String()
+		if i == 0 {
+			if r.OfferedVRAMMB != gpu.VRAM_MB {
+				line += fmt.Sprintf(", offering %d MB", r.OfferedVRAMMB)
+			}
+			if r.TemperatureC > 0 {
+				line += fmt.Sprintf(", %d°C", r.TemperatureC)
+			}
+		} else {
+			line += " (unused)"
+		}
+		fmt.Fprintf(tw, "GPU\t%s\n", line)
+	}
+
+	fmt.Fprintf(tw, "Model\t%s\n", orNone(r.LoadedModel))
+	fmt.Fprintf(tw, "Job\t%s\n", orNone(r.CurrentJob))
+	fmt.Fprintf(tw, "Uptime\t%s\n", time.Duration(r.UptimeSec)*time.Second)
+	if r.Policy != nil {
+		fmt.Fprintf(tw, "Policy\t%s\n", describePolicy(r.Policy))
+	}
+	tw.Flush()
+
+	if len(r.Heartbeats) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nRecent heartbeats")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i := len(r.Heartbeats) - 1; i >= 0; i-- {
+		hb := r.Heartbeats[i]
+		result := fmt.Sprintf("ok, next in %ds", hb.NextInterval)
+		if hb.Error != "" {
+			result = "failed: " + hb.Error
+		}
+		if len(hb.Commands) > 0 {
+			result += ", commands " + strings.Join(hb.Commands, " ")
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", hb.At.Local().Format("15:04:05"), hb.Status, result)
+	}
+	tw.Flush()
+}
+
+// describePolicy summarises a contribution policy on one line
+func describePolicy(p *PolicyConfig) string {
+	var parts []string
+	if len(p.Windows) > 0 {
+		parts = append(parts, "windows "+strings.Join(p.Windows, ", "))
+	}
+	if p.IdleOnly {
+		parts = append(parts, fmt.Sprintf("idle for %dm", p.IdleMinutes))
+	}
+	if p.MaxVRAMPercent > 0 {
+		parts = append(parts, fmt.Sprintf("%d%% of VRAM", p.MaxVRAMPercent))
+	}
+	if p.MaxTemperatureC > 0 {
+		parts = append(parts, fmt.Sprintf("below %d°C", p.MaxTemperatureC))
+	}
+	if len(p.PauseProcesses) > 0 {
+		parts = append(parts, "not while "+strings.Join(p.PauseProcesses, ", ")+" runs")
+	}
+	if len(parts) == 0 {
+		return "always"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// orNone returns s, or "-" if it is empty
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// redirectStdio feeds input to the command under test and returns a
+// function reading what it has printed so far
+func redirectStdio(t *testing.T, input string) func() string {
+	t.Helper()
+	dir := t.TempDir()
+	in := filepath.Join(dir, "stdin")
+	if err := os.WriteFile(in, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIn, oldOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	t.Cleanup(func() {
+		os.Stdin, os.Stdout = oldIn, oldOut
+		stdin.Close()
+		stdout.Close()
+	})
+	return func() string {
+		data, _ := os.ReadFile(stdout.Name())
+		return string(data)
+	}
+}
+
+// useConfigPath points -config at path for the test
+func useConfigPath(t *testing.T, path string) {
+	old := *configPath
+	*configPath = path
+	t.Cleanup(func() { *configPath = old })
+}
+
+func TestInitWritesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	useConfigPath(t, path)
+	model := writeConfig(t, "llama.gguf", "")
+	// URL, token, name, llama-server, then one model and an empty name to finish
+	redirectStdio(t, "https://pool.example.com/\nenroll-me\ndesk\n\nllama\n"+model+"\nQ4_K_M\n8192\n\n\n")
+
+	if code := initCommand(nil); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.ServerURL != "https://pool.example.com" || cfg.EnrollmentToken != "enroll-me" || cfg.Name != "desk" || cfg.LlamaServerPath != "llama-server" {
+		t.Errorf("config %+v", cfg)
+	}
+	if len(cfg.Models) != 1 || cfg.Models[0] != (ModelConfig{Name: "llama", Path: model, Quantization: "Q4_K_M", MaxContext: 8192, Kind: shared.ModelKindGenerate}) {
+		t.Errorf("models %+v", cfg.Models)
+	}
+}
+
+func TestInitRequiresAModel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	useConfigPath(t, path)
+	stdout := redirectStdio(t, "https://pool.example.com\nenroll-me\ndesk\nllama-server\n\nllama\n/models/llama.gguf\n\n\n\n\n")
+
+	if code := initCommand(nil); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	if !strings.Contains(stdout(), "At least one model is required.") {
+		t.Errorf("finishing without a model wasn't refused:\n%s", stdout())
+	}
+}
+
+func TestInitKeepsExistingConfig(t *testing.T) {
+	path := writeConfig(t, "config.json", testConfigJSON)
+	useConfigPath(t, path)
+	redirectStdio(t, "\n")
+
+	if code := initCommand(nil); code != 1 {
+		t.Errorf("exit code %d, want 1 when not overwriting", code)
+	}
+	if data, _ := os.ReadFile(path); string(data) != testConfigJSON {
+		t.Errorf("config changed to:\n%s", data)
+	}
+}
+
+func TestDetectFallsBackToCPU(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	stdout := redirectStdio(t, "")
+
+	if code := detectCommand([]string{"-json"}); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	var d GPUDetection
+	if err := json.Unmarshal([]byte(stdout()), &d); err != nil {
+		t.Fatalf("decoding %q: %v", stdout(), err)
+	}
+	if d.Detector != detectorCPU || len(d.GPUs) != 1 || d.Failed[detectorLlamaServer] == "" {
+		t.Errorf("detection %+v, want the CPU after llama-server failed", d)
+	}
+	if runtime.GOOS == "linux" && d.Failed[detectorNVIDIASMI] == "" {
+		t.Errorf("nvidia-smi not tried: %+v", d.Failed)
+	}
+}
+
+func TestParseLlamaServerOutput(t *testing.T) {
+	gpus, err := parseLlamaServerOutput("Available devices:\n  GPU 0: NVIDIA GeForce RTX 4090 CC 8.9 (24564 MB)\nMetal: Apple M2 Max\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GPUInfo{
+		{ID: "cuda:0", Type: "nvidia", Name: "NVIDIA GeForce RTX 4090 CC 8.9", VRAM_MB: 24564, ComputeCap: "8.9"},
+		{ID: "metal:0", Type: "apple", Name: "Apple M2 Max", ComputeCap: "apple3"},
+	}
+	if len(gpus) != 2 || gpus[0] != want[0] || gpus[1] != want[1] {
+		t.Errorf("got %+v, want %+v", gpus, want)
+	}
+}
@@ -1,60 +1,326 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
 )
 
-// Config holds agent configuration
+// Config holds agent configuration: the shared connection settings and
+// the agent's own. It is read from JSON or YAML, by the file's extension,
+// and the top-level settings can be overridden from the environment, e.g.
+// GPU_AGENT_SERVER_URL or GPU_AGENT_LOCAL_PORT.
 type Config struct {
-	ServerURL string `json:"server_url"`
-	APIKey    string `json:"api_key"`
-	AgentID   string `json:"agent_id,omitempty"` // Assigned by server on first registration
-	LogLevel  string `json:"log_level,omitempty"`
+	shared.AgentConfig `yaml:",inline"`
+
+	Name            string         `json:"name,omitempty" yaml:"name,omitempty"`
+	LogLevel        string         `json:"log_level,omitempty" yaml:"log_level,omitempty"`         // debug, info, warn or error
+	LogFormat       string         `json:"log_format,omitempty" yaml:"log_format,omitempty"`       // text or json
+	OTLPEndpoint    string         `json:"otlp_endpoint,omitempty" yaml:"otlp_endpoint,omitempty"` // OTLP/HTTP collector; empty disables trace export
+	StatusAddr      string         `json:"status_addr,omitempty" yaml:"status_addr,omitempty"`     // local status API, loopback only; "off" disables it
+	Models          []ModelConfig  `json:"models" yaml:"models"`
+	Policy          *PolicyConfig  `json:"policy,omitempty" yaml:"policy,omitempty"`                       // when the GPU is offered to the pool; unset means always
+	UpdatePublicKey string         `json:"update_public_key,omitempty" yaml:"update_public_key,omitempty"` // base64 ed25519 key releases are signed with; overrides the built-in one, "off" disables self-update
+	Sandbox         *SandboxConfig `json:"sandbox,omitempty" yaml:"sandbox,omitempty"`                     // how llama-server is restricted; unset means all the host supports
+	PromptCacheMB   int            `json:"prompt_cache_mb,omitempty" yaml:"prompt_cache_mb,omitempty"`     // cap on the RAM llama-server keeps prompt caches in; 0 leaves its default
+
+	fromEnv []envOverride // settings taken from the environment
+}
+
+// envOverride is a setting taken from the environment instead of the file
+type envOverride struct {
+	field    []int // index in Config, as for reflect.Value.FieldByIndex
+	variable string
+	file     any // the file's value, which is what gets saved
+	env      any
+}
+
+// SandboxConfig tunes the restricted profile llama-server runs with. The
+// parts the host can't provide are skipped and reported at startup.
+type SandboxConfig struct {
+	Disabled     bool `json:"disabled,omitempty" yaml:"disabled,omitempty"`             // run llama-server unrestricted
+	MaxMemoryMB  int  `json:"max_memory_mb,omitempty" yaml:"max_memory_mb,omitempty"`   // limit on its heap; default 3/4 of RAM
+	MaxOpenFiles int  `json:"max_open_files,omitempty" yaml:"max_open_files,omitempty"` // default 1024
 }
 
-// DefaultConfigPath returns the default config file path
+// PolicyConfig limits when and how much of the GPU a workstation offers to
+// the pool. Work pauses whenever any limit is hit.
+type PolicyConfig struct {
+	// Windows are the times work is taken, in local time, e.g.
+	// "Mon-Fri 18:00-08:00", "Sat,Sun" or "22:00-07:00". A window ending
+	// before it starts runs past midnight. Empty means any time.
+	Windows         []string `json:"windows,omitempty" yaml:"windows,omitempty"`
+	IdleOnly        bool     `json:"idle_only,omitempty" yaml:"idle_only,omitempty"`                 // only while the user is away
+	IdleMinutes     int      `json:"idle_minutes,omitempty" yaml:"idle_minutes,omitempty"`           // without input before the user counts as away; default 5
+	MaxVRAMPercent  int      `json:"max_vram_percent,omitempty" yaml:"max_vram_percent,omitempty"`   // share of VRAM offered; 0 means all
+	MaxTemperatureC int      `json:"max_temperature_c,omitempty" yaml:"max_temperature_c,omitempty"` // pause while the GPU is hotter; 0 means no limit
+	PauseProcesses  []string `json:"pause_processes,omitempty" yaml:"pause_processes,omitempty"`     // pause while any of these programs runs, e.g. "steam"
+}
+
+// ModelConfig describes a model file this agent can serve
+type ModelConfig struct {
+	Name         string `json:"name" yaml:"name"`
+	Path         string `json:"path" yaml:"path"` // GGUF file passed to llama-server -m
+	Quantization string `json:"quantization,omitempty" yaml:"quantization,omitempty"`
+	MaxContext   int    `json:"max_context,omitempty" yaml:"max_context,omitempty"`
+	Kind         string `json:"kind,omitempty" yaml:"kind,omitempty"` // "generate" (default) or "embed"
+}
+
+// defaultStatusAddr is where the local status API listens unless configured
+const defaultStatusAddr = "127.0.0.1:8090"
+
+// envPrefix starts the names of the environment variables overriding
+// top-level settings: GPU_AGENT_ and the setting's name in capitals
+const envPrefix = "GPU_AGENT_"
+
+// DefaultConfigPath returns the default config file path: config.yaml or
+// config.yml if there is one, otherwise config.json
 func DefaultConfigPath() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "gpu-agent.json"
 	}
-	return filepath.Join(home, ".config", "gpu-agent", "config.json")
+	dir := filepath.Join(home, ".config", "gpu-agent")
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return filepath.Join(dir, "config.json")
 }
 
-// LoadConfig loads configuration from file
+// LoadConfig loads configuration from file, applies the environment's
+// overrides and validates the result, reporting every invalid setting
 func LoadConfig(path string) (*Config, error) {
 	if path == "" {
 		path = DefaultConfigPath()
 	}
 
-	data, err := os.ReadFile(path)
+	cfg, err := shared.LoadConfig[Config](path)
 	if err != nil {
-		return nil, fmt.Errorf("reading config file: %w", err)
+		return nil, err
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
 	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parsing config: %w", err)
+// settingName returns the name of a top-level setting, as in the file
+func settingName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+// settingFields returns the fields of the top-level settings, including
+// those of the embedded shared.AgentConfig
+func settingFields() []reflect.StructField {
+	var fields []reflect.StructField
+	for _, f := range reflect.VisibleFields(reflect.TypeOf(Config{})) {
+		if settingName(f) != "" {
+			fields = append(fields, f)
+		}
 	}
+	return fields
+}
 
-	if cfg.ServerURL == "" {
-		return nil, fmt.Errorf("server_url is required")
+// applyEnv overrides scalar top-level settings from the environment.
+// Models, policy and sandbox only come from the file.
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	var errs []error
+	for _, field := range settingFields() {
+		variable := envPrefix + strings.ToUpper(settingName(field))
+		value, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+
+		f := v.FieldByIndex(field.Index)
+		file := f.Interface()
+		switch {
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration", variable, value))
+				continue
+			}
+			f.SetInt(int64(d))
+		case f.Kind() == reflect.String:
+			f.SetString(value)
+		case f.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", variable, value))
+				continue
+			}
+			f.SetInt(int64(n))
+		default:
+			continue
+		}
+		c.fromEnv = append(c.fromEnv, envOverride{field: field.Index, variable: variable, file: file, env: f.Interface()})
 	}
-	if cfg.APIKey == "" {
-		return nil, fmt.Errorf("api_key is required")
+	return errors.Join(errs...)
+}
+
+// setting names a top-level setting in an error, with the environment
+// variable it came from if it did
+func (c *Config) setting(name string) string {
+	for _, o := range c.fromEnv {
+		if settingName(reflect.TypeOf(*c).FieldByIndex(o.field)) == name {
+			return fmt.Sprintf("%s (from %s)", name, o.variable)
+		}
 	}
+	return name
+}
 
-	if cfg.LogLevel == "" {
-		cfg.LogLevel = "info"
+// validate checks the settings and fills in defaults. Every invalid setting
+// is reported, each by its path in the file, e.g. models[1].path.
+func (c *Config) validate() error {
+	var errs []error
+	invalid := func(setting, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
 	}
 
-	return &cfg, nil
+	if c.ServerURL == "" {
+		invalid(c.setting("server_url"), "is required")
+	} else if u, err := url.Parse(c.ServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid(c.setting("server_url"), "%q is not an http or https URL", c.ServerURL)
+	}
+	if c.APIKey == "" && c.EnrollmentToken == "" {
+		invalid(c.setting("api_key"), "is required, or an enrollment_token to get one")
+	}
+
+	if len(c.Models) == 0 {
+		invalid("models", "at least one model is required")
+	}
+	names := make(map[string]int)
+	for i, m := range c.Models {
+		setting := fmt.Sprintf("models[%d]", i)
+		if m.Name == "" {
+			invalid(setting+".name", "is required")
+		} else if first, dup := names[m.Name]; dup {
+			invalid(setting+".name", "%q is also models[%d]", m.Name, first)
+		} else {
+			names[m.Name] = i
+		}
+		if m.Path == "" {
+			invalid(setting+".path", "is required")
+		}
+		if m.MaxContext < 0 {
+			invalid(setting+".max_context", "must not be negative")
+		}
+		if m.MaxContext == 0 {
+			c.Models[i].MaxContext = 4096
+		}
+		switch m.Kind {
+		case "":
+			c.Models[i].Kind = shared.ModelKindGenerate
+		case shared.ModelKindGenerate, shared.ModelKindEmbed:
+		default:
+			invalid(setting+".kind", "must be generate or embed, not %q", m.Kind)
+		}
+	}
+
+	if p := c.Policy; p != nil {
+		if _, err := parseWindows(p.Windows); err != nil {
+			invalid("policy.windows", "%v", err)
+		}
+		if p.MaxVRAMPercent < 0 || p.MaxVRAMPercent > 100 {
+			invalid("policy.max_vram_percent", "must be between 0 and 100")
+		}
+		if p.IdleMinutes < 0 {
+			invalid("policy.idle_minutes", "must not be negative")
+		}
+		if p.MaxTemperatureC < 0 {
+			invalid("policy.max_temperature_c", "must not be negative")
+		}
+		if p.IdleMinutes == 0 {
+			p.IdleMinutes = 5
+		}
+	}
+
+	if sb := c.Sandbox; sb != nil {
+		if sb.MaxMemoryMB < 0 {
+			invalid("sandbox.max_memory_mb", "must not be negative")
+		}
+		if sb.MaxOpenFiles < 0 {
+			invalid("sandbox.max_open_files", "must not be negative")
+		}
+	}
+
+	switch strings.ToLower(c.LogLevel) {
+	case "":
+		c.LogLevel = "info"
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		invalid(c.setting("log_level"), "must be debug, info, warn or error, not %q", c.LogLevel)
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "":
+		c.LogFormat = "text"
+	case "text", "json":
+	default:
+		invalid(c.setting("log_format"), "must be text or json, not %q", c.LogFormat)
+	}
+	if c.Name == "" {
+		c.Name, _ = os.Hostname()
+	}
+	if c.HeartbeatInterval < 0 {
+		invalid(c.setting("heartbeat_interval"), "must not be negative")
+	}
+	c.AgentConfig.SetDefaults()
+	if c.LocalPort < 1 || c.LocalPort > 65535 {
+		invalid(c.setting("local_port"), "must be between 1 and 65535")
+	}
+	if c.PromptCacheMB < 0 {
+		invalid(c.setting("prompt_cache_mb"), "must not be negative")
+	}
+	if c.StatusAddr == "" {
+		c.StatusAddr = defaultStatusAddr
+	}
+	if c.StatusAddr != "off" {
+		if err := checkLoopback(c.StatusAddr); err != nil {
+			invalid(c.setting("status_addr"), "%v", err)
+		}
+	}
+	if k := c.UpdatePublicKey; k != "" && k != "off" {
+		if _, err := parsePublicKey(k); err != nil {
+			invalid(c.setting("update_public_key"), "%v", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// modelFiles returns the models with their paths resolved against
+// model_cache_dir. The config keeps the paths as written, so they are
+// saved that way.
+func (c *Config) modelFiles() []ModelConfig {
+	models := make([]ModelConfig, len(c.Models))
+	for i, m := range c.Models {
+		if c.ModelCacheDir != "" && m.Path != "" && !filepath.IsAbs(m.Path) {
+			m.Path = filepath.Join(c.ModelCacheDir, m.Path)
+		}
+		models[i] = m
+	}
+	return models
 }
 
-// SaveConfig saves configuration to file
+// SaveConfig saves configuration to file, as JSON or YAML by its extension.
+// Settings taken from the environment are saved with the file's values,
+// unless the agent has changed them since, as it does with a new API key.
 func SaveConfig(cfg *Config, path string) error {
 	if path == "" {
 		path = DefaultConfigPath()
@@ -66,14 +332,12 @@ func SaveConfig(cfg *Config, path string) error {
 		return fmt.Errorf("creating config directory: %w", err)
 	}
 
-	data, err := json.MarshalIndent(cfg, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshaling config: %w", err)
-	}
-
-	if err := os.WriteFile(path, data, 0600); err != nil {
-		return fmt.Errorf("writing config file: %w", err)
+	saved := *cfg
+	v := reflect.ValueOf(&saved).Elem()
+	for _, o := range cfg.fromEnv {
+		if f := v.FieldByIndex(o.field); f.Interface() == o.env {
+			f.Set(reflect.ValueOf(o.file))
+		}
 	}
-
-	return nil
+	return shared.SaveConfig(path, &saved)
 }
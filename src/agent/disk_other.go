@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// freeDiskMB is not implemented on this platform
+func freeDiskMB(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeDiskMB returns the space available to the agent on the file system
+// holding path, in MB
+func freeDiskMB(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", path, err)
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize) >> 20), nil
+}
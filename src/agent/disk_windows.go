@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeDiskMB returns the space available to the agent on the volume
+// holding path, in MB
+func freeDiskMB(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if ok, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&available)), 0, 0); ok == 0 {
+		return 0, fmt.Errorf("GetDiskFreeSpaceEx %s: %w", path, err)
+	}
+	return int64(available >> 20), nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Doctor tuning
+const (
+	doctorTimeout   = 10 * time.Second // per check that talks to something
+	doctorMinFreeMB = 10 * 1024        // less free disk next to the models is a warning
+)
+
+// Doctor check outcomes
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip" // a check it depends on failed
+)
+
+// DoctorReport is the output of `gpu-agent doctor`, meant to be attached
+// to support tickets. It never contains the API key or enrollment token.
+type DoctorReport struct {
+	Time       time.Time     `json:"time"`
+	Host       string        `json:"host"`
+	Version    string        `json:"version"`  // of the agent
+	Platform   string        `json:"platform"` // GOOS/GOARCH
+	ConfigPath string        `json:"config_path"`
+	OK         bool          `json:"ok"` // no check failed
+	Checks     []DoctorCheck `json:"checks"`
+}
+
+// DoctorCheck is the outcome of one check
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok, warn, fail or skip
+	Detail string `json:"detail,omitempty"`
+}
+
+// doctorCommand runs `gpu-agent doctor`: it checks everything the agent
+// needs and prints a JSON report. It exits non-zero if a check failed.
+func doctorCommand(args []string) int {
+	fs := newFlagSet("doctor")
+	fs.Parse(args)
+
+	path := *configPath
+	if path == "" {
+		path = DefaultConfigPath()
+	}
+	host, _ := os.Hostname()
+	report := DoctorReport{
+		Time:       time.Now().UTC().Round(time.Second),
+		Host:       host,
+		Version:    version,
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		ConfigPath: path,
+	}
+	check := func(name, status, format string, args ...any) {
+		report.Checks = append(report.Checks, DoctorCheck{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		check("config", checkFail, "%v", err)
+		for _, name := range []string{"config_writable", "server", "auth", "llama_server", "models", "model_dirs", "sandbox"} {
+			check(name, checkSkip, "no valid config")
+		}
+	} else {
+		check("config", checkOK, "%d models, server %s", len(cfg.Models), cfg.ServerURL)
+		doctorConfigWritable(path, check)
+		if doctorServer(cfg, check) {
+			doctorAuth(cfg, check)
+		} else {
+			check("auth", checkSkip, "server unreachable")
+		}
+		doctorLlamaServer(cfg, check)
+		doctorModels(cfg, check)
+		doctorSandbox(cfg, path, check)
+	}
+	doctorGPUs(check)
+
+	report.OK = true
+	for _, c := range report.Checks {
+		if c.Status == checkFail {
+			report.OK = false
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// doctorCheckFunc records the outcome of a check
+type doctorCheckFunc func(name, status, format string, args ...any)
+
+// doctorConfigWritable checks the agent can save its ID and key to config
+func doctorConfigWritable(path string, check doctorCheckFunc) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		check("config_writable", checkFail, "the agent saves its ID and key here: %v", err)
+		return
+	}
+	f.Close()
+	check("config_writable", checkOK, "")
+}
+
+// doctorServer checks the server answers its health endpoint
+func doctorServer(cfg *Config, check doctorCheckFunc) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewHeartbeatClient(cfg.ServerURL, "").do(ctx, http.MethodGet, "/health", nil, nil)
+	if err != nil {
+		check("server", checkFail, "%v", err)
+		return false
+	}
+	check("server", checkOK, "healthy, answered in %s", time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// doctorAuth checks the server accepts the agent's key
+func doctorAuth(cfg *Config, check doctorCheckFunc) {
+	switch {
+	case cfg.EnrollmentToken != "":
+		check("auth", checkWarn, "enrollment token not used yet; it can only be checked by enrolling, which the agent does on start")
+		return
+	case cfg.AgentID == "":
+		check("auth", checkWarn, "API key set but the agent has not registered yet")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+
+	var info struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	}
+	_, err := NewHeartbeatClient(cfg.ServerURL, cfg.APIKey).do(ctx, http.MethodGet, "/v1/agents/"+cfg.AgentID, nil, &info)
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+		check("auth", checkWarn, "server does not know agent %s; it registers again on start", cfg.AgentID)
+	case err != nil:
+		check("auth", checkFail, "agent %s: %v", cfg.AgentID, err)
+	default:
+		check("auth", checkOK, "agent %s registered as %q, %s", cfg.AgentID, info.Name, info.Status)
+	}
+}
+
+// doctorLlamaServer checks the llama-server binary is there and runs
+func doctorLlamaServer(cfg *Config, check doctorCheckFunc) {
+	path, err := exec.LookPath(cfg.LlamaServerPath)
+	if err != nil {
+		check("llama_server", checkFail, "%v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "--version")
+	cmd.WaitDelay = time.Second // don't wait on children holding the output open
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		check("llama_server", checkWarn, "%s: --version failed: %v", path, err)
+		return
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(bytes.ToValidUTF8(output, nil))), "\n")
+	check("llama_server", checkOK, "%s: %s", path, version)
+}
+
+// doctorModels checks the model files can be read, and that the
+// directories holding them are writable and have room for more
+func doctorModels(cfg *Config, check doctorCheckFunc) {
+	var problems, sizes []string
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, m := range cfg.modelFiles() {
+		f, err := os.Open(m.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", m.Name, err))
+			continue
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", m.Name, err))
+			continue
+		}
+		sizes = append(sizes, fmt.Sprintf("%s %d MB", m.Name, info.Size()>>20))
+
+		if dir := filepath.Dir(m.Path); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(problems) > 0 {
+		check("models", checkFail, "%s", strings.Join(problems, "; "))
+	} else {
+		check("models", checkOK, "%s", strings.Join(sizes, ", "))
+	}
+
+	if len(dirs) == 0 {
+		check("model_dirs", checkSkip, "no readable models")
+		return
+	}
+	status, details := checkOK, []string(nil)
+	for _, dir := range dirs {
+		detail := dir
+		if f, err := os.CreateTemp(dir, ".gpu-agent-doctor-*"); err != nil {
+			status = checkWarn
+			detail += " not writable"
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		if free, err := freeDiskMB(dir); err != nil {
+			detail += fmt.Sprintf(", free space unknown: %v", err)
+		} else {
+			if free < doctorMinFreeMB {
+				status = checkWarn
+			}
+			detail += fmt.Sprintf(", %d MB free", free)
+		}
+		details = append(details, detail)
+	}
+	check("model_dirs", status, "%s", strings.Join(details, "; "))
+}
+
+// doctorSandbox checks which parts of llama-server's sandbox the host
+// supports; missing ones are a warning, as the agent runs without them
+func doctorSandbox(cfg *Config, path string, check doctorCheckFunc) {
+	var on, off []string
+	for _, f := range NewSandbox(cfg, path, cfg.LlamaServerPath).Features() {
+		if f.Enabled {
+			on = append(on, f.Name)
+		} else {
+			off = append(off, f.Name+": "+f.Detail)
+		}
+	}
+	if len(off) > 0 {
+		check("sandbox", checkWarn, "unavailable: %s", strings.Join(off, "; "))
+		return
+	}
+	check("sandbox", checkOK, "%s", strings.Join(on, ", "))
+}
+
+// doctorGPUs reports what GPU detection finds
+func doctorGPUs(check doctorCheckFunc) {
+	d := RunGPUDetection()
+	var names []string
+	for _, gpu := range d.GPUs {
+		names = append(names, gpu.String())
+	}
+	status := checkOK
+	if d.Detector == detectorCPU {
+		status = checkWarn
+	}
+	check("gpus", status, "%s: %s", d.Detector, strings.Join(names, ", "))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// runDoctor runs checks and returns their outcomes by name
+func runDoctor(checks func(check doctorCheckFunc)) map[string]DoctorCheck {
+	got := make(map[string]DoctorCheck)
+	checks(func(name, status, format string, args ...any) {
+		got[name] = DoctorCheck{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)}
+	})
+	return got
+}
+
+// doctorConfig returns a registered agent's config for the server at url
+func doctorConfig(url string) *Config {
+	return &Config{AgentConfig: shared.AgentConfig{ServerURL: url, APIKey: "key", AgentID: "agent-1"}}
+}
+
+func TestDoctorServerHealthy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	got := runDoctor(func(check doctorCheckFunc) { doctorServer(doctorConfig(srv.URL), check) })
+	if got["server"].Status != checkOK {
+		t.Errorf("server check %+v", got["server"])
+	}
+}
+
+func TestDoctorServerUnreachable(t *testing.T) {
+	url := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	got := runDoctor(func(check doctorCheckFunc) { doctorServer(doctorConfig(url), check) })
+	if got["server"].Status != checkFail {
+		t.Errorf("server check %+v, want fail", got["server"])
+	}
+}
+
+func TestDoctorAuthUnknownAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agents/agent-1" || r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("request %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	got := runDoctor(func(check doctorCheckFunc) { doctorAuth(doctorConfig(srv.URL), check) })
+	if got["auth"].Status != checkWarn || !strings.Contains(got["auth"].Detail, "registers again") {
+		t.Errorf("auth check %+v, want a warning", got["auth"])
+	}
+}
+
+func TestDoctorAuthRejectedKey(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	got := runDoctor(func(check doctorCheckFunc) { doctorAuth(doctorConfig(srv.URL), check) })
+	if got["auth"].Status != checkFail {
+		t.Errorf("auth check %+v, want fail", got["auth"])
+	}
+}
+
+func TestDoctorAuthUnusedEnrollmentToken(t *testing.T) {
+	cfg := &Config{AgentConfig: shared.AgentConfig{ServerURL: "http://unused.invalid", EnrollmentToken: "enroll-me"}}
+	got := runDoctor(func(check doctorCheckFunc) { doctorAuth(cfg, check) })
+	if got["auth"].Status != checkWarn {
+		t.Errorf("auth check %+v, want a warning", got["auth"])
+	}
+}
+
+func TestDoctorLlamaServerMissing(t *testing.T) {
+	cfg := &Config{AgentConfig: shared.AgentConfig{LlamaServerPath: filepath.Join(t.TempDir(), "llama-server")}}
+	got := runDoctor(func(check doctorCheckFunc) { doctorLlamaServer(cfg, check) })
+	if got["llama_server"].Status != checkFail {
+		t.Errorf("llama_server check %+v, want fail", got["llama_server"])
+	}
+}
+
+func TestDoctorModelsReadable(t *testing.T) {
+	path := writeConfig(t, "llama.gguf", "GGUF")
+	cfg := &Config{Models: []ModelConfig{{Name: "llama", Path: path}}}
+	got := runDoctor(func(check doctorCheckFunc) { doctorModels(cfg, check) })
+	if got["models"].Status != checkOK || got["models"].Detail != "llama 0 MB" {
+		t.Errorf("models check %+v", got["models"])
+	}
+	if dirs := got["model_dirs"]; dirs.Status == checkSkip || !strings.HasPrefix(dirs.Detail, filepath.Dir(path)) {
+		t.Errorf("model_dirs check %+v, want the model's directory", dirs)
+	}
+}
+
+func TestDoctorModelsMissingFile(t *testing.T) {
+	cfg := &Config{Models: []ModelConfig{{Name: "llama", Path: filepath.Join(t.TempDir(), "missing.gguf")}}}
+	got := runDoctor(func(check doctorCheckFunc) { doctorModels(cfg, check) })
+	if got["models"].Status != checkFail || !strings.HasPrefix(got["models"].Detail, "llama: ") {
+		t.Errorf("models check %+v, want the model named", got["models"])
+	}
+	if got["model_dirs"].Status != checkSkip {
+		t.Errorf("model_dirs check %+v, want skip", got["model_dirs"])
+	}
+}
+
+func TestDoctorCommandInvalidConfig(t *testing.T) {
+	useConfigPath(t, writeConfig(t, "config.json", `{"server_url": ""}`))
+	t.Setenv("PATH", t.TempDir())
+	stdout := redirectStdio(t, "")
+
+	if code := doctorCommand(nil); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	var report DoctorReport
+	if err := json.Unmarshal([]byte(stdout()), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.OK || report.Checks[0].Name != "config" || report.Checks[0].Status != checkFail || report.Checks[1].Status != checkSkip {
+		t.Errorf("report %+v, want the config failed and later checks skipped", report)
+	}
+}
@@ -1,3 +1,9 @@
 module github.com/metalyard/gpu-agent
 
 go 1.21
+
+require github.com/janvanoekelen/metalyard v0.0.0
+
+require gopkg.in/yaml.v3 v3.0.1 // indirect
+
+replace github.com/janvanoekelen/metalyard => ../..
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os/exec"
 	"regexp"
@@ -19,23 +20,58 @@ type GPUInfo struct {
 	ComputeCap string `json:"compute_cap"` // "8.9" for NVIDIA, "apple3" for Metal, "" for CPU
 }
 
+// GPU detectors, in the order they are tried
+const (
+	detectorLlamaServer    = "llama-server"
+	detectorNVIDIASMI      = "nvidia-smi"
+	detectorSystemProfiler = "system_profiler"
+	detectorCPU            = "cpu"
+)
+
+// GPUDetection is the outcome of GPU detection: the GPUs found, the
+// detector that found them, and why the detectors tried before it didn't
+type GPUDetection struct {
+	GPUs     []GPUInfo         `json:"gpus"`
+	Detector string            `json:"detector"`
+	Failed   map[string]string `json:"failed,omitempty"` // detector -> error
+}
+
 // DetectGPUs detects available GPUs using llama-server
 func DetectGPUs() ([]GPUInfo, error) {
-	// Try llama-server first (preferred method)
-	gpus, err := detectViaLlamaServer()
-	if err == nil && len(gpus) > 0 {
-		return gpus, nil
-	}
+	return RunGPUDetection().GPUs, nil
+}
 
-	// Fallback to platform-specific detection
+// RunGPUDetection tries llama-server first, then the platform's own tool,
+// and falls back to the CPU
+func RunGPUDetection() GPUDetection {
+	type detector struct {
+		name   string
+		detect func() ([]GPUInfo, error)
+	}
+	detectors := []detector{{detectorLlamaServer, detectViaLlamaServer}}
 	switch runtime.GOOS {
 	case "darwin":
-		return detectAppleSilicon()
+		detectors = append(detectors, detector{detectorSystemProfiler, detectAppleSilicon})
 	case "linux", "windows":
-		return detectNVIDIA()
-	default:
-		return detectCPUOnly()
+		detectors = append(detectors, detector{detectorNVIDIASMI, detectNVIDIA})
+	}
+
+	d := GPUDetection{Failed: make(map[string]string)}
+	for _, det := range detectors {
+		gpus, err := det.detect()
+		if err == nil && len(gpus) == 0 {
+			err = errors.New("no GPUs found")
+		}
+		if err != nil {
+			d.Failed[det.name] = err.Error()
+			continue
+		}
+		d.GPUs, d.Detector = gpus, det.name
+		return d
 	}
+	d.GPUs, _ = detectCPUOnly()
+	d.Detector = detectorCPU
+	return d
 }
 
 // detectViaLlamaServer uses llama-server --list-gpus
@@ -103,7 +139,7 @@ func detectNVIDIA() ([]GPUInfo, error) {
 		"--format=csv,noheader,nounits")
 	output, err := cmd.Output()
 	if err != nil {
-		return detectCPUOnly()
+		return nil, fmt.Errorf("nvidia-smi not found or failed: %w", err)
 	}
 
 	var gpus []GPUInfo
@@ -129,10 +165,6 @@ func detectNVIDIA() ([]GPUInfo, error) {
 		})
 	}
 
-	if len(gpus) == 0 {
-		return detectCPUOnly()
-	}
-
 	return gpus, nil
 }
 
@@ -141,7 +173,7 @@ func detectAppleSilicon() ([]GPUInfo, error) {
 	cmd := exec.Command("system_profiler", "SPDisplaysDataType")
 	output, err := cmd.Output()
 	if err != nil {
-		return detectCPUOnly()
+		return nil, fmt.Errorf("system_profiler failed: %w", err)
 	}
 
 	// Parse system_profiler output for chip name
@@ -156,7 +188,7 @@ func detectAppleSilicon() ([]GPUInfo, error) {
 		}}, nil
 	}
 
-	return detectCPUOnly()
+	return nil, nil
 }
 
 // detectCPUOnly returns CPU-only fallback
@@ -202,3 +234,58 @@ func (g GPUInfo) String() string {
 	}
 	return fmt.Sprintf("%s (%d MB, CC %s)", g.Name, g.VRAM_MB, g.ComputeCap)
 }
+
+// errNoGPUStats is returned for GPUs whose state can't be read
+var errNoGPUStats = errors.New("no stats for this GPU")
+
+// GPUStats is a sample of a GPU's current state
+type GPUStats struct {
+	TemperatureC int
+	UsedMB       int // VRAM used by all processes
+	AgentMB      int // of which by llama-server
+}
+
+// ReadGPUStats samples an NVIDIA GPU with nvidia-smi. agentPID is
+// llama-server's process ID, 0 if it isn't running.
+func ReadGPUStats(gpu GPUInfo, agentPID int) (GPUStats, error) {
+	var stats GPUStats
+	if gpu.Type != "nvidia" {
+		return stats, errNoGPUStats
+	}
+	id := "--id=" + strings.TrimPrefix(gpu.ID, "cuda:")
+
+	output, err := exec.Command("nvidia-smi", id,
+		"--query-gpu=temperature.gpu,memory.used",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return stats, fmt.Errorf("querying nvidia-smi: %w", err)
+	}
+	parts := strings.Split(strings.TrimSpace(string(output)), ", ")
+	if len(parts) < 2 {
+		return stats, fmt.Errorf("unexpected nvidia-smi output %q", output)
+	}
+	stats.TemperatureC, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
+	stats.UsedMB, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+
+	if agentPID == 0 {
+		return stats, nil
+	}
+	output, err = exec.Command("nvidia-smi", id,
+		"--query-compute-apps=pid,used_memory",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return stats, fmt.Errorf("querying nvidia-smi processes: %w", err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ", ")
+		if len(parts) < 2 {
+			continue
+		}
+		if pid, _ := strconv.Atoi(strings.TrimSpace(parts[0])); pid == agentPID {
+			mb, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
+			stats.AgentMB += mb
+		}
+	}
+	return stats, nil
+}
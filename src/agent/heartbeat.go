@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"runtime"
+	"sync"
 	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
 )
 
 // HeartbeatClient handles registration and heartbeat communication with server
 type HeartbeatClient struct {
 	serverURL  string
-	apiKey     string
 	httpClient *http.Client
+
+	mu     sync.Mutex
+	apiKey string
 }
 
 // NewHeartbeatClient creates a new heartbeat client
@@ -22,114 +29,182 @@ func NewHeartbeatClient(serverURL, apiKey string) *HeartbeatClient {
 		serverURL: serverURL,
 		apiKey:    apiKey,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout: 60 * time.Second, // must exceed the work poll timeout
 		},
 	}
 }
 
+// SetAPIKey replaces the key used to authenticate, e.g. once one is issued
+func (c *HeartbeatClient) SetAPIKey(apiKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiKey = apiKey
+}
+
+// APIError is an error response returned by the server
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("HTTP %d: %s - %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("HTTP %d", e.StatusCode)
+}
+
 // RegistrationRequest is sent when agent first registers
 type RegistrationRequest struct {
-	GPU GPUInfo `json:"gpu"`
+	Name            string              `json:"name"`
+	EnrollmentToken string              `json:"enrollment_token,omitempty"`
+	Version         string              `json:"version"`
+	Capabilities    shared.Capabilities `json:"capabilities"`
+	Models          []shared.ModelInfo  `json:"models"`
 }
 
 // RegistrationResponse is returned by server on registration
 type RegistrationResponse struct {
-	AgentID    string   `json:"agent_id"`
-	ServerTime int64    `json:"server_time"`
-	Models     []string `json:"models"`
+	AgentID           string `json:"agent_id"`
+	APIKey            string `json:"api_key,omitempty"` // Only set when a new key was issued
+	HeartbeatInterval int    `json:"heartbeat_interval_sec"`
+	AgentVersions
+}
+
+// AgentVersions are the agent versions the server advertises; empty if it
+// has no update channel
+type AgentVersions struct {
+	MinimumAgentVersion string `json:"minimum_agent_version,omitempty"` // older agents get no work
+	LatestAgentVersion  string `json:"latest_agent_version,omitempty"`  // older agents update themselves
 }
 
 // Heartbeat represents the periodic health report
 type Heartbeat struct {
-	AgentID      string  `json:"agent_id"`
-	Status       string  `json:"status"`        // "available", "busy", "degraded"
-	LoadedModel  string  `json:"loaded_model"`  // Empty if none
-	TemperatureC int     `json:"temperature_c"` // GPU temp if available
-	UptimeSec    int     `json:"uptime_sec"`
-	GPU          GPUInfo `json:"gpu"`
+	AgentID       string              `json:"-"`
+	Status        string              `json:"status"`        // "online", "busy", "paused", "degraded", "suspending"
+	CurrentLoad   int                 `json:"current_load"`  // Active jobs
+	LoadedModel   string              `json:"loaded_model"`  // Empty if none
+	TemperatureC  int                 `json:"temperature_c"` // GPU temp if available
+	UptimeSec     int                 `json:"uptime_sec"`
+	Capabilities  shared.Capabilities `json:"capabilities"`
+	PrefixCache   *shared.PrefixCache `json:"prefix_cache,omitempty"`
+	OfflineSec    int                 `json:"offline_sec,omitempty"`     // how long the server was unreachable before this heartbeat
+	SuspendedSec  int                 `json:"suspended_sec,omitempty"`   // how long the host slept before this heartbeat
+	WakeWithinSec int                 `json:"wake_within_sec,omitempty"` // with "suspending": how long the server should wait for the host to wake
+	PausedReason  string              `json:"paused_reason,omitempty"`   // why the contribution policy paused work
 }
 
 // HeartbeatResponse is returned by server on heartbeat
 type HeartbeatResponse struct {
-	Ack      bool     `json:"ack"`
-	Commands []string `json:"commands"` // e.g., ["load_model:llama-7b-q4"], ["shutdown"]
+	Acknowledged bool     `json:"acknowledged"`
+	NextInterval int      `json:"next_interval_sec"` // 0 keeps the current interval
+	Commands     []string `json:"commands"`          // e.g., ["load_model:llama-7b-q4"], ["shutdown"]
+	AgentVersions
 }
 
-// Register registers the agent with the server
-func (c *HeartbeatClient) Register(gpu GPUInfo) (*RegistrationResponse, error) {
-	url := fmt.Sprintf("%s/api/v1/agents/register", c.serverURL)
-
-	reqBody := RegistrationRequest{GPU: gpu}
-	body, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("sending request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("registration failed: %s - %s", resp.Status, string(respBody))
+// CapabilitiesOf converts detected GPU info to the capabilities sent to the server
+func CapabilitiesOf(gpu GPUInfo) shared.Capabilities {
+	return shared.Capabilities{
+		GPUVendor: gpu.Type,
+		GPUModel:  gpu.Name,
+		VRAM_MB:   gpu.VRAM_MB,
+		Platform:  runtime.GOOS,
 	}
+}
 
+// Register registers the agent with the server.
+// With an enrollment token the server issues a new API key; otherwise the
+// configured key is used and the agent keeps its ID.
+func (c *HeartbeatClient) Register(ctx context.Context, req RegistrationRequest) (*RegistrationResponse, error) {
 	var regResp RegistrationResponse
-	if err := json.NewDecoder(resp.Body).Decode(&regResp); err != nil {
-		return nil, fmt.Errorf("decoding response: %w", err)
+	if _, err := c.do(ctx, http.MethodPost, "/v1/agents/register", req, &regResp); err != nil {
+		return nil, fmt.Errorf("registration failed: %w", err)
 	}
-
 	return &regResp, nil
 }
 
 // SendHeartbeat sends a heartbeat to the server
-func (c *HeartbeatClient) SendHeartbeat(hb Heartbeat) (*HeartbeatResponse, error) {
-	url := fmt.Sprintf("%s/api/v1/agents/%s/heartbeat", c.serverURL, hb.AgentID)
+func (c *HeartbeatClient) SendHeartbeat(ctx context.Context, hb Heartbeat) (*HeartbeatResponse, error) {
+	path := fmt.Sprintf("/v1/agents/%s/heartbeat", hb.AgentID)
 
-	body, err := json.Marshal(hb)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling heartbeat: %w", err)
+	var hbResp HeartbeatResponse
+	if _, err := c.do(ctx, http.MethodPost, path, hb, &hbResp); err != nil {
+		return nil, fmt.Errorf("heartbeat failed: %w", err)
+	}
+	return &hbResp, nil
+}
+
+// do sends a JSON request and decodes a JSON response into result.
+// It returns the HTTP status code; server error responses become *APIError.
+func (c *HeartbeatClient) do(ctx context.Context, method, path string, body, result any) (int, error) {
+	status, _, err := c.exchange(ctx, method, path, body, result)
+	return status, err
+}
+
+// exchange is do, additionally returning the response headers
+func (c *HeartbeatClient) exchange(ctx context.Context, method, path string, body, result any) (int, http.Header, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("marshaling request: %w", err)
+		}
+		bodyReader = bytes.NewReader(data)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, method, c.serverURL+path, bodyReader)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return 0, nil, fmt.Errorf("creating request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	c.mu.Lock()
+	apiKey := c.apiKey
+	c.mu.Unlock()
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	shared.InjectTraceparent(ctx, req.Header)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("sending heartbeat: %w", err)
+		return 0, nil, fmt.Errorf("sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode >= 400 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
 		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("heartbeat failed: %s - %s", resp.Status, string(respBody))
+		json.Unmarshal(respBody, apiErr)
+		return resp.StatusCode, resp.Header, apiErr
 	}
 
-	var hbResp HeartbeatResponse
-	if err := json.NewDecoder(resp.Body).Decode(&hbResp); err != nil {
-		return nil, fmt.Errorf("decoding response: %w", err)
+	if resp.StatusCode == http.StatusNoContent || result == nil {
+		return resp.StatusCode, resp.Header, nil
 	}
 
-	return &hbResp, nil
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return resp.StatusCode, resp.Header, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return resp.StatusCode, resp.Header, nil
 }
 
-// HeartbeatInterval is the time between heartbeats
-const HeartbeatInterval = 30 * time.Second
+// maxHeartbeatRetry is the longest wait before retrying a failed heartbeat
+const maxHeartbeatRetry = 30 * time.Second
 
-// MaxMissedHeartbeats before agent is considered offline
-const MaxMissedHeartbeats = 3
+// serverInterval returns the interval the server asked for in seconds, or
+// current if it didn't ask for one
+func serverInterval(sec int, current time.Duration) time.Duration {
+	if sec <= 0 {
+		return current
+	}
+	return time.Duration(sec) * time.Second
+}
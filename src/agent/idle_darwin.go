@@ -0,0 +1,32 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// hidIdleTime finds the HID system's idle time in ioreg output
+var hidIdleTime = regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
+
+// userIdle returns how long the user has not touched keyboard or mouse,
+// from the HID system's idle time in nanoseconds
+func userIdle() (time.Duration, error) {
+	output, err := exec.Command("ioreg", "-c", "IOHIDSystem", "-d", "4").Output()
+	if err != nil {
+		return 0, fmt.Errorf("running ioreg: %w", err)
+	}
+	m := hidIdleTime.FindSubmatch(output)
+	if m == nil {
+		return 0, fmt.Errorf("no HIDIdleTime in ioreg output")
+	}
+	ns, err := strconv.ParseInt(string(m[1]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing HIDIdleTime: %w", err)
+	}
+	return time.Duration(ns), nil
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idleDigits finds the idle time in gdbus and xprintidle output
+var idleDigits = regexp.MustCompile(`\d+`)
+
+// userIdle returns how long the user has not touched keyboard or mouse.
+// It asks GNOME's idle monitor (Wayland and X11), then xprintidle (other
+// X11 desktops), then logind's IdleHint, which desktops set once the
+// screen idles; the first two need the agent to run in the user's session.
+func userIdle() (time.Duration, error) {
+	if d, err := mutterIdle(); err == nil {
+		return d, nil
+	}
+	if os.Getenv("DISPLAY") != "" {
+		if d, err := xIdle(); err == nil {
+			return d, nil
+		}
+	}
+	return logindIdle()
+}
+
+// mutterIdle asks GNOME's idle monitor on the session bus
+func mutterIdle() (time.Duration, error) {
+	output, err := exec.Command("gdbus", "call", "--session",
+		"--dest", "org.gnome.Mutter.IdleMonitor",
+		"--object-path", "/org/gnome/Mutter/IdleMonitor/Core",
+		"--method", "org.gnome.Mutter.IdleMonitor.GetIdletime").Output()
+	if err != nil {
+		return 0, fmt.Errorf("asking GNOME idle monitor: %w", err)
+	}
+	// "(uint64 12345,)"
+	ms, err := strconv.ParseInt(idleDigits.FindString(strings.TrimPrefix(string(output), "(uint64")), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected idle monitor output %q", output)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// xIdle runs xprintidle, which prints the X11 idle time in milliseconds
+func xIdle() (time.Duration, error) {
+	output, err := exec.Command("xprintidle").Output()
+	if err != nil {
+		return 0, fmt.Errorf("running xprintidle: %w", err)
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected xprintidle output %q", output)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// logindIdle returns how long every active session on the machine has
+// been idle according to logind. With nobody logged in the user is away.
+func logindIdle() (time.Duration, error) {
+	output, err := exec.Command("loginctl", "list-sessions", "--no-legend").Output()
+	if err != nil {
+		return 0, fmt.Errorf("listing logind sessions: %w", err)
+	}
+
+	idle := time.Duration(math.MaxInt64)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		props, err := exec.Command("loginctl", "show-session", fields[0],
+			"-p", "Active", "-p", "Remote", "-p", "IdleHint", "-p", "IdleSinceHint").Output()
+		if err != nil {
+			return 0, fmt.Errorf("reading logind session %s: %w", fields[0], err)
+		}
+		p := make(map[string]string)
+		for _, kv := range strings.Split(string(props), "\n") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				p[k] = v
+			}
+		}
+		if p["Active"] != "yes" || p["Remote"] == "yes" {
+			continue
+		}
+		if p["IdleHint"] != "yes" {
+			return 0, nil
+		}
+		since, _ := strconv.ParseInt(p["IdleSinceHint"], 10, 64) // microseconds since the epoch
+		idle = min(idle, time.Since(time.UnixMicro(since)))
+	}
+	return idle, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// userIdle is not implemented on this platform
+func userIdle() (time.Duration, error) {
+	return 0, errors.New("idle detection is not supported on this platform")
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	procGetLastInputInfo = syscall.NewLazyDLL("user32.dll").NewProc("GetLastInputInfo")
+	procGetTickCount     = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount")
+)
+
+// lastInputInfo is the LASTINPUTINFO structure
+type lastInputInfo struct {
+	size uint32
+	time uint32 // tick count of the last input
+}
+
+// userIdle returns how long the user has not touched keyboard or mouse.
+// It only sees input in the agent's own session.
+func userIdle() (time.Duration, error) {
+	info := lastInputInfo{size: uint32(unsafe.Sizeof(lastInputInfo{}))}
+	if ok, _, err := procGetLastInputInfo.Call(uintptr(unsafe.Pointer(&info))); ok == 0 {
+		return 0, fmt.Errorf("GetLastInputInfo: %w", err)
+	}
+	now, _, _ := procGetTickCount.Call()
+	return time.Duration(uint32(now)-info.time) * time.Millisecond, nil
+}
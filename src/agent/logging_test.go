@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+func TestSetupLoggingLevel(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	var logs bytes.Buffer
+	if err := setupLogging(&logs, "error", "json"); err != nil {
+		t.Fatalf("setupLogging: %v", err)
+	}
+
+	slog.Warn("quiet")
+	slog.Error("loud")
+	if got := logs.String(); strings.Contains(got, "quiet") || !strings.Contains(got, `"msg":"loud"`) {
+		t.Errorf("logged %q, want only the error, as JSON", got)
+	}
+}
+
+func TestResultPostCarriesRequestID(t *testing.T) {
+	seen := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get(requestIDHeader)
+	}))
+	defer srv.Close()
+
+	ctx := withRequestID(context.Background(), "client-req-3")
+	if err := NewHeartbeatClient(srv.URL, "key").PostResult(ctx, "agent-1", shared.ResultRequest{RequestID: "cmpl-1"}); err != nil {
+		t.Fatalf("PostResult: %v", err)
+	}
+	if got := <-seen; got != "client-req-3" {
+		t.Errorf("server got request ID %q, want the job's", got)
+	}
+}
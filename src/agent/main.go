@@ -2,69 +2,179 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
 )
 
 var (
 	configPath = flag.String("config", "", "Path to config file (default: ~/.config/gpu-agent/config.json)")
 	logLevel   = flag.String("log-level", "", "Log level: debug, info, warn, error")
+	logFormat  = flag.String("log-format", "", "Log format: text, json")
 )
 
+// usage describes the subcommands
+const usage = `Usage: %s [flags] [command] [command flags]
+
+Commands:
+  run      join the pool and serve jobs (default)
+  init     write a config file interactively
+  detect   show the GPUs the agent would use
+  doctor   check the setup and print a JSON report for support
+  status   show what the running agent is doing; -watch keeps it on screen
+  pause    stop the running agent taking work
+  resume   let it take work again
+  drain    let it finish its job, then exit
+  service  install, uninstall or check the systemd service (Linux)
+  sign     sign release binaries for the server's update channel
+  version  print the agent version
+
+Flags:
+`
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	cmd, args := "run", flag.Args()
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "run":
+		os.Exit(runCommand(args))
+	case "init":
+		os.Exit(initCommand(args))
+	case "detect":
+		os.Exit(detectCommand(args))
+	case "doctor":
+		os.Exit(doctorCommand(args))
+	case "status":
+		os.Exit(statusCommand(args))
+	case "pause", "resume", "drain":
+		os.Exit(controlCommand(cmd, args))
+	case "service":
+		os.Exit(serviceCommand(args))
+	case "sign":
+		os.Exit(signCommand(args))
+	case "version":
+		fmt.Println(version)
+	case sandboxCommandName:
+		os.Exit(sandboxCommand(args))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// exitRejected is the exit status when the server rejects the agent's
+// credentials. It is EX_CONFIG, which the service unit doesn't restart on.
+const exitRejected = 78
+
+// runCommand runs the agent until it is stopped or drained, returning the
+// exit status
+func runCommand(args []string) int {
+	fs := newFlagSet("run")
+	fs.StringVar(logLevel, "log-level", *logLevel, "Log level: debug, info, warn, error")
+	fs.StringVar(logFormat, "log-format", *logFormat, "Log format: text, json")
+	fs.Parse(args)
+
 	// Load configuration
 	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("Failed to load config", "err", err)
 	}
 
-	if *logLevel != "" {
-		cfg.LogLevel = *logLevel
+	// Log flags take precedence over the config, without being saved to it
+	logSettings := func(c *Config) (level, format string) {
+		level, format = c.LogLevel, c.LogFormat
+		if *logLevel != "" {
+			level = *logLevel
+		}
+		if *logFormat != "" {
+			format = *logFormat
+		}
+		return level, format
+	}
+	level, format := logSettings(cfg)
+	if err := setupLogging(os.Stderr, level, format); err != nil {
+		fatal("Invalid logging config", "err", err)
 	}
 
-	log.Printf("GPU Agent starting...")
-	log.Printf("Server URL: %s", cfg.ServerURL)
-	log.Printf("Log level: %s", cfg.LogLevel)
+	slog.Info("GPU Agent starting", "version", version, "server_url", cfg.ServerURL, "log_level", level)
 
 	// Detect GPUs
 	gpus, err := DetectGPUs()
 	if err != nil {
-		log.Fatalf("Failed to detect GPUs: %v", err)
+		fatal("Failed to detect GPUs", "err", err)
 	}
 
 	if len(gpus) == 0 {
-		log.Fatalf("No GPUs detected")
+		fatal("No GPUs detected")
 	}
 
 	// Use first GPU (single GPU per agent for now)
 	gpu := gpus[0]
-	log.Printf("Detected GPU: %s", gpu.String())
+	slog.Info("Detected GPU", "gpu", gpu.String())
+
+	// llama-server runs prompts from anyone using the pool
+	sandbox := NewSandbox(cfg, *configPath, cfg.LlamaServerPath)
+	sandbox.LogFeatures()
+
+	runner := NewRunner(cfg.LlamaServerPath, cfg.LocalPort, cfg.modelFiles(), sandbox)
+	runner.SetPromptCacheMB(cfg.PromptCacheMB)
+	defer runner.Unload()
+
+	// Only the share of VRAM the policy offers is advertised to the server
+	policy := NewPolicy(cfg.Policy, gpu, runner.PID)
+	if offered := policy.OfferedVRAM(); offered != gpu.VRAM_MB {
+		slog.Info("Offering part of the GPU's memory", "vram_mb", offered, "max_vram_percent", cfg.Policy.MaxVRAMPercent)
+		gpu.VRAM_MB = offered
+	}
 
 	// Create heartbeat client
 	hbClient := NewHeartbeatClient(cfg.ServerURL, cfg.APIKey)
 
-	// Register with server
-	log.Printf("Registering with server...")
-	regResp, err := hbClient.Register(gpu)
+	// An updated binary is on trial until its first heartbeat; one that
+	// keeps failing is rolled back here, before it gets any further
+	updater, err := NewUpdater(hbClient, cfg.UpdatePublicKey, runner.Unload)
 	if err != nil {
-		log.Fatalf("Failed to register: %v", err)
+		fatal("Failed to set up self-update", "err", err)
 	}
+	updater.Start()
 
-	agentID := regResp.AgentID
-	log.Printf("Registered successfully. Agent ID: %s", agentID)
-	log.Printf("Available models: %s", strings.Join(regResp.Models, ", "))
-
-	// Save agent ID to config
-	cfg.AgentID = agentID
-	if err := SaveConfig(cfg, *configPath); err != nil {
-		log.Printf("Warning: failed to save config with agent ID: %v", err)
+	// Register with server; a pending enrollment token takes precedence so
+	// that re-enrolling an agent only needs a config edit
+	regReq := RegistrationRequest{
+		Name:         cfg.Name,
+		Version:      version,
+		Capabilities: CapabilitiesOf(gpu),
+	}
+	if cfg.EnrollmentToken != "" {
+		regReq.EnrollmentToken = cfg.EnrollmentToken
+		hbClient.SetAPIKey("")
+	}
+	var modelNames []string
+	for _, m := range cfg.Models {
+		regReq.Models = append(regReq.Models, shared.ModelInfo{
+			Name:         m.Name,
+			Quantization: m.Quantization,
+			MaxContext:   m.MaxContext,
+			Kind:         m.Kind,
+		})
+		modelNames = append(modelNames, m.Name)
 	}
 
 	// Setup graceful shutdown
@@ -76,77 +186,292 @@ func main() {
 
 	go func() {
 		sig := <-sigCh
-		log.Printf("Received signal %v, shutting down...", sig)
+		slog.Info("Received signal, shutting down", "signal", sig.String())
 		cancel()
 	}()
 
+	// Log settings, the contribution policy and the prompt cache cap follow
+	// the config file as it is edited; flags still take precedence
+	watcher := NewConfigWatcher(*configPath, cfg, func(c *Config) {
+		level, format := logSettings(c)
+		if err := setupLogging(os.Stderr, level, format); err != nil {
+			slog.Warn("Invalid logging config", "err", err)
+		}
+		policy.SetConfig(c.Policy)
+		runner.SetPromptCacheMB(c.PromptCacheMB)
+	})
+	go watcher.Run(ctx)
+
+	// Register, retrying until the server is reachable. Every registration
+	// saves the agent ID and any newly issued key to config.
+	supervisor := NewSupervisor(hbClient, regReq, func(resp *RegistrationResponse) {
+		slog.Info("Registered successfully", "agent_id", resp.AgentID, "models", strings.Join(modelNames, ", "))
+		err := watcher.Update(func(c *Config) {
+			c.AgentID = resp.AgentID
+			if resp.APIKey != "" {
+				c.APIKey = resp.APIKey
+				c.EnrollmentToken = ""
+			}
+		})
+		if resp.APIKey != "" {
+			slog.Info("Received agent API key")
+		}
+		if err != nil {
+			slog.Warn("Failed to save config with agent ID", "err", err)
+		}
+		updater.Advertised(resp.MinimumAgentVersion, resp.LatestAgentVersion)
+	})
+
+	var exporter shared.SpanExporter
+	if cfg.OTLPEndpoint != "" {
+		exporter = shared.NewOTLPExporter(cfg.OTLPEndpoint, "gpu-agent")
+		defer exporter.Shutdown(context.Background())
+		slog.Info("Exporting traces", "endpoint", cfg.OTLPEndpoint)
+	}
+	worker := NewWorker(hbClient, supervisor.AgentID, runner, shared.NewTracer(exporter))
+
+	// Tell the server straight away when work is paused, resumed or drained
+	checkIn := make(chan struct{}, 1)
+	poke := func() {
+		select {
+		case checkIn <- struct{}{}:
+		default:
+		}
+	}
+
+	// The status API is up during registration, to show why it's taking
+	// long. The heartbeat loop exits once a drain is over; until the agent
+	// has registered there is nothing to drain.
+	if cfg.StatusAddr != "off" {
+		status := NewStatusServer(cfg, watcher, gpus, supervisor, worker, policy, func() {
+			worker.Drain()
+			poke()
+			if supervisor.AgentID() == "" {
+				cancel()
+			}
+		})
+		go status.Run(ctx)
+	}
+
+	slog.Info("Registering with server")
+	regResp, err := supervisor.Register(ctx)
+	if errors.Is(err, ErrRejected) {
+		slog.Error("Cannot join the pool; set a new enrollment_token or api_key and restart the agent", "err", err)
+		return exitRejected
+	}
+	if err != nil {
+		slog.Info("Shutdown complete")
+		return 0
+	}
+
+	// Start work loop
+	go worker.Run(ctx)
+
 	// Track uptime
 	startTime := time.Now()
 
-	// Main heartbeat loop
-	ticker := time.NewTicker(HeartbeatInterval)
-	defer ticker.Stop()
+	// Hand work back before the host sleeps, and check in as soon as it
+	// wakes up again
+	woke := make(chan time.Duration, 1)
+	sleeper := NewSleepWatcher(func() {
+		suspendCtx, cancel := context.WithTimeout(ctx, suspendTimeout)
+		defer cancel()
+		worker.Suspend(suspendCtx)
+		sendSuspending(suspendCtx, hbClient, supervisor, gpu, startTime)
+	}, func(slept time.Duration) {
+		supervisor.Slept(slept)
+		worker.Resume()
+		select {
+		case woke <- slept:
+		default:
+		}
+	})
+	go sleeper.Run(ctx)
+
+	// Pause and resume work as the contribution policy says
+	go policy.Run(ctx, func(reason string) {
+		worker.SetPaused(reason)
+		poke()
+	})
 
-	log.Printf("Starting heartbeat loop (interval: %v)", HeartbeatInterval)
+	// Main heartbeat loop. The server sets the pace: every response says
+	// how long to wait before the next heartbeat.
+	interval := serverInterval(regResp.HeartbeatInterval, cfg.HeartbeatInterval)
+	slog.Info("Starting heartbeat loop", "interval", interval)
 
 	// Send initial heartbeat immediately
-	sendHeartbeat(hbClient, agentID, gpu, startTime)
+	interval = sendHeartbeat(ctx, hbClient, supervisor, updater, gpu, worker, policy, startTime, interval)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	// A downloaded update is swapped in once the agent has drained
+	updateReady, updating := updater.Ready(), false
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("Shutdown complete")
-			return
+			slog.Info("Shutdown complete")
+			return 0
+
+		case err := <-supervisor.Rejected():
+			slog.Error("Cannot rejoin the pool; set a new enrollment_token or api_key and restart the agent", "err", err)
+			return exitRejected
+
+		case <-timer.C:
+			interval = sendHeartbeat(ctx, hbClient, supervisor, updater, gpu, worker, policy, startTime, interval)
+			timer.Reset(interval)
+
+		case <-worker.Drained():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			sendHeartbeat(ctx, hbClient, supervisor, updater, gpu, worker, policy, startTime, interval)
+			if updating {
+				if err := updater.Apply(); err != nil {
+					fatal("Failed to apply update", "err", err)
+				}
+			}
+			slog.Info("Drained, shutting down")
+			return 0
+
+		case <-updateReady:
+			updateReady, updating = nil, true
+			worker.Drain()
+			poke()
+
+		case <-checkIn:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			interval = sendHeartbeat(ctx, hbClient, supervisor, updater, gpu, worker, policy, startTime, interval)
+			timer.Reset(interval)
 
-		case <-ticker.C:
-			sendHeartbeat(hbClient, agentID, gpu, startTime)
+		case slept := <-woke:
+			// A job that ran through the sleep has lost its lease if the
+			// server marked us offline meanwhile
+			if job := worker.CurrentJob(); job != "" && slept >= interval*shared.MaxMissedHeartbeats && worker.CancelJob(job) {
+				slog.Info("Abandoned job whose lease expired during sleep", "job_id", job)
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			interval = sendHeartbeat(ctx, hbClient, supervisor, updater, gpu, worker, policy, startTime, interval)
+			timer.Reset(interval)
 		}
 	}
 }
 
-func sendHeartbeat(client *HeartbeatClient, agentID string, gpu GPUInfo, startTime time.Time) {
+// sendHeartbeat sends one heartbeat and carries out the server's commands.
+// It returns the interval until the next heartbeat.
+func sendHeartbeat(ctx context.Context, client *HeartbeatClient, supervisor *Supervisor, updater *Updater, gpu GPUInfo, worker *Worker, policy *Policy, startTime time.Time, interval time.Duration) time.Duration {
+	if worker.Suspended() {
+		// Said goodbye already; the host is about to sleep
+		return interval
+	}
 	hb := Heartbeat{
-		AgentID:      agentID,
-		Status:       "available", // TODO: track actual status
-		LoadedModel:  "",          // TODO: track loaded model
-		TemperatureC: 0,           // TODO: read GPU temperature
+		AgentID:      supervisor.AgentID(),
+		Status:       "online",
+		LoadedModel:  worker.runner.LoadedModel(),
+		TemperatureC: policy.TemperatureC(),
 		UptimeSec:    int(time.Since(startTime).Seconds()),
-		GPU:          gpu,
+		Capabilities: CapabilitiesOf(gpu),
+		PrefixCache:  worker.runner.PrefixCache(),
+		OfflineSec:   int(supervisor.Outage().Seconds()),
+		SuspendedSec: int(supervisor.Asleep().Seconds()),
+	}
+	if worker.CurrentJob() != "" {
+		hb.Status = "busy"
+		hb.CurrentLoad = 1
+	}
+	if reason := worker.Paused(); reason != "" {
+		// A job started before the pause still finishes
+		hb.Status = "paused"
+		hb.PausedReason = reason
+	}
+	if worker.Draining() {
+		hb.Status = "paused"
+		hb.PausedReason = stateDraining
 	}
 
-	resp, err := client.SendHeartbeat(hb)
+	resp, err := client.SendHeartbeat(ctx, hb)
 	if err != nil {
-		log.Printf("Heartbeat failed: %v", err)
-		return
+		slog.Warn("Heartbeat failed", "err", err)
+		supervisor.Record(HeartbeatRecord{At: time.Now(), Status: hb.Status, Error: err.Error()})
+		updater.HeartbeatFailed(err)
+		supervisor.HandleError(ctx, err)
+		return min(interval, maxHeartbeatRetry)
 	}
+	supervisor.Connected()
 
-	if !resp.Ack {
-		log.Printf("Heartbeat not acknowledged")
-		return
+	if !resp.Acknowledged {
+		slog.Warn("Heartbeat not acknowledged")
+		supervisor.Record(HeartbeatRecord{At: time.Now(), Status: hb.Status, Error: "not acknowledged"})
+		return interval
 	}
 
-	log.Printf("Heartbeat sent (uptime: %ds)", hb.UptimeSec)
+	next := serverInterval(resp.NextInterval, interval)
+	if next != interval {
+		slog.Debug("Heartbeat interval changed", "from", interval, "to", next)
+	}
+	slog.Debug("Heartbeat sent", "status", hb.Status, "uptime_sec", hb.UptimeSec, "next_in", next)
+	supervisor.Record(HeartbeatRecord{At: time.Now(), Status: hb.Status, NextInterval: int(next.Seconds()), Commands: resp.Commands})
+	updater.HeartbeatSent()
+	updater.Advertised(resp.MinimumAgentVersion, resp.LatestAgentVersion)
 
 	// Handle commands from server
 	for _, cmd := range resp.Commands {
-		handleCommand(cmd)
+		handleCommand(cmd, worker)
+	}
+	return next
+}
+
+// sendSuspending tells the server the host is going to sleep, so it takes
+// back the agent's work and doesn't count it as failed while it sleeps
+func sendSuspending(ctx context.Context, client *HeartbeatClient, supervisor *Supervisor, gpu GPUInfo, startTime time.Time) {
+	hb := Heartbeat{
+		AgentID:       supervisor.AgentID(),
+		Status:        "suspending",
+		WakeWithinSec: int(suspendWakeWithin.Seconds()),
+		UptimeSec:     int(time.Since(startTime).Seconds()),
+		Capabilities:  CapabilitiesOf(gpu),
+	}
+	if _, err := client.SendHeartbeat(ctx, hb); err != nil {
+		slog.Warn("Failed to tell server about sleep", "err", err)
 	}
 }
 
-func handleCommand(cmd string) {
-	log.Printf("Received command: %s", cmd)
+func handleCommand(cmd string, worker *Worker) {
+	slog.Info("Received command", "command", cmd)
 
 	switch {
+	case strings.HasPrefix(cmd, "cancel_job:"):
+		jobID := strings.TrimPrefix(cmd, "cancel_job:")
+		if worker.CancelJob(jobID) {
+			slog.Info("Server cancelled the running job", "job_id", jobID)
+		}
+
 	case strings.HasPrefix(cmd, "load_model:"):
 		model := strings.TrimPrefix(cmd, "load_model:")
-		log.Printf("Server requested model load: %s", model)
-		// TODO: implement model loading
+		slog.Info("Server requested model load", "model", model)
+		go worker.Preload(context.Background(), model)
+
+	case strings.HasPrefix(cmd, "unload_model:"):
+		model := strings.TrimPrefix(cmd, "unload_model:")
+		if worker.UnloadIdle(model) {
+			slog.Info("Server requested model unload", "model", model)
+		}
 
 	case cmd == "shutdown":
-		log.Printf("Server requested shutdown")
+		slog.Info("Server requested shutdown")
 		os.Exit(0)
 
 	default:
-		log.Printf("Unknown command: %s", cmd)
+		slog.Warn("Unknown command", "command", cmd)
 	}
 }
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy tuning
+const (
+	policyCheckInterval = 15 * time.Second
+	policyCoolDownC     = 5 // a GPU paused for heat resumes this far below the limit
+)
+
+// Reasons work is paused, reported to the server in heartbeats. A paused
+// process reason names the process, e.g. "process_running:steam".
+const (
+	pauseManual        = "manual" // paused through the local status API
+	pauseOutsideWindow = "outside_window"
+	pauseUserActive    = "user_active"
+	pauseIdleUnknown   = "idle_unknown" // idle_only is set but idle time can't be read here
+	pauseProcess       = "process_running"
+	pauseTemperature   = "gpu_temperature"
+	pauseVRAM          = "vram_in_use"
+)
+
+// Policy applies the config's contribution policy: it decides whether the
+// agent may take work right now, and why not if it may not
+type Policy struct {
+	cfg      PolicyConfig
+	windows  []timeWindow
+	gpu      GPUInfo
+	agentPID func() int // llama-server's process, whose VRAM is ours
+
+	updateMu sync.Mutex // serializes updates and reloads of cfg and windows
+	mu       sync.Mutex
+	onChange func(reason string) // set by Run
+	manual   bool                // paused by hand until resumed
+	reason   string              // why work is paused, empty when it isn't
+	tempC    int                 // last GPU temperature read, 0 if unknown
+}
+
+// NewPolicy creates a policy from the config's policy section, which may
+// be nil. The config has been validated by LoadConfig.
+func NewPolicy(cfg *PolicyConfig, gpu GPUInfo, agentPID func() int) *Policy {
+	p := &Policy{gpu: gpu, agentPID: agentPID}
+	if cfg != nil {
+		p.cfg = *cfg
+		p.windows, _ = parseWindows(cfg.Windows)
+	}
+	return p
+}
+
+// SetConfig replaces the policy's settings when the config is reloaded,
+// which may be nil. max_vram_percent is kept: the VRAM offered is only
+// advertised when the agent registers.
+func (p *Policy) SetConfig(cfg *PolicyConfig) {
+	var c PolicyConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	windows, _ := parseWindows(c.Windows)
+
+	p.updateMu.Lock()
+	p.windows = windows
+	p.cfg.Windows = c.Windows
+	p.cfg.IdleOnly = c.IdleOnly
+	p.cfg.IdleMinutes = c.IdleMinutes
+	p.cfg.MaxTemperatureC = c.MaxTemperatureC
+	p.cfg.PauseProcesses = c.PauseProcesses
+	p.updateMu.Unlock()
+
+	p.mu.Lock()
+	running := p.onChange != nil
+	p.mu.Unlock()
+	if running {
+		p.update()
+	}
+}
+
+// OfferedVRAM returns the VRAM offered to the pool in MB
+func (p *Policy) OfferedVRAM() int {
+	if p.cfg.MaxVRAMPercent == 0 {
+		return p.gpu.VRAM_MB
+	}
+	return p.gpu.VRAM_MB * p.cfg.MaxVRAMPercent / 100
+}
+
+// Reason returns why work is paused, or "" if it isn't
+func (p *Policy) Reason() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reason
+}
+
+// SetManual pauses work by hand, overriding the rest of the policy, or
+// hands control back to it. Once Run has started the change applies
+// before SetManual returns.
+func (p *Policy) SetManual(paused bool) {
+	p.mu.Lock()
+	p.manual = paused
+	running := p.onChange != nil
+	p.mu.Unlock()
+
+	if running {
+		p.update()
+	}
+}
+
+// TemperatureC returns the last GPU temperature read, 0 if unknown
+func (p *Policy) TemperatureC() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tempC
+}
+
+// Run re-evaluates the policy until the context is cancelled, calling
+// onChange with the new pause reason whenever it changes
+func (p *Policy) Run(ctx context.Context, onChange func(reason string)) {
+	p.mu.Lock()
+	p.onChange = onChange
+	p.mu.Unlock()
+
+	ticker := time.NewTicker(policyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.update()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update re-evaluates the policy and reports a change of pause reason
+func (p *Policy) update() {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	reason := p.evaluate(time.Now())
+
+	p.mu.Lock()
+	changed := reason != p.reason
+	p.reason = reason
+	onChange := p.onChange
+	p.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if reason != "" {
+		slog.Info("Work paused by policy", "reason", reason)
+	} else {
+		slog.Info("Work resumed by policy")
+	}
+	onChange(reason)
+}
+
+// evaluate returns why work should be paused at now, or "" if it shouldn't
+func (p *Policy) evaluate(now time.Time) string {
+	// The GPU is read even without limits on it, for the heartbeat
+	stats, statsErr := ReadGPUStats(p.gpu, p.agentPID())
+	if statsErr != nil && statsErr != errNoGPUStats {
+		slog.Debug("Reading GPU stats failed", "err", statsErr)
+	}
+	p.mu.Lock()
+	p.tempC = stats.TemperatureC
+	paused, manual := p.reason, p.manual
+	p.mu.Unlock()
+
+	if manual {
+		return pauseManual
+	}
+
+	if len(p.windows) > 0 && !inWindows(p.windows, now) {
+		return pauseOutsideWindow
+	}
+
+	if p.cfg.IdleOnly {
+		idle, err := userIdle()
+		if err != nil {
+			if paused != pauseIdleUnknown {
+				slog.Warn("Cannot tell whether the user is idle, not taking work", "err", err)
+			}
+			return pauseIdleUnknown
+		}
+		if idle < time.Duration(p.cfg.IdleMinutes)*time.Minute {
+			return pauseUserActive
+		}
+	}
+
+	if len(p.cfg.PauseProcesses) > 0 {
+		names, err := runningProcesses()
+		if err != nil {
+			slog.Debug("Listing processes failed", "err", err)
+		}
+		if name := firstMatch(names, p.cfg.PauseProcesses); name != "" {
+			return pauseProcess + ":" + name
+		}
+	}
+
+	if statsErr != nil {
+		return ""
+	}
+	if limit := p.cfg.MaxTemperatureC; limit > 0 {
+		if paused == pauseTemperature {
+			limit -= policyCoolDownC
+		}
+		if stats.TemperatureC > limit {
+			return pauseTemperature
+		}
+	}
+	if p.cfg.MaxVRAMPercent > 0 && p.gpu.VRAM_MB > 0 {
+		// Other programs may use whatever isn't offered to the pool
+		if others := stats.UsedMB - stats.AgentMB; others > p.gpu.VRAM_MB-p.OfferedVRAM() {
+			return pauseVRAM
+		}
+	}
+	return ""
+}
+
+// firstMatch returns the first running process named in blocked, compared
+// case-insensitively and ignoring a ".exe" suffix
+func firstMatch(running, blocked []string) string {
+	want := make(map[string]bool, len(blocked))
+	for _, name := range blocked {
+		want[processKey(name)] = true
+	}
+	for _, name := range running {
+		if want[processKey(name)] {
+			return name
+		}
+	}
+	return ""
+}
+
+// processKey normalizes a process name for comparison
+func processKey(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".exe")
+}
+
+// timeWindow is a recurring time span on some days of the week. A window
+// ending before it starts runs into the next day.
+type timeWindow struct {
+	days       [7]bool // indexed by time.Weekday, the day the window starts
+	start, end int     // minutes since midnight; end may be 24*60
+}
+
+// weekdays maps day names in windows to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWindows parses policy windows such as "Mon-Fri 18:00-08:00",
+// "Sat,Sun" or "22:00-07:00"
+func parseWindows(specs []string) ([]timeWindow, error) {
+	windows := make([]timeWindow, 0, len(specs))
+	for i, spec := range specs {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("[%d] %q: %w", i, spec, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseWindow parses one policy window
+func parseWindow(spec string) (timeWindow, error) {
+	w := timeWindow{end: 24 * 60}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("want [days] [HH:MM-HH:MM]")
+	}
+
+	days, times := fields[0], ""
+	if len(fields) == 2 {
+		times = fields[1]
+	} else if strings.Contains(days, ":") {
+		days, times = "", days
+	}
+
+	if days == "" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	}
+	for _, part := range strings.Split(days, ",") {
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(strings.ToLower(part), "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return w, fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	if times != "" {
+		from, to, ok := strings.Cut(times, "-")
+		if !ok {
+			return w, fmt.Errorf("want HH:MM-HH:MM")
+		}
+		var err error
+		if w.start, err = parseClock(from); err != nil {
+			return w, err
+		}
+		if w.end, err = parseClock(to); err != nil {
+			return w, err
+		}
+		if w.start == w.end {
+			return w, fmt.Errorf("window is empty")
+		}
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight; 24:00 is allowed
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// inWindows reports whether t falls in any of the windows
+func inWindows(windows []timeWindow, t time.Time) bool {
+	day, minute := t.Weekday(), t.Hour()*60+t.Minute()
+	yesterday := (day + 6) % 7
+	for _, w := range windows {
+		if w.start < w.end {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Runs past midnight
+		if (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
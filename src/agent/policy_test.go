@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cpuGPU has no stats, so policies on it never pause for heat or VRAM
+var cpuGPU = GPUInfo{ID: "cpu", Type: "cpu", Name: "CPU"}
+
+// newTestPolicy returns a policy for the config on cpuGPU
+func newTestPolicy(cfg *PolicyConfig) *Policy {
+	return NewPolicy(cfg, cpuGPU, func() int { return 0 })
+}
+
+// at returns 2026-03-02 (a Monday) plus days at hh:mm local time
+func at(days, hh, mm int) time.Time {
+	return time.Date(2026, 3, 2+days, hh, mm, 0, 0, time.Local)
+}
+
+// mustWindows parses windows that must be valid
+func mustWindows(t *testing.T, specs ...string) []timeWindow {
+	t.Helper()
+	windows, err := parseWindows(specs)
+	if err != nil {
+		t.Fatalf("parseWindows: %v", err)
+	}
+	return windows
+}
+
+func TestWindowWeekdaysOnly(t *testing.T) {
+	w := mustWindows(t, "Mon-Fri")
+	if !inWindows(w, at(4, 12, 0)) || inWindows(w, at(5, 12, 0)) {
+		t.Error("Mon-Fri should cover Friday and not Saturday")
+	}
+}
+
+func TestWindowPastMidnight(t *testing.T) {
+	w := mustWindows(t, "Fri 22:00-06:00")
+	if !inWindows(w, at(5, 5, 59)) {
+		t.Error("a Friday night window doesn't run into Saturday morning")
+	}
+	if inWindows(w, at(5, 6, 0)) || inWindows(w, at(4, 5, 0)) {
+		t.Error("window covers times outside it")
+	}
+}
+
+func TestWindowDayRangeWraps(t *testing.T) {
+	w := mustWindows(t, "Sat-Mon 09:00-17:00")
+	if !inWindows(w, at(6, 10, 0)) || !inWindows(w, at(0, 10, 0)) || inWindows(w, at(1, 10, 0)) {
+		t.Error("Sat-Mon should cover Saturday through Monday only")
+	}
+}
+
+func TestWindowTimesEveryDay(t *testing.T) {
+	w := mustWindows(t, "18:00-24:00")
+	if !inWindows(w, at(3, 23, 59)) || inWindows(w, at(3, 17, 59)) {
+		t.Error("18:00-24:00 should cover the evening of any day")
+	}
+}
+
+func TestWindowRejectsUnknownDay(t *testing.T) {
+	if _, err := parseWindows([]string{"Mon-Fry 09:00-17:00"}); err == nil || !strings.Contains(err.Error(), `"fry"`) {
+		t.Errorf("err = %v, want the unknown day named", err)
+	}
+}
+
+func TestWindowRejectsEmpty(t *testing.T) {
+	if _, err := parseWindows([]string{"09:00-09:00"}); err == nil {
+		t.Error("accepted an empty window")
+	}
+}
+
+func TestFirstMatchIgnoresCaseAndExe(t *testing.T) {
+	if got := firstMatch([]string{"bash", "Steam.exe"}, []string{"steam"}); got != "Steam.exe" {
+		t.Errorf("matched %q, want Steam.exe", got)
+	}
+}
+
+func TestPolicyOfferedVRAM(t *testing.T) {
+	p := NewPolicy(&PolicyConfig{MaxVRAMPercent: 75}, GPUInfo{Type: "nvidia", VRAM_MB: 24000}, nil)
+	if got := p.OfferedVRAM(); got != 18000 {
+		t.Errorf("offered %d MB, want 18000", got)
+	}
+}
+
+func TestPolicyOutsideWindow(t *testing.T) {
+	p := newTestPolicy(&PolicyConfig{Windows: []string{"Sat,Sun"}})
+	if got := p.evaluate(at(2, 12, 0)); got != pauseOutsideWindow {
+		t.Errorf("reason %q on a Wednesday, want %s", got, pauseOutsideWindow)
+	}
+}
+
+func TestPolicyManualOverridesWindow(t *testing.T) {
+	p := newTestPolicy(&PolicyConfig{Windows: []string{"Sat,Sun"}})
+	p.SetManual(true)
+	if got := p.evaluate(at(2, 12, 0)); got != pauseManual {
+		t.Errorf("reason %q, want %s", got, pauseManual)
+	}
+}
+
+func TestPolicyProcessRunning(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process listing is tested on Linux")
+	}
+	self := filepath.Base(os.Args[0])
+	p := newTestPolicy(&PolicyConfig{PauseProcesses: []string{strings.ToUpper(self) + ".exe"}})
+	if got := p.evaluate(time.Now()); got != pauseProcess+":"+self {
+		t.Errorf("reason %q, want %s:%s", got, pauseProcess, self)
+	}
+}
+
+func TestPolicyRunReportsChanges(t *testing.T) {
+	p := newTestPolicy(nil)
+	p.SetManual(true)
+	changes := make(chan string, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx, func(reason string) { changes <- reason })
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if got := <-changes; got != pauseManual {
+		t.Fatalf("first change %q, want %s", got, pauseManual)
+	}
+	p.SetManual(false)
+	if got := <-changes; got != "" || p.Reason() != "" {
+		t.Errorf("after resuming: change %q, reason %q; want both empty", got, p.Reason())
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runningProcesses returns the program names of all processes
+func runningProcesses() ([]string, error) {
+	output, err := exec.Command("ps", "-axo", "comm=").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running ps: %w", err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, filepath.Base(line))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os/exec"
+)
+
+// runningProcesses returns the image names of all processes, e.g. "steam.exe"
+func runningProcesses() ([]string, error) {
+	output, err := exec.Command("tasklist", "/fo", "csv", "/nh").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running tasklist: %w", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(output)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parsing tasklist output: %w", err)
+	}
+	names := make([]string, 0, len(records))
+	for _, r := range records {
+		names = append(names, r[0])
+	}
+	return names, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// reexec is not supported here; the agent has to be restarted by hand
+func reexec(path string) error {
+	return errors.New("restarting into a new binary is not supported on this platform")
+}
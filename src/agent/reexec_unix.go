@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replaces the process with the binary at path, keeping its
+// arguments, environment and PID, so a service manager sees no restart
+func reexec(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configCheckInterval is how often the config file is checked for changes
+const configCheckInterval = 5 * time.Second
+
+// Settings applied without a restart, and settings the agent saves itself
+// after registering, whose changes are its own
+var (
+	reloadableSettings = map[string]bool{"log_level": true, "log_format": true, "policy": true, "prompt_cache_mb": true}
+	agentSavedSettings = map[string]bool{"agent_id": true, "api_key": true, "enrollment_token": true}
+)
+
+// ConfigWatcher holds the running config. It reloads it on SIGHUP or when
+// the file changes: log level and format and the contribution policy take
+// effect at once, and the prompt cache cap from the next model load; other
+// changed settings are logged as needing a restart.
+// A config that fails to load is logged and the running one kept. Changes
+// the agent makes itself go through Update, so they are saved on top of
+// the latest edits rather than over them.
+type ConfigWatcher struct {
+	path  string
+	apply func(cfg *Config)
+
+	mu      sync.Mutex
+	current *Config
+	modTime time.Time
+}
+
+// NewConfigWatcher watches the config at path, as loaded into cfg. apply
+// is called with every reloaded config.
+func NewConfigWatcher(path string, cfg *Config, apply func(cfg *Config)) *ConfigWatcher {
+	if path == "" {
+		path = DefaultConfigPath()
+	}
+	w := &ConfigWatcher{path: path, current: cfg, apply: apply}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	return w
+}
+
+// Current returns the running config, which must not be modified
+func (w *ConfigWatcher) Current() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Update changes the running config and saves it. Edits to the file not
+// yet picked up are loaded first.
+func (w *ConfigWatcher) Update(change func(cfg *Config)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reloadLocked(false)
+
+	cfg := *w.current
+	change(&cfg)
+	if err := SaveConfig(&cfg, w.path); err != nil {
+		return err
+	}
+	w.current = &cfg
+	if info, err := os.Stat(w.path); err == nil {
+		w.modTime = info.ModTime() // not an edit to reload
+	}
+	return nil
+}
+
+// Run watches the config until the context is cancelled
+func (w *ConfigWatcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config", "path", w.path)
+			w.reload(true)
+		case <-ticker.C:
+			w.reload(false)
+		}
+	}
+}
+
+// reload loads the config if it changed, or regardless if forced
+func (w *ConfigWatcher) reload(force bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reloadLocked(force)
+}
+
+// reloadLocked is reload with w.mu held
+func (w *ConfigWatcher) reloadLocked(force bool) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		if force {
+			slog.Error("Config reload failed, keeping the running config", "err", err)
+		}
+		return
+	}
+	if !force && info.ModTime().Equal(w.modTime) {
+		return
+	}
+	w.modTime = info.ModTime() // a broken config is reported once, not on every check
+
+	cfg, err := LoadConfig(w.path)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the running config", "path", w.path, "err", err)
+		return
+	}
+	if changed := restartSettings(w.current, cfg); len(changed) > 0 {
+		slog.Warn("Changed settings need a restart to take effect", "settings", strings.Join(changed, ", "))
+	}
+	w.current = cfg
+	w.apply(cfg)
+	slog.Info("Config reloaded", "path", w.path)
+}
+
+// restartSettings returns the settings changed from old to cfg that are
+// only read at startup
+func restartSettings(old, cfg *Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(old).Elem(), reflect.ValueOf(cfg).Elem()
+	for _, f := range settingFields() {
+		name := settingName(f)
+		if reloadableSettings[name] || agentSavedSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(a.FieldByIndex(f.Index).Interface(), b.FieldByIndex(f.Index).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	var before, after int
+	if old.Policy != nil {
+		before = old.Policy.MaxVRAMPercent
+	}
+	if cfg.Policy != nil {
+		after = cfg.Policy.MaxVRAMPercent
+	}
+	if before != after {
+		changed = append(changed, "policy.max_vram_percent")
+	}
+	return changed
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// touch moves the file's modification time on, so a change is seen even
+// where the file system's clock is coarse
+func touch(t *testing.T, path string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testConfigJSON = `{
+	"server_url": "https://pool.example.com",
+	"enrollment_token": "enroll-me",
+	"models": [{"name": "llama", "path": "/models/llama.gguf"}]
+}`
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+server_url: https://pool.example.com
+api_key: secret
+local_port: 9001
+log_level: debug
+models:
+  - name: embedder
+    path: /models/embed.gguf
+    kind: embed
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.ServerURL != "https://pool.example.com" || cfg.APIKey != "secret" || cfg.LocalPort != 9001 || cfg.LogLevel != "debug" {
+		t.Errorf("loaded %+v", cfg)
+	}
+	if cfg.LlamaServerPath != "llama-server" || cfg.Models[0].MaxContext != 4096 {
+		t.Errorf("defaults not applied: llama_server_path %q, max_context %d", cfg.LlamaServerPath, cfg.Models[0].MaxContext)
+	}
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	path := writeConfig(t, "config.json", testConfigJSON)
+	t.Setenv("GPU_AGENT_SERVER_URL", "https://other.example.com")
+	t.Setenv("GPU_AGENT_LOCAL_PORT", "9002")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.ServerURL != "https://other.example.com" || cfg.LocalPort != 9002 {
+		t.Errorf("server_url %q, local_port %d; want the environment's", cfg.ServerURL, cfg.LocalPort)
+	}
+
+	// The file keeps its own values, while the agent's changes are saved
+	cfg.APIKey = "issued-key"
+	if err := SaveConfig(cfg, path); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	os.Unsetenv("GPU_AGENT_SERVER_URL")
+	os.Unsetenv("GPU_AGENT_LOCAL_PORT")
+	saved, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if saved.ServerURL != "https://pool.example.com" || saved.LocalPort != 8081 || saved.APIKey != "issued-key" {
+		t.Errorf("saved server_url %q, local_port %d, api_key %q", saved.ServerURL, saved.LocalPort, saved.APIKey)
+	}
+
+	t.Setenv("GPU_AGENT_LOCAL_PORT", "high")
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "GPU_AGENT_LOCAL_PORT") {
+		t.Errorf("LoadConfig error = %v, want one naming GPU_AGENT_LOCAL_PORT", err)
+	}
+}
+
+func TestConfigWatcherUpdateKeepsEdits(t *testing.T) {
+	path := writeConfig(t, "config.json", testConfigJSON)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	var applied []*Config
+	w := NewConfigWatcher(path, cfg, func(c *Config) { applied = append(applied, c) })
+
+	// The file is edited, and the agent registers before the edit is seen
+	edited := *cfg
+	edited.LogLevel = "debug"
+	edited.Policy = &PolicyConfig{IdleOnly: true}
+	if err := SaveConfig(&edited, path); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	touch(t, path)
+	err = w.Update(func(c *Config) {
+		c.AgentID = "agent-1"
+		c.APIKey = "issued-key"
+		c.EnrollmentToken = ""
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	saved, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if saved.LogLevel != "debug" || saved.Policy == nil || !saved.Policy.IdleOnly {
+		t.Errorf("the edit was lost: log_level %q, policy %+v", saved.LogLevel, saved.Policy)
+	}
+	if saved.AgentID != "agent-1" || saved.APIKey != "issued-key" || saved.EnrollmentToken != "" {
+		t.Errorf("the agent's changes were lost: agent_id %q, api_key %q, enrollment_token %q", saved.AgentID, saved.APIKey, saved.EnrollmentToken)
+	}
+	if cur := w.Current(); cur.LogLevel != "debug" || cur.AgentID != "agent-1" {
+		t.Errorf("running config has log_level %q, agent_id %q", cur.LogLevel, cur.AgentID)
+	}
+	if len(applied) != 1 || applied[0].LogLevel != "debug" {
+		t.Fatalf("edit applied %d times, want once", len(applied))
+	}
+
+	// The agent's own save isn't an edit to reload
+	w.reload(false)
+	if len(applied) != 1 {
+		t.Errorf("the agent's own save was reloaded")
+	}
+}
+
+func TestConfigEnvDuration(t *testing.T) {
+	path := writeConfig(t, "config.json", testConfigJSON)
+	t.Setenv("GPU_AGENT_HEARTBEAT_INTERVAL", "10s")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.HeartbeatInterval != 10*time.Second {
+		t.Errorf("heartbeat_interval %v, want 10s", cfg.HeartbeatInterval)
+	}
+}
+
+func TestConfigModelCacheDir(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+server_url: https://pool.example.com
+api_key: secret
+model_cache_dir: /var/lib/models
+models:
+  - name: relative
+    path: llama.gguf
+  - name: absolute
+    path: /opt/embed.gguf
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	files := cfg.modelFiles()
+	if files[0].Path != filepath.Join("/var/lib/models", "llama.gguf") || files[1].Path != "/opt/embed.gguf" {
+		t.Errorf("model files %q and %q", files[0].Path, files[1].Path)
+	}
+	if cfg.Models[0].Path != "llama.gguf" {
+		t.Errorf("config path changed to %q; it is saved as written", cfg.Models[0].Path)
+	}
+}
+
+func TestConfigWatcherReloadsPromptCache(t *testing.T) {
+	path := writeConfig(t, "config.json", testConfigJSON)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	var applied []*Config
+	w := NewConfigWatcher(path, cfg, func(c *Config) { applied = append(applied, c) })
+
+	edited := *cfg
+	edited.PromptCacheMB = 2048
+	if err := SaveConfig(&edited, path); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	touch(t, path)
+	w.reload(false)
+
+	if len(applied) != 1 || applied[0].PromptCacheMB != 2048 {
+		t.Fatalf("prompt_cache_mb not applied: %d reloads", len(applied))
+	}
+	if changed := restartSettings(cfg, applied[0]); len(changed) != 0 {
+		t.Errorf("settings needing a restart: %v", changed)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// modelLoadTimeout bounds how long llama-server may take to become healthy
+const modelLoadTimeout = 5 * time.Minute
+
+// Runner manages the local llama-server process and runs inference on it
+type Runner struct {
+	llamaPath  string
+	port       int
+	models     map[string]ModelConfig
+	httpClient *http.Client
+	sandbox    *Sandbox
+
+	loadMu     sync.Mutex // serializes loads and unloads; held while llama-server starts
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	exited     chan struct{} // closed when cmd has exited
+	loaded     string
+	cached     string // prompt and output of the last generation, in llama-server's KV cache
+	generating bool
+	claims     int // jobs using the runner; see Claim
+	cacheMB    int // llama-server's prompt cache cap, from the next start; 0 leaves its default
+}
+
+// Generation summarises a finished inference run
+type Generation struct {
+	FinishReason     string // "stop" or "length"
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// NewRunner creates a runner for the configured models
+func NewRunner(llamaPath string, port int, models []ModelConfig, sandbox *Sandbox) *Runner {
+	byName := make(map[string]ModelConfig, len(models))
+	for _, m := range models {
+		byName[m.Name] = m
+	}
+	return &Runner{
+		llamaPath:  llamaPath,
+		port:       port,
+		models:     byName,
+		httpClient: &http.Client{Transport: sandbox.Transport()},
+		sandbox:    sandbox,
+	}
+}
+
+// LoadedModel returns the name of the currently loaded model, if any
+func (r *Runner) LoadedModel() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loaded
+}
+
+// PID returns the process ID of llama-server, or 0 if it isn't running
+func (r *Runner) PID() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd == nil || r.cmd.Process == nil {
+		return 0
+	}
+	return r.cmd.Process.Pid
+}
+
+// errRunnerBusy is returned by Preload while a job has claimed the runner
+var errRunnerBusy = errors.New("a job is using the runner")
+
+// Claim reserves the runner for a job, from before it loads its model until
+// release is called once it is done. Preloads don't replace the model of a
+// claimed runner.
+func (r *Runner) Claim() (release func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.claims++
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.claims--
+	}
+}
+
+// SetPromptCacheMB caps the RAM llama-server keeps prompt caches in. A
+// running llama-server keeps its cap; the new one applies from the next
+// model load, so a reload never interrupts a job.
+func (r *Runner) SetPromptCacheMB(mb int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheMB = mb
+}
+
+// Load starts llama-server with the given model, replacing any loaded model
+func (r *Runner) Load(ctx context.Context, model string) error {
+	return r.load(ctx, model, false)
+}
+
+// Preload is Load for a model no job has asked for yet. It returns
+// errRunnerBusy rather than replace the model while a job has claimed the
+// runner.
+func (r *Runner) Preload(ctx context.Context, model string) error {
+	return r.load(ctx, model, true)
+}
+
+// load is Load, or Preload if preload is set
+func (r *Runner) load(ctx context.Context, model string, preload bool) error {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+
+	r.mu.Lock()
+	if r.loaded == model && r.cmd != nil {
+		r.mu.Unlock()
+		return nil
+	}
+	if preload && r.claims > 0 {
+		r.mu.Unlock()
+		return errRunnerBusy
+	}
+
+	cfg, ok := r.models[model]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("model not configured: %s", model)
+	}
+
+	r.stopLocked()
+
+	slog.Info("Loading model", "model", model, "path", cfg.Path, "kind", cfg.Kind)
+	// In its own network namespace llama-server is reached over a socket
+	host := "127.0.0.1"
+	if socket := r.sandbox.Socket(); socket != "" {
+		host = socket
+	}
+	args := []string{
+		"-m", cfg.Path,
+		"--host", host,
+		"--port", strconv.Itoa(r.port),
+		"-c", strconv.Itoa(cfg.MaxContext),
+	}
+	if cfg.Kind == shared.ModelKindEmbed {
+		args = append(args, "--embedding")
+	}
+	if r.cacheMB > 0 {
+		args = append(args, "--cache-ram", strconv.Itoa(r.cacheMB))
+	}
+	cmd, err := r.sandbox.Command(r.llamaPath, args)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		r.mu.Unlock()
+		return fmt.Errorf("starting llama-server: %w", err)
+	}
+	exited := make(chan struct{})
+	r.cmd, r.exited = cmd, exited
+	r.mu.Unlock()
+	go r.reap(cmd, exited, model)
+
+	// Status reads must not wait for the model to load
+	err = r.waitHealthy(ctx, exited)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && r.cmd != cmd {
+		err = errors.New("llama-server exited while loading")
+	}
+	if err != nil {
+		r.stopLocked()
+		return fmt.Errorf("loading %s: %w", model, err)
+	}
+
+	r.loaded = model
+	slog.Info("Model loaded", "model", model)
+	return nil
+}
+
+// Unload stops llama-server
+func (r *Runner) Unload() {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+}
+
+// UnloadIdle stops llama-server if it has the given model loaded and is
+// neither loading nor claimed by a job. It reports whether it did.
+func (r *Runner) UnloadIdle(model string) bool {
+	if !r.loadMu.TryLock() {
+		return false
+	}
+	defer r.loadMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loaded != model || r.claims > 0 {
+		return false
+	}
+	r.stopLocked()
+	return true
+}
+
+// stopLocked kills the llama-server process; r.mu must be held
+func (r *Runner) stopLocked() {
+	if r.cmd == nil {
+		return
+	}
+	r.cmd.Process.Kill()
+	<-r.exited
+	slog.Info("Model unloaded", "model", r.loaded)
+	r.cmd = nil
+	r.loaded = ""
+	r.cached = ""
+}
+
+// reap waits for llama-server to exit. If it wasn't stopped, it crashed or
+// was killed, and the model is no longer loaded: the next job loads it again.
+func (r *Runner) reap(cmd *exec.Cmd, exited chan struct{}, model string) {
+	err := cmd.Wait()
+	close(exited)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd != cmd {
+		return
+	}
+	slog.Warn("llama-server exited", "model", model, "err", err)
+	r.cmd = nil
+	r.loaded = ""
+	r.cached = ""
+}
+
+// PrefixCache reports what llama-server's slot holds, or nil if no model
+// is loaded. The agent runs one job at a time, so there is one slot.
+func (r *Runner) PrefixCache() *shared.PrefixCache {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loaded == "" {
+		return nil
+	}
+	return &shared.PrefixCache{
+		Model: r.loaded,
+		Slots: []shared.CacheSlot{{Busy: r.generating, Prefix: shared.PrefixHashes(r.cached)}},
+	}
+}
+
+// setCached records the text in llama-server's slot
+func (r *Runner) setCached(text string, generating bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cached = text
+	r.generating = generating
+}
+
+// waitHealthy polls llama-server's /health endpoint until it reports ready,
+// giving up as soon as it exits
+func (r *Runner) waitHealthy(ctx context.Context, exited <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(ctx, modelLoadTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/health", r.port)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := r.httpClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("llama-server did not become healthy: %w", ctx.Err())
+		case <-exited:
+			return errors.New("llama-server exited while loading")
+		case <-ticker.C:
+		}
+	}
+}
+
+// completionRequest is the llama-server /completion request body
+type completionRequest struct {
+	Prompt        string          `json:"prompt"`
+	NPredict      int             `json:"n_predict"`
+	Stream        bool            `json:"stream"`
+	CachePrompt   bool            `json:"cache_prompt"` // reuse the slot's KV cache for a shared prefix
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	TopK          *int            `json:"top_k,omitempty"`
+	MinP          *float64        `json:"min_p,omitempty"`
+	RepeatPenalty *float64        `json:"repeat_penalty,omitempty"`
+	Seed          *int64          `json:"seed,omitempty"`
+	Stop          []string        `json:"stop,omitempty"`
+	Grammar       string          `json:"grammar,omitempty"`
+	JSONSchema    json.RawMessage `json:"json_schema,omitempty"`
+	LogitBias     [][2]float64    `json:"logit_bias,omitempty"` // [token ID, bias] pairs
+}
+
+// completionChunk is one streamed llama-server /completion event
+type completionChunk struct {
+	Content         string `json:"content"`
+	Stop            bool   `json:"stop"`
+	StoppedLimit    bool   `json:"stopped_limit"`
+	Truncated       bool   `json:"truncated"` // context window exhausted
+	TokensEvaluated int    `json:"tokens_evaluated"`
+	TokensPredicted int    `json:"tokens_predicted"`
+}
+
+// logitBiasPairs converts a token ID keyed bias map to llama-server's
+// [[id, bias], ...] form
+func logitBiasPairs(bias map[string]float64) ([][2]float64, error) {
+	pairs := make([][2]float64, 0, len(bias))
+	for token, b := range bias {
+		id, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logit_bias token %q", token)
+		}
+		pairs = append(pairs, [2]float64{float64(id), b})
+	}
+	return pairs, nil
+}
+
+// Generate streams a completion from the loaded model, calling onToken for
+// each piece of generated text. Returning an error from onToken aborts.
+func (r *Runner) Generate(ctx context.Context, prompt string, maxTokens int, params shared.SamplingParams, onToken func(string) error) (*Generation, error) {
+	logitBias, err := logitBiasPairs(params.LogitBias)
+	if err != nil {
+		return nil, err
+	}
+
+	// The slot keeps the prompt and whatever was generated, even if aborted
+	var output strings.Builder
+	r.setCached(prompt, true)
+	defer func() { r.setCached(prompt+output.String(), false) }()
+	body, err := json.Marshal(completionRequest{
+		Prompt:        prompt,
+		NPredict:      maxTokens,
+		Stream:        true,
+		CachePrompt:   true,
+		Temperature:   params.Temperature,
+		TopP:          params.TopP,
+		TopK:          params.TopK,
+		MinP:          params.MinP,
+		RepeatPenalty: params.RepeatPenalty,
+		Seed:          params.Seed,
+		Stop:          params.Stop,
+		Grammar:       params.Grammar,
+		JSONSchema:    params.JSONSchema,
+		LogitBias:     logitBias,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling completion request: %w", err)
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/completion", r.port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating completion request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling llama-server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("llama-server returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var chunk completionChunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			return nil, fmt.Errorf("decoding llama-server chunk: %w", err)
+		}
+
+		if chunk.Content != "" {
+			output.WriteString(chunk.Content)
+			if err := onToken(chunk.Content); err != nil {
+				return nil, err
+			}
+		}
+
+		if chunk.Stop {
+			gen := &Generation{
+				FinishReason:     "stop",
+				PromptTokens:     chunk.TokensEvaluated,
+				CompletionTokens: chunk.TokensPredicted,
+			}
+			if chunk.StoppedLimit || chunk.Truncated {
+				gen.FinishReason = "length"
+			}
+			return gen, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading llama-server stream: %w", err)
+	}
+	return nil, fmt.Errorf("llama-server stream ended without a stop event")
+}
+
+// embeddingResponse is the llama-server /v1/embeddings response body
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+// Embed returns one vector per input from the loaded embedding model, in
+// input order, and the number of tokens embedded
+func (r *Runner) Embed(ctx context.Context, input []string) ([][]float32, int, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return nil, 0, fmt.Errorf("marshaling embedding request: %w", err)
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/v1/embeddings", r.port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating embedding request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("calling llama-server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("llama-server returned %s", resp.Status)
+	}
+
+	var out embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, fmt.Errorf("decoding embedding response: %w", err)
+	}
+	if len(out.Data) != len(input) {
+		return nil, 0, fmt.Errorf("llama-server returned %d embeddings for %d inputs", len(out.Data), len(input))
+	}
+
+	vectors := make([][]float32, len(input))
+	for _, d := range out.Data {
+		if d.Index < 0 || d.Index >= len(input) {
+			return nil, 0, fmt.Errorf("llama-server returned embedding index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, out.Usage.PromptTokens, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// fakeLlamaEnv makes the test binary stand in for llama-server
+const fakeLlamaEnv = "GPU_AGENT_FAKE_LLAMA_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeLlamaEnv) != "" {
+		fakeLlamaServer(os.Args[1:])
+		return
+	}
+	// The test binary is the sandbox launcher, as the agent's is
+	if len(os.Args) > 1 && os.Args[1] == sandboxCommandName {
+		os.Exit(sandboxCommand(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeLlamaServer serves llama-server's health check on the --port it is
+// given, until it is killed
+func fakeLlamaServer(args []string) {
+	port := ""
+	for i, arg := range args {
+		if arg == "--port" && i+1 < len(args) {
+			port = args[i+1]
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	http.ListenAndServe("127.0.0.1:"+port, mux)
+	os.Exit(1)
+}
+
+// freePort returns a loopback port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// newTestRunner returns a runner serving models "a" and "b" with a fake
+// llama-server, which it unloads when the test ends
+func newTestRunner(t *testing.T) *Runner {
+	t.Helper()
+	t.Setenv(fakeLlamaEnv, "1")
+	port := freePort(t)
+	models := []ModelConfig{{Name: "a", Path: "a.gguf", MaxContext: 512}, {Name: "b", Path: "b.gguf", MaxContext: 512}}
+	r := NewRunner(os.Args[0], port, models, &Sandbox{})
+	t.Cleanup(r.Unload)
+	return r
+}
+
+func TestRunnerLoad(t *testing.T) {
+	r := newTestRunner(t)
+	if err := r.Load(context.Background(), "a"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	pid := r.PID()
+	if r.LoadedModel() != "a" || pid == 0 {
+		t.Fatalf("loaded %q with pid %d", r.LoadedModel(), pid)
+	}
+	if err := r.Load(context.Background(), "a"); err != nil || r.PID() != pid {
+		t.Errorf("loading the loaded model again restarted llama-server (err %v)", err)
+	}
+	if err := r.Load(context.Background(), "c"); err == nil {
+		t.Error("loaded a model that isn't configured")
+	}
+}
+
+func TestRunnerPreloadLeavesClaimedRunner(t *testing.T) {
+	r := newTestRunner(t)
+	ctx := context.Background()
+
+	// A job claims the runner and loads its model; preloads racing with it
+	// must not replace the model under it
+	release := r.Claim()
+	if err := r.Load(ctx, "a"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	pid := r.PID()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.Preload(ctx, "b"); err != errRunnerBusy {
+				t.Errorf("Preload during a job = %v, want errRunnerBusy", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if r.LoadedModel() != "a" || r.PID() != pid {
+		t.Fatalf("the job's llama-server was replaced: loaded %q", r.LoadedModel())
+	}
+	if r.UnloadIdle("a") {
+		t.Error("unloaded the model of a claimed runner")
+	}
+
+	release()
+	if err := r.Preload(ctx, "b"); err != nil || r.LoadedModel() != "b" {
+		t.Errorf("Preload after the job = %v, loaded %q, want b", err, r.LoadedModel())
+	}
+}
+
+func TestRunnerJobWaitsForPreload(t *testing.T) {
+	r := newTestRunner(t)
+	ctx := context.Background()
+
+	// A job arriving while a preload is under way loads its own model once
+	// the preload is done, and keeps it
+	preloaded := make(chan error, 1)
+	go func() { preloaded <- r.Preload(ctx, "b") }()
+	release := r.Claim()
+	defer release()
+	if err := r.Load(ctx, "a"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := <-preloaded; err != nil && err != errRunnerBusy {
+		t.Fatalf("Preload: %v", err)
+	}
+	if r.LoadedModel() != "a" {
+		t.Errorf("loaded %q after the job's load, want a", r.LoadedModel())
+	}
+}
+
+func TestRunnerNoticesExit(t *testing.T) {
+	r := newTestRunner(t)
+	if err := r.Load(context.Background(), "a"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	p, err := os.FindProcess(r.PID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Kill()
+
+	// A crashed llama-server is no longer loaded, so the next job starts it
+	deadline := time.Now().Add(5 * time.Second)
+	for r.LoadedModel() != "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.LoadedModel() != "" || r.PID() != 0 {
+		t.Fatalf("still loaded %q after llama-server exited", r.LoadedModel())
+	}
+	if err := r.Load(context.Background(), "a"); err != nil || r.PID() == 0 {
+		t.Errorf("loading again after the crash: %v", err)
+	}
+}
+
+func TestRunnerPromptCacheFromNextLoad(t *testing.T) {
+	r := newTestRunner(t)
+	ctx := context.Background()
+	if err := r.Load(ctx, "a"); err != nil {
+		t.Fatalf("Load a: %v", err)
+	}
+	pid := r.PID()
+
+	r.SetPromptCacheMB(256)
+	if r.PID() != pid {
+		t.Fatal("changing the prompt cache cap restarted llama-server")
+	}
+	if err := r.Load(ctx, "b"); err != nil {
+		t.Fatalf("Load b: %v", err)
+	}
+	r.mu.Lock()
+	args := strings.Join(r.cmd.Args, " ")
+	r.mu.Unlock()
+	if !strings.Contains(args, "--cache-ram 256") {
+		t.Errorf("llama-server started with %q, want --cache-ram 256", args)
+	}
+}
+
+// newCompletionRunner returns a runner whose llama-server streams chunks
+// for every completion, and the requests it was sent
+func newCompletionRunner(t *testing.T, chunks ...completionChunk) (*Runner, <-chan completionRequest) {
+	t.Helper()
+	reqs := make(chan completionRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req completionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		reqs <- req
+		for _, c := range chunks {
+			data, _ := json.Marshal(c)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	return NewRunner(os.Args[0], port, nil, &Sandbox{}), reqs
+}
+
+func TestRunnerGenerateSamplingParams(t *testing.T) {
+	r, reqs := newCompletionRunner(t, completionChunk{Stop: true})
+	temp, topK, seed := 0.3, 20, int64(9)
+	params := shared.SamplingParams{
+		Temperature: &temp, TopK: &topK, Seed: &seed,
+		Stop:      shared.StopSequences{"END"},
+		Grammar:   `root ::= "a"`,
+		LogitBias: map[string]float64{"42": -100},
+	}
+	if _, err := r.Generate(context.Background(), "Hi", 16, params, func(string) error { return nil }); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	req := <-reqs
+	if req.NPredict != 16 || *req.Temperature != 0.3 || *req.TopK != 20 || *req.Seed != 9 || req.Grammar != params.Grammar {
+		t.Errorf("llama-server request %+v", req)
+	}
+	if len(req.Stop) != 1 || req.Stop[0] != "END" || len(req.LogitBias) != 1 || req.LogitBias[0] != [2]float64{42, -100} {
+		t.Errorf("stop %q, logit_bias %v", req.Stop, req.LogitBias)
+	}
+}
+
+func TestRunnerGenerateFinishReasonLength(t *testing.T) {
+	r, _ := newCompletionRunner(t,
+		completionChunk{Content: "Hel"},
+		completionChunk{Content: "lo", Stop: true, StoppedLimit: true, TokensEvaluated: 3, TokensPredicted: 2},
+	)
+	var text string
+	gen, err := r.Generate(context.Background(), "Hi", 2, shared.SamplingParams{}, func(tok string) error {
+		text += tok
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if text != "Hello" || gen.FinishReason != "length" || gen.PromptTokens != 3 || gen.CompletionTokens != 2 {
+		t.Errorf("generated %q, %+v", text, gen)
+	}
+}
+
+func TestRunnerGenerateRejectsLogitBiasKey(t *testing.T) {
+	r, _ := newCompletionRunner(t, completionChunk{Stop: true})
+	params := shared.SamplingParams{LogitBias: map[string]float64{"hello": 1}}
+	if _, err := r.Generate(context.Background(), "Hi", 2, params, func(string) error { return nil }); err == nil {
+		t.Error("sent a logit_bias key that isn't a token ID")
+	}
+}
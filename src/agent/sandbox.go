@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sandbox features, as reported at startup and by doctor
+const (
+	sandboxWorkDir    = "working_dir"      // llama-server runs in an empty directory of its own
+	sandboxRlimits    = "rlimits"          // memory, open file and core dump limits
+	sandboxNoNewPrivs = "no_new_privs"     // no gaining privileges through setuid binaries
+	sandboxReadOnly   = "read_only_models" // model directories mounted read-only
+	sandboxHideConfig = "hidden_config"    // the config file, which holds the API key, is unreadable
+	sandboxNetwork    = "loopback_network" // a network namespace with only loopback
+)
+
+// sandboxCommandName is the hidden subcommand the agent runs itself as to
+// set up the sandbox before becoming llama-server
+const sandboxCommandName = "__sandbox"
+
+// Sandbox tuning
+const (
+	defaultMaxOpenFiles = 1024
+	sandboxProbeTimeout = 5 * time.Second
+	maxSocketPath       = 100 // unix socket paths are limited to a little more
+)
+
+// SandboxFeature is one part of the sandbox and whether it is in effect
+type SandboxFeature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Detail  string `json:"detail,omitempty"` // why it is off
+}
+
+// sandboxProfile tells the launcher what to set up. It is passed as an
+// argument, as JSON.
+type sandboxProfile struct {
+	WorkDir      string   `json:"work_dir"`
+	Rlimits      bool     `json:"rlimits,omitempty"`
+	MaxMemoryMB  int      `json:"max_memory_mb,omitempty"` // 0 leaves memory unlimited
+	MaxOpenFiles int      `json:"max_open_files,omitempty"`
+	NoNewPrivs   bool     `json:"no_new_privs,omitempty"`
+	Namespaces   bool     `json:"namespaces,omitempty"` // new user and mount namespaces
+	ReadOnly     []string `json:"read_only,omitempty"`  // needs Namespaces
+	Hidden       []string `json:"hidden,omitempty"`     // files covered with /dev/null; needs Namespaces
+	Network      bool     `json:"network,omitempty"`    // new network namespace; needs Namespaces
+	Probe        bool     `json:"probe,omitempty"`      // report what fails instead of running anything
+}
+
+// Sandbox starts llama-server with a restricted profile: it runs prompts
+// from strangers on someone's workstation. What the host can't provide is
+// left out and reported rather than failing the agent.
+type Sandbox struct {
+	exe      string // the agent binary, run as the launcher; empty without one
+	profile  sandboxProfile
+	features []SandboxFeature
+}
+
+// NewSandbox works out what of the sandbox the host supports. It probes
+// by starting the launcher, which takes a moment.
+func NewSandbox(cfg *Config, configPath, llamaPath string) *Sandbox {
+	sc := cfg.Sandbox
+	if sc == nil {
+		sc = &SandboxConfig{}
+	}
+	s := &Sandbox{profile: sandboxProfile{WorkDir: runnerWorkDir()}}
+	if sc.Disabled {
+		s.profile.WorkDir = ""
+		for _, name := range []string{sandboxWorkDir, sandboxRlimits, sandboxNoNewPrivs, sandboxReadOnly, sandboxHideConfig, sandboxNetwork} {
+			s.features = append(s.features, SandboxFeature{Name: name, Detail: "sandbox disabled in config"})
+		}
+		return s
+	}
+
+	s.profile.MaxMemoryMB = sc.MaxMemoryMB
+	if s.profile.MaxMemoryMB == 0 {
+		s.profile.MaxMemoryMB = totalMemoryMB() * 3 / 4
+	}
+	s.profile.MaxOpenFiles = sc.MaxOpenFiles
+	if s.profile.MaxOpenFiles == 0 {
+		s.profile.MaxOpenFiles = defaultMaxOpenFiles
+	}
+	seen := make(map[string]bool)
+	for _, m := range cfg.modelFiles() {
+		if dir, err := filepath.Abs(filepath.Dir(m.Path)); err == nil && !seen[dir] {
+			seen[dir] = true
+			s.profile.ReadOnly = append(s.profile.ReadOnly, dir)
+		}
+	}
+	if configPath == "" {
+		configPath = DefaultConfigPath()
+	}
+	if path, err := filepath.Abs(configPath); err == nil {
+		s.profile.Hidden = []string{path}
+	}
+
+	failed := probeSandbox(s, llamaPath)
+	s.features = []SandboxFeature{{Name: sandboxWorkDir, Enabled: true}}
+	for _, name := range []string{sandboxRlimits, sandboxNoNewPrivs, sandboxReadOnly, sandboxHideConfig, sandboxNetwork} {
+		reason, off := failed[name]
+		s.features = append(s.features, SandboxFeature{Name: name, Enabled: !off, Detail: reason})
+	}
+	return s
+}
+
+// Features reports which parts of the sandbox are in effect
+func (s *Sandbox) Features() []SandboxFeature {
+	return s.features
+}
+
+// LogFeatures logs the sandbox, warning about what is missing
+func (s *Sandbox) LogFeatures() {
+	var on []string
+	for _, f := range s.features {
+		if f.Enabled {
+			on = append(on, f.Name)
+		} else {
+			slog.Warn("llama-server sandbox feature unavailable", "feature", f.Name, "reason", f.Detail)
+		}
+	}
+	slog.Info("llama-server sandbox", "features", strings.Join(on, ", "))
+}
+
+// Socket returns the unix socket llama-server listens on, or "" if it
+// listens on loopback TCP. Only a socket reaches into its own network
+// namespace.
+func (s *Sandbox) Socket() string {
+	if !s.profile.Network {
+		return ""
+	}
+	return filepath.Join(s.profile.WorkDir, "llama.sock")
+}
+
+// Transport returns the HTTP transport for talking to llama-server
+func (s *Sandbox) Transport() http.RoundTripper {
+	socket := s.Socket()
+	if socket == "" {
+		return http.DefaultTransport
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+}
+
+// Command returns the command starting llama-server in the sandbox. Each
+// llama-server gets a fresh working directory, so nothing an earlier one
+// wrote is left for it.
+func (s *Sandbox) Command(path string, args []string) (*exec.Cmd, error) {
+	if s.profile.WorkDir == "" {
+		return exec.Command(path, args...), nil
+	}
+	// The working directory changes, so relative paths must be resolved first
+	path, err := exec.LookPath(path)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding llama-server: %w", err)
+	}
+	if err := os.RemoveAll(s.profile.WorkDir); err != nil {
+		return nil, fmt.Errorf("clearing working dir: %w", err)
+	}
+	if err := os.MkdirAll(s.profile.WorkDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating working dir: %w", err)
+	}
+
+	var cmd *exec.Cmd
+	if s.exe == "" {
+		cmd = exec.Command(path, args...)
+	} else {
+		profile, _ := json.Marshal(s.profile)
+		cmd = exec.Command(s.exe, append([]string{sandboxCommandName, string(profile), path}, args...)...)
+		cmd.SysProcAttr = sandboxAttr(s.profile)
+	}
+	cmd.Dir = s.profile.WorkDir
+	cmd.Env = append(os.Environ(), "HOME="+s.profile.WorkDir, "TMPDIR="+s.profile.WorkDir)
+	return cmd, nil
+}
+
+// runProbe starts the launcher in probe mode. It returns the features that
+// failed to set up, or an error if the launcher couldn't run at all.
+func runProbe(exe string, p sandboxProfile) (map[string]string, error) {
+	p.Probe = true
+	profile, _ := json.Marshal(p)
+	ctx, cancel := context.WithTimeout(context.Background(), sandboxProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, exe, sandboxCommandName, string(profile))
+	cmd.SysProcAttr = sandboxAttr(p)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var failed map[string]string
+	if err := json.Unmarshal(output, &failed); err != nil {
+		return nil, fmt.Errorf("reading probe result: %w", err)
+	}
+	if failed == nil {
+		failed = make(map[string]string)
+	}
+	return failed, nil
+}
+
+// llamaServerSupportsSocket reports whether llama-server can listen on a
+// unix socket, which it says in its help
+func llamaServerSupportsSocket(llamaPath string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), sandboxProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, llamaPath, "--help")
+	cmd.WaitDelay = time.Second
+	output, _ := cmd.CombinedOutput()
+	return strings.Contains(string(output), ".sock")
+}
+
+// runnerWorkDir returns llama-server's working directory
+func runnerWorkDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("gpu-agent-%d", os.Getuid()), "runner")
+	}
+	return filepath.Join(dir, "gpu-agent", "runner")
+}
+
+// sandboxCommand runs the hidden launcher: it sets up the sandbox in its
+// own process and then becomes llama-server. In probe mode it prints which
+// features failed as JSON instead.
+func sandboxCommand(args []string) int {
+	var p sandboxProfile
+	if len(args) == 0 || json.Unmarshal([]byte(args[0]), &p) != nil {
+		fmt.Fprintln(os.Stderr, "gpu-agent "+sandboxCommandName+" is used by the agent to start llama-server")
+		return 2
+	}
+	failed := enterSandbox(p)
+	if p.Probe {
+		json.NewEncoder(os.Stdout).Encode(failed)
+		return 0
+	}
+	if len(failed) > 0 || len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "sandbox setup failed: %v\n", failed)
+		return 126
+	}
+	err := execSandboxed(args[1], args[1:])
+	fmt.Fprintf(os.Stderr, "starting %s: %v\n", args[1], err)
+	return 126
+}
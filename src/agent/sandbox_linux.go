@@ -0,0 +1,287 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sandboxNamespaces is the launcher's own failure to set up namespaces,
+// after which the probe tries again without them
+const sandboxNamespaces = "namespaces"
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS, which syscall lacks
+const prSetNoNewPrivs = 38
+
+// probeSandbox runs the launcher to see which features the host allows
+// and trims the profile to those, returning why the others are off
+func probeSandbox(s *Sandbox, llamaPath string) map[string]string {
+	exe, err := os.Executable()
+	if err != nil {
+		return launcherUnavailable(fmt.Errorf("finding agent binary: %w", err))
+	}
+
+	p := s.profile
+	p.Rlimits, p.NoNewPrivs, p.Namespaces = true, true, true
+	noNetwork := ""
+	switch {
+	case len(s.profile.WorkDir)+len("/llama.sock") > maxSocketPath:
+		noNetwork = "working dir path is too long for llama-server's unix socket"
+	case !llamaServerSupportsSocket(llamaPath):
+		noNetwork = "llama-server can't listen on a unix socket; newer llama.cpp builds can"
+	default:
+		p.Network = true
+	}
+
+	failed, err := runProbe(exe, p)
+	if err == nil && failed[sandboxNamespaces] != "" {
+		err = fmt.Errorf("%s", failed[sandboxNamespaces])
+	}
+	if err != nil {
+		// Unprivileged user namespaces are off on some distributions
+		reason := fmt.Sprintf("no user namespaces: %v", err)
+		p.Namespaces, p.Network, p.ReadOnly, p.Hidden = false, false, nil, nil
+		if failed, err = runProbe(exe, p); err != nil {
+			return launcherUnavailable(fmt.Errorf("running sandbox launcher: %w", err))
+		}
+		failed[sandboxReadOnly], failed[sandboxHideConfig] = reason, reason
+		if noNetwork == "" {
+			noNetwork = reason
+		}
+	}
+	if noNetwork != "" {
+		failed[sandboxNetwork] = noNetwork
+	}
+
+	for name := range failed {
+		switch name {
+		case sandboxRlimits:
+			p.Rlimits = false
+		case sandboxNoNewPrivs:
+			p.NoNewPrivs = false
+		case sandboxReadOnly:
+			p.ReadOnly = nil
+		case sandboxHideConfig:
+			p.Hidden = nil
+		case sandboxNetwork:
+			p.Network = false
+		}
+	}
+	s.exe, s.profile = exe, p
+	return failed
+}
+
+// launcherUnavailable reports every feature the launcher provides as off
+func launcherUnavailable(err error) map[string]string {
+	failed := make(map[string]string)
+	for _, name := range []string{sandboxRlimits, sandboxNoNewPrivs, sandboxReadOnly, sandboxHideConfig, sandboxNetwork} {
+		failed[name] = err.Error()
+	}
+	return failed
+}
+
+// sandboxAttr returns the process attributes putting the launcher in new
+// namespaces. It is root in its user namespace, mapped to the agent's own
+// user, until it drops its capabilities.
+func sandboxAttr(p sandboxProfile) *syscall.SysProcAttr {
+	if !p.Namespaces {
+		return nil
+	}
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if p.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return &syscall.SysProcAttr{
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+}
+
+// enterSandbox sets up the profile in the launcher, returning what failed
+func enterSandbox(p sandboxProfile) map[string]string {
+	// Capabilities and the no_new_privs bit are per thread, and llama-server
+	// must be executed from the thread that has them dropped
+	runtime.LockOSThread()
+
+	failed := make(map[string]string)
+	if p.Namespaces {
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			failed[sandboxNamespaces] = fmt.Sprintf("making mounts private: %v", err)
+			return failed
+		}
+		for _, dir := range p.ReadOnly {
+			if err := mountReadOnly(dir); err != nil {
+				failed[sandboxReadOnly] = fmt.Sprintf("%s: %v", dir, err)
+				break
+			}
+		}
+		for _, path := range p.Hidden {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue
+			}
+			if err := syscall.Mount("/dev/null", path, "", syscall.MS_BIND, ""); err != nil {
+				failed[sandboxHideConfig] = fmt.Sprintf("%s: %v", path, err)
+			}
+		}
+	}
+	if p.Network {
+		if err := loopbackUp(); err != nil {
+			failed[sandboxNetwork] = fmt.Sprintf("bringing up loopback: %v", err)
+		}
+	}
+	if p.Namespaces {
+		if err := dropCapabilities(); err != nil {
+			failed[sandboxNamespaces] = fmt.Sprintf("dropping capabilities: %v", err)
+		}
+	}
+	if p.Rlimits {
+		if err := setLimits(p); err != nil {
+			failed[sandboxRlimits] = err.Error()
+		}
+	}
+	if p.NoNewPrivs {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+			failed[sandboxNoNewPrivs] = errno.Error()
+		}
+	}
+	return failed
+}
+
+// execSandboxed replaces the launcher with llama-server
+func execSandboxed(path string, argv []string) error {
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// lockedMountFlags pairs statfs flags with the mount flags that must be
+// kept when remounting: a user namespace can't clear them
+var lockedMountFlags = []struct{ statfs, mount int64 }{
+	{0x2, syscall.MS_NOSUID},
+	{0x4, syscall.MS_NODEV},
+	{0x8, syscall.MS_NOEXEC},
+	{0x400, syscall.MS_NOATIME},
+	{0x800, syscall.MS_NODIRATIME},
+	{0x1000, syscall.MS_RELATIME},
+}
+
+// mountReadOnly bind-mounts a directory onto itself, read-only
+func mountReadOnly(dir string) error {
+	if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount: %w", err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("statfs: %w", err)
+	}
+	flags := int64(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for _, f := range lockedMountFlags {
+		if int64(st.Flags)&f.statfs != 0 {
+			flags |= f.mount
+		}
+	}
+	if err := syscall.Mount("", dir, "", uintptr(flags), ""); err != nil {
+		return fmt.Errorf("remount read-only: %w", err)
+	}
+	return nil
+}
+
+// loopbackUp brings up lo, which starts down in a new network namespace
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropCapabilities clears the bounding set and then every capability the
+// launcher holds as root of its user namespace, so llama-server has none
+func dropCapabilities() error {
+	for c := 0; c < 64; c++ {
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0, 0)
+		if errno == syscall.EINVAL {
+			break // past the last capability the kernel knows
+		}
+		if errno != 0 {
+			return fmt.Errorf("bounding set: %w", errno)
+		}
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: 0x20080522} // _LINUX_CAPABILITY_VERSION_3
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setLimits caps llama-server's heap and open files, and turns off core
+// dumps, which would hold prompts. Limits already lower are kept.
+func setLimits(p sandboxProfile) error {
+	type limit struct {
+		name     string
+		resource int
+		value    uint64
+	}
+	limits := []limit{
+		{"open files", syscall.RLIMIT_NOFILE, uint64(p.MaxOpenFiles)},
+		{"core", syscall.RLIMIT_CORE, 0},
+	}
+	if p.MaxMemoryMB > 0 {
+		limits = append(limits, limit{"data", syscall.RLIMIT_DATA, uint64(p.MaxMemoryMB) << 20})
+	}
+	for _, l := range limits {
+		var rl syscall.Rlimit
+		if err := syscall.Getrlimit(l.resource, &rl); err != nil {
+			return fmt.Errorf("%s limit: %w", l.name, err)
+		}
+		rl.Cur, rl.Max = min(l.value, rl.Max), min(l.value, rl.Max)
+		if err := syscall.Setrlimit(l.resource, &rl); err != nil {
+			return fmt.Errorf("%s limit: %w", l.name, err)
+		}
+	}
+	return nil
+}
+
+// totalMemoryMB returns the host's RAM, or 0 if it can't be read
+func totalMemoryMB() int {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.Atoi(fields[1])
+			return kb / 1024
+		}
+	}
+	return 0
+}
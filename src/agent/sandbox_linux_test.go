@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandboxProbeTrimsProfile(t *testing.T) {
+	s, _, modelDir := newTestSandbox(t, nil)
+	if f := sandboxFeature(t, s, sandboxNetwork); f.Enabled || !strings.Contains(f.Detail, "unix socket") {
+		t.Errorf("network %+v, want off for a llama-server without socket support", f)
+	}
+	if s.exe == "" || !s.profile.Rlimits || s.profile.MaxOpenFiles != defaultMaxOpenFiles {
+		t.Errorf("profile %+v, want the launcher with limits", s.profile)
+	}
+	if ro := sandboxFeature(t, s, sandboxReadOnly); ro.Enabled && (len(s.profile.ReadOnly) != 1 || s.profile.ReadOnly[0] != modelDir) {
+		t.Errorf("read-only dirs %q, want the model dir", s.profile.ReadOnly)
+	}
+}
+
+func TestSandboxProtectsModelsAndConfig(t *testing.T) {
+	s, configPath, modelDir := newTestSandbox(t, nil)
+	for _, name := range []string{sandboxReadOnly, sandboxHideConfig} {
+		if f := sandboxFeature(t, s, name); !f.Enabled {
+			t.Skipf("%s unavailable here: %s", name, f.Detail)
+		}
+	}
+
+	script := "cat " + configPath + "; touch " + filepath.Join(modelDir, "written") + "; echo ran"
+	cmd, err := s.Command("sh", []string{"-c", script})
+	if err != nil {
+		t.Fatalf("Command: %v", err)
+	}
+	output, _ := cmd.Output()
+	if string(output) != "ran\n" {
+		t.Errorf("output %q, want the script to run without reading the config", output)
+	}
+	if _, err := os.Stat(filepath.Join(modelDir, "written")); err == nil {
+		t.Error("llama-server wrote to the model dir")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+// probeSandbox reports the launcher's features as unavailable: they are
+// built on Linux namespaces and prctl. llama-server still gets its own
+// working directory.
+func probeSandbox(s *Sandbox, llamaPath string) map[string]string {
+	failed := make(map[string]string)
+	for _, name := range []string{sandboxRlimits, sandboxNoNewPrivs, sandboxReadOnly, sandboxHideConfig, sandboxNetwork} {
+		failed[name] = "not supported on " + runtime.GOOS
+	}
+	return failed
+}
+
+// sandboxAttr returns no process attributes; there is no launcher
+func sandboxAttr(p sandboxProfile) *syscall.SysProcAttr {
+	return nil
+}
+
+// enterSandbox fails every feature; there is no launcher
+func enterSandbox(p sandboxProfile) map[string]string {
+	return probeSandbox(nil, "")
+}
+
+// execSandboxed fails; there is no launcher
+func execSandboxed(path string, argv []string) error {
+	return errors.New("sandbox not supported on " + runtime.GOOS)
+}
+
+// totalMemoryMB returns 0, leaving memory unlimited
+func totalMemoryMB() int {
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sandboxFeature returns the named feature of a sandbox
+func sandboxFeature(t *testing.T, s *Sandbox, name string) SandboxFeature {
+	t.Helper()
+	for _, f := range s.Features() {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("no %s feature in %+v", name, s.Features())
+	return SandboxFeature{}
+}
+
+// newTestSandbox probes a sandbox for a config serving a model from a
+// directory of its own, with llama-server's working dir in the test's
+func newTestSandbox(t *testing.T, sc *SandboxConfig) (s *Sandbox, configPath, modelDir string) {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	configPath = writeConfig(t, "config.json", testConfigJSON)
+	modelDir = t.TempDir()
+	cfg := &Config{Models: []ModelConfig{{Name: "llama", Path: filepath.Join(modelDir, "llama.gguf")}}, Sandbox: sc}
+	return NewSandbox(cfg, configPath, filepath.Join(t.TempDir(), "llama-server")), configPath, modelDir
+}
+
+func TestSandboxDisabled(t *testing.T) {
+	s, _, _ := newTestSandbox(t, &SandboxConfig{Disabled: true})
+	for _, f := range s.Features() {
+		if f.Enabled {
+			t.Errorf("%s enabled with the sandbox disabled", f.Name)
+		}
+	}
+	cmd, err := s.Command(os.Args[0], []string{"-h"})
+	if err != nil || cmd.Path != os.Args[0] || cmd.Dir != "" {
+		t.Errorf("command %v in %q (err %v), want llama-server run directly", cmd.Args, cmd.Dir, err)
+	}
+}
+
+func TestSandboxCommandFreshWorkDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "runner")
+	s := &Sandbox{profile: sandboxProfile{WorkDir: dir}}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "left-behind")
+	if err := os.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := s.Command(os.Args[0], nil)
+	if err != nil {
+		t.Fatalf("Command: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("files of an earlier llama-server were kept")
+	}
+	if cmd.Dir != dir || cmd.Env[len(cmd.Env)-2] != "HOME="+dir {
+		t.Errorf("runs in %q with %q, want the working dir as home", cmd.Dir, cmd.Env[len(cmd.Env)-2:])
+	}
+}
+
+func TestSandboxCommandMissingBinary(t *testing.T) {
+	s := &Sandbox{profile: sandboxProfile{WorkDir: t.TempDir()}}
+	if _, err := s.Command(filepath.Join(t.TempDir(), "llama-server"), nil); err == nil {
+		t.Error("no error for a missing llama-server")
+	}
+}
+
+func TestSandboxSocketNeedsNetworkNamespace(t *testing.T) {
+	s := &Sandbox{profile: sandboxProfile{WorkDir: "/run/runner"}}
+	if s.Socket() != "" || s.Transport() != http.DefaultTransport {
+		t.Errorf("socket %q without a network namespace, want loopback TCP", s.Socket())
+	}
+	s.profile.Network = true
+	if s.Socket() != "/run/runner/llama.sock" {
+		t.Errorf("socket %q, want one in the working dir", s.Socket())
+	}
+}
+
+func TestSandboxLauncherUsage(t *testing.T) {
+	if code := sandboxCommand([]string{"not json"}); code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// serviceUnitName is the systemd unit the agent is installed as
+const serviceUnitName = "gpu-agent.service"
+
+// systemConfigPath is the default config of a system service, which has
+// no home directory of its own to look in
+const systemConfigPath = "/etc/gpu-agent/config.json"
+
+// unitOptions are the inputs to a generated systemd unit
+type unitOptions struct {
+	System     bool   // a system service rather than a user service
+	Executable string // absolute path of the gpu-agent binary
+	ConfigPath string // absolute path of the config file
+	User       string // account a system service runs as
+	Path       string // PATH the agent finds llama-server and nvidia-smi on
+}
+
+// unitTemplate is the generated unit. Restart is on failure only, so a
+// drained agent stays stopped, and not on exitRejected, which restarting
+// can't fix. The agent yields CPU and IO to the desktop.
+// System services are sandboxed; a user service can't be, since the
+// directives need privileges the user's service manager doesn't have.
+// Their cache dir, which holds llama-server's working dir, is moved to
+// /var/cache, as their home is read-only, and the binary's directory stays
+// writable so the agent can replace itself when it updates.
+// GPUs need /dev, so PrivateDevices stays off either way, and CUDA
+// generates code at run time, so MemoryDenyWriteExecute does too.
+var unitTemplate = template.Must(template.New("unit").Funcs(template.FuncMap{
+	"exec":           systemdExecArg,
+	"value":          systemdValue,
+	"dir":            filepath.Dir,
+	"rejectedStatus": func() int { return exitRejected },
+}).Parse(`# Generated by gpu-agent service install; reinstall rather than edit.
+[Unit]
+Description=GPU pool agent
+{{- if .System}}
+After=network-online.target
+Wants=network-online.target
+{{- end}}
+StartLimitIntervalSec=10min
+StartLimitBurst=10
+
+[Service]
+Type=simple
+ExecStart={{exec .Executable}} -config {{exec .ConfigPath}} run
+ExecReload=/bin/kill -HUP $MAINPID
+{{- if .System}}
+User={{value .User}}
+{{- end}}
+Environment={{exec (print "PATH=" .Path)}}
+Restart=on-failure
+RestartSec=10s
+RestartPreventExitStatus={{rejectedStatus}}
+KillMode=mixed
+TimeoutStopSec=30s
+
+Nice=10
+CPUWeight=20
+IOWeight=20
+LimitNOFILE=65536
+
+NoNewPrivileges=yes
+{{- if .System}}
+ProtectSystem=strict
+ProtectHome=read-only
+ReadWritePaths={{exec (dir .ConfigPath)}}{{if ne (dir .Executable) (dir .ConfigPath)}} {{exec (dir .Executable)}}{{end}}
+CacheDirectory=gpu-agent
+Environment=XDG_CACHE_HOME=/var/cache
+PrivateTmp=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+RestrictSUIDSGID=yes
+RestrictRealtime=yes
+LockPersonality=yes
+SystemCallArchitectures=native
+{{- end}}
+
+[Install]
+WantedBy={{if .System}}multi-user.target{{else}}default.target{{end}}
+`))
+
+// renderUnit returns the systemd unit for the options. The output depends
+// only on them, so it can be compared against golden files.
+func renderUnit(o unitOptions) string {
+	var b strings.Builder
+	if err := unitTemplate.Execute(&b, o); err != nil {
+		panic(err) // the template and its inputs are ours
+	}
+	return b.String()
+}
+
+// systemdValue escapes specifiers in a unit setting's value
+func systemdValue(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// systemdExecArg quotes a word of a command line or list setting so
+// systemd reads it back unchanged
+func systemdExecArg(s string) string {
+	s = strings.ReplaceAll(systemdValue(s), "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// serviceCommand runs `gpu-agent service install|uninstall|status`
+func serviceCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, "Usage: gpu-agent service install|uninstall|status [-system] [-run-as user] [-dry-run] [-config path]")
+		return 2
+	}
+	action := args[0]
+	fs := newFlagSet("service " + action)
+	system := fs.Bool("system", false, "Manage a system service instead of a user service (needs root)")
+	runAs := fs.String("run-as", os.Getenv("SUDO_USER"), "Account a system service runs as")
+	dryRun := fs.Bool("dry-run", false, "Print the unit and systemctl commands instead of running them")
+	fs.Parse(args[1:])
+
+	unitPath, err := serviceUnitPath(*system)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	systemctl := func(args ...string) []string {
+		if *system {
+			return append([]string{"systemctl"}, args...)
+		}
+		return append([]string{"systemctl", "--user"}, args...)
+	}
+
+	var unit string
+	var steps [][]string
+	switch action {
+	case "install":
+		opts, err := serviceOptions(*system, *runAs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		unit = renderUnit(opts)
+		steps = [][]string{systemctl("daemon-reload"), systemctl("enable", "--now", serviceUnitName)}
+	case "uninstall":
+		steps = [][]string{systemctl("disable", "--now", serviceUnitName), systemctl("daemon-reload")}
+	case "status":
+		steps = [][]string{systemctl("status", "--no-pager", serviceUnitName)}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown service command %q, want install, uninstall or status\n", action)
+		return 2
+	}
+
+	if *dryRun {
+		if unit != "" {
+			fmt.Printf("# %s\n%s\n", unitPath, unit)
+		}
+		for i, step := range steps {
+			fmt.Println(strings.Join(step, " "))
+			if action == "uninstall" && i == 0 {
+				fmt.Println("rm -f " + unitPath)
+			}
+		}
+		return 0
+	}
+
+	if runtime.GOOS != "linux" {
+		fmt.Fprintln(os.Stderr, "Services are only supported with systemd on Linux")
+		return 1
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		fmt.Fprintln(os.Stderr, "systemctl not found; services need systemd")
+		return 1
+	}
+	if action == "install" && !*system && os.Geteuid() == 0 {
+		fmt.Fprintln(os.Stderr, "Installing a user service for root; run without sudo, or pass -system for a system service")
+	}
+
+	switch action {
+	case "install":
+		if err := os.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := os.WriteFile(unitPath, []byte(unit), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Wrote %s\n", unitPath)
+		if err := runSteps(steps); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *system {
+			fmt.Println("Installed and started. Check it with `gpu-agent service status -system`.")
+		} else {
+			fmt.Println("Installed and started. It stops when you log out unless you run `loginctl enable-linger`.")
+		}
+	case "uninstall":
+		// Disabling fails if it was never installed, which is fine
+		runSteps(steps[:1])
+		if err := os.Remove(unitPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := runSteps(steps[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Removed %s\n", unitPath)
+	case "status":
+		var exitErr *exec.ExitError
+		if err := runSteps(steps); errors.As(err, &exitErr) {
+			return exitErr.ExitCode() // systemctl's: 3 when not running, 4 when not installed
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// serviceOptions works out the unit for this binary and config, which
+// must be valid: a service restarting on a broken config helps nobody
+func serviceOptions(system bool, runAs string) (unitOptions, error) {
+	path := *configPath
+	if path == "" {
+		path = DefaultConfigPath()
+		if system {
+			path = systemConfigPath
+		}
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return unitOptions{}, err
+	}
+	if _, err := LoadConfig(path); err != nil {
+		return unitOptions{}, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return unitOptions{}, fmt.Errorf("finding the gpu-agent binary: %w", err)
+	}
+
+	if system && runAs == "" {
+		return unitOptions{}, errors.New("pass -run-as with the account the system service runs as")
+	}
+	return unitOptions{
+		System:     system,
+		Executable: exe,
+		ConfigPath: path,
+		User:       runAs,
+		Path:       os.Getenv("PATH"),
+	}, nil
+}
+
+// serviceUnitPath returns where the unit file goes
+func serviceUnitPath(system bool) (string, error) {
+	if system {
+		return filepath.Join("/etc/systemd/system", serviceUnitName), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding the user unit directory: %w", err)
+	}
+	return filepath.Join(dir, "systemd", "user", serviceUnitName), nil
+}
+
+// runSteps runs commands in order with their output on ours, stopping at
+// the first that fails
+func runSteps(steps [][]string) error {
+	for _, step := range steps {
+		cmd := exec.Command(step[0], step[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(step, " "), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// update rewrites the golden files from the current output
+var update = flag.Bool("update", false, "rewrite testdata golden files")
+
+func TestRenderUnit(t *testing.T) {
+	tests := []struct {
+		golden string
+		opts   unitOptions
+	}{
+		{"user.service", unitOptions{
+			Executable: "/home/alex/.local/bin/gpu-agent",
+			ConfigPath: "/home/alex/.config/gpu-agent/config.json",
+			Path:       "/home/alex/.local/bin:/usr/local/bin:/usr/bin:/bin",
+		}},
+		{"system.service", unitOptions{
+			System:     true,
+			Executable: "/opt/gpu agent/bin/gpu-agent",
+			ConfigPath: systemConfigPath,
+			User:       "gpu-agent",
+			Path:       "/usr/local/cuda/bin:/usr/local/bin:/usr/bin:/bin",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			got := renderUnit(tt.opts)
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading golden file (run with -update to create it): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("unit differs from %s (run with -update if the change is intended):\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestRenderUnitBinaryInConfigDir(t *testing.T) {
+	unit := renderUnit(unitOptions{
+		System:     true,
+		Executable: "/etc/gpu-agent/gpu-agent",
+		ConfigPath: systemConfigPath,
+		User:       "gpu-agent",
+	})
+	if !strings.Contains(unit, "\nReadWritePaths=/etc/gpu-agent\n") {
+		t.Errorf("want the shared directory writable once, got:\n%s", unit)
+	}
+}
+
+func TestSystemdExecArg(t *testing.T) {
+	tests := map[string]string{
+		"/usr/bin/gpu-agent":   "/usr/bin/gpu-agent",
+		"/opt/gpu agent/agent": `"/opt/gpu agent/agent"`,
+		"100%":                 "100%%",
+		"$HOME/agent":          "$$HOME/agent",
+		`say "hi"`:             `"say \"hi\""`,
+		`C:\agent`:             `"C:\\agent"`,
+		"a;b":                  `"a;b"`,
+		"":                     `""`,
+	}
+	for in, want := range tests {
+		if got := systemdExecArg(in); got != want {
+			t.Errorf("systemdExecArg(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Sleep detection tuning
+const (
+	sleepCheckInterval = 5 * time.Second
+	sleepMinGap        = 10 * time.Second // shorter gaps are scheduling noise
+	suspendTimeout     = 4 * time.Second  // to hand back work; logind waits 5s by default
+	suspendWakeWithin  = 24 * time.Hour   // asked of the server: how long to wait for a sleeping host before counting the agent gone
+)
+
+// SleepWatcher notices the host going to sleep and waking up again, as
+// laptops in the pool do without warning. Wake-ups are detected from the
+// clocks on every platform: the monotonic clock stops while the host
+// sleeps but the wall clock does not, and a process frozen some other way
+// sees its periodic check arrive late. On Linux, logind also announces a
+// sleep before it happens, giving the agent a moment to hand back work.
+type SleepWatcher struct {
+	onSuspend func()              // called before the host sleeps, when that is announced
+	onResume  func(time.Duration) // called after it wakes up, with how long it was gone
+
+	mu      sync.Mutex
+	asleep  time.Time // wall clock time a sleep was announced; zero when awake
+	checked time.Time // last clock check
+}
+
+// NewSleepWatcher creates a watcher calling onSuspend before announced
+// sleeps and onResume after every wake-up
+func NewSleepWatcher(onSuspend func(), onResume func(time.Duration)) *SleepWatcher {
+	return &SleepWatcher{onSuspend: onSuspend, onResume: onResume}
+}
+
+// Run watches for sleeps until the context is cancelled
+func (s *SleepWatcher) Run(ctx context.Context) {
+	go watchPrepareForSleep(ctx, s.suspending, s.woke)
+
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+
+	s.mu.Lock()
+	s.checked = time.Now()
+	s.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check compares the clocks against the last check and reports a wake-up
+// if they show the process was stopped
+func (s *SleepWatcher) check() {
+	s.mu.Lock()
+	now := time.Now()
+	gap := sleepGap(s.checked, now, sleepCheckInterval)
+	s.checked = now
+	if gap < sleepMinGap {
+		// Nothing happened, or an announced sleep hasn't begun yet
+		s.mu.Unlock()
+		return
+	}
+	if !s.asleep.IsZero() {
+		gap = max(gap, now.Round(0).Sub(s.asleep))
+		s.asleep = time.Time{}
+	}
+	s.mu.Unlock()
+
+	s.resumed(gap)
+}
+
+// suspending handles an announced sleep
+func (s *SleepWatcher) suspending() {
+	s.mu.Lock()
+	s.asleep = time.Now().Round(0)
+	s.mu.Unlock()
+
+	slog.Info("Host is going to sleep")
+	s.onSuspend()
+}
+
+// woke handles an announced wake-up, unless the clocks already gave it away.
+// logind also announces this when a sleep is called off.
+func (s *SleepWatcher) woke() {
+	s.mu.Lock()
+	if s.asleep.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	gap := now.Round(0).Sub(s.asleep)
+	s.asleep = time.Time{}
+	s.checked = now
+	s.mu.Unlock()
+
+	s.resumed(gap)
+}
+
+// resumed reports a wake-up
+func (s *SleepWatcher) resumed(slept time.Duration) {
+	slog.Info("Host woke up", "slept", slept.Round(time.Second))
+	s.onResume(slept)
+}
+
+// sleepGap returns how long the process was stopped between two checks
+// meant to be interval apart: how far the wall clock ran ahead of the
+// monotonic clock, or how far the monotonic clock overran the interval,
+// whichever is more. The former also catches the wall clock being stepped.
+func sleepGap(last, now time.Time, interval time.Duration) time.Duration {
+	mono := now.Sub(last)
+	wall := now.Round(0).Sub(last.Round(0))
+	return max(wall-mono, mono-interval)
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+// logind is watched through the gdbus and systemd-inhibit tools rather than
+// a D-Bus library, which keeps the agent free of dependencies.
+
+// watchPrepareForSleep calls suspending when logind announces that the host
+// is going to sleep and woke when it has woken up. Between sleeps it holds
+// a delay inhibitor lock, so logind waits for suspending to return (up to
+// its InhibitDelayMaxSec, 5s by default) before the host sleeps. It returns
+// when the context is cancelled or logind can't be watched.
+func watchPrepareForSleep(ctx context.Context, suspending, woke func()) {
+	cmd := exec.CommandContext(ctx, "gdbus", "monitor", "--system",
+		"--dest", "org.freedesktop.login1", "--object-path", "/org/freedesktop/login1")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		slog.Info("Not watching logind for sleep, wake-ups are still detected", "err", err)
+		return
+	}
+	defer cmd.Wait()
+
+	lock := takeSleepLock()
+	defer func() { lock.release() }()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, ".PrepareForSleep (true,)"):
+			suspending()
+			lock.release()
+		case strings.Contains(line, ".PrepareForSleep (false,)"):
+			woke()
+			lock = takeSleepLock()
+		}
+	}
+	if ctx.Err() == nil {
+		slog.Info("Stopped watching logind for sleep", "err", scanner.Err())
+	}
+}
+
+// sleepLock is a logind delay lock on sleep, held for as long as a
+// systemd-inhibit process runs
+type sleepLock struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+// takeSleepLock takes a delay lock on sleep. It returns nil if it can't,
+// in which case the host may sleep before work is handed back.
+func takeSleepLock() *sleepLock {
+	// cat runs under the lock until its stdin is closed
+	cmd := exec.Command("systemd-inhibit", "--what=sleep", "--mode=delay",
+		"--who=gpu-agent", "--why=Handing back work before sleep", "cat")
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		slog.Debug("Cannot delay sleep", "err", err)
+		return nil
+	}
+	return &sleepLock{cmd: cmd, stdin: stdin}
+}
+
+// release drops the lock, letting the host sleep
+func (l *sleepLock) release() {
+	if l == nil || l.cmd == nil {
+		return
+	}
+	l.stdin.Close()
+	l.cmd.Wait()
+	l.cmd = nil
+}
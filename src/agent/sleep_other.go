@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// watchPrepareForSleep does nothing: sleeps are only announced in advance
+// by logind on Linux. Wake-ups are still detected from the clocks.
+func watchPrepareForSleep(ctx context.Context, suspending, woke func()) {}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusShutdownTimeout bounds how long the status API waits for open requests on exit
+const statusShutdownTimeout = 2 * time.Second
+
+// Agent states shown by the status API
+const (
+	stateRegistering = "registering"
+	stateWorking     = "working"
+	stateIdle        = "idle"
+	statePaused      = "paused"
+	stateDraining    = "draining"
+	stateSuspended   = "suspended"
+)
+
+// StatusReport is what the local status API reports about the agent
+type StatusReport struct {
+	Name          string            `json:"name"`
+	Version       string            `json:"version"`
+	AgentID       string            `json:"agent_id,omitempty"` // empty until registered
+	ServerURL     string            `json:"server_url"`
+	OfflineSec    int               `json:"offline_sec,omitempty"` // how long the server has been unreachable
+	State         string            `json:"state"`
+	PausedReason  string            `json:"paused_reason,omitempty"`
+	GPUs          []GPUInfo         `json:"gpus"`
+	OfferedVRAMMB int               `json:"offered_vram_mb"`
+	TemperatureC  int               `json:"temperature_c,omitempty"`
+	LoadedModel   string            `json:"loaded_model,omitempty"`
+	CurrentJob    string            `json:"current_job,omitempty"`
+	Policy        *PolicyConfig     `json:"policy,omitempty"`
+	UptimeSec     int               `json:"uptime_sec"`
+	Heartbeats    []HeartbeatRecord `json:"recent_heartbeats"`
+}
+
+// StatusServer serves the local status API: GET /status reports what the
+// agent is doing, and POST /pause, /resume and /drain control it. It only
+// listens on loopback, so anyone who can use it is already on the host.
+type StatusServer struct {
+	cfg        *Config        // as the agent started
+	config     *ConfigWatcher // for the settings reloaded since
+	gpus       []GPUInfo
+	supervisor *Supervisor
+	worker     *Worker
+	policy     *Policy
+	started    time.Time
+	onDrain    func() // called once when a drain is requested
+}
+
+// NewStatusServer creates a status API for the agent's components
+func NewStatusServer(cfg *Config, config *ConfigWatcher, gpus []GPUInfo, supervisor *Supervisor, worker *Worker, policy *Policy, onDrain func()) *StatusServer {
+	return &StatusServer{
+		cfg:        cfg,
+		config:     config,
+		gpus:       gpus,
+		supervisor: supervisor,
+		worker:     worker,
+		policy:     policy,
+		started:    time.Now(),
+		onDrain:    onDrain,
+	}
+}
+
+// Run serves the API on cfg.StatusAddr until the context is cancelled
+func (s *StatusServer) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/pause", s.handlePause)
+	mux.HandleFunc("/resume", s.handleResume)
+	mux.HandleFunc("/drain", s.handleDrain)
+
+	ln, err := net.Listen("tcp", s.cfg.StatusAddr)
+	if err != nil {
+		slog.Warn("Status API unavailable", "addr", s.cfg.StatusAddr, "err", err)
+		return
+	}
+	srv := &http.Server{Handler: s.localOnly(mux), ReadHeaderTimeout: 5 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	slog.Info("Status API listening", "addr", ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Warn("Status API stopped", "err", err)
+	}
+}
+
+// localOnly turns away requests from web pages. Browsers send an Origin
+// header with cross-site requests, which a page could otherwise aim at
+// loopback to pause or drain the agent.
+func (s *StatusServer) localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeStatusError(w, http.StatusForbidden, "forbidden", "Browser requests are not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Report returns the agent's current status
+func (s *StatusServer) Report() StatusReport {
+	report := StatusReport{
+		Name:          s.cfg.Name,
+		Version:       version,
+		AgentID:       s.supervisor.AgentID(),
+		ServerURL:     s.cfg.ServerURL,
+		OfflineSec:    int(s.supervisor.Outage().Seconds()),
+		PausedReason:  s.worker.Paused(),
+		GPUs:          s.gpus,
+		OfferedVRAMMB: s.policy.OfferedVRAM(),
+		TemperatureC:  s.policy.TemperatureC(),
+		LoadedModel:   s.worker.runner.LoadedModel(),
+		CurrentJob:    s.worker.CurrentJob(),
+		Policy:        s.config.Current().Policy,
+		UptimeSec:     int(time.Since(s.started).Seconds()),
+		Heartbeats:    s.supervisor.Heartbeats(),
+	}
+	switch {
+	case report.AgentID == "":
+		report.State = stateRegistering
+	case s.worker.Suspended():
+		report.State = stateSuspended
+	case s.worker.Draining():
+		report.State = stateDraining
+	case report.PausedReason != "":
+		report.State = statePaused
+	case report.CurrentJob != "":
+		report.State = stateWorking
+	default:
+		report.State = stateIdle
+	}
+	return report
+}
+
+// handleStatus handles GET /status
+func (s *StatusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+	writeStatusJSON(w, http.StatusOK, s.Report())
+}
+
+// handlePause handles POST /pause
+func (s *StatusServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is allowed")
+		return
+	}
+	slog.Info("Pause requested through status API")
+	s.policy.SetManual(true)
+	writeStatusJSON(w, http.StatusOK, s.Report())
+}
+
+// handleResume handles POST /resume. It lifts a manual pause; the rest of
+// the policy still applies.
+func (s *StatusServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is allowed")
+		return
+	}
+	if s.worker.Draining() {
+		writeStatusError(w, http.StatusConflict, "draining", "The agent is draining and will exit")
+		return
+	}
+	slog.Info("Resume requested through status API")
+	s.policy.SetManual(false)
+	writeStatusJSON(w, http.StatusOK, s.Report())
+}
+
+// handleDrain handles POST /drain: the agent takes no more work and exits
+// once the running job is over
+func (s *StatusServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is allowed")
+		return
+	}
+	if !s.worker.Draining() {
+		slog.Info("Drain requested through status API")
+		s.onDrain()
+	}
+	writeStatusJSON(w, http.StatusAccepted, s.Report())
+}
+
+// writeStatusJSON writes a JSON response
+func writeStatusJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeStatusError writes an error in the server's format, which APIError parses
+func writeStatusError(w http.ResponseWriter, status int, code, message string) {
+	writeStatusJSON(w, status, APIError{Code: code, Message: message})
+}
+
+// checkLoopback returns an error unless addr is host:port on a loopback address
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// testStatus is a status API over an idle, registered agent
+type testStatus struct {
+	server *StatusServer
+	client *HeartbeatClient
+	drains *atomic.Int32 // times onDrain was called
+}
+
+// newTestStatus starts a status API, with the policy applying pauses to
+// the worker as the agent does, until the test ends
+func newTestStatus(t *testing.T) *testStatus {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cfg := &Config{AgentConfig: shared.AgentConfig{ServerURL: "https://pool.example.com"}, Name: "desk", StatusAddr: addr}
+	gpu := GPUInfo{ID: "cuda:0", Type: "nvidia", Name: "RTX 4090", VRAM_MB: 24000, ComputeCap: "8.9"}
+
+	client := NewHeartbeatClient(cfg.ServerURL, "")
+	supervisor := NewSupervisor(client, RegistrationRequest{}, nil)
+	supervisor.agentID = "agent-1"
+	worker := NewWorker(client, supervisor.AgentID, NewRunner("llama-server", 0, nil, &Sandbox{}), shared.NewTracer(nil))
+	policy := NewPolicy(&PolicyConfig{MaxVRAMPercent: 75}, gpu, func() int { return 0 })
+	drains := &atomic.Int32{}
+	s := NewStatusServer(cfg, NewConfigWatcher(writeConfig(t, "config.json", testConfigJSON), cfg, nil), []GPUInfo{gpu}, supervisor, worker, policy, func() {
+		drains.Add(1)
+		worker.Drain()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	go func() { policy.Run(ctx, worker.SetPaused); done <- struct{}{} }()
+	go func() { s.Run(ctx); done <- struct{}{} }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+	})
+
+	ts := &testStatus{server: s, client: statusClient(addr), drains: drains}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := fetchStatus(ctx, ts.client); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("status API not up: %v", err)
+		}
+	}
+	return ts
+}
+
+// post sends a control request and returns the report and the error
+func (ts *testStatus) post(t *testing.T, path string) (StatusReport, error) {
+	t.Helper()
+	var report StatusReport
+	_, err := ts.client.do(context.Background(), http.MethodPost, path, nil, &report)
+	return report, err
+}
+
+func TestStatusReportIdle(t *testing.T) {
+	ts := newTestStatus(t)
+	report, err := fetchStatus(context.Background(), ts.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.State != stateIdle || report.Name != "desk" || report.AgentID != "agent-1" || report.OfferedVRAMMB != 18000 {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestStatusRegistering(t *testing.T) {
+	ts := newTestStatus(t)
+	ts.server.supervisor.mu.Lock()
+	ts.server.supervisor.agentID = ""
+	ts.server.supervisor.mu.Unlock()
+	if state := ts.server.Report().State; state != stateRegistering {
+		t.Errorf("state %q before registering, want %s", state, stateRegistering)
+	}
+}
+
+func TestStatusPauseAndResume(t *testing.T) {
+	ts := newTestStatus(t)
+	report, err := ts.post(t, "/pause")
+	if err != nil || report.State != statePaused || report.PausedReason != pauseManual {
+		t.Fatalf("after pause: state %q, reason %q, err %v", report.State, report.PausedReason, err)
+	}
+	if report, err = ts.post(t, "/resume"); err != nil || report.State != stateIdle {
+		t.Errorf("after resume: state %q, err %v", report.State, err)
+	}
+}
+
+func TestStatusDrainRefusesResume(t *testing.T) {
+	ts := newTestStatus(t)
+	ts.post(t, "/drain")
+	report, err := ts.post(t, "/drain")
+	if err != nil || report.State != stateDraining || ts.drains.Load() != 1 {
+		t.Fatalf("state %q, %d drains, err %v; want draining once", report.State, ts.drains.Load(), err)
+	}
+
+	_, err = ts.post(t, "/resume")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Code != "draining" {
+		t.Errorf("resume while draining: %v, want 409 draining", err)
+	}
+}
+
+func TestStatusRejectsBrowserRequests(t *testing.T) {
+	ts := newTestStatus(t)
+	req, _ := http.NewRequest(http.MethodPost, ts.client.serverURL+"/pause", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || ts.server.Report().State != stateIdle {
+		t.Errorf("status %d, state %q; want 403 and still idle", resp.StatusCode, ts.server.Report().State)
+	}
+}
+
+func TestStatusRejectsWrongMethod(t *testing.T) {
+	ts := newTestStatus(t)
+	_, err := ts.client.do(context.Background(), http.MethodGet, "/drain", nil, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusMethodNotAllowed || ts.drains.Load() != 0 {
+		t.Errorf("GET /drain: %v, want 405 without draining", err)
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	var b bytes.Buffer
+	printStatus(&b, StatusReport{
+		Name: "desk", AgentID: "agent-1", State: statePaused, PausedReason: "process_running:steam",
+		GPUs:          []GPUInfo{{Type: "nvidia", Name: "RTX 4090", VRAM_MB: 24000, ComputeCap: "8.9"}},
+		OfferedVRAMMB: 18000,
+		TemperatureC:  71,
+	})
+	out := b.String()
+	for _, want := range []string{"desk (agent-1)", "paused (process_running:steam)", "offering 18000 MB, 71°C", "Model    -"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestDescribePolicy(t *testing.T) {
+	got := describePolicy(&PolicyConfig{Windows: []string{"Sat,Sun"}, IdleOnly: true, IdleMinutes: 5, PauseProcesses: []string{"steam"}})
+	want := "windows Sat,Sun; idle for 5m; not while steam runs"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCheckLoopback(t *testing.T) {
+	if err := checkLoopback("0.0.0.0:8090"); err == nil {
+		t.Error("accepted a wildcard address")
+	}
+	if err := checkLoopback("localhost:8090"); err != nil {
+		t.Errorf("rejected localhost: %v", err)
+	}
+}
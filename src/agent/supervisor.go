@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Registration retry backoff
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 2 * time.Minute
+)
+
+// recentHeartbeats is how many heartbeat results are kept for the status API
+const recentHeartbeats = 10
+
+// HeartbeatRecord is the outcome of one heartbeat, as shown by the status API
+type HeartbeatRecord struct {
+	At           time.Time `json:"at"`
+	Status       string    `json:"status"` // as reported to the server
+	Error        string    `json:"error,omitempty"`
+	NextInterval int       `json:"next_interval_sec,omitempty"`
+	Commands     []string  `json:"commands,omitempty"`
+}
+
+// ErrRejected marks a registration the server refused for good, e.g. with
+// a revoked key or a used-up enrollment token. Retrying can't help; the
+// agent needs new credentials.
+var ErrRejected = errors.New("server rejected registration")
+
+// Supervisor keeps the agent registered with the server. Registration is
+// retried with jittered exponential backoff until the server answers, and
+// repeated when the server no longer knows the agent or its key, e.g.
+// after losing its database. It tracks how long the agent has been cut off so the
+// outage can be logged and reported once the server is reachable again,
+// and keeps the last few heartbeat results for the status API.
+type Supervisor struct {
+	client       *HeartbeatClient
+	req          RegistrationRequest
+	onRegistered func(*RegistrationResponse)          // e.g. to persist the agent ID and key
+	sleep        func(context.Context, time.Duration) // between registration attempts; replaceable in tests
+	rejected     chan error                           // a registration again refused for good; see Rejected
+
+	mu             sync.Mutex
+	agentID        string
+	disconnectedAt time.Time     // zero while connected
+	slept          time.Duration // host sleep not yet reported to the server
+	heartbeats     []HeartbeatRecord
+}
+
+// NewSupervisor creates a supervisor registering with req. onRegistered is
+// called after every successful registration.
+func NewSupervisor(client *HeartbeatClient, req RegistrationRequest, onRegistered func(*RegistrationResponse)) *Supervisor {
+	return &Supervisor{
+		client:       client,
+		req:          req,
+		onRegistered: onRegistered,
+		sleep:        sleepCtx,
+		rejected:     make(chan error, 1),
+	}
+}
+
+// AgentID returns the ID the server assigned at the last registration
+func (s *Supervisor) AgentID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.agentID
+}
+
+// Register registers the agent, retrying until it succeeds, the server
+// rejects it for good or ctx is done
+func (s *Supervisor) Register(ctx context.Context) (*RegistrationResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.client.Register(ctx, s.req)
+		if err == nil {
+			s.registered(resp)
+			return resp, nil
+		}
+
+		s.Disconnected()
+		if permanent(err) {
+			return nil, fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+		delay := backoffDelay(attempt)
+		slog.Warn("Registration failed, retrying", "err", err, "attempt", attempt+1, "retry_in", delay.Round(time.Millisecond))
+		s.sleep(ctx, delay)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// registered records a successful registration. Once the server has
+// issued a key the enrollment token is used up, so later registrations
+// authenticate with the key instead.
+func (s *Supervisor) registered(resp *RegistrationResponse) {
+	if resp.APIKey != "" {
+		s.client.SetAPIKey(resp.APIKey)
+		s.req.EnrollmentToken = ""
+	}
+
+	s.mu.Lock()
+	s.agentID = resp.AgentID
+	s.mu.Unlock()
+
+	if s.onRegistered != nil {
+		s.onRegistered(resp)
+	}
+}
+
+// HandleError inspects a failed heartbeat. If the server no longer knows
+// the agent, or no longer accepts its key, it re-registers, blocking until
+// that succeeds or ctx is done; a registration rejected for good is sent
+// on Rejected. Any other failure just marks the agent disconnected.
+func (s *Supervisor) HandleError(ctx context.Context, err error) {
+	s.Disconnected()
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return
+	}
+	switch apiErr.StatusCode {
+	case http.StatusNotFound:
+		slog.Warn("Server no longer knows this agent, registering again", "agent_id", s.AgentID())
+	case http.StatusUnauthorized:
+		slog.Warn("Server no longer accepts this agent's key, registering again", "agent_id", s.AgentID())
+	default:
+		return
+	}
+	if _, err := s.Register(ctx); err != nil {
+		if errors.Is(err, ErrRejected) {
+			select {
+			case s.rejected <- err:
+			default:
+			}
+		}
+		return
+	}
+	slog.Info("Registered again", "agent_id", s.AgentID())
+}
+
+// Rejected delivers the error once a re-registration is rejected for good,
+// after which the agent can't go on
+func (s *Supervisor) Rejected() <-chan error {
+	return s.rejected
+}
+
+// permanent reports whether a registration error is an answer from the
+// server that won't change on retrying: any 4xx but a timeout or rate limit
+func permanent(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code := apiErr.StatusCode
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+// Disconnected marks the start of an outage, if one isn't already under way
+func (s *Supervisor) Disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnectedAt.IsZero() {
+		s.disconnectedAt = time.Now()
+	}
+}
+
+// Connected ends an outage, if there was one, and logs how long it lasted.
+// It is called once a heartbeat gets through, which has also reported any
+// host sleep.
+func (s *Supervisor) Connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slept = 0
+	if s.disconnectedAt.IsZero() {
+		return
+	}
+	slog.Info("Reconnected to server", "disconnected_for", time.Since(s.disconnectedAt).Round(time.Second))
+	s.disconnectedAt = time.Time{}
+}
+
+// Outage returns how long the agent has been disconnected, 0 if it isn't
+func (s *Supervisor) Outage() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnectedAt.IsZero() {
+		return 0
+	}
+	return time.Since(s.disconnectedAt)
+}
+
+// Slept records that the host slept. The server is told with the next
+// heartbeat, so that it doesn't take the silence for a failure.
+func (s *Supervisor) Slept(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slept += d
+}
+
+// Asleep returns how long the host slept since the last heartbeat got through
+func (s *Supervisor) Asleep() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.slept
+}
+
+// Record keeps a heartbeat result, dropping the oldest beyond recentHeartbeats
+func (s *Supervisor) Record(hb HeartbeatRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeats = append(s.heartbeats, hb)
+	if n := len(s.heartbeats) - recentHeartbeats; n > 0 {
+		s.heartbeats = append(s.heartbeats[:0], s.heartbeats[n:]...)
+	}
+}
+
+// Heartbeats returns the recent heartbeat results, oldest first
+func (s *Supervisor) Heartbeats() []HeartbeatRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HeartbeatRecord(nil), s.heartbeats...)
+}
+
+// backoffDelay returns the wait before retry attempt+1: exponential from
+// reconnectBaseDelay up to reconnectMaxDelay, with jitter spreading it over
+// its upper half so that agents cut off together don't retry in lockstep
+func backoffDelay(attempt int) time.Duration {
+	d := reconnectMaxDelay
+	if attempt < 20 {
+		d = min(reconnectBaseDelay<<attempt, reconnectMaxDelay)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
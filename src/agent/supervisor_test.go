@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registration is one registration call the flapping server received
+type registration struct {
+	token string // enrollment token
+	auth  string // Authorization header
+}
+
+// flappingServer is an agent API that can fail registration a number of
+// times, go down, and lose its agents, or its keys too, as if it lost its
+// database. It checks heartbeats in the server's order: the key, then
+// that it is this agent's, then that the agent exists.
+type flappingServer struct {
+	mu            sync.Mutex
+	failRegister  int               // registrations still to fail
+	down          bool              // heartbeats fail with 503
+	tokens        map[string]bool   // unused enrollment tokens
+	keys          map[string]string // agent ID by issued key
+	agents        map[string]bool   // registered agents
+	registrations []registration
+	heartbeats    int
+}
+
+// newFlappingServer returns a server accepting the enrollment token "enroll-me"
+func newFlappingServer() *flappingServer {
+	return &flappingServer{
+		tokens: map[string]bool{"enroll-me": true},
+		keys:   make(map[string]string),
+		agents: make(map[string]bool),
+	}
+}
+
+func (f *flappingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if r.URL.Path == "/v1/agents/register" {
+		if f.failRegister > 0 {
+			f.failRegister--
+			http.Error(w, `{"error":"unavailable","message":"restarting"}`, http.StatusServiceUnavailable)
+			return
+		}
+		var req RegistrationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.registrations = append(f.registrations, registration{token: req.EnrollmentToken, auth: r.Header.Get("Authorization")})
+
+		resp := RegistrationResponse{AgentID: "agent-1", HeartbeatInterval: 30}
+		switch agentID, ok := f.keys[key]; {
+		case req.EnrollmentToken != "":
+			if !f.tokens[req.EnrollmentToken] {
+				http.Error(w, `{"error":"invalid_enrollment_token","message":"used up"}`, http.StatusUnauthorized)
+				return
+			}
+			delete(f.tokens, req.EnrollmentToken)
+			resp.APIKey = "issued-key"
+			f.keys[resp.APIKey] = resp.AgentID
+		case ok:
+			resp.AgentID = agentID
+		default:
+			http.Error(w, `{"error":"unauthorized","message":"revoked"}`, http.StatusUnauthorized)
+			return
+		}
+		f.agents[resp.AgentID] = true
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	pathID, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/agents/"), "/heartbeat")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	agentID, known := f.keys[key]
+	switch {
+	case f.down:
+		http.Error(w, `{"error":"unavailable","message":"down"}`, http.StatusServiceUnavailable)
+	case !known:
+		http.Error(w, `{"error":"unauthorized","message":"Invalid, expired or revoked API key"}`, http.StatusUnauthorized)
+	case agentID != pathID:
+		http.Error(w, `{"error":"forbidden","message":"API key is not issued to this agent"}`, http.StatusForbidden)
+	case !f.agents[agentID]:
+		http.Error(w, `{"error":"agent_not_found","message":"Agent not found"}`, http.StatusNotFound)
+	default:
+		f.heartbeats++
+		json.NewEncoder(w).Encode(HeartbeatResponse{Acknowledged: true})
+	}
+}
+
+// set changes the server's state under its lock
+func (f *flappingServer) set(change func(f *flappingServer)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change(f)
+}
+
+// newTestSupervisor returns a supervisor enrolling with the server, whose
+// backoff sleeps are recorded instead of slept
+func newTestSupervisor(srv *httptest.Server, onRegistered func(*RegistrationResponse)) (*Supervisor, *[]time.Duration) {
+	var delays []time.Duration
+	s := NewSupervisor(NewHeartbeatClient(srv.URL, ""), RegistrationRequest{Name: "test", EnrollmentToken: "enroll-me"}, onRegistered)
+	s.sleep = func(ctx context.Context, d time.Duration) { delays = append(delays, d) }
+	return s, &delays
+}
+
+func TestSupervisorRegisterBacksOff(t *testing.T) {
+	fs := newFlappingServer()
+	fs.failRegister = 6
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	var registered []*RegistrationResponse
+	s, delays := newTestSupervisor(srv, func(resp *RegistrationResponse) { registered = append(registered, resp) })
+
+	resp, err := s.Register(context.Background())
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if resp.AgentID != "agent-1" || s.AgentID() != "agent-1" || len(registered) != 1 {
+		t.Errorf("registered as %q (supervisor has %q, %d callbacks), want agent-1 once", resp.AgentID, s.AgentID(), len(registered))
+	}
+
+	// One wait per failure, each in the upper half of a doubling delay
+	if len(*delays) != 6 {
+		t.Fatalf("waited %d times, want 6", len(*delays))
+	}
+	for i, d := range *delays {
+		limit := reconnectBaseDelay << i
+		if d < limit/2 || d > limit {
+			t.Errorf("wait %d = %v, want between %v and %v", i+1, d, limit/2, limit)
+		}
+	}
+
+	// The outage lasts from the first failure until a heartbeat gets through
+	if s.Outage() <= 0 {
+		t.Error("no outage recorded after failed registrations")
+	}
+	s.Connected()
+	if s.Outage() != 0 {
+		t.Errorf("outage = %v after connecting, want 0", s.Outage())
+	}
+}
+
+// registeredSupervisor returns a supervisor registered with a new flapping
+// server, and a heartbeat that handles its errors as the agent does
+func registeredSupervisor(t *testing.T) (*flappingServer, *Supervisor, *[]time.Duration, func() error) {
+	t.Helper()
+	fs := newFlappingServer()
+	srv := httptest.NewServer(fs)
+	t.Cleanup(srv.Close)
+	s, delays := newTestSupervisor(srv, nil)
+	ctx := context.Background()
+	if _, err := s.Register(ctx); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	heartbeat := func() error {
+		_, err := s.client.SendHeartbeat(ctx, Heartbeat{AgentID: s.AgentID(), Status: "online", OfflineSec: int(s.Outage().Seconds())})
+		if err != nil {
+			s.HandleError(ctx, err)
+		} else {
+			s.Connected()
+		}
+		return err
+	}
+	return fs, s, delays, heartbeat
+}
+
+func TestSupervisorReregistersWhenForgotten(t *testing.T) {
+	fs, s, _, heartbeat := registeredSupervisor(t)
+	if err := heartbeat(); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+
+	// The server going down is an outage, but not a reason to register again
+	fs.set(func(f *flappingServer) { f.down = true })
+	if err := heartbeat(); err == nil {
+		t.Fatal("heartbeat succeeded while the server was down")
+	}
+	if s.Outage() <= 0 {
+		t.Error("no outage recorded while the server was down")
+	}
+	fs.set(func(f *flappingServer) { f.down = false })
+	if err := heartbeat(); err != nil {
+		t.Fatalf("heartbeat after the server came back: %v", err)
+	}
+	if s.Outage() != 0 {
+		t.Errorf("outage = %v after reconnecting, want 0", s.Outage())
+	}
+
+	// A server that lost the agent gets a new registration, with the issued
+	// key rather than the used-up enrollment token
+	fs.set(func(f *flappingServer) { delete(f.agents, "agent-1") })
+	if err := heartbeat(); err == nil {
+		t.Fatal("heartbeat succeeded while the server had forgotten the agent")
+	}
+	if err := heartbeat(); err != nil {
+		t.Fatalf("heartbeat after registering again: %v", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	want := []registration{{token: "enroll-me"}, {auth: "Bearer issued-key"}}
+	if len(fs.registrations) != len(want) {
+		t.Fatalf("server saw %d registrations, want %d", len(fs.registrations), len(want))
+	}
+	for i, reg := range fs.registrations {
+		if reg != want[i] {
+			t.Errorf("registration %d = %+v, want %+v", i+1, reg, want[i])
+		}
+	}
+	if fs.heartbeats != 3 {
+		t.Errorf("server took %d heartbeats, want 3", fs.heartbeats)
+	}
+}
+
+func TestSupervisorRejectedWhenKeyLost(t *testing.T) {
+	// A server that lost its keys as well answers 401 to the heartbeat, and
+	// to registering again with the key
+	fs, s, delays, heartbeat := registeredSupervisor(t)
+	fs.set(func(f *flappingServer) { clear(f.keys); clear(f.agents) })
+	if err := heartbeat(); err == nil {
+		t.Fatal("heartbeat succeeded with a lost key")
+	}
+	select {
+	case err := <-s.Rejected():
+		if !errors.Is(err, ErrRejected) {
+			t.Errorf("rejected with %v, want ErrRejected", err)
+		}
+	default:
+		t.Fatal("re-registration with a lost key wasn't reported as rejected")
+	}
+	if len(*delays) != 0 {
+		t.Errorf("retried a rejected registration %d times", len(*delays))
+	}
+	if n := len(fs.registrations); n != 2 {
+		t.Errorf("server saw %d registrations, want 2", n)
+	}
+}
+
+func TestSupervisorRegisterRejected(t *testing.T) {
+	fs := newFlappingServer()
+	clear(fs.tokens) // the enrollment token was used before
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	s, delays := newTestSupervisor(srv, nil)
+
+	if _, err := s.Register(context.Background()); !errors.Is(err, ErrRejected) {
+		t.Fatalf("Register error = %v, want ErrRejected", err)
+	}
+	if len(*delays) != 0 {
+		t.Errorf("retried a rejected registration %d times", len(*delays))
+	}
+}
+
+func TestSupervisorRegisterStopsWithContext(t *testing.T) {
+	// A server that accepts the connection but never answers
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hung:
+		}
+	}))
+	defer srv.Close()
+	defer close(hung)
+	s := NewSupervisor(NewHeartbeatClient(srv.URL, ""), RegistrationRequest{Name: "test"}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.Register(ctx); err == nil {
+		t.Fatal("Register succeeded against a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Register returned %v after its context was done", elapsed)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 30; attempt++ {
+		limit := reconnectMaxDelay
+		if attempt < 20 {
+			limit = min(reconnectBaseDelay<<attempt, reconnectMaxDelay)
+		}
+		for i := 0; i < 20; i++ {
+			if d := backoffDelay(attempt); d < limit/2 || d > limit {
+				t.Fatalf("backoffDelay(%d) = %v, want between %v and %v", attempt, d, limit/2, limit)
+			}
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// version is the agent's version, set at build time with
+// -ldflags "-X main.version=1.3.0". Development builds count as older than
+// every release.
+var version = "dev"
+
+// updatePublicKey is the base64 ed25519 key release binaries are signed
+// with, set at build time like version. Config update_public_key
+// overrides it; without either the agent doesn't update itself.
+var updatePublicKey = ""
+
+// Self-update tuning
+const (
+	updateDownloadTimeout = 10 * time.Minute
+	updateMaxSize         = 512 << 20        // largest binary downloaded
+	updateRetryDelay      = time.Hour        // before retrying a failed download
+	updateTrialTimeout    = 5 * time.Minute  // for a new binary to get a heartbeat through
+	updateMaxTrialStarts  = 3                // starts of a new binary without a heartbeat before rolling back
+	updateCheckTimeout    = 10 * time.Second // for a downloaded binary to report its version
+)
+
+// updateState is kept next to the binary across the swap, so that the new
+// binary knows it is on trial and an old one knows what was rejected
+type updateState struct {
+	From     string `json:"from,omitempty"`     // version that was replaced
+	To       string `json:"to,omitempty"`       // version on trial; empty once it has proven itself
+	Starts   int    `json:"starts,omitempty"`   // times To started without getting a heartbeat through
+	Rejected string `json:"rejected,omitempty"` // version that failed its trial and isn't tried again
+}
+
+// Updater replaces the agent binary with newer releases from the server.
+// A newer version advertised by the server is downloaded next to the
+// binary and its signature checked. Once the agent has finished its work
+// the binary is swapped for it and re-executed. The previous binary is kept
+// until the new one gets its first heartbeat through, and put back if it
+// doesn't.
+type Updater struct {
+	client     *HeartbeatClient
+	key        ed25519.PublicKey // nil when updates are off
+	exe        string            // running binary
+	beforeExec func()            // stops what would outlive the exec, e.g. llama-server
+
+	mu        sync.Mutex
+	state     updateState
+	trial     *time.Timer // running while this binary is on trial
+	busy      bool        // downloading, or downloaded and waiting to swap
+	retryAt   time.Time
+	staged    string // version of the downloaded binary
+	ready     chan struct{}
+	announced string // latest version logged as not installable
+	outdated  bool   // below the minimum version at the last check
+}
+
+// NewUpdater returns an updater for the running binary. key is the base64
+// public key from config: empty means the built-in one, "off" turns
+// updates off.
+func NewUpdater(client *HeartbeatClient, key string, beforeExec func()) (*Updater, error) {
+	u := &Updater{client: client, beforeExec: beforeExec, ready: make(chan struct{})}
+	if key == "" {
+		key = updatePublicKey
+	}
+	if key != "" && key != "off" {
+		pub, err := parsePublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		u.key = pub
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding the agent binary: %w", err)
+	}
+	u.exe = exe
+	return u, nil
+}
+
+// Start picks up an update in progress. A binary on trial gets
+// updateTrialTimeout to get a heartbeat through; one that keeps failing
+// to start is rolled back straight away.
+func (u *Updater) Start() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	data, err := os.ReadFile(u.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &u.state)
+	}
+	if err != nil {
+		slog.Warn("Ignoring unreadable update state", "path", u.statePath(), "err", err)
+		return
+	}
+
+	switch {
+	case u.state.To == "":
+	case u.state.To != version:
+		// Rolled back, or replaced by hand
+		u.state.From, u.state.To, u.state.Starts = "", "", 0
+		u.saveState()
+	case u.state.Starts >= updateMaxTrialStarts:
+		u.rollbackLocked(fmt.Sprintf("started %d times without a heartbeat", u.state.Starts))
+	default:
+		u.state.Starts++
+		u.saveState()
+		slog.Info("Running updated agent", "from", u.state.From, "to", version)
+		u.trial = time.AfterFunc(updateTrialTimeout, func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			if u.trial != nil {
+				u.rollbackLocked("no heartbeat within " + updateTrialTimeout.String())
+			}
+		})
+	}
+}
+
+// HeartbeatSent ends the trial of an updated binary: it works, so the
+// previous one can go
+func (u *Updater) HeartbeatSent() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.trial == nil {
+		return
+	}
+	u.trial.Stop()
+	u.trial = nil
+	os.Remove(u.exe + ".old")
+	slog.Info("Update complete", "from", u.state.From, "to", version)
+	u.state.From, u.state.To, u.state.Starts = "", "", 0
+	u.saveState()
+}
+
+// HeartbeatFailed rolls an updated binary back if the server rejected its
+// first heartbeat. Failures to reach the server are left to the trial
+// timeout, as the old binary couldn't reach it either.
+func (u *Updater) HeartbeatFailed(err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode == http.StatusNotFound {
+		return // an unknown agent registers again
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.trial != nil {
+		u.rollbackLocked("first heartbeat rejected: " + err.Error())
+	}
+}
+
+// Advertised takes the versions from a registration or heartbeat response
+// and starts downloading the latest one if it is newer
+func (u *Updater) Advertised(minimum, latest string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	outdated := shared.BelowMinimum(version, minimum)
+	if outdated && !u.outdated {
+		slog.Warn("Agent is below the server's minimum version and gets no work until it is updated", "version", version, "minimum_version", minimum)
+	}
+	u.outdated = outdated
+
+	if latest == "" || shared.CompareVersions(latest, version) <= 0 || latest == u.state.Rejected {
+		return
+	}
+	if u.busy || u.trial != nil || time.Now().Before(u.retryAt) {
+		return
+	}
+	if u.key == nil {
+		if u.announced != latest {
+			u.announced = latest
+			slog.Info("Newer agent available; self-update is off, so update by hand", "version", version, "latest_version", latest)
+		}
+		return
+	}
+
+	u.busy = true
+	go u.download(latest)
+}
+
+// Ready is closed once a new binary is downloaded and verified. The agent
+// should finish its work and call Apply.
+func (u *Updater) Ready() <-chan struct{} {
+	return u.ready
+}
+
+// download fetches and verifies a version, leaving it next to the running
+// binary for Apply
+func (u *Updater) download(v string) {
+	slog.Info("Downloading agent update", "version", v)
+	err := u.fetch(v)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		slog.Warn("Agent update failed", "version", v, "err", err, "retry_in", updateRetryDelay)
+		os.Remove(u.exe + ".new")
+		u.busy = false
+		u.retryAt = time.Now().Add(updateRetryDelay)
+		return
+	}
+	slog.Info("Agent update verified; restarting once work is finished", "version", v)
+	u.staged = v
+	close(u.ready)
+}
+
+// fetch downloads a version's binary and signature, checks the signature
+// and that the binary runs and is the version it claims to be
+func (u *Updater) fetch(v string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), updateDownloadTimeout)
+	defer cancel()
+
+	name := "gpu-agent-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	path := "/v1/agent-updates/" + v + "/" + name
+	binary, err := u.client.download(ctx, path, updateMaxSize)
+	if err != nil {
+		return err
+	}
+	sig, err := u.client.download(ctx, path+".sig", 1024)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(u.key, binary, sig); err != nil {
+		return err
+	}
+
+	staged := u.exe + ".new"
+	if err := os.WriteFile(staged, binary, 0755); err != nil {
+		return fmt.Errorf("writing next to the agent binary: %w", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), updateCheckTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, staged, "version").Output()
+	if err != nil {
+		return fmt.Errorf("running the new binary: %w", err)
+	}
+	if got := strings.TrimSpace(string(output)); got != v {
+		return fmt.Errorf("new binary reports version %q, want %q", got, v)
+	}
+	return nil
+}
+
+// Apply swaps the downloaded binary in and re-executes it. It only returns
+// if that fails, with the running binary left in place where possible.
+func (u *Updater) Apply() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.staged == "" {
+		return errors.New("no update downloaded")
+	}
+
+	// A version that can't be swapped in isn't tried again
+	u.state = updateState{Rejected: u.staged}
+	if err := os.Rename(u.exe, u.exe+".old"); err != nil {
+		u.saveState()
+		return fmt.Errorf("moving the old binary aside: %w", err)
+	}
+	if err := os.Rename(u.exe+".new", u.exe); err != nil {
+		os.Rename(u.exe+".old", u.exe)
+		u.saveState()
+		return fmt.Errorf("moving the new binary in: %w", err)
+	}
+	u.state = updateState{From: version, To: u.staged}
+	u.saveState()
+	slog.Info("Restarting into the updated agent", "from", version, "to", u.staged)
+	u.beforeExec()
+	return reexec(u.exe)
+}
+
+// rollbackLocked puts the previous binary back and re-executes it. The
+// version that failed is not tried again.
+func (u *Updater) rollbackLocked(reason string) {
+	slog.Error("Updated agent failed, rolling back", "version", version, "to", u.state.From, "reason", reason)
+	u.state = updateState{Rejected: u.state.To}
+	u.saveState()
+
+	// The running binary can be moved but not always replaced, e.g. on Windows
+	failed := u.exe + ".failed"
+	if err := os.Rename(u.exe, failed); err != nil {
+		slog.Error("Rollback failed", "err", err)
+		return
+	}
+	if err := os.Rename(u.exe+".old", u.exe); err != nil {
+		os.Rename(failed, u.exe)
+		slog.Error("Rollback failed", "err", err)
+		return
+	}
+	os.Remove(failed)
+	u.beforeExec()
+	if err := reexec(u.exe); err != nil {
+		fatal("Failed to restart the previous agent", "err", err)
+	}
+}
+
+// statePath is where updateState is kept
+func (u *Updater) statePath() string {
+	return u.exe + ".update"
+}
+
+// saveState writes updateState, removing it when there is nothing to keep
+func (u *Updater) saveState() {
+	if u.state == (updateState{}) {
+		os.Remove(u.statePath())
+		return
+	}
+	data, _ := json.Marshal(u.state)
+	if err := os.WriteFile(u.statePath(), data, 0644); err != nil {
+		slog.Warn("Failed to save update state", "err", err)
+	}
+}
+
+// download fetches a file of at most limit bytes
+func (c *HeartbeatClient) download(ctx context.Context, path string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.serverURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	c.mu.Lock()
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.mu.Unlock()
+
+	// Not c.httpClient: its timeout is too short for a binary on a slow link
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(apiErr)
+		return nil, fmt.Errorf("downloading %s: %w", path, apiErr)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", path, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("downloading %s: larger than %d bytes", path, limit)
+	}
+	return data, nil
+}
+
+// parsePublicKey decodes a base64 ed25519 public key
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("update key must be a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifySignature checks a base64 ed25519 signature of data
+func verifySignature(key ed25519.PublicKey, data, sig []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil || len(raw) != ed25519.SignatureSize {
+		return errors.New("malformed signature")
+	}
+	if !ed25519.Verify(key, data, raw) {
+		return errors.New("signature does not match the update key")
+	}
+	return nil
+}
+
+// signCommand runs `gpu-agent sign`: it signs release binaries for the
+// server's update channel, writing a .sig next to each. With -generate it
+// creates the key first and prints the public key to build agents with.
+func signCommand(args []string) int {
+	fs := newFlagSet("sign")
+	keyPath := fs.String("key", "", "Private release key file (required)")
+	generate := fs.Bool("generate", false, "Create the key file instead of reading it")
+	fs.Parse(args)
+	if *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: gpu-agent sign -key file [-generate] [binary...]")
+		return 2
+	}
+
+	var priv ed25519.PrivateKey
+	if *generate {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err == nil {
+			seed := base64.StdEncoding.EncodeToString(key.Seed())
+			err = os.WriteFile(*keyPath, []byte(seed+"\n"), 0600)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Wrote %s. Build agents with -ldflags \"-X main.updatePublicKey=%s\"\n", *keyPath, base64.StdEncoding.EncodeToString(pub))
+		priv = key
+	} else {
+		data, err := os.ReadFile(*keyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			fmt.Fprintf(os.Stderr, "%s is not a release key\n", *keyPath)
+			return 1
+		}
+		priv = ed25519.NewKeyFromSeed(seed)
+	}
+
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))
+		if err := os.WriteFile(path+".sig", []byte(sig+"\n"), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Signed %s\n", path)
+	}
+	return 0
+}
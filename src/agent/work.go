@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Work loop tuning
+const (
+	workPollTimeout  = 25 * time.Second       // server holds the poll open this long
+	workRetryDelay   = 5 * time.Second        // wait after a failed poll
+	releaseTimeout   = 3 * time.Second        // for handing a job back before the host sleeps
+	resultFlushEvery = 100 * time.Millisecond // batch tokens for at most this long
+	resultFlushSize  = 16                     // or until this many tokens are buffered
+)
+
+// errJobGone is returned when the server no longer wants results for a job
+var errJobGone = errors.New("job no longer active on server")
+
+// errSuspending aborts the running job when the host is going to sleep
+var errSuspending = errors.New("host is going to sleep")
+
+// Job is a job handed out by the server
+type Job struct {
+	shared.WorkResponse
+	Trace shared.SpanContext // server's lease span, from the traceparent header
+}
+
+// PollWork long-polls the server for a job; it returns nil if none arrived
+func (c *HeartbeatClient) PollWork(ctx context.Context, agentID string) (*Job, error) {
+	path := fmt.Sprintf("/v1/agents/%s/work?timeout=%d", agentID, int(workPollTimeout.Seconds()))
+
+	var work Job
+	status, header, err := c.exchange(ctx, http.MethodGet, path, nil, &work.WorkResponse)
+	if err != nil {
+		return nil, fmt.Errorf("polling for work: %w", err)
+	}
+	if status == http.StatusNoContent {
+		return nil, nil
+	}
+	work.Trace, _ = shared.ParseTraceparent(header.Get(shared.TraceparentHeader))
+	return &work, nil
+}
+
+// PostResult sends generated tokens for a job to the server
+func (c *HeartbeatClient) PostResult(ctx context.Context, agentID string, result shared.ResultRequest) error {
+	path := fmt.Sprintf("/v1/agents/%s/result", agentID)
+
+	_, err := c.do(ctx, http.MethodPost, path, result, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusGone {
+		return errJobGone
+	}
+	if err != nil {
+		return fmt.Errorf("posting result: %w", err)
+	}
+	return nil
+}
+
+// Worker polls the server for jobs and runs them one at a time
+type Worker struct {
+	client  *HeartbeatClient
+	agentID func() string // changes if the agent registers again
+	runner  *Runner
+	tracer  *shared.Tracer
+
+	mu        sync.Mutex
+	current   string                  // ID of the running job, empty when idle
+	cancel    context.CancelCauseFunc // aborts the running job
+	jobDone   chan struct{}           // closed when the running job is over
+	stopPoll  context.CancelFunc      // aborts the work poll in flight
+	suspended bool                    // the host is asleep or about to be
+	paused    string                  // why the contribution policy paused work, empty if it hasn't
+	wake      chan struct{}           // closed when work may resume
+	draining  bool                    // takes no more work, for good
+	drained   chan struct{}           // closed once draining and idle
+}
+
+// NewWorker creates a worker for a registered agent
+func NewWorker(client *HeartbeatClient, agentID func() string, runner *Runner, tracer *shared.Tracer) *Worker {
+	return &Worker{
+		client:  client,
+		agentID: agentID,
+		runner:  runner,
+		tracer:  tracer,
+		drained: make(chan struct{}),
+	}
+}
+
+// CurrentJob returns the ID of the running job, or "" when idle
+func (w *Worker) CurrentJob() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Preload loads a model the server wants kept warm, unless a job is
+// running. A job arriving meanwhile waits for the load before loading its
+// own model.
+func (w *Worker) Preload(ctx context.Context, model string) {
+	if reason := w.Paused(); reason != "" {
+		slog.Debug("Not preloading model while paused", "model", model, "reason", reason)
+		return
+	}
+	err := w.runner.Preload(ctx, model)
+	if errors.Is(err, errRunnerBusy) {
+		slog.Info("Not preloading model while a job runs", "model", model, "job_id", w.CurrentJob())
+	} else if err != nil {
+		slog.Warn("Preloading model failed", "model", model, "err", err)
+	}
+}
+
+// UnloadIdle unloads a model the server no longer wants kept warm, unless
+// a job is running or another model was loaded since. It reports whether
+// the model was unloaded.
+func (w *Worker) UnloadIdle(model string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current == "" && w.runner.UnloadIdle(model)
+}
+
+// Run polls for and executes jobs until the context is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	slog.Info("Work loop started")
+	for {
+		w.waitAwake(ctx)
+		if ctx.Err() != nil {
+			slog.Info("Work loop stopped")
+			return
+		}
+
+		pollCtx, stopPoll := context.WithCancel(ctx)
+		w.setPoll(stopPoll)
+		job, err := w.client.PollWork(pollCtx, w.agentID())
+		w.setPoll(nil)
+		stopPoll()
+		if err != nil {
+			if pollCtx.Err() == nil {
+				slog.Warn("Work poll failed", "err", err)
+				sleepCtx(ctx, workRetryDelay)
+			}
+			continue
+		}
+		if job == nil {
+			continue
+		}
+		if w.held() {
+			// Leased just as the host was going to sleep or work was paused
+			w.release(job)
+			continue
+		}
+
+		w.execute(ctx, job)
+	}
+}
+
+// setPoll records how to abort the work poll in flight, so Suspend,
+// SetPaused and Drain can
+func (w *Worker) setPoll(stop context.CancelFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopPoll = stop
+}
+
+// setCurrent records the running job and how to abort it
+func (w *Worker) setCurrent(jobID string, cancel context.CancelCauseFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.current = jobID
+	w.cancel = cancel
+	if jobID != "" {
+		w.jobDone = make(chan struct{})
+	} else if w.jobDone != nil {
+		close(w.jobDone)
+		w.jobDone = nil
+	}
+}
+
+// Suspend stops taking work and hands the running job back to the server
+// so the host can sleep without stranding a lease. It waits until the job
+// has been handed back or the context is done.
+func (w *Worker) Suspend(ctx context.Context) {
+	w.mu.Lock()
+	w.suspended = true
+	if w.stopPoll != nil {
+		w.stopPoll()
+	}
+	if w.cancel != nil {
+		w.cancel(errSuspending)
+	}
+	done := w.jobDone
+	w.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Resume takes work again after Suspend
+func (w *Worker) Resume() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.suspended = false
+	w.wakeLocked()
+}
+
+// Suspended reports whether the worker is suspended
+func (w *Worker) Suspended() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.suspended
+}
+
+// SetPaused stops taking work for the given reason, or takes work again
+// if it is empty. A running job is allowed to finish, after which the
+// model is unloaded to give the GPU back.
+func (w *Worker) SetPaused(reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = reason
+	if reason == "" {
+		w.wakeLocked()
+	} else if w.stopPoll != nil {
+		w.stopPoll()
+	}
+}
+
+// Paused returns why work is paused, or "" if it isn't
+func (w *Worker) Paused() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// Drain stops taking work for good, letting the running job finish
+func (w *Worker) Drain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.draining {
+		w.draining = true
+		if w.stopPoll != nil {
+			w.stopPoll()
+		}
+		// Let a paused waitAwake notice
+		if w.wake != nil {
+			close(w.wake)
+			w.wake = nil
+		}
+	}
+}
+
+// Drained returns a channel closed once the worker is draining and the
+// running job, if any, is over
+func (w *Worker) Drained() <-chan struct{} {
+	return w.drained
+}
+
+// Draining reports whether Drain was called
+func (w *Worker) Draining() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.draining
+}
+
+// held reports whether anything holds work back
+func (w *Worker) held() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.heldLocked()
+}
+
+// heldLocked reports whether anything holds work back; w.mu must be held
+func (w *Worker) heldLocked() bool {
+	return w.suspended || w.paused != "" || w.draining
+}
+
+// wakeLocked lets waitAwake return if nothing holds work back any more;
+// w.mu must be held
+func (w *Worker) wakeLocked() {
+	if w.wake != nil && !w.heldLocked() {
+		close(w.wake)
+		w.wake = nil
+	}
+}
+
+// waitAwake blocks while the worker is suspended, paused or draining. A
+// draining worker gets here once its last job is over.
+func (w *Worker) waitAwake(ctx context.Context) {
+	for {
+		w.mu.Lock()
+		if !w.heldLocked() {
+			w.mu.Unlock()
+			return
+		}
+		if w.draining {
+			select {
+			case <-w.drained:
+			default:
+				close(w.drained)
+			}
+		}
+		if w.wake == nil {
+			w.wake = make(chan struct{})
+		}
+		wake, paused := w.wake, w.paused != ""
+		w.mu.Unlock()
+
+		if paused {
+			w.runner.Unload()
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CancelJob aborts the job if it is the one running, e.g. because its
+// client went away. It reports whether it was.
+func (w *Worker) CancelJob(jobID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current != jobID || w.cancel == nil {
+		return false
+	}
+	w.cancel(errJobGone)
+	return true
+}
+
+// execute runs a single job, streaming batched tokens back to the server.
+// Its spans continue the server's trace, and result posts carry both the
+// request ID and the trace context so server logs and spans line up with ours.
+func (w *Worker) execute(ctx context.Context, job *Job) {
+	logger := jobLogger(job)
+	logger.Info("Job started", "model", job.Model, "max_tokens", job.MaxTokens)
+	start := time.Now()
+
+	ctx, cancel := context.WithCancelCause(withRequestID(ctx, job.CorrelationID))
+	defer cancel(nil)
+	w.setCurrent(job.RequestID, cancel)
+	defer w.setCurrent("", nil)
+	release := w.runner.Claim()
+	defer release()
+
+	ctx, span := w.tracer.Start(shared.ContextWithRemoteSpan(ctx, job.Trace), "job.execute")
+	span.SetAttr("job_id", job.RequestID)
+	span.SetAttr("model", job.Model)
+	defer span.End()
+
+	_, loadSpan := w.tracer.Start(ctx, "model.load")
+	loadSpan.SetAttr("model", job.Model)
+	loadSpan.SetAttr("already_loaded", w.runner.LoadedModel() == job.Model)
+	err := w.runner.Load(ctx, job.Model)
+	loadSpan.SetError(err)
+	loadSpan.End()
+	if err != nil {
+		span.SetError(err)
+		w.fail(ctx, job, err)
+		return
+	}
+
+	if job.Type == shared.JobTypeEmbedding {
+		w.embed(ctx, job, start)
+		return
+	}
+
+	var pending []string
+	lastFlush := time.Now()
+	flush := func(ctx context.Context, final *shared.ResultRequest) error {
+		result := shared.ResultRequest{RequestID: job.RequestID, Tokens: pending}
+		if final != nil {
+			result = *final
+			result.Tokens = pending
+		}
+		pending = nil
+		lastFlush = time.Now()
+		return w.client.PostResult(ctx, w.agentID(), result)
+	}
+
+	genCtx, genSpan := w.tracer.Start(ctx, "generate")
+	_, firstSpan := w.tracer.Start(genCtx, "first_token")
+	gen, err := w.runner.Generate(genCtx, job.Prompt, job.MaxTokens, job.SamplingParams, func(tok string) error {
+		firstSpan.End()
+		pending = append(pending, tok)
+		if len(pending) >= resultFlushSize || time.Since(lastFlush) >= resultFlushEvery {
+			return flush(genCtx, nil)
+		}
+		return nil
+	})
+	firstSpan.End()
+	if gen != nil {
+		genSpan.SetAttr("completion_tokens", gen.CompletionTokens)
+		genSpan.SetAttr("finish_reason", gen.FinishReason)
+	}
+	genSpan.SetError(err)
+	genSpan.End()
+	if errors.Is(err, errJobGone) || errors.Is(context.Cause(ctx), errJobGone) {
+		logger.Info("Job abandoned by server, stopped generating")
+		span.SetAttr("abandoned", true)
+		return
+	}
+	if err != nil {
+		span.SetError(err)
+		w.fail(ctx, job, err)
+		return
+	}
+
+	resultCtx, resultSpan := w.tracer.Start(ctx, "result.final")
+	err = flush(resultCtx, &shared.ResultRequest{
+		RequestID:    job.RequestID,
+		Finished:     true,
+		FinishReason: gen.FinishReason,
+		Usage: &shared.CompletionUsage{
+			PromptTokens:     gen.PromptTokens,
+			CompletionTokens: gen.CompletionTokens,
+		},
+	})
+	resultSpan.SetError(err)
+	resultSpan.End()
+	if err != nil {
+		logger.Warn("Failed to post final result", "err", err)
+		return
+	}
+
+	logger.Info("Job finished", "duration", time.Since(start).Round(time.Millisecond),
+		"completion_tokens", gen.CompletionTokens, "finish_reason", gen.FinishReason)
+}
+
+// embed runs an embedding job and posts all vectors in one final result
+func (w *Worker) embed(ctx context.Context, job *Job, start time.Time) {
+	logger := jobLogger(job)
+
+	embedCtx, span := w.tracer.Start(ctx, "embed")
+	span.SetAttr("inputs", len(job.Input))
+	vectors, promptTokens, err := w.runner.Embed(embedCtx, job.Input)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		w.fail(ctx, job, err)
+		return
+	}
+
+	err = w.client.PostResult(ctx, w.agentID(), shared.ResultRequest{
+		RequestID:  job.RequestID,
+		Finished:   true,
+		Usage:      &shared.CompletionUsage{PromptTokens: promptTokens},
+		Embeddings: vectors,
+	})
+	if err != nil {
+		logger.Warn("Failed to post embeddings", "err", err)
+		return
+	}
+
+	logger.Info("Job finished", "duration", time.Since(start).Round(time.Millisecond),
+		"inputs", len(job.Input), "prompt_tokens", promptTokens)
+}
+
+// fail reports a job error to the server, or hands the job back if it
+// was stopped because the host is going to sleep
+func (w *Worker) fail(ctx context.Context, job *Job, err error) {
+	logger := jobLogger(job)
+	if errors.Is(context.Cause(ctx), errJobGone) {
+		logger.Info("Job abandoned by server")
+		return
+	}
+	if errors.Is(context.Cause(ctx), errSuspending) {
+		w.release(job)
+		return
+	}
+	logger.Error("Job failed", "err", err)
+	msg := err.Error()
+	result := shared.ResultRequest{RequestID: job.RequestID, Finished: true, Error: &msg}
+	if err := w.client.PostResult(ctx, w.agentID(), result); err != nil && !errors.Is(err, errJobGone) {
+		logger.Warn("Failed to report job error", "err", err)
+	}
+}
+
+// release hands a job back to the server to run elsewhere. The job's own
+// context is cancelled by then, so the post gets one of its own.
+func (w *Worker) release(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	err := w.client.PostResult(ctx, w.agentID(), shared.ResultRequest{RequestID: job.RequestID, Released: true})
+	if err != nil && !errors.Is(err, errJobGone) {
+		jobLogger(job).Warn("Failed to hand back job", "err", err)
+		return
+	}
+	jobLogger(job).Info("Handed job back to server")
+}
+
+// jobLogger returns a logger tagged with a job's IDs
+func jobLogger(job *Job) *slog.Logger {
+	logger := slog.With("job_id", job.RequestID)
+	if job.CorrelationID != "" {
+		logger = logger.With("request_id", job.CorrelationID)
+	}
+	return logger
+}
+
+// sleepCtx waits for d or until the context is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
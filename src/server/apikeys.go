@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API key scopes
+const (
+	ScopeClientComplete = "client:complete"
+	ScopeAgentRegister  = "agent:register"
+	ScopeAdminRead      = "admin:read"
+	ScopeAdminWrite     = "admin:write"
+)
+
+// validScopes lists every scope that can be granted to a key
+var validScopes = map[string]bool{
+	ScopeClientComplete: true,
+	ScopeAgentRegister:  true,
+	ScopeAdminRead:      true,
+	ScopeAdminWrite:     true,
+}
+
+// Key prefixes make leaked secrets easy to recognise
+const (
+	apiKeyPrefix          = "myk_"
+	enrollmentTokenPrefix = "mye_"
+)
+
+// errNotFound is returned when a looked-up row does not exist
+var errNotFound = errors.New("not found")
+
+// APIKey is a hashed credential with scopes and an optional model allow-list
+type APIKey struct {
+	ID        string
+	KeyHash   string
+	Name      string
+	Scopes    []string
+	Models    []string // empty means every model is allowed
+	AgentID   string   // set for keys issued to an agent at registration
+	Limits    RateLimits
+	Weight    float64 // share of agent time relative to other keys queuing at the same priority
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// HasScope reports whether the key was granted the given scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the key may request the given model
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, m := range k.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key is neither revoked nor expired
+func (k *APIKey) Active(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+// EnrollmentToken lets a new agent register once without a pre-shared key
+type EnrollmentToken struct {
+	ID            string
+	TokenHash     string
+	Name          string
+	UsesRemaining int
+	ExpiresAt     *time.Time
+	CreatedAt     time.Time
+}
+
+// generateSecret returns a random secret with the given prefix
+func generateSecret(prefix string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashSecret hashes a key or token for storage and lookup.
+// Secrets are 256 bits of randomness, so a fast unsalted hash is enough and
+// keeps the per-request lookup a single indexed query.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey generates a key and returns it with its plaintext secret.
+// The secret is only ever returned here; the database stores the hash.
+func NewAPIKey(name string, scopes, models []string, agentID string, expiresAt *time.Time) (*APIKey, string, error) {
+	secret, err := generateSecret(apiKeyPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	key := &APIKey{
+		ID:        uuid.New().String(),
+		KeyHash:   hashSecret(secret),
+		Name:      name,
+		Scopes:    scopes,
+		Models:    models,
+		AgentID:   agentID,
+		Weight:    1,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	return key, secret, nil
+}
+
+// CreateAPIKey stores a new API key
+func (db *DB) CreateAPIKey(k *APIKey) error {
+	return createAPIKey(db, k)
+}
+
+// createAPIKey is CreateAPIKey on the database or within a transaction
+func createAPIKey(ex execer, k *APIKey) error {
+	scopes, err := json.Marshal(k.Scopes)
+	if err != nil {
+		return fmt.Errorf("marshal scopes: %w", err)
+	}
+	models, err := json.Marshal(k.Models)
+	if err != nil {
+		return fmt.Errorf("marshal models: %w", err)
+	}
+
+	_, err = ex.Exec(`
+		INSERT INTO api_keys (key_id, key_hash, name, scopes, models, agent_id,
+			rpm_limit, tpm_limit, daily_token_quota, monthly_token_quota, weight, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, k.ID, k.KeyHash, k.Name, string(scopes), string(models), nullString(k.AgentID),
+		k.Limits.RequestsPerMinute, k.Limits.TokensPerMinute, k.Limits.DailyTokens, k.Limits.MonthlyTokens,
+		k.Weight, nullUnix(k.ExpiresAt), k.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert api key: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKeyByHash looks up a key by the hash of its secret
+func (db *DB) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	row := db.QueryRow(`
+		SELECT key_id, key_hash, name, scopes, models, agent_id,
+			rpm_limit, tpm_limit, daily_token_quota, monthly_token_quota, weight, expires_at, revoked_at, created_at
+		FROM api_keys
+		WHERE key_hash = ?
+	`, hash)
+	k, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	return k, err
+}
+
+// GetAPIKey looks up a key by ID
+func (db *DB) GetAPIKey(keyID string) (*APIKey, error) {
+	row := db.QueryRow(`
+		SELECT key_id, key_hash, name, scopes, models, agent_id,
+			rpm_limit, tpm_limit, daily_token_quota, monthly_token_quota, weight, expires_at, revoked_at, created_at
+		FROM api_keys
+		WHERE key_id = ?
+	`, keyID)
+	k, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	return k, err
+}
+
+// ListAPIKeys returns all API keys, newest first
+func (db *DB) ListAPIKeys() ([]APIKey, error) {
+	rows, err := db.Query(`
+		SELECT key_id, key_hash, name, scopes, models, agent_id,
+			rpm_limit, tpm_limit, daily_token_quota, monthly_token_quota, weight, expires_at, revoked_at, created_at
+		FROM api_keys
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey marks a key as revoked; revoking twice keeps the first timestamp
+func (db *DB) RevokeAPIKey(keyID string) error {
+	result, err := db.Exec(`
+		UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE key_id = ?
+	`, time.Now().Unix(), keyID)
+	if err != nil {
+		return fmt.Errorf("revoke api key: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if rows == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// SetAPIKeyWeight changes a key's fair-share weight; it applies to the
+// key's next request
+func (db *DB) SetAPIKeyWeight(keyID string, weight float64) error {
+	result, err := db.Exec(`UPDATE api_keys SET weight = ? WHERE key_id = ?`, weight, keyID)
+	if err != nil {
+		return fmt.Errorf("update api key weight: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if rows == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanAPIKey scans a single api_keys row
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var k APIKey
+	var name, agentID sql.NullString
+	var scopes, models string
+	var expiresAt, revokedAt sql.NullInt64
+	var createdAt int64
+
+	err := row.Scan(&k.ID, &k.KeyHash, &name, &scopes, &models, &agentID,
+		&k.Limits.RequestsPerMinute, &k.Limits.TokensPerMinute, &k.Limits.DailyTokens, &k.Limits.MonthlyTokens,
+		&k.Weight, &expiresAt, &revokedAt, &createdAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("scan api key: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+		return nil, fmt.Errorf("parse scopes: %w", err)
+	}
+	if err := json.Unmarshal([]byte(models), &k.Models); err != nil {
+		return nil, fmt.Errorf("parse models: %w", err)
+	}
+	k.Name = name.String
+	k.AgentID = agentID.String
+	k.ExpiresAt = timeFromNull(expiresAt)
+	k.RevokedAt = timeFromNull(revokedAt)
+	k.CreatedAt = time.Unix(createdAt, 0)
+	return &k, nil
+}
+
+// NewEnrollmentToken generates a token and returns it with its plaintext secret
+func NewEnrollmentToken(name string, uses int, expiresAt *time.Time) (*EnrollmentToken, string, error) {
+	secret, err := generateSecret(enrollmentTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &EnrollmentToken{
+		ID:            uuid.New().String(),
+		TokenHash:     hashSecret(secret),
+		Name:          name,
+		UsesRemaining: uses,
+		ExpiresAt:     expiresAt,
+		CreatedAt:     time.Now(),
+	}
+	return token, secret, nil
+}
+
+// CreateEnrollmentToken stores a new enrollment token
+func (db *DB) CreateEnrollmentToken(t *EnrollmentToken) error {
+	_, err := db.Exec(`
+		INSERT INTO enrollment_tokens (token_id, token_hash, name, uses_remaining, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, t.ID, t.TokenHash, t.Name, t.UsesRemaining, nullUnix(t.ExpiresAt), t.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert enrollment token: %w", err)
+	}
+	return nil
+}
+
+// consumeEnrollmentToken atomically uses up one registration from a token.
+// It returns errNotFound if the token is unknown, expired or exhausted.
+func consumeEnrollmentToken(ex execer, hash string) error {
+	result, err := ex.Exec(`
+		UPDATE enrollment_tokens
+		SET uses_remaining = uses_remaining - 1
+		WHERE token_hash = ? AND uses_remaining > 0 AND (expires_at IS NULL OR expires_at > ?)
+	`, hash, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("consume enrollment token: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if rows == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// nullString maps an empty string to SQL NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullUnix maps a nil time to SQL NULL and others to a unix timestamp
+func nullUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+// timeFromNull converts a nullable unix timestamp back to a time
+func timeFromNull(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(n.Int64, 0)
+	return &t
+}
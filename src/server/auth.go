@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authentication errors
+var (
+	errMissingKey = errors.New("missing API key")
+	errInvalidKey = errors.New("invalid API key")
+	errForbidden  = errors.New("API key lacks the required scope")
+)
+
+// bootstrapKeyID identifies the -admin-key flag in logs and audit output
+const bootstrapKeyID = "bootstrap"
+
+// CreateKeyRequest is the request body for minting an API key
+type CreateKeyRequest struct {
+	Name         string      `json:"name"`
+	Scopes       []string    `json:"scopes"`
+	Models       []string    `json:"models,omitempty"`
+	Limits       *RateLimits `json:"limits,omitempty"`         // unset fields inherit server defaults
+	Weight       *float64    `json:"weight,omitempty"`         // fair-share weight, default 1
+	ExpiresInSec int         `json:"expires_in_sec,omitempty"` // 0 means never
+}
+
+// UpdateKeyRequest is the request body for changing a key at runtime
+type UpdateKeyRequest struct {
+	Weight *float64 `json:"weight"`
+}
+
+// CreateKeyResponse returns a freshly minted key; the secret is never shown again
+type CreateKeyResponse struct {
+	Key string `json:"key"`
+	KeyInfo
+}
+
+// KeyInfo is the admin view of an API key
+type KeyInfo struct {
+	KeyID     string     `json:"key_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Models    []string   `json:"models,omitempty"`
+	AgentID   string     `json:"agent_id,omitempty"`
+	Limits    RateLimits `json:"limits"`
+	Weight    float64    `json:"weight"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// maxKeyWeight bounds fair-share weights; a key at the maximum gets this
+// many times the agent time of a default key when both are queuing
+const maxKeyWeight = 1000
+
+// ListKeysResponse is the response for the admin key listing
+type ListKeysResponse struct {
+	Keys  []KeyInfo `json:"keys"`
+	Total int       `json:"total"`
+}
+
+// CreateEnrollmentRequest is the request body for minting an enrollment token
+type CreateEnrollmentRequest struct {
+	Name         string `json:"name"`
+	Uses         int    `json:"uses,omitempty"`           // defaults to 1
+	ExpiresInSec int    `json:"expires_in_sec,omitempty"` // defaults to 24h
+}
+
+// CreateEnrollmentResponse returns a freshly minted enrollment token
+type CreateEnrollmentResponse struct {
+	TokenID   string     `json:"token_id"`
+	Token     string     `json:"token"`
+	Name      string     `json:"name"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+}
+
+// authenticate resolves the request's bearer token (or x-api-key) to an API key.
+// The -admin-key flag acts as a bootstrap key holding both admin scopes so
+// that the first real keys can be minted.
+func (h *Handlers) authenticate(r *http.Request) (*APIKey, error) {
+	token := bearerToken(r)
+	if token == "" {
+		// Anthropic clients send the key in x-api-key instead
+		token = strings.TrimSpace(r.Header.Get("X-Api-Key"))
+	}
+	if token == "" {
+		return nil, errMissingKey
+	}
+
+	if h.adminAPIKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminAPIKey)) == 1 {
+		return &APIKey{
+			ID:     bootstrapKeyID,
+			Name:   "admin-key flag",
+			Scopes: []string{ScopeAdminRead, ScopeAdminWrite},
+		}, nil
+	}
+
+	key, err := h.db.GetAPIKeyByHash(hashSecret(token))
+	if errors.Is(err, errNotFound) {
+		return nil, errInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !key.Active(time.Now()) {
+		return nil, errInvalidKey
+	}
+	return key, nil
+}
+
+// authorize authenticates the request and checks that the key holds a scope
+func (h *Handlers) authorize(r *http.Request, scope string) (*APIKey, error) {
+	key, err := h.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !key.HasScope(scope) {
+		return nil, errForbidden
+	}
+	return key, nil
+}
+
+// requireScope authorizes the request and writes an error response on failure
+func (h *Handlers) requireScope(w http.ResponseWriter, r *http.Request, scope string) (*APIKey, bool) {
+	key, err := h.authorize(r, scope)
+	switch {
+	case err == nil:
+		return key, true
+	case errors.Is(err, errMissingKey):
+		h.writeError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid Authorization header")
+	case errors.Is(err, errInvalidKey):
+		h.writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid, expired or revoked API key")
+	case errors.Is(err, errForbidden):
+		h.writeError(w, http.StatusForbidden, "forbidden", "API key lacks the "+scope+" scope")
+	default:
+		requestLogger(r).Error("Error authenticating request", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to authenticate request")
+	}
+	return nil, false
+}
+
+// requireAgent authorizes an agent protocol call for the agent in the path.
+// Agents may only act as themselves, using the key issued at registration.
+func (h *Handlers) requireAgent(w http.ResponseWriter, r *http.Request, agentID string) bool {
+	key, ok := h.requireScope(w, r, ScopeAgentRegister)
+	if !ok {
+		return false
+	}
+	if key.AgentID != agentID {
+		h.writeError(w, http.StatusForbidden, "forbidden", "API key is not issued to this agent")
+		return false
+	}
+	return true
+}
+
+// HandleAdminKeys handles GET and POST /v1/admin/keys
+func (h *Handlers) HandleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listKeys(w, r)
+	case http.MethodPost:
+		h.createKey(w, r)
+	default:
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET and POST are allowed")
+	}
+}
+
+// HandleAdminKey handles /v1/admin/keys/{id}
+// DELETE revokes the key; PATCH changes its fair-share weight.
+func (h *Handlers) HandleAdminKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPatch {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only DELETE and PATCH are allowed")
+		return
+	}
+	admin, ok := h.requireScope(w, r, ScopeAdminWrite)
+	if !ok {
+		return
+	}
+
+	keyID := strings.TrimPrefix(r.URL.Path, "/v1/admin/keys/")
+	if keyID == "" || strings.Contains(keyID, "/") {
+		h.writeError(w, http.StatusBadRequest, "invalid_path", "Invalid path format")
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		h.updateKey(w, r, admin, keyID)
+		return
+	}
+
+	if err := h.db.RevokeAPIKey(keyID); err != nil {
+		if errors.Is(err, errNotFound) {
+			h.writeError(w, http.StatusNotFound, "key_not_found", "API key not found")
+			return
+		}
+		requestLogger(r).Error("Error revoking API key", "key_id", keyID, "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to revoke API key")
+		return
+	}
+
+	requestLogger(r).Info("API key revoked", "key_id", keyID, "by", admin.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateKey applies a PATCH to a key and writes the updated key
+func (h *Handlers) updateKey(w http.ResponseWriter, r *http.Request, admin *APIKey, keyID string) {
+	var req UpdateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid_json", "Failed to parse request body")
+		return
+	}
+	if req.Weight == nil {
+		h.writeError(w, http.StatusBadRequest, "missing_fields", "Nothing to update; weight is the only updatable field")
+		return
+	}
+	if !validKeyWeight(*req.Weight) {
+		h.writeError(w, http.StatusBadRequest, "invalid_weight", fmt.Sprintf("weight must be greater than 0 and at most %d", maxKeyWeight))
+		return
+	}
+
+	if err := h.db.SetAPIKeyWeight(keyID, *req.Weight); err != nil {
+		if errors.Is(err, errNotFound) {
+			h.writeError(w, http.StatusNotFound, "key_not_found", "API key not found")
+			return
+		}
+		requestLogger(r).Error("Error updating API key weight", "key_id", keyID, "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to update API key")
+		return
+	}
+	key, err := h.db.GetAPIKey(keyID)
+	if err != nil {
+		requestLogger(r).Error("Error reading updated API key", "key_id", keyID, "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to update API key")
+		return
+	}
+
+	requestLogger(r).Info("API key weight changed", "key_id", keyID, "weight", key.Weight, "by", admin.ID)
+	h.writeJSON(w, http.StatusOK, keyInfo(key))
+}
+
+// validKeyWeight reports whether a fair-share weight is in range
+func validKeyWeight(weight float64) bool {
+	return weight > 0 && weight <= maxKeyWeight
+}
+
+// listKeys writes every API key without its secret
+func (h *Handlers) listKeys(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireScope(w, r, ScopeAdminRead); !ok {
+		return
+	}
+
+	keys, err := h.db.ListAPIKeys()
+	if err != nil {
+		requestLogger(r).Error("Error listing API keys", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to list API keys")
+		return
+	}
+
+	infos := make([]KeyInfo, 0, len(keys))
+	for i := range keys {
+		infos = append(infos, keyInfo(&keys[i]))
+	}
+	h.writeJSON(w, http.StatusOK, ListKeysResponse{Keys: infos, Total: len(infos)})
+}
+
+// createKey mints a new API key
+func (h *Handlers) createKey(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.requireScope(w, r, ScopeAdminWrite)
+	if !ok {
+		return
+	}
+
+	var req CreateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid_json", "Failed to parse request body")
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		h.writeError(w, http.StatusBadRequest, "missing_scopes", "At least one scope is required")
+		return
+	}
+	for _, s := range req.Scopes {
+		if !validScopes[s] {
+			h.writeError(w, http.StatusBadRequest, "invalid_scope", "Unknown scope: "+s)
+			return
+		}
+	}
+	if req.ExpiresInSec < 0 {
+		h.writeError(w, http.StatusBadRequest, "invalid_expiry", "expires_in_sec must not be negative")
+		return
+	}
+	if req.Weight != nil && !validKeyWeight(*req.Weight) {
+		h.writeError(w, http.StatusBadRequest, "invalid_weight", fmt.Sprintf("weight must be greater than 0 and at most %d", maxKeyWeight))
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInSec > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInSec) * time.Second)
+		expiresAt = &t
+	}
+
+	key, secret, err := NewAPIKey(req.Name, req.Scopes, req.Models, "", expiresAt)
+	if err != nil {
+		requestLogger(r).Error("Error generating API key", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create API key")
+		return
+	}
+	if req.Limits != nil {
+		key.Limits = *req.Limits
+	}
+	if req.Weight != nil {
+		key.Weight = *req.Weight
+	}
+	if err := h.db.CreateAPIKey(key); err != nil {
+		requestLogger(r).Error("Error storing API key", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create API key")
+		return
+	}
+
+	requestLogger(r).Info("API key created", "key_id", key.ID, "name", key.Name, "scopes", key.Scopes, "by", admin.ID)
+	h.writeJSON(w, http.StatusCreated, CreateKeyResponse{Key: secret, KeyInfo: keyInfo(key)})
+}
+
+// HandleAdminEnrollment handles POST /v1/admin/enrollment-tokens
+func (h *Handlers) HandleAdminEnrollment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is allowed")
+		return
+	}
+	admin, ok := h.requireScope(w, r, ScopeAdminWrite)
+	if !ok {
+		return
+	}
+
+	var req CreateEnrollmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid_json", "Failed to parse request body")
+		return
+	}
+	if req.Uses < 0 || req.ExpiresInSec < 0 {
+		h.writeError(w, http.StatusBadRequest, "invalid_request", "uses and expires_in_sec must not be negative")
+		return
+	}
+	if req.Uses == 0 {
+		req.Uses = 1
+	}
+	if req.ExpiresInSec == 0 {
+		req.ExpiresInSec = int((24 * time.Hour).Seconds())
+	}
+	expiresAt := time.Now().Add(time.Duration(req.ExpiresInSec) * time.Second)
+
+	token, secret, err := NewEnrollmentToken(req.Name, req.Uses, &expiresAt)
+	if err != nil {
+		requestLogger(r).Error("Error generating enrollment token", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create enrollment token")
+		return
+	}
+	if err := h.db.CreateEnrollmentToken(token); err != nil {
+		requestLogger(r).Error("Error storing enrollment token", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create enrollment token")
+		return
+	}
+
+	requestLogger(r).Info("Enrollment token created", "token_id", token.ID, "name", token.Name, "uses", token.UsesRemaining, "by", admin.ID)
+	h.writeJSON(w, http.StatusCreated, CreateEnrollmentResponse{
+		TokenID:   token.ID,
+		Token:     secret,
+		Name:      token.Name,
+		Uses:      token.UsesRemaining,
+		ExpiresAt: token.ExpiresAt,
+	})
+}
+
+// keyInfo converts a stored key to its admin view
+func keyInfo(k *APIKey) KeyInfo {
+	return KeyInfo{
+		KeyID:     k.ID,
+		Name:      k.Name,
+		Scopes:    k.Scopes,
+		Models:    k.Models,
+		AgentID:   k.AgentID,
+		Limits:    k.Limits,
+		Weight:    k.Weight,
+		ExpiresAt: k.ExpiresAt,
+		RevokedAt: k.RevokedAt,
+		CreatedAt: k.CreatedAt,
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Batch upload limits
+const (
+	maxBatchBytes    = 100 << 20 // whole JSONL file
+	maxBatchLine     = 8 << 20   // one request
+	maxBatchRequests = 50000
+	maxBatchList     = 100 // batches returned by the listing
+)
+
+// Batch item statuses
+const (
+	batchItemPending   = "pending"
+	batchItemCompleted = "completed"
+	batchItemFailed    = "failed"
+	batchItemCancelled = "cancelled"
+)
+
+// errBatchFinished is returned when cancelling a batch that already ended
+var errBatchFinished = errors.New("batch already finished")
+
+// Batch is a stored batch and the key that owns it
+type Batch struct {
+	shared.Batch
+	KeyID string
+}
+
+// Finished reports whether the batch has reached a final status
+func (b *Batch) Finished() bool {
+	return b.Status == shared.BatchStatusCompleted || b.Status == shared.BatchStatusCancelled
+}
+
+// BatchItem is one request of a batch that has not run yet
+type BatchItem struct {
+	Index   int
+	Request shared.CompletionRequest
+}
+
+// CreateBatch stores a batch and its requests
+func (db *DB) CreateBatch(b *Batch, requests []shared.CompletionRequest) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO batches (batch_id, key_id, status, total, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, b.ID, b.KeyID, b.Status, b.Total, b.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert batch: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO batch_items (batch_id, idx, request) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare batch item insert: %w", err)
+	}
+	defer stmt.Close()
+	for i, req := range requests {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("marshal request %d: %w", i, err)
+		}
+		if _, err := stmt.Exec(b.ID, i, string(data)); err != nil {
+			return fmt.Errorf("insert batch item: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// GetBatch looks up a batch by ID
+func (db *DB) GetBatch(batchID string) (*Batch, error) {
+	row := db.QueryRow(`
+		SELECT batch_id, key_id, status, total, completed, failed, created_at, finished_at, cancelled_at
+		FROM batches
+		WHERE batch_id = ?
+	`, batchID)
+	b, err := scanBatch(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	return b, err
+}
+
+// ListBatches returns a key's most recent batches, newest first
+func (db *DB) ListBatches(keyID string, limit int) ([]Batch, error) {
+	return db.queryBatches(`
+		SELECT batch_id, key_id, status, total, completed, failed, created_at, finished_at, cancelled_at
+		FROM batches
+		WHERE key_id = ?
+		ORDER BY created_at DESC, batch_id
+		LIMIT ?
+	`, keyID, limit)
+}
+
+// ActiveBatches returns every batch not yet finished, oldest first
+func (db *DB) ActiveBatches() ([]Batch, error) {
+	return db.queryBatches(`
+		SELECT batch_id, key_id, status, total, completed, failed, created_at, finished_at, cancelled_at
+		FROM batches
+		WHERE status IN (?, ?, ?)
+		ORDER BY created_at, batch_id
+	`, shared.BatchStatusQueued, shared.BatchStatusInProgress, shared.BatchStatusCancelling)
+}
+
+func (db *DB) queryBatches(query string, args ...any) ([]Batch, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query batches: %w", err)
+	}
+	defer rows.Close()
+
+	var batches []Batch
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, *b)
+	}
+	return batches, rows.Err()
+}
+
+// scanBatch scans a single batches row
+func scanBatch(row rowScanner) (*Batch, error) {
+	b := Batch{Batch: shared.Batch{Object: "batch"}}
+	var finishedAt, cancelledAt sql.NullInt64
+	err := row.Scan(&b.ID, &b.KeyID, &b.Status, &b.Total, &b.Completed, &b.Failed, &b.CreatedAt, &finishedAt, &cancelledAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("scan batch: %w", err)
+	}
+	if finishedAt.Valid {
+		b.FinishedAt = &finishedAt.Int64
+	}
+	if cancelledAt.Valid {
+		b.CancelledAt = &cancelledAt.Int64
+	}
+	return &b, nil
+}
+
+// StartBatch moves a queued batch to in progress
+func (db *DB) StartBatch(batchID string) error {
+	_, err := db.Exec(`UPDATE batches SET status = ? WHERE batch_id = ? AND status = ?`,
+		shared.BatchStatusInProgress, batchID, shared.BatchStatusQueued)
+	if err != nil {
+		return fmt.Errorf("start batch: %w", err)
+	}
+	return nil
+}
+
+// CancelBatch asks for a running batch to be cancelled. The batch runner
+// finishes the cancellation once in-flight requests have stopped.
+func (db *DB) CancelBatch(batchID string) error {
+	result, err := db.Exec(`
+		UPDATE batches SET status = ?, cancelled_at = ?
+		WHERE batch_id = ? AND status IN (?, ?)
+	`, shared.BatchStatusCancelling, time.Now().Unix(), batchID, shared.BatchStatusQueued, shared.BatchStatusInProgress)
+	if err != nil {
+		return fmt.Errorf("cancel batch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if rows == 0 {
+		b, err := db.GetBatch(batchID)
+		if err != nil {
+			return err
+		}
+		if b.Finished() {
+			return errBatchFinished
+		}
+	}
+	return nil
+}
+
+// CompleteBatch marks a batch completed if none of its requests are pending.
+// It reports whether it did.
+func (db *DB) CompleteBatch(batchID string) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE batches SET status = ?, finished_at = ?
+		WHERE batch_id = ? AND status = ?
+			AND NOT EXISTS (SELECT 1 FROM batch_items WHERE batch_id = ? AND status = ?)
+	`, shared.BatchStatusCompleted, time.Now().Unix(), batchID, shared.BatchStatusInProgress, batchID, batchItemPending)
+	if err != nil {
+		return false, fmt.Errorf("complete batch: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected: %w", err)
+	}
+	return rows > 0, nil
+}
+
+// FinishCancelledBatch marks a cancelling batch cancelled along with the
+// requests that never ran
+func (db *DB) FinishCancelledBatch(batchID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE batch_items SET status = ? WHERE batch_id = ? AND status = ?`,
+		batchItemCancelled, batchID, batchItemPending)
+	if err != nil {
+		return fmt.Errorf("cancel batch items: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE batches SET status = ?, finished_at = ? WHERE batch_id = ? AND status = ?`,
+		shared.BatchStatusCancelled, time.Now().Unix(), batchID, shared.BatchStatusCancelling)
+	if err != nil {
+		return fmt.Errorf("finish cancelled batch: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// PendingBatchItems returns up to limit pending requests of a batch with an
+// index above after, in index order
+func (db *DB) PendingBatchItems(batchID string, after, limit int) ([]BatchItem, error) {
+	rows, err := db.Query(`
+		SELECT idx, request FROM batch_items
+		WHERE batch_id = ? AND status = ? AND idx > ?
+		ORDER BY idx
+		LIMIT ?
+	`, batchID, batchItemPending, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query batch items: %w", err)
+	}
+	defer rows.Close()
+
+	var items []BatchItem
+	for rows.Next() {
+		var item BatchItem
+		var request string
+		if err := rows.Scan(&item.Index, &request); err != nil {
+			return nil, fmt.Errorf("scan batch item: %w", err)
+		}
+		if err := json.Unmarshal([]byte(request), &item.Request); err != nil {
+			return nil, fmt.Errorf("parse batch item %d: %w", item.Index, err)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// FinishBatchItem stores the outcome of one request and counts it on the
+// batch. Exactly one of resp and perr is set.
+func (db *DB) FinishBatchItem(batchID string, index int, resp *shared.CompletionResponse, perr *shared.ProtocolError) error {
+	status, counter := batchItemCompleted, "completed"
+	var data []byte
+	var err error
+	if perr != nil {
+		status, counter = batchItemFailed, "failed"
+		data, err = json.Marshal(perr)
+	} else {
+		data, err = json.Marshal(resp)
+	}
+	if err != nil {
+		return fmt.Errorf("marshal batch result: %w", err)
+	}
+	column := "response"
+	if perr != nil {
+		column = "error"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(fmt.Sprintf(`UPDATE batch_items SET status = ?, %s = ? WHERE batch_id = ? AND idx = ? AND status = ?`, column),
+		status, string(data), batchID, index, batchItemPending)
+	if err != nil {
+		return fmt.Errorf("update batch item: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if rows == 0 {
+		return errNotFound
+	}
+	_, err = tx.Exec(fmt.Sprintf(`UPDATE batches SET %[1]s = %[1]s + 1 WHERE batch_id = ?`, counter), batchID)
+	if err != nil {
+		return fmt.Errorf("count batch item: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// EachBatchResult calls fn for every request of a batch, in index order.
+// Requests that never ran are reported as cancelled.
+func (db *DB) EachBatchResult(batchID string, fn func(shared.BatchResult) error) error {
+	rows, err := db.Query(`
+		SELECT idx, status, response, error FROM batch_items
+		WHERE batch_id = ?
+		ORDER BY idx
+	`, batchID)
+	if err != nil {
+		return fmt.Errorf("query batch results: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var res shared.BatchResult
+		var status string
+		var response, perr sql.NullString
+		if err := rows.Scan(&res.Index, &status, &response, &perr); err != nil {
+			return fmt.Errorf("scan batch result: %w", err)
+		}
+		switch status {
+		case batchItemCompleted:
+			if err := json.Unmarshal([]byte(response.String), &res.Response); err != nil {
+				return fmt.Errorf("parse batch response %d: %w", res.Index, err)
+			}
+		case batchItemFailed:
+			if err := json.Unmarshal([]byte(perr.String), &res.Error); err != nil {
+				return fmt.Errorf("parse batch error %d: %w", res.Index, err)
+			}
+		default:
+			res.Error = shared.ErrCancelled
+		}
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// HandleBatches handles /v1/batches
+// POST uploads a JSONL file of completion requests as a new batch; GET
+// lists the key's batches.
+func (h *Handlers) HandleBatches(w http.ResponseWriter, r *http.Request) {
+	f := &legacyFormat{}
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("only GET and POST are allowed"))
+		return
+	}
+
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		batches, err := h.db.ListBatches(key.ID, maxBatchList)
+		if err != nil {
+			requestLogger(r).Error("Error listing batches", "key_id", key.ID, "err", err)
+			h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+			return
+		}
+		list := shared.BatchList{Object: "list", Data: []shared.Batch{}}
+		for _, b := range batches {
+			list.Data = append(list.Data, b.Batch)
+		}
+		shared.WriteJSON(w, http.StatusOK, list)
+		return
+	}
+
+	requests, err := h.parseBatch(http.MaxBytesReader(w, r.Body, maxBatchBytes), key)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+
+	b := &Batch{
+		Batch: shared.Batch{
+			ID:        "batch_" + uuid.New().String(),
+			Object:    "batch",
+			Status:    shared.BatchStatusQueued,
+			Total:     len(requests),
+			CreatedAt: time.Now().Unix(),
+		},
+		KeyID: key.ID,
+	}
+	if err := h.db.CreateBatch(b, requests); err != nil {
+		requestLogger(r).Error("Error storing batch", "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+		return
+	}
+	h.batches.Notify()
+
+	requestLogger(r).Info("Batch created", "batch_id", b.ID, "key_id", key.ID, "requests", b.Total)
+	shared.WriteJSON(w, http.StatusCreated, b.Batch)
+}
+
+// parseBatch reads and validates an uploaded JSONL file. Blank lines are
+// skipped; every other line must be a completion request the key may run.
+func (h *Handlers) parseBatch(body io.Reader, key *APIKey) ([]shared.CompletionRequest, error) {
+	var requests []shared.CompletionRequest
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), maxBatchLine)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if len(requests) == maxBatchRequests {
+			return nil, fmt.Errorf("a batch holds at most %d requests", maxBatchRequests)
+		}
+
+		var req shared.CompletionRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := h.validateBatchRequest(&req, key); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading batch: %w", err)
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("batch contains no requests")
+	}
+	return requests, nil
+}
+
+// validateBatchRequest checks one request the way /v1/completions would
+// and resolves its model alias
+func (h *Handlers) validateBatchRequest(req *shared.CompletionRequest, key *APIKey) error {
+	if req.Model == "" || req.Prompt == "" {
+		return fmt.Errorf("model and prompt are required")
+	}
+	if req.Stream {
+		return fmt.Errorf("stream is not supported in batches")
+	}
+	if req.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must not be negative")
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = defaultMaxTokens
+	}
+	if err := validateSampling(req.SamplingParams); err != nil {
+		return err
+	}
+	req.Model = h.models.Resolve(req.Model)
+	if !key.AllowsModel(req.Model) {
+		return fmt.Errorf("model %s is not allowed for this key", req.Model)
+	}
+	return h.models.CheckKind(req.Model, shared.ModelKindGenerate)
+}
+
+// HandleBatch handles /v1/batches/{id}, POST /v1/batches/{id}/cancel and
+// GET /v1/batches/{id}/results
+func (h *Handlers) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	f := &legacyFormat{}
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, shared.PathBatches+"/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		h.writeFormatError(w, f, http.StatusNotFound, shared.ErrInvalidRequest.WithDetails("unknown batch path"))
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	// Other keys' batches are reported as missing rather than forbidden
+	b, err := h.db.GetBatch(parts[0])
+	if err == nil && b.KeyID != key.ID {
+		err = errNotFound
+	}
+	if errors.Is(err, errNotFound) {
+		h.writeFormatError(w, f, http.StatusNotFound, shared.ErrInvalidRequest.WithDetails("batch not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error getting batch", "batch_id", parts[0], "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		shared.WriteJSON(w, http.StatusOK, b.Batch)
+	case action == "cancel" && r.Method == http.MethodPost:
+		h.cancelBatch(w, r, b, f)
+	case action == "results" && r.Method == http.MethodGet:
+		h.writeBatchResults(w, r, b, f)
+	case action == "" || action == "cancel" || action == "results":
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("method not allowed"))
+	default:
+		h.writeFormatError(w, f, http.StatusNotFound, shared.ErrInvalidRequest.WithDetails("unknown batch path"))
+	}
+}
+
+// cancelBatch stops feeding a batch to agents and cancels its running
+// requests. Requests that already finished keep their results.
+func (h *Handlers) cancelBatch(w http.ResponseWriter, r *http.Request, b *Batch, f errorFormat) {
+	if err := h.db.CancelBatch(b.ID); err != nil {
+		if errors.Is(err, errBatchFinished) {
+			h.writeFormatError(w, f, http.StatusConflict, shared.ErrInvalidRequest.WithDetails("batch already finished"))
+			return
+		}
+		requestLogger(r).Error("Error cancelling batch", "batch_id", b.ID, "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+		return
+	}
+	h.batches.Cancel(b.ID)
+
+	updated, err := h.db.GetBatch(b.ID)
+	if err != nil {
+		requestLogger(r).Error("Error getting batch", "batch_id", b.ID, "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+		return
+	}
+	requestLogger(r).Info("Batch cancelled", "batch_id", b.ID)
+	shared.WriteJSON(w, http.StatusOK, updated.Batch)
+}
+
+// writeBatchResults streams a finished batch's results as JSONL
+func (h *Handlers) writeBatchResults(w http.ResponseWriter, r *http.Request, b *Batch, f errorFormat) {
+	if !b.Finished() {
+		h.writeFormatError(w, f, http.StatusConflict, shared.ErrInvalidRequest.WithDetails("batch is "+b.Status+"; results are available once it finishes"))
+		return
+	}
+
+	// Large result files outlive the server's default WriteTimeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(h.requestTimeout)); err != nil {
+		requestLogger(r).Warn("Error extending write deadline", "err", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.jsonl"`, b.ID))
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err := h.db.EachBatchResult(b.ID, func(res shared.BatchResult) error {
+		return enc.Encode(res)
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// Headers are already sent; the truncated file is all we can do
+		requestLogger(r).Error("Error writing batch results", "batch_id", b.ID, "err", err)
+	}
+}
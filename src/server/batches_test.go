@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// uploadBatch posts a JSONL file of the lines and returns the response
+// status and body
+func uploadBatch(t *testing.T, p *testPool, key string, lines ...string) (int, []byte) {
+	t.Helper()
+	body := strings.NewReader(strings.Join(lines, "\n"))
+	req, err := http.NewRequest(http.MethodPost, p.srv.URL+"/v1/batches", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("uploading batch: %v", err)
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	return resp.StatusCode, buf.Bytes()
+}
+
+// createBatch uploads a batch that must be accepted
+func createBatch(t *testing.T, p *testPool, lines ...string) shared.Batch {
+	t.Helper()
+	status, body := uploadBatch(t, p, p.client, lines...)
+	if status != http.StatusCreated {
+		t.Fatalf("creating batch: status %d, body %s", status, body)
+	}
+	var b shared.Batch
+	if err := json.Unmarshal(body, &b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// runBatches runs the pool's batch runner until the test ends
+func runBatches(t *testing.T, p *testPool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.h.batches.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitBatch polls a batch until it has the status
+func waitBatch(t *testing.T, p *testPool, id, status string) shared.Batch {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var b shared.Batch
+		if code := doJSON(t, http.MethodGet, p.srv.URL+"/v1/batches/"+id, p.client, nil, &b); code != http.StatusOK {
+			t.Fatalf("getting batch: status %d", code)
+		}
+		if b.Status == status {
+			return b
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch still %s, want %s", b.Status, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// batchResults downloads a finished batch's results
+func batchResults(t *testing.T, p *testPool, id string) []shared.BatchResult {
+	t.Helper()
+	resp, body := doRequest(t, http.MethodGet, p.srv.URL+"/v1/batches/"+id+"/results", p.client, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("results: status %d, body %s", resp.StatusCode, body)
+	}
+	var results []shared.BatchResult
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var res shared.BatchResult
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			t.Fatalf("decoding result %q: %v", scanner.Text(), err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestBatchRunsToCompletion(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	b := createBatch(t, p,
+		`{"model":"llama","prompt":"one"}`,
+		``,
+		`{"model":"llama","prompt":"two"}`,
+	)
+	if b.Status != shared.BatchStatusQueued || b.Total != 2 {
+		t.Fatalf("created %+v, want 2 queued requests", b)
+	}
+	runBatches(t, p)
+
+	done := waitBatch(t, p, b.ID, shared.BatchStatusCompleted)
+	if done.Completed != 2 || done.Failed != 0 || done.FinishedAt == nil {
+		t.Errorf("finished %+v", done)
+	}
+	results := batchResults(t, p, b.ID)
+	if len(results) != 2 || results[1].Index != 1 || results[1].Response == nil || results[1].Response.Choices[0].Text != "ok" {
+		t.Errorf("results %+v", results)
+	}
+}
+
+func TestBatchRecordsFailedRequests(t *testing.T) {
+	p := newTestPool(t, func(work shared.WorkResponse) shared.ResultRequest {
+		msg := "model crashed"
+		return shared.ResultRequest{Finished: true, Error: &msg}
+	})
+	b := createBatch(t, p, `{"model":"llama","prompt":"one"}`)
+	runBatches(t, p)
+
+	done := waitBatch(t, p, b.ID, shared.BatchStatusCompleted)
+	results := batchResults(t, p, b.ID)
+	if done.Failed != 1 || len(results) != 1 || results[0].Error == nil || results[0].Error.Code != shared.ErrInternalServer.Code {
+		t.Errorf("batch %+v, results %+v; want one internal error", done, results)
+	}
+}
+
+func TestBatchRejectsInvalidLine(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	status, body := uploadBatch(t, p, p.client,
+		`{"model":"llama","prompt":"one"}`,
+		`{"model":"llama","prompt":"two","stream":true}`,
+	)
+	if status != http.StatusBadRequest || !strings.Contains(string(body), "line 2") {
+		t.Errorf("status %d, body %s; want 400 naming line 2", status, body)
+	}
+}
+
+func TestBatchCancelBeforeRunning(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	b := createBatch(t, p, `{"model":"llama","prompt":"one"}`)
+
+	var cancelled shared.Batch
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/batches/"+b.ID+"/cancel", p.client, nil, &cancelled); status != http.StatusOK {
+		t.Fatalf("cancel: status %d", status)
+	}
+	if cancelled.Status != shared.BatchStatusCancelling || cancelled.CancelledAt == nil {
+		t.Errorf("after cancel %+v, want cancelling", cancelled)
+	}
+	runBatches(t, p)
+
+	waitBatch(t, p, b.ID, shared.BatchStatusCancelled)
+	results := batchResults(t, p, b.ID)
+	if len(results) != 1 || results[0].Error == nil || results[0].Error.Code != shared.ErrCancelled.Code {
+		t.Errorf("results %+v, want the request cancelled", results)
+	}
+}
+
+func TestBatchResultsWaitForFinish(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	b := createBatch(t, p, `{"model":"llama","prompt":"one"}`)
+	resp, _ := doRequest(t, http.MethodGet, p.srv.URL+"/v1/batches/"+b.ID+"/results", p.client, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("status %d, want 409 while queued", resp.StatusCode)
+	}
+}
+
+func TestBatchHiddenFromOtherKeys(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	b := createBatch(t, p, `{"model":"llama","prompt":"one"}`)
+	other := newTestKey(t, p.h, ScopeClientComplete)
+	if status := doJSON(t, http.MethodGet, p.srv.URL+"/v1/batches/"+b.ID, other, nil, nil); status != http.StatusNotFound {
+		t.Errorf("status %d, want 404 for another key's batch", status)
+	}
+}
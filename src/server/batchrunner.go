@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Batch runner timing and paging
+const (
+	batchPollInterval = 10 * time.Second // fallback when no Notify arrives, and quota retry interval
+	batchPageSize     = 100              // pending requests read from the database at once
+)
+
+// errBatchCancelled is the cancellation cause of a batch cancelled by its owner
+var errBatchCancelled = errors.New("batch cancelled")
+
+// BatchRunner feeds stored batches into the job queue at batch priority.
+// All batch state lives in the database, so batches left unfinished when
+// the server stops are picked up again once it starts.
+type BatchRunner struct {
+	h           *Handlers
+	concurrency int // requests of one batch in flight at a time
+	wake        chan struct{}
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc // by batch ID
+}
+
+// NewBatchRunner creates a batch runner using the handlers' queue and ledger
+func NewBatchRunner(h *Handlers, concurrency int) *BatchRunner {
+	return &BatchRunner{
+		h:           h,
+		concurrency: max(concurrency, 1),
+		wake:        make(chan struct{}, 1),
+		running:     make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// Run starts every unfinished batch and keeps starting new ones
+// It blocks until the context is cancelled
+func (b *BatchRunner) Run(ctx context.Context) {
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+
+	slog.Info("Batch runner started", "concurrency", b.concurrency)
+
+	for {
+		b.startBatches(ctx)
+		select {
+		case <-ctx.Done():
+			slog.Info("Batch runner stopped")
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+	}
+}
+
+// Notify makes the runner look for new batches without waiting for its next poll
+func (b *BatchRunner) Notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel stops a running batch. Its in-flight requests are abandoned and
+// the runner marks the batch cancelled once they have stopped.
+func (b *BatchRunner) Cancel(batchID string) {
+	b.mu.Lock()
+	cancel, ok := b.running[batchID]
+	b.mu.Unlock()
+	if ok {
+		cancel(errBatchCancelled)
+	}
+	b.Notify()
+}
+
+// startBatches starts a goroutine for every unfinished batch not already running
+func (b *BatchRunner) startBatches(ctx context.Context) {
+	batches, err := b.h.db.ActiveBatches()
+	if err != nil {
+		slog.Error("Error listing active batches", "err", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, batch := range batches {
+		if _, ok := b.running[batch.ID]; ok {
+			continue
+		}
+		if batch.Status == shared.BatchStatusCancelling {
+			// Cancelled while no runner was feeding it, e.g. across a restart
+			if err := b.h.db.FinishCancelledBatch(batch.ID); err != nil {
+				slog.Error("Error finishing cancelled batch", "batch_id", batch.ID, "err", err)
+			}
+			continue
+		}
+
+		batchCtx, cancel := context.WithCancelCause(ctx)
+		b.running[batch.ID] = cancel
+		go func(batch Batch) {
+			defer func() {
+				b.mu.Lock()
+				delete(b.running, batch.ID)
+				b.mu.Unlock()
+				cancel(nil)
+			}()
+			b.runBatch(batchCtx, batch)
+		}(batch)
+	}
+}
+
+// runBatch runs a batch's pending requests until none are left or ctx is done
+func (b *BatchRunner) runBatch(ctx context.Context, batch Batch) {
+	log := slog.With("batch_id", batch.ID)
+	if batch.Status == shared.BatchStatusQueued {
+		if err := b.h.db.StartBatch(batch.ID); err != nil {
+			log.Error("Error starting batch", "err", err)
+			return
+		}
+		log.Info("Batch started", "requests", batch.Total)
+	} else {
+		log.Info("Batch resumed", "requests", batch.Total, "completed", batch.Completed, "failed", batch.Failed)
+	}
+
+	items := make(chan BatchItem)
+	var wg sync.WaitGroup
+	for i := 0; i < b.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				b.runItem(ctx, log, batch, item)
+			}
+		}()
+	}
+
+	fed := b.feed(ctx, log, batch.ID, items)
+	close(items)
+	wg.Wait()
+
+	switch {
+	case errors.Is(context.Cause(ctx), errBatchCancelled):
+		if err := b.h.db.FinishCancelledBatch(batch.ID); err != nil {
+			log.Error("Error finishing cancelled batch", "err", err)
+			return
+		}
+		log.Info("Batch cancelled")
+	case ctx.Err() != nil:
+		// Shutting down; unfinished requests stay pending until the next start
+	case fed:
+		done, err := b.h.db.CompleteBatch(batch.ID)
+		if err != nil {
+			log.Error("Error completing batch", "err", err)
+			return
+		}
+		if done {
+			log.Info("Batch completed")
+		}
+	}
+}
+
+// feed sends the batch's pending requests to items in index order. It
+// reports whether every pending request was sent.
+func (b *BatchRunner) feed(ctx context.Context, log *slog.Logger, batchID string, items chan<- BatchItem) bool {
+	after := -1
+	for {
+		page, err := b.h.db.PendingBatchItems(batchID, after, batchPageSize)
+		if err != nil {
+			log.Error("Error reading batch requests", "err", err)
+			return false
+		}
+		if len(page) == 0 {
+			return true
+		}
+		for _, item := range page {
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		after = page[len(page)-1].Index
+	}
+}
+
+// runItem runs one request of a batch as a job and stores its outcome.
+// The key's quota and rate limits pace the batch rather than fail it, and
+// a request only times out once an agent has held it for the request
+// timeout; until then it waits in the queue for a capable agent.
+func (b *BatchRunner) runItem(ctx context.Context, log *slog.Logger, batch Batch, item BatchItem) {
+	key, err := b.h.db.GetAPIKey(batch.KeyID)
+	if err != nil {
+		log.Error("Error getting batch key", "key_id", batch.KeyID, "err", err)
+		return
+	}
+	if !key.Active(time.Now()) {
+		b.storeItem(log, batch, item, nil, shared.ErrUnauthorized.WithDetails("API key was revoked or expired"))
+		return
+	}
+
+	estimate := estimateTokens(item.Request.Prompt, item.Request.MaxTokens)
+	if !b.admit(ctx, log, key, estimate) {
+		return
+	}
+	b.h.demand.Record(item.Request.Model)
+
+	ctx, span := b.h.tracer.Start(ctx, "batch.request")
+	defer span.End()
+	span.SetAttr("batch_id", batch.ID)
+	span.SetAttr("index", item.Index)
+
+	job := NewJob(fmt.Sprintf("%s-%d", batch.ID, item.Index), key.ID, item.Request)
+	job.Priority = PriorityBatch
+	job.Cost = estimate
+	job.Weight = key.Weight
+	job.CorrelationID = batch.ID
+	job.Trace = span.SpanContext()
+	b.h.queue.Submit(job)
+
+	final, text, timedOut := b.await(ctx, job)
+	b.h.queue.Finish(job.ID)
+	b.h.settleJobs(log, key, estimate, []*Job{job}, []*shared.ResultRequest{final}, timedOut)
+
+	switch {
+	case timedOut:
+		b.storeItem(log, batch, item, nil, shared.ErrTimeout)
+	case final == nil && isClosed(job.Cancelled()):
+		b.storeItem(log, batch, item, nil, shared.ErrCancelled.WithDetails(job.ID))
+	case final == nil:
+		// Cancelled or shutting down; the request is left pending
+	case final.Error != nil:
+		b.storeItem(log, batch, item, nil, shared.ErrInternalServer.WithDetails(*final.Error))
+	default:
+		b.storeItem(log, batch, item, &shared.CompletionResponse{
+			ID:      job.ID,
+			Model:   item.Request.Model,
+			Choices: []shared.CompletionChoice{{Text: text, FinishReason: finishReason(*final)}},
+			Usage:   usageOf(*final),
+		}, nil)
+	}
+}
+
+// admit waits until the key has quota left and its rate limits admit the
+// estimated tokens. It returns false if ctx ends first.
+func (b *BatchRunner) admit(ctx context.Context, log *slog.Logger, key *APIKey, estimate int) bool {
+	for {
+		var wait time.Duration
+		exhausted, reset, err := b.h.exhaustedQuota(key, time.Now())
+		switch {
+		case err != nil:
+			log.Error("Error reading token usage", "key_id", key.ID, "err", err)
+			wait = batchPollInterval
+		case exhausted != "":
+			wait = reset
+		default:
+			decision := b.h.limiter.Allow(key, estimate)
+			if decision.Allowed {
+				return true
+			}
+			wait = decision.RetryAfter
+		}
+
+		timer := time.NewTimer(max(wait, 100*time.Millisecond))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// await collects a job's output. It returns the final result post, nil if
+// the job timed out, was cancelled or ctx ended first.
+func (b *BatchRunner) await(ctx context.Context, job *Job) (*shared.ResultRequest, string, bool) {
+	var text strings.Builder
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, "", false
+		case <-job.Cancelled():
+			return nil, "", false
+		case res := <-job.Results():
+			if res.Error != nil {
+				return &res, "", false
+			}
+			for _, tok := range res.Tokens {
+				text.WriteString(tok)
+			}
+			if res.Finished {
+				return &res, text.String(), false
+			}
+		case <-ticker.C:
+			if leased := b.h.queue.LeasedAt(job); !leased.IsZero() && time.Since(leased) > b.h.requestTimeout {
+				return nil, "", true
+			}
+		}
+	}
+}
+
+// storeItem records a request's outcome
+func (b *BatchRunner) storeItem(log *slog.Logger, batch Batch, item BatchItem, resp *shared.CompletionResponse, perr *shared.ProtocolError) {
+	if err := b.h.db.FinishBatchItem(batch.ID, item.Index, resp, perr); err != nil {
+		log.Error("Error storing batch result", "index", item.Index, "err", err)
+	}
+}
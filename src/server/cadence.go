@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Heartbeat cadence bounds
+const (
+	minHeartbeatInterval = 5 * time.Second
+	maxHeartbeatInterval = 5 * time.Minute
+	fleetHeartbeatRate   = 50  // heartbeats per second the whole fleet is spread over at most
+	lateHeartbeatFactor  = 1.5 // a heartbeat this many intervals after the last one is late
+)
+
+// Cadence picks the interval each agent is told to send its next heartbeat
+// after. Busy agents and agents that look unreliable (just registered,
+// back from an outage, or late with their last heartbeat) report more
+// often so cancellations and failures are noticed sooner; idle agents
+// report less often. However busy it is, a large fleet is slowed down so
+// that heartbeats never arrive faster than fleetHeartbeatRate.
+type Cadence struct {
+	base time.Duration // interval of a healthy agent with normal load
+
+	mu     sync.Mutex
+	agents map[string]*agentCadence // by agent ID
+}
+
+// agentCadence is the last heartbeat of one agent and the interval it was given
+type agentCadence struct {
+	seen     time.Time
+	interval time.Duration
+	suspect  bool // registered or reconnected since the last heartbeat
+}
+
+// NewCadence creates a cadence around a base interval
+func NewCadence(base time.Duration) *Cadence {
+	return &Cadence{
+		base:   base,
+		agents: make(map[string]*agentCadence),
+	}
+}
+
+// Registered records an agent's registration and returns the interval
+// until its first heartbeat
+func (c *Cadence) Registered(agentID string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	interval := c.clampLocked(c.base, now)
+	c.agents[agentID] = &agentCadence{seen: now, interval: interval, suspect: true}
+	return interval
+}
+
+// Next records a heartbeat and returns the interval until the next one.
+// busy is whether the agent is running a job; reconnected whether it has
+// just come back from losing the server; resumed whether its host has just
+// woken up, which excuses a late heartbeat.
+func (c *Cadence) Next(agentID string, busy, reconnected, resumed bool) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	a, ok := c.agents[agentID]
+	if !ok {
+		// First heartbeat since the server started
+		a = &agentCadence{suspect: true}
+		c.agents[agentID] = a
+	}
+	late := ok && !resumed && now.Sub(a.seen) > time.Duration(float64(a.interval)*lateHeartbeatFactor)
+
+	var interval time.Duration
+	switch {
+	case a.suspect || late || reconnected:
+		interval = c.base / 3
+	case busy:
+		interval = c.base / 2
+	default:
+		interval = c.base * 2
+	}
+	interval = c.clampLocked(interval, now)
+
+	a.seen, a.interval, a.suspect = now, interval, false
+	return interval
+}
+
+// clampLocked bounds an interval and stretches it to keep the fleet's
+// combined heartbeat rate under fleetHeartbeatRate. It also forgets agents
+// the stale cleanup will have marked offline, so only the live fleet counts.
+func (c *Cadence) clampLocked(interval time.Duration, now time.Time) time.Duration {
+	for agentID, a := range c.agents {
+		if now.Sub(a.seen) > a.interval*shared.MaxMissedHeartbeats {
+			delete(c.agents, agentID)
+		}
+	}
+	fleet := time.Duration(len(c.agents)+1) * time.Second / fleetHeartbeatRate
+
+	interval = max(interval, fleet, minHeartbeatInterval)
+	return min(interval, maxHeartbeatInterval).Round(time.Second)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// maxChoices caps n on chat completions; each choice is a separate job
+const maxChoices = 8
+
+// HandleChatCompletions handles POST /v1/chat/completions
+// It renders the messages with the model's chat template and runs the
+// prompt like a completion, answering in the OpenAI chat format.
+func (h *Handlers) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	f := &chatFormat{}
+	if r.Method != http.MethodPost {
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("only POST is allowed"))
+		return
+	}
+
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	req, err := shared.ParseJSON[shared.ChatCompletionRequest](r)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	if req.Model == "" || len(req.Messages) == 0 {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("model and messages are required"))
+		return
+	}
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		case "developer":
+			// Newer OpenAI name for the system role
+			req.Messages[i].Role = "system"
+		default:
+			h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("unsupported message role "+m.Role))
+			return
+		}
+	}
+
+	maxTokens := req.MaxTokens
+	if req.MaxCompletionTokens != 0 {
+		maxTokens = req.MaxCompletionTokens
+	}
+	if maxTokens < 0 {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("max_tokens must not be negative"))
+		return
+	}
+	if maxTokens == 0 {
+		maxTokens = defaultMaxTokens
+	}
+	n := req.N
+	if n == 0 {
+		n = 1
+	}
+	if n < 1 || n > maxChoices {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(fmt.Sprintf("n must be between 1 and %d", maxChoices)))
+		return
+	}
+	if err := applyResponseFormat(&req.SamplingParams, req.ResponseFormat); err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	if err := validateSampling(req.SamplingParams); err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	model := h.models.Resolve(req.Model)
+	if !key.AllowsModel(model) {
+		h.writeFormatError(w, f, http.StatusForbidden, shared.ErrForbidden.WithDetails("model "+model+" is not allowed for this key"))
+		return
+	}
+
+	tmpl := h.models.ChatTemplate(model)
+	prompt, err := tmpl.Render(req.Messages)
+	if err != nil {
+		requestLogger(r).Error("Error rendering chat template", "model", model, "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer.WithDetails(err.Error()))
+		return
+	}
+
+	// The template's end-of-turn markers always stop generation, on top of
+	// whatever the client asked for
+	sampling := req.SamplingParams
+	sampling.Stop = append(append(shared.StopSequences{}, req.Stop...), tmpl.Stop()...)
+
+	f.id = "chatcmpl-" + uuid.New().String()
+	f.model = req.Model
+	f.created = time.Now().Unix()
+	f.includeUsage = req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+
+	h.serveCompletion(w, r, key, &shared.CompletionRequest{
+		Model:          model,
+		Prompt:         prompt,
+		MaxTokens:      maxTokens,
+		Stream:         req.Stream,
+		SamplingParams: sampling,
+	}, n, f)
+}
+
+// applyResponseFormat turns an OpenAI response_format into a JSON schema
+// constraint. json_object accepts any object.
+func applyResponseFormat(p *shared.SamplingParams, rf *shared.ResponseFormat) error {
+	if rf == nil {
+		return nil
+	}
+	switch rf.Type {
+	case "", "text":
+		return nil
+	case "json_object":
+		p.JSONSchema = json.RawMessage(`{"type":"object"}`)
+	case "json_schema":
+		if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+			return fmt.Errorf("response_format json_schema requires a schema")
+		}
+		p.JSONSchema = rf.JSONSchema.Schema
+	default:
+		return fmt.Errorf("unsupported response_format type %q", rf.Type)
+	}
+	return nil
+}
+
+// chatFormat is the OpenAI chat completions format
+type chatFormat struct {
+	openAIErrorFormat
+	id           string
+	model        string
+	created      int64
+	includeUsage bool
+}
+
+// openAIError is the error body of the OpenAI API
+type openAIError struct {
+	Error openAIErrorBody `json:"error"`
+}
+
+type openAIErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// openAIErrorTypes maps protocol error codes to OpenAI error types, which
+// SDKs use to pick an exception class
+var openAIErrorTypes = map[string]string{
+	shared.ErrInvalidRequest.Code:  "invalid_request_error",
+	shared.ErrModelNotFound.Code:   "invalid_request_error",
+	shared.ErrUnauthorized.Code:    "authentication_error",
+	shared.ErrForbidden.Code:       "permission_error",
+	shared.ErrRateLimited.Code:     "rate_limit_error",
+	shared.ErrNoCapableAgents.Code: "service_unavailable_error",
+	shared.ErrTimeout.Code:         "timeout_error",
+	shared.ErrCancelled.Code:       "invalid_request_error",
+}
+
+// toOpenAIError converts a protocol error to the OpenAI error body
+func toOpenAIError(err *shared.ProtocolError) openAIError {
+	typ, ok := openAIErrorTypes[err.Code]
+	if !ok {
+		typ = "server_error"
+	}
+	msg := err.Message
+	if err.Details != "" {
+		msg += ": " + err.Details
+	}
+	return openAIError{Error: openAIErrorBody{Message: msg, Type: typ, Code: strings.ToLower(err.Code)}}
+}
+
+func (f *chatFormat) responseID() string { return f.id }
+
+// openAIErrorFormat writes errors in the OpenAI format
+type openAIErrorFormat struct{}
+
+func (openAIErrorFormat) writeError(w http.ResponseWriter, status int, err *shared.ProtocolError) {
+	shared.WriteJSON(w, status, toOpenAIError(err))
+}
+
+func (f *chatFormat) writeResponse(w http.ResponseWriter, choices []completedChoice, usage shared.CompletionUsage) {
+	resp := shared.ChatCompletionResponse{
+		ID:      f.id,
+		Object:  "chat.completion",
+		Created: f.created,
+		Model:   f.model,
+		Choices: make([]shared.ChatChoice, len(choices)),
+		Usage:   usage,
+	}
+	for i, c := range choices {
+		resp.Choices[i] = shared.ChatChoice{
+			Index:        i,
+			Message:      shared.ChatReplyMessage{Role: "assistant", Content: c.Text},
+			FinishReason: c.FinishReason,
+		}
+	}
+	shared.WriteJSON(w, http.StatusOK, resp)
+}
+
+// chunk builds a streamed event carrying the given choices
+func (f *chatFormat) chunk(choices ...shared.ChatChunkChoice) shared.ChatCompletionChunk {
+	return shared.ChatCompletionChunk{
+		ID:      f.id,
+		Object:  "chat.completion.chunk",
+		Created: f.created,
+		Model:   f.model,
+		Choices: choices,
+	}
+}
+
+// startStream announces the assistant role for every choice, as OpenAI
+// does in the first chunk of each choice
+func (f *chatFormat) startStream(w http.ResponseWriter, n int) {
+	for i := 0; i < n; i++ {
+		shared.WriteSSEEvent(w, f.chunk(shared.ChatChunkChoice{Index: i, Delta: shared.ChatDelta{Role: "assistant"}}))
+	}
+}
+
+func (f *chatFormat) writeDelta(w http.ResponseWriter, index int, text string) {
+	shared.WriteSSEEvent(w, f.chunk(shared.ChatChunkChoice{Index: index, Delta: shared.ChatDelta{Content: text}}))
+}
+
+func (f *chatFormat) writeFinish(w http.ResponseWriter, index int, reason string) {
+	shared.WriteSSEEvent(w, f.chunk(shared.ChatChunkChoice{Index: index, FinishReason: &reason}))
+}
+
+func (f *chatFormat) endStream(w http.ResponseWriter, usage shared.CompletionUsage) {
+	if f.includeUsage {
+		last := f.chunk()
+		last.Choices = []shared.ChatChunkChoice{}
+		last.Usage = &usage
+		shared.WriteSSEEvent(w, last)
+	}
+	shared.WriteSSEDone(w)
+}
+
+func (f *chatFormat) writeStreamError(w http.ResponseWriter, err *shared.ProtocolError) {
+	shared.WriteSSEEvent(w, toOpenAIError(err))
+	shared.WriteSSEDone(w)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// chatRequest is a chat completion request for testModel, with extra
+// fields merged in
+func chatRequest(extra map[string]any) map[string]any {
+	req := map[string]any{
+		"model":    testModel,
+		"messages": []map[string]string{{"role": "user", "content": "Hi"}},
+	}
+	for k, v := range extra {
+		req[k] = v
+	}
+	return req
+}
+
+func TestChatCompletionsResponse(t *testing.T) {
+	p := newTestPool(t, reply("Hel", "lo"))
+	var resp shared.ChatCompletionResponse
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/chat/completions", p.client, chatRequest(nil), &resp); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	if resp.Object != "chat.completion" || !strings.HasPrefix(resp.ID, "chatcmpl-") || resp.Model != testModel {
+		t.Errorf("response %q %q for model %q", resp.Object, resp.ID, resp.Model)
+	}
+	if len(resp.Choices) != 1 {
+		t.Fatalf("%d choices, want 1", len(resp.Choices))
+	}
+	c := resp.Choices[0]
+	if c.Message.Role != "assistant" || c.Message.Content != "Hello" || c.FinishReason != "stop" {
+		t.Errorf("choice %+v", c)
+	}
+	if resp.Usage.PromptTokens != 5 || resp.Usage.CompletionTokens != 2 || resp.Usage.TotalTokens != 7 {
+		t.Errorf("usage %+v", resp.Usage)
+	}
+}
+
+func TestChatCompletionsRenderPromptAndStop(t *testing.T) {
+	handle, jobs := recordJobs(reply("ok"))
+	p := newTestPool(t, handle)
+	req := chatRequest(map[string]any{"stop": "END"})
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/chat/completions", p.client, req, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	work := <-jobs
+	if want := "<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"; work.Prompt != want {
+		t.Errorf("prompt %q, want %q", work.Prompt, want)
+	}
+	if strings.Join(work.Stop, ",") != "END,<|im_end|>" {
+		t.Errorf("stop %q, want the client's and the template's", work.Stop)
+	}
+}
+
+func TestChatCompletionsChoices(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	var resp shared.ChatCompletionResponse
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/chat/completions", p.client, chatRequest(map[string]any{"n": 3}), &resp); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if len(resp.Choices) != 3 || resp.Choices[2].Index != 2 {
+		t.Errorf("choices %+v, want 3 indexed in order", resp.Choices)
+	}
+	if resp.Usage.PromptTokens != 5 || resp.Usage.CompletionTokens != 3 {
+		t.Errorf("usage %+v, want the prompt counted once and completions summed", resp.Usage)
+	}
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	p := newTestPool(t, reply("Hel", "lo"))
+	req := chatRequest(map[string]any{"stream": true, "stream_options": map[string]bool{"include_usage": true}})
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/chat/completions", p.client, req)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := readSSE(t, body)
+	if last := events[len(events)-1].Data; last != "[DONE]" {
+		t.Fatalf("stream ends with %q, want [DONE]", last)
+	}
+	var chunks []shared.ChatCompletionChunk
+	for _, e := range events[:len(events)-1] {
+		var c shared.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(e.Data), &c); err != nil || c.Object != "chat.completion.chunk" {
+			t.Fatalf("event %q is not a chunk: %v", e.Data, err)
+		}
+		chunks = append(chunks, c)
+	}
+
+	if first := chunks[0].Choices[0].Delta; first.Role != "assistant" {
+		t.Errorf("first delta %+v, want the assistant role", first)
+	}
+	var text, finish string
+	for _, c := range chunks[:len(chunks)-1] {
+		text += c.Choices[0].Delta.Content
+		if r := c.Choices[0].FinishReason; r != nil {
+			finish = *r
+		}
+	}
+	if text != "Hello" || finish != "stop" {
+		t.Errorf("streamed %q finishing %q, want Hello finishing stop", text, finish)
+	}
+	if usage := chunks[len(chunks)-1]; len(usage.Choices) != 0 || usage.Usage == nil || usage.Usage.TotalTokens != 7 {
+		t.Errorf("last chunk %+v, want only the usage", usage)
+	}
+}
+
+func TestChatCompletionsOpenAIErrors(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	req := chatRequest(map[string]any{"messages": []map[string]string{{"role": "tool", "content": "x"}}})
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/chat/completions", p.client, req)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	var e openAIError
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	if e.Error.Type != "invalid_request_error" || e.Error.Code != "invalid_request" || !strings.Contains(e.Error.Message, "tool") {
+		t.Errorf("error %+v", e.Error)
+	}
+}
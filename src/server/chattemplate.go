@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// defaultChatTemplate is used for models without a chat_template
+const defaultChatTemplate = "chatml"
+
+// builtinChatTemplate is a named prompt format and the end-of-turn markers
+// that should stop generation if the model emits them as text
+type builtinChatTemplate struct {
+	source string
+	stop   []string
+}
+
+// builtinChatTemplates are the prompt formats of common model families.
+// Templates see .Messages (role, content) and render the prompt up to the
+// start of the assistant's reply.
+var builtinChatTemplates = map[string]builtinChatTemplate{
+	"chatml": {
+		source: `{{range .Messages}}<|im_start|>{{.Role}}
+{{.Content}}<|im_end|>
+{{end}}<|im_start|>assistant
+`,
+		stop: []string{"<|im_end|>"},
+	},
+	"llama3": {
+		source: `<|begin_of_text|>{{range .Messages}}<|start_header_id|>{{.Role}}<|end_header_id|>
+
+{{.Content}}<|eot_id|>{{end}}<|start_header_id|>assistant<|end_header_id|>
+
+`,
+		stop: []string{"<|eot_id|>"},
+	},
+	// Mistral has no system role; the system prompt is folded into the
+	// first user turn by foldSystem
+	"mistral": {
+		source: `<s>{{range .Messages}}{{if eq .Role "user"}}[INST] {{.Content}} [/INST]{{else}}{{.Content}}</s>{{end}}{{end}}`,
+		stop:   []string{"</s>"},
+	},
+	"gemma": {
+		source: `<bos>{{range .Messages}}<start_of_turn>{{if eq .Role "assistant"}}model{{else}}{{.Role}}{{end}}
+{{.Content}}<end_of_turn>
+{{end}}<start_of_turn>model
+`,
+		stop: []string{"<end_of_turn>"},
+	},
+	"phi3": {
+		source: `{{range .Messages}}<|{{.Role}}|>
+{{.Content}}<|end|>
+{{end}}<|assistant|>
+`,
+		stop: []string{"<|end|>"},
+	},
+}
+
+// foldsSystem lists templates whose models have no system role
+var foldsSystem = map[string]bool{"mistral": true, "gemma": true}
+
+// ChatTemplate renders chat messages into a model's prompt format
+type ChatTemplate struct {
+	name       string
+	tmpl       *template.Template
+	stop       []string
+	foldSystem bool
+}
+
+// chatTurn is a message as seen by templates
+type chatTurn struct {
+	Role    string
+	Content string
+}
+
+// ParseChatTemplate resolves a chat_template setting: a built-in name, a Go
+// text/template, or empty for the default
+func ParseChatTemplate(spec string) (*ChatTemplate, error) {
+	if spec == "" {
+		spec = defaultChatTemplate
+	}
+
+	name, source := "custom", spec
+	var stop []string
+	if builtin, ok := builtinChatTemplates[spec]; ok {
+		name, source, stop = spec, builtin.source, builtin.stop
+	} else if !strings.Contains(spec, "{{") {
+		return nil, fmt.Errorf("unknown chat template %q", spec)
+	}
+
+	tmpl, err := template.New(name).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("parsing chat template: %w", err)
+	}
+	return &ChatTemplate{name: name, tmpl: tmpl, stop: stop, foldSystem: foldsSystem[name]}, nil
+}
+
+// Render builds the prompt for a conversation
+func (t *ChatTemplate) Render(messages []shared.ChatMessage) (string, error) {
+	turns := make([]chatTurn, 0, len(messages))
+	var system []string
+	for _, m := range messages {
+		if t.foldSystem && m.Role == "system" {
+			system = append(system, string(m.Content))
+			continue
+		}
+		turns = append(turns, chatTurn{Role: m.Role, Content: string(m.Content)})
+	}
+	if len(system) > 0 {
+		for i := range turns {
+			if turns[i].Role == "user" {
+				turns[i].Content = strings.Join(system, "\n\n") + "\n\n" + turns[i].Content
+				break
+			}
+		}
+	}
+
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, struct{ Messages []chatTurn }{turns}); err != nil {
+		return "", fmt.Errorf("rendering chat template %s: %w", t.name, err)
+	}
+	return b.String(), nil
+}
+
+// Stop returns the template's end-of-turn markers
+func (t *ChatTemplate) Stop() []string {
+	return t.stop
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// testConversation is a system prompt and one user turn
+var testConversation = []shared.ChatMessage{
+	{Role: "system", Content: "Be brief."},
+	{Role: "user", Content: "Hi"},
+}
+
+// renderChat renders testConversation with the template spec
+func renderChat(t *testing.T, spec string) string {
+	t.Helper()
+	tmpl, err := ParseChatTemplate(spec)
+	if err != nil {
+		t.Fatalf("ParseChatTemplate(%q): %v", spec, err)
+	}
+	prompt, err := tmpl.Render(testConversation)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	return prompt
+}
+
+func TestChatTemplateDefaultIsChatML(t *testing.T) {
+	want := "<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"
+	if got := renderChat(t, ""); got != want {
+		t.Errorf("prompt %q, want %q", got, want)
+	}
+}
+
+func TestChatTemplateFoldsSystemIntoFirstUserTurn(t *testing.T) {
+	if got, want := renderChat(t, "mistral"), "<s>[INST] Be brief.\n\nHi [/INST]"; got != want {
+		t.Errorf("prompt %q, want %q", got, want)
+	}
+}
+
+func TestChatTemplateCustom(t *testing.T) {
+	spec := "{{range .Messages}}{{.Role}}: {{.Content}}\n{{end}}assistant:"
+	if got, want := renderChat(t, spec), "system: Be brief.\nuser: Hi\nassistant:"; got != want {
+		t.Errorf("prompt %q, want %q", got, want)
+	}
+}
+
+func TestChatTemplateStopMarkers(t *testing.T) {
+	tmpl, err := ParseChatTemplate("llama3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop := tmpl.Stop(); len(stop) != 1 || stop[0] != "<|eot_id|>" {
+		t.Errorf("stop markers %q, want <|eot_id|>", stop)
+	}
+}
+
+func TestParseChatTemplateUnknownName(t *testing.T) {
+	if _, err := ParseChatTemplate("vicuna"); err == nil {
+		t.Error("accepted an unknown template name")
+	}
+}
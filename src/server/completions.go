@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// defaultMaxTokens is used when a completion request does not set max_tokens
+const defaultMaxTokens = 256
+
+// HandleCompletions handles POST /v1/completions
+func (h *Handlers) HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	f := &legacyFormat{}
+	if r.Method != http.MethodPost {
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("only POST is allowed"))
+		return
+	}
+
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	req, err := shared.ParseJSON[shared.CompletionRequest](r)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	if req.Model == "" || req.Prompt == "" {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("model and prompt are required"))
+		return
+	}
+	if req.MaxTokens < 0 {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("max_tokens must not be negative"))
+		return
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = defaultMaxTokens
+	}
+	if err := validateSampling(req.SamplingParams); err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	f.id, f.model = "cmpl-"+uuid.New().String(), req.Model
+	req.Model = h.models.Resolve(req.Model)
+	if !key.AllowsModel(req.Model) {
+		h.writeFormatError(w, f, http.StatusForbidden, shared.ErrForbidden.WithDetails("model "+req.Model+" is not allowed for this key"))
+		return
+	}
+
+	h.serveCompletion(w, r, key, req, 1, f)
+}
+
+// serveCompletion runs a validated request as n independent jobs, one per
+// choice, and writes their output in the client's wire format
+func (h *Handlers) serveCompletion(w http.ResponseWriter, r *http.Request, key *APIKey, req *shared.CompletionRequest, n int, f apiFormat) {
+	if err := h.models.CheckKind(req.Model, shared.ModelKindGenerate); err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	priority, err := requestPriority(r)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	estimate := estimateTokens(req.Prompt, req.MaxTokens) * n
+	if !h.schedule(w, r, key, req.Model, shared.ModelKindGenerate, estimate, f) {
+		return
+	}
+
+	jobs := make([]*Job, n)
+	for i := range jobs {
+		id := f.responseID()
+		if n > 1 {
+			id = fmt.Sprintf("%s-%d", id, i)
+		}
+		job := NewJob(id, key.ID, *req)
+		job.Priority = priority
+		job.Cost = estimate / n
+		job.Weight = key.Weight
+		job.CorrelationID = requestIDFrom(r.Context())
+		job.Trace = shared.SpanContextFromContext(r.Context())
+		h.queue.Submit(job)
+		defer h.queue.Finish(job.ID)
+		jobs[i] = job
+	}
+
+	ctx, stop := withJobCancel(r.Context(), jobs)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, h.requestTimeout)
+	defer cancel()
+
+	// Completions outlive the server's default WriteTimeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(h.requestTimeout + 10*time.Second)); err != nil {
+		requestLogger(r).Warn("Error extending write deadline", "err", err)
+	}
+
+	var finals []*shared.ResultRequest
+	if req.Stream {
+		finals = h.streamCompletion(ctx, w, jobs, f)
+	} else {
+		finals = h.collectCompletion(ctx, w, jobs, f)
+	}
+	if r.Context().Err() != nil {
+		requestLogger(r).Info("Client disconnected, cancelling jobs", "id", f.responseID())
+	}
+	h.settleJobs(requestLogger(r), key, estimate, jobs, finals, errors.Is(ctx.Err(), context.DeadlineExceeded))
+}
+
+// priorityHeader lets clients of every API pick a priority class
+const priorityHeader = "X-Priority"
+
+// requestPriority returns the priority class a request asked for,
+// interactive by default
+func requestPriority(r *http.Request) (string, error) {
+	p := strings.ToLower(strings.TrimSpace(r.Header.Get(priorityHeader)))
+	if p == "" {
+		return PriorityInteractive, nil
+	}
+	if !validPriorities[p] {
+		return "", fmt.Errorf("%s must be %s or %s", priorityHeader, PriorityInteractive, PriorityBatch)
+	}
+	return p, nil
+}
+
+// HandleJob handles DELETE /v1/jobs/{id}
+// The ID is a response ID, cancelling every job of that request, or the ID
+// of a single job such as a batch request. Agents running the jobs are told
+// to stop.
+func (h *Handlers) HandleJob(w http.ResponseWriter, r *http.Request) {
+	f := &legacyFormat{}
+	if r.Method != http.MethodDelete {
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("only DELETE is allowed"))
+		return
+	}
+
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, shared.PathJobs+"/")
+	if id == "" || strings.Contains(id, "/") {
+		h.writeFormatError(w, f, http.StatusNotFound, shared.ErrInvalidRequest.WithDetails("unknown job path"))
+		return
+	}
+
+	n := h.queue.Cancel(key.ID, id)
+	if n == 0 {
+		h.writeFormatError(w, f, http.StatusNotFound, shared.ErrInvalidRequest.WithDetails("no running job "+id))
+		return
+	}
+
+	requestLogger(r).Info("Jobs cancelled by client", "id", id, "jobs", n, "key_id", key.ID)
+	shared.WriteJSON(w, http.StatusOK, shared.JobCancelResponse{ID: id, Cancelled: n})
+}
+
+// doneError is the error reported when a request's context ends before
+// its jobs finish: either its jobs were cancelled or it timed out
+func doneError(ctx context.Context, id string) (int, *shared.ProtocolError) {
+	if errors.Is(context.Cause(ctx), errJobCancelled) {
+		return http.StatusConflict, shared.ErrCancelled.WithDetails(id)
+	}
+	return http.StatusGatewayTimeout, shared.ErrTimeout.WithDetails(id)
+}
+
+// settleJobs settles a request's token estimate against what its jobs
+// actually used and writes each job to the usage ledger
+func (h *Handlers) settleJobs(log *slog.Logger, key *APIKey, estimate int, jobs []*Job, finals []*shared.ResultRequest, timedOut bool) {
+	used := 0
+	for _, final := range finals {
+		if final != nil && final.Error == nil {
+			used += usageOf(*final).TotalTokens
+		}
+	}
+	h.limiter.Adjust(key, used-estimate)
+	if used > 0 {
+		if err := h.db.AddTokenUsage(key.ID, used, time.Now()); err != nil {
+			log.Error("Error recording token usage", "key_id", key.ID, "err", err)
+		}
+	}
+
+	for i, job := range jobs {
+		h.recordUsage(job, finals[i], timedOut)
+	}
+}
+
+// schedule decides whether a request may be queued: the key must have quota
+// left, some online agent must serve the model as the given kind and the
+// key's rate limits must admit the estimated tokens. The estimate is
+// settled once the request's jobs finish.
+func (h *Handlers) schedule(w http.ResponseWriter, r *http.Request, key *APIKey, model, kind string, estimate int, f errorFormat) bool {
+	_, span := h.tracer.Start(r.Context(), "schedule")
+	defer span.End()
+	span.SetAttr("model", model)
+
+	if !h.checkQuota(w, r, key, f) {
+		span.SetAttr("decision", "quota_exhausted")
+		return false
+	}
+	h.demand.Record(model)
+
+	var minimum string
+	if h.updates != nil {
+		minimum, _ = h.updates.Versions()
+	}
+	capable, err := h.db.CountOnlineAgentsForModel(model, kind, minimum)
+	if err != nil {
+		requestLogger(r).Error("Error counting agents for model", "model", model, "err", err)
+		span.SetError(err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+		return false
+	}
+	span.SetAttr("capable_agents", capable)
+	if capable == 0 {
+		span.SetAttr("decision", "no_capable_agents")
+		h.writeFormatError(w, f, http.StatusServiceUnavailable, shared.ErrNoCapableAgents.WithDetails(model))
+		return false
+	}
+
+	decision := h.limiter.Allow(key, estimate)
+	setRateLimitHeaders(w, decision)
+	if !decision.Allowed {
+		span.SetAttr("decision", "rate_limited")
+		setRetryAfter(w, decision.RetryAfter)
+		h.writeFormatError(w, f, http.StatusTooManyRequests, shared.ErrRateLimited.WithDetails("per-minute rate limit exceeded"))
+		return false
+	}
+
+	span.SetAttr("decision", "queued")
+	span.SetAttr("estimated_tokens", estimate)
+	return true
+}
+
+// recordUsage writes a finished job to the usage ledger. A job without a
+// final result either timed out or was given up on with its request.
+func (h *Handlers) recordUsage(job *Job, final *shared.ResultRequest, timedOut bool) {
+	rec := UsageRecord{
+		JobID:     job.ID,
+		KeyID:     job.KeyID,
+		Model:     job.Request.Model,
+		AgentID:   h.queue.AgentOf(job),
+		WallTime:  time.Since(job.CreatedAt),
+		CreatedAt: time.Now(),
+	}
+
+	switch {
+	case final == nil && timedOut:
+		rec.Outcome = OutcomeTimeout
+	case final == nil:
+		rec.Outcome = OutcomeCancelled
+	case final.Error != nil:
+		rec.Outcome = OutcomeFailed
+	default:
+		rec.Outcome = OutcomeCompleted
+		usage := usageOf(*final)
+		rec.PromptTokens = usage.PromptTokens
+		rec.CompletionTokens = usage.CompletionTokens
+	}
+
+	if err := h.db.RecordUsage(rec); err != nil {
+		jobLogger(job).Error("Error recording usage", "err", err)
+	}
+
+	h.metrics.JobLatency.ObserveDuration(rec.WallTime, rec.Model, rec.Outcome)
+	if rec.CompletionTokens > 0 {
+		h.metrics.TokensGenerated.Add(float64(rec.CompletionTokens), rec.Model)
+	}
+}
+
+// checkQuota rejects the request if the key has used up its daily or
+// monthly token quota
+func (h *Handlers) checkQuota(w http.ResponseWriter, r *http.Request, key *APIKey, f errorFormat) bool {
+	exhausted, reset, err := h.exhaustedQuota(key, time.Now())
+	if err != nil {
+		requestLogger(r).Error("Error reading token usage", "key_id", key.ID, "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+		return false
+	}
+	if exhausted != "" {
+		setRetryAfter(w, reset)
+		h.writeFormatError(w, f, http.StatusTooManyRequests, shared.ErrRateLimited.WithDetails(exhausted+" token quota exhausted"))
+		return false
+	}
+	return true
+}
+
+// exhaustedQuota returns "daily" or "monthly" if the key has used up that
+// token quota, with the time until it resets, or "" if it has quota left
+func (h *Handlers) exhaustedQuota(key *APIKey, now time.Time) (string, time.Duration, error) {
+	limits := h.limiter.LimitsFor(key)
+	if limits.DailyTokens == 0 && limits.MonthlyTokens == 0 {
+		return "", 0, nil
+	}
+
+	daily, monthly, err := h.db.GetTokenUsage(key.ID, now)
+	if err != nil {
+		return "", 0, err
+	}
+	if limits.MonthlyTokens > 0 && monthly >= limits.MonthlyTokens {
+		return "monthly", untilNextMonth(now), nil
+	}
+	if limits.DailyTokens > 0 && daily >= limits.DailyTokens {
+		return "daily", untilNextDay(now), nil
+	}
+	return "", 0, nil
+}
+
+// requireClient authorizes a client request and writes an error in the
+// client's format on failure
+func (h *Handlers) requireClient(w http.ResponseWriter, r *http.Request, f errorFormat) (*APIKey, bool) {
+	key, err := h.authorize(r, ScopeClientComplete)
+	switch {
+	case err == nil:
+		return key, true
+	case errors.Is(err, errMissingKey), errors.Is(err, errInvalidKey):
+		h.writeFormatError(w, f, http.StatusUnauthorized, shared.ErrUnauthorized)
+	case errors.Is(err, errForbidden):
+		h.writeFormatError(w, f, http.StatusForbidden, shared.ErrForbidden.WithDetails("missing scope "+ScopeClientComplete))
+	default:
+		requestLogger(r).Error("Error authenticating client", "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer)
+	}
+	return nil, false
+}
+
+// jobResult is a result post tagged with the choice its job produces
+type jobResult struct {
+	index int
+	res   shared.ResultRequest
+}
+
+// mergeResults fans the result posts of several jobs into one channel.
+// Forwarding stops once a job finishes or fails, or ctx is done.
+func mergeResults(ctx context.Context, jobs []*Job) <-chan jobResult {
+	merged := make(chan jobResult)
+	for i, job := range jobs {
+		go func(i int, job *Job) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case res := <-job.Results():
+					select {
+					case merged <- jobResult{i, res}:
+					case <-ctx.Done():
+						return
+					}
+					if res.Finished || res.Error != nil {
+						return
+					}
+				}
+			}
+		}(i, job)
+	}
+	return merged
+}
+
+// collectCompletion waits for every job and writes a single response.
+// It returns each job's final result post, nil where a job never finished.
+func (h *Handlers) collectCompletion(ctx context.Context, w http.ResponseWriter, jobs []*Job, f apiFormat) []*shared.ResultRequest {
+	finals := make([]*shared.ResultRequest, len(jobs))
+	texts := make([]strings.Builder, len(jobs))
+	results := mergeResults(ctx, jobs)
+	for remaining := len(jobs); remaining > 0; {
+		select {
+		case <-ctx.Done():
+			status, perr := doneError(ctx, f.responseID())
+			h.writeFormatError(w, f, status, perr)
+			return finals
+
+		case jr := <-results:
+			job, res := jobs[jr.index], jr.res
+			if res.Error != nil {
+				jobLogger(job).Warn("Job failed on agent", "agent_id", h.queue.AgentOf(job), "error", *res.Error)
+				h.writeFormatError(w, f, http.StatusBadGateway, shared.ErrInternalServer.WithDetails(*res.Error))
+				finals[jr.index] = &res
+				return finals
+			}
+			h.observeFirstToken(job, res)
+			for _, tok := range res.Tokens {
+				texts[jr.index].WriteString(tok)
+			}
+			if res.Finished {
+				finals[jr.index] = &res
+				remaining--
+			}
+		}
+	}
+
+	choices := make([]completedChoice, len(jobs))
+	for i := range choices {
+		choices[i] = completedChoice{Text: texts[i].String(), FinishReason: finishReason(*finals[i])}
+	}
+	f.writeResponse(w, choices, mergeUsage(finals))
+	return finals
+}
+
+// streamCompletion relays result posts to the client as SSE events.
+// Headers are only sent with the first tokens so that a request that never
+// starts can still be reported with a proper status code.
+// It returns each job's final result post, nil where a job never finished.
+func (h *Handlers) streamCompletion(ctx context.Context, w http.ResponseWriter, jobs []*Job, f apiFormat) []*shared.ResultRequest {
+	finals := make([]*shared.ResultRequest, len(jobs))
+	started := false
+	start := func() {
+		if !started {
+			shared.SetSSEHeaders(w)
+			w.WriteHeader(http.StatusOK)
+			f.startStream(w, len(jobs))
+			started = true
+		}
+	}
+	fail := func(status int, perr *shared.ProtocolError) {
+		if !started {
+			h.writeFormatError(w, f, status, perr)
+			return
+		}
+		h.metrics.ProtocolErrors.Inc(perr.Code)
+		f.writeStreamError(w, perr)
+	}
+
+	results := mergeResults(ctx, jobs)
+	for remaining := len(jobs); remaining > 0; {
+		select {
+		case <-ctx.Done():
+			fail(doneError(ctx, f.responseID()))
+			return finals
+
+		case jr := <-results:
+			job, res := jobs[jr.index], jr.res
+			if res.Error != nil {
+				jobLogger(job).Warn("Job failed on agent", "agent_id", h.queue.AgentOf(job), "error", *res.Error)
+				fail(http.StatusBadGateway, shared.ErrInternalServer.WithDetails(*res.Error))
+				finals[jr.index] = &res
+				return finals
+			}
+
+			h.observeFirstToken(job, res)
+			if len(res.Tokens) > 0 {
+				start()
+				f.writeDelta(w, jr.index, strings.Join(res.Tokens, ""))
+			}
+			if res.Finished {
+				start()
+				f.writeFinish(w, jr.index, finishReason(res))
+				finals[jr.index] = &res
+				remaining--
+			}
+		}
+	}
+
+	f.endStream(w, mergeUsage(finals))
+	return finals
+}
+
+// Limits on list-valued sampling parameters, as in the OpenAI API
+const (
+	maxStopSequences = 4
+	maxLogitBias     = 300
+)
+
+// validateSampling checks sampling parameters against the ranges the
+// OpenAI API and llama.cpp accept
+func validateSampling(p shared.SamplingParams) error {
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if p.TopP != nil && (*p.TopP < 0 || *p.TopP > 1) {
+		return fmt.Errorf("top_p must be between 0 and 1")
+	}
+	if p.TopK != nil && *p.TopK < 0 {
+		return fmt.Errorf("top_k must not be negative")
+	}
+	if p.MinP != nil && (*p.MinP < 0 || *p.MinP > 1) {
+		return fmt.Errorf("min_p must be between 0 and 1")
+	}
+	if p.RepeatPenalty != nil && *p.RepeatPenalty <= 0 {
+		return fmt.Errorf("repeat_penalty must be positive")
+	}
+	if p.Grammar != "" && len(p.JSONSchema) > 0 {
+		return fmt.Errorf("grammar and json_schema are mutually exclusive")
+	}
+	if len(p.JSONSchema) > 0 {
+		var schema map[string]any
+		if err := json.Unmarshal(p.JSONSchema, &schema); err != nil {
+			return fmt.Errorf("json_schema must be a JSON object")
+		}
+	}
+	if len(p.LogitBias) > maxLogitBias {
+		return fmt.Errorf("at most %d logit_bias entries are allowed", maxLogitBias)
+	}
+	for token, bias := range p.LogitBias {
+		if _, err := strconv.Atoi(token); err != nil {
+			return fmt.Errorf("logit_bias keys must be token IDs, got %q", token)
+		}
+		if bias < -100 || bias > 100 {
+			return fmt.Errorf("logit_bias values must be between -100 and 100")
+		}
+	}
+	if len(p.Stop) > maxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are allowed", maxStopSequences)
+	}
+	for _, stop := range p.Stop {
+		if stop == "" {
+			return fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+	return nil
+}
+
+// finishReason returns the agent-reported finish reason, defaulting to "stop"
+func finishReason(res shared.ResultRequest) string {
+	if res.FinishReason != "" {
+		return res.FinishReason
+	}
+	return "stop"
+}
+
+// mergeUsage reports the usage of several choices generated for the same
+// prompt: the prompt is counted once, completions are summed
+func mergeUsage(finals []*shared.ResultRequest) shared.CompletionUsage {
+	var total shared.CompletionUsage
+	for _, final := range finals {
+		if final == nil {
+			continue
+		}
+		u := usageOf(*final)
+		total.PromptTokens = max(total.PromptTokens, u.PromptTokens)
+		total.CompletionTokens += u.CompletionTokens
+	}
+	total.TotalTokens = total.PromptTokens + total.CompletionTokens
+	return total
+}
+
+// usageOf returns the agent-reported usage with the total filled in
+func usageOf(res shared.ResultRequest) shared.CompletionUsage {
+	if res.Usage == nil {
+		return shared.CompletionUsage{}
+	}
+	u := *res.Usage
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// observeFirstToken records time-to-first-token when a job first produces output
+func (h *Handlers) observeFirstToken(job *Job, res shared.ResultRequest) {
+	if len(res.Tokens) == 0 {
+		return
+	}
+	if ttft, first := h.queue.FirstToken(job); first {
+		h.metrics.TimeToFirstToken.ObserveDuration(ttft, job.Request.Model)
+	}
+}
+
+// writeFormatError writes an error in the client's wire format
+func (h *Handlers) writeFormatError(w http.ResponseWriter, f errorFormat, status int, err *shared.ProtocolError) {
+	h.metrics.ProtocolErrors.Inc(err.Code)
+	f.writeError(w, status, err)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+func TestValidateSamplingTemperatureRange(t *testing.T) {
+	temp := 2.5
+	if err := validateSampling(shared.SamplingParams{Temperature: &temp}); err == nil {
+		t.Error("accepted temperature 2.5")
+	}
+}
+
+func TestValidateSamplingGrammarExcludesSchema(t *testing.T) {
+	p := shared.SamplingParams{Grammar: `root ::= "a"`, JSONSchema: json.RawMessage(`{"type":"object"}`)}
+	if err := validateSampling(p); err == nil {
+		t.Error("accepted both grammar and json_schema")
+	}
+}
+
+func TestValidateSamplingLogitBiasKeys(t *testing.T) {
+	if err := validateSampling(shared.SamplingParams{LogitBias: map[string]float64{"hello": 5}}); err == nil {
+		t.Error("accepted a logit_bias key that isn't a token ID")
+	}
+}
+
+func TestCompletionsInvalidSampling(t *testing.T) {
+	p := newTestPool(t, reply("hi"))
+	req := map[string]any{"model": testModel, "prompt": "Hello", "top_p": 1.5}
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/completions", p.client, req)
+	if resp.StatusCode != http.StatusBadRequest || errorCode(t, body) != shared.ErrInvalidRequest.Code {
+		t.Errorf("status %d, body %s; want 400 INVALID_REQUEST", resp.StatusCode, body)
+	}
+}
+
+func TestCompletionsForwardSampling(t *testing.T) {
+	handle, jobs := recordJobs(reply("hi"))
+	p := newTestPool(t, handle)
+	req := map[string]any{
+		"model": testModel, "prompt": "Hello",
+		"temperature": 0.2, "top_k": 40, "seed": 7, "stop": "END",
+		"logit_bias": map[string]float64{"42": -100},
+	}
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/completions", p.client, req, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	work := <-jobs
+	if work.Temperature == nil || *work.Temperature != 0.2 || work.TopK == nil || *work.TopK != 40 || work.Seed == nil || *work.Seed != 7 {
+		t.Errorf("sampling params not forwarded: %+v", work.SamplingParams)
+	}
+	if len(work.Stop) != 1 || work.Stop[0] != "END" || work.LogitBias["42"] != -100 {
+		t.Errorf("stop %q, logit_bias %v", work.Stop, work.LogitBias)
+	}
+}
+
+func TestCompletionsFinishReasonLength(t *testing.T) {
+	p := newTestPool(t, func(work shared.WorkResponse) shared.ResultRequest {
+		res := reply("cut")(work)
+		res.FinishReason = "length"
+		return res
+	})
+	var resp shared.CompletionResponse
+	req := shared.CompletionRequest{Model: testModel, Prompt: "Hello"}
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/completions", p.client, req, &resp); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].FinishReason != "length" {
+		t.Errorf("choices %+v, want finish_reason length", resp.Choices)
+	}
+}
+
+func TestChatResponseFormatJSONObject(t *testing.T) {
+	handle, jobs := recordJobs(reply("{}"))
+	p := newTestPool(t, handle)
+	req := chatRequest(map[string]any{"response_format": map[string]string{"type": "json_object"}})
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/chat/completions", p.client, req, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if work := <-jobs; string(work.JSONSchema) != `{"type":"object"}` {
+		t.Errorf("json_schema %s, want any object", work.JSONSchema)
+	}
+}
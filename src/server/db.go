@@ -2,11 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
 )
 
 // DB wraps the SQLite database connection
@@ -59,6 +62,69 @@ func migrate(db *sql.DB) error {
 			FOREIGN KEY (agent_id) REFERENCES agents(agent_id) ON DELETE CASCADE
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_agent_models_model ON agent_models(model_name)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			key_id          TEXT PRIMARY KEY,
+			key_hash        TEXT NOT NULL UNIQUE,
+			name            TEXT,
+			scopes          TEXT NOT NULL DEFAULT '[]',
+			models          TEXT NOT NULL DEFAULT '[]',
+			agent_id        TEXT,
+			expires_at      INTEGER,
+			revoked_at      INTEGER,
+			created_at      INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_agent ON api_keys(agent_id)`,
+		`CREATE TABLE IF NOT EXISTS enrollment_tokens (
+			token_id        TEXT PRIMARY KEY,
+			token_hash      TEXT NOT NULL UNIQUE,
+			name            TEXT,
+			uses_remaining  INTEGER NOT NULL DEFAULT 1,
+			expires_at      INTEGER,
+			created_at      INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS usage (
+			id                INTEGER PRIMARY KEY AUTOINCREMENT,
+			job_id            TEXT NOT NULL,
+			key_id            TEXT NOT NULL,
+			model             TEXT NOT NULL,
+			agent_id          TEXT,
+			prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+			completion_tokens INTEGER NOT NULL DEFAULT 0,
+			wall_ms           INTEGER NOT NULL DEFAULT 0,
+			outcome           TEXT NOT NULL,
+			created_at        INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_usage_created ON usage(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_usage_key ON usage(key_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_usage_agent ON usage(agent_id)`,
+		`CREATE TABLE IF NOT EXISTS token_usage (
+			key_id          TEXT NOT NULL,
+			period          TEXT NOT NULL,
+			tokens          INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (key_id, period)
+		)`,
+		`CREATE TABLE IF NOT EXISTS batches (
+			batch_id        TEXT PRIMARY KEY,
+			key_id          TEXT NOT NULL,
+			status          TEXT NOT NULL,
+			total           INTEGER NOT NULL,
+			completed       INTEGER NOT NULL DEFAULT 0,
+			failed          INTEGER NOT NULL DEFAULT 0,
+			created_at      INTEGER NOT NULL,
+			finished_at     INTEGER,
+			cancelled_at    INTEGER
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_batches_key ON batches(key_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_batches_status ON batches(status)`,
+		`CREATE TABLE IF NOT EXISTS batch_items (
+			batch_id        TEXT NOT NULL,
+			idx             INTEGER NOT NULL,
+			request         TEXT NOT NULL,
+			status          TEXT NOT NULL DEFAULT 'pending',
+			response        TEXT,
+			error           TEXT,
+			PRIMARY KEY (batch_id, idx)
+		)`,
 	}
 
 	for _, m := range migrations {
@@ -67,21 +133,71 @@ func migrate(db *sql.DB) error {
 		}
 	}
 
-	log.Println("Database migrations completed")
+	// Columns added to tables after they were first created
+	columns := []struct{ table, column, decl string }{
+		{"api_keys", "rpm_limit", "INTEGER NOT NULL DEFAULT 0"},
+		{"api_keys", "tpm_limit", "INTEGER NOT NULL DEFAULT 0"},
+		{"api_keys", "daily_token_quota", "INTEGER NOT NULL DEFAULT 0"},
+		{"api_keys", "monthly_token_quota", "INTEGER NOT NULL DEFAULT 0"},
+		{"agent_models", "kind", "TEXT NOT NULL DEFAULT 'generate'"},
+		{"api_keys", "weight", "REAL NOT NULL DEFAULT 1"},
+		{"agents", "heartbeat_interval", "INTEGER NOT NULL DEFAULT 0"},
+		{"agents", "paused_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"agents", "version", "TEXT NOT NULL DEFAULT ''"},
+		{"agents", "wake_deadline", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, c := range columns {
+		if err := addColumn(db, c.table, c.column, c.decl); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	slog.Info("Database migrations completed")
 	return nil
 }
 
+// addColumn adds a column to a table unless it already exists
+func addColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return fmt.Errorf("table info: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("scan table info: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
 // Agent represents a registered GPU agent
 type Agent struct {
-	ID            string
-	APIKeyHash    string
-	Name          string
-	Status        string
-	LastHeartbeat time.Time
-	Capabilities  string
-	CurrentLoad   int
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	ID                string
+	APIKeyHash        string
+	Name              string
+	Status            string
+	LastHeartbeat     time.Time
+	HeartbeatInterval time.Duration // last interval the agent was given; 0 if never recorded
+	PausedReason      string        // why a paused agent's contribution policy stopped it taking work
+	Version           string        // agent binary version it registered with
+	Capabilities      string
+	CurrentLoad       int
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
 }
 
 // AgentModel represents a model an agent can serve
@@ -90,29 +206,58 @@ type AgentModel struct {
 	ModelName    string
 	Quantization string
 	MaxContext   int
+	Kind         string // shared.ModelKindGenerate or shared.ModelKindEmbed
+}
+
+// execer runs statements on the database or within a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
 }
 
 // RegisterAgent inserts or updates an agent in the database
 func (db *DB) RegisterAgent(agent *Agent, models []AgentModel) error {
+	return db.EnrollAgent("", nil, agent, models)
+}
+
+// EnrollAgent registers an agent together with what it enrolled with, in
+// one transaction: a use of the enrollment token with hash tokenHash unless
+// it is empty, and the key issued to the agent unless nil. A registration
+// that fails leaves the token unused. It returns errNotFound if the token
+// is unknown, expired or exhausted.
+func (db *DB) EnrollAgent(tokenHash string, key *APIKey, agent *Agent, models []AgentModel) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
+	if tokenHash != "" {
+		if err := consumeEnrollmentToken(tx, tokenHash); err != nil {
+			return err
+		}
+	}
+	if key != nil {
+		if err := createAPIKey(tx, key); err != nil {
+			return err
+		}
+	}
+
 	now := time.Now().Unix()
 
 	// Upsert agent
 	_, err = tx.Exec(`
-		INSERT INTO agents (agent_id, api_key_hash, name, status, last_heartbeat, capabilities, current_load, created_at, updated_at)
-		VALUES (?, ?, ?, 'online', ?, ?, 0, ?, ?)
+		INSERT INTO agents (agent_id, api_key_hash, name, version, status, last_heartbeat, heartbeat_interval, capabilities, current_load, created_at, updated_at)
+		VALUES (?, ?, ?, ?, 'online', ?, ?, ?, 0, ?, ?)
 		ON CONFLICT(agent_id) DO UPDATE SET
 			name = excluded.name,
+			version = excluded.version,
 			status = 'online',
+			paused_reason = '',
 			last_heartbeat = excluded.last_heartbeat,
+			heartbeat_interval = excluded.heartbeat_interval,
 			capabilities = excluded.capabilities,
 			updated_at = excluded.updated_at
-	`, agent.ID, agent.APIKeyHash, agent.Name, now, agent.Capabilities, now, now)
+	`, agent.ID, agent.APIKeyHash, agent.Name, agent.Version, now, int64(agent.HeartbeatInterval.Seconds()), agent.Capabilities, now, now)
 	if err != nil {
 		return fmt.Errorf("upsert agent: %w", err)
 	}
@@ -126,9 +271,9 @@ func (db *DB) RegisterAgent(agent *Agent, models []AgentModel) error {
 	// Insert new models
 	for _, m := range models {
 		_, err = tx.Exec(`
-			INSERT INTO agent_models (agent_id, model_name, quantization, max_context)
-			VALUES (?, ?, ?, ?)
-		`, agent.ID, m.ModelName, m.Quantization, m.MaxContext)
+			INSERT INTO agent_models (agent_id, model_name, quantization, max_context, kind)
+			VALUES (?, ?, ?, ?, ?)
+		`, agent.ID, m.ModelName, m.Quantization, m.MaxContext, m.Kind)
 		if err != nil {
 			return fmt.Errorf("insert model: %w", err)
 		}
@@ -141,14 +286,22 @@ func (db *DB) RegisterAgent(agent *Agent, models []AgentModel) error {
 	return nil
 }
 
-// UpdateHeartbeat updates the agent's last heartbeat time and status
-func (db *DB) UpdateHeartbeat(agentID string, capabilities string) error {
+// UpdateHeartbeat updates the agent's last heartbeat time, status ("online",
+// "paused" with a reason when its contribution policy stops it taking work,
+// or "suspended" when its host is going to sleep) and the interval it was
+// given until the next one. wakeBy is when a suspended agent is due back;
+// it is ignored for other statuses.
+func (db *DB) UpdateHeartbeat(agentID, status, pausedReason, capabilities string, interval time.Duration, wakeBy time.Time) error {
 	now := time.Now().Unix()
+	var wakeDeadline int64
+	if status == "suspended" {
+		wakeDeadline = wakeBy.Unix()
+	}
 	result, err := db.Exec(`
 		UPDATE agents
-		SET last_heartbeat = ?, capabilities = ?, status = 'online', updated_at = ?
+		SET last_heartbeat = ?, heartbeat_interval = ?, capabilities = ?, status = ?, paused_reason = ?, wake_deadline = ?, updated_at = ?
 		WHERE agent_id = ?
-	`, now, capabilities, now, agentID)
+	`, now, int64(interval.Seconds()), capabilities, status, pausedReason, wakeDeadline, now, agentID)
 	if err != nil {
 		return fmt.Errorf("update heartbeat: %w", err)
 	}
@@ -164,25 +317,67 @@ func (db *DB) UpdateHeartbeat(agentID string, capabilities string) error {
 	return nil
 }
 
-// MarkStaleAgentsOffline marks agents as offline if they haven't sent a heartbeat recently
-func (db *DB) MarkStaleAgentsOffline(timeout time.Duration) (int64, error) {
-	cutoff := time.Now().Add(-timeout).Unix()
-	result, err := db.Exec(`
+// MarkStaleAgentsOffline marks agents as offline once they have missed
+// shared.MaxMissedHeartbeats of their heartbeat intervals. Agents without a
+// recorded interval get fallback instead. Paused agents still heartbeat
+// and go stale like online ones. Suspended agents said goodbye, so the same
+// grace only starts at their wake deadline; one whose host never comes
+// back still goes offline in the end. It returns the IDs of the agents
+// marked offline.
+func (db *DB) MarkStaleAgentsOffline(fallback time.Duration) ([]string, error) {
+	now := time.Now().Unix()
+	rows, err := db.Query(`
 		UPDATE agents
 		SET status = 'offline', updated_at = ?
-		WHERE status = 'online' AND last_heartbeat < ?
-	`, time.Now().Unix(), cutoff)
+		WHERE CASE status
+				WHEN 'suspended' THEN MAX(last_heartbeat, wake_deadline)
+				WHEN 'online' THEN last_heartbeat
+				WHEN 'paused' THEN last_heartbeat
+			END < ? - CASE WHEN heartbeat_interval > 0 THEN heartbeat_interval * ? ELSE ? END
+		RETURNING agent_id
+	`, now, now, shared.MaxMissedHeartbeats, int64(fallback.Seconds()))
 	if err != nil {
-		return 0, fmt.Errorf("mark stale agents: %w", err)
+		return nil, fmt.Errorf("mark stale agents: %w", err)
 	}
+	defer rows.Close()
 
-	return result.RowsAffected()
+	var agentIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan agent ID: %w", err)
+		}
+		agentIDs = append(agentIDs, id)
+	}
+	return agentIDs, rows.Err()
+}
+
+// GetAgent looks up an agent by ID, returning errNotFound if there is none
+func (db *DB) GetAgent(agentID string) (*Agent, error) {
+	var a Agent
+	var lastHB, interval, createdAt, updatedAt int64
+	err := db.QueryRow(`
+		SELECT agent_id, api_key_hash, name, version, status, paused_reason, last_heartbeat, heartbeat_interval, capabilities, current_load, created_at, updated_at
+		FROM agents
+		WHERE agent_id = ?
+	`, agentID).Scan(&a.ID, &a.APIKeyHash, &a.Name, &a.Version, &a.Status, &a.PausedReason, &lastHB, &interval, &a.Capabilities, &a.CurrentLoad, &createdAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get agent: %w", err)
+	}
+	a.LastHeartbeat = time.Unix(lastHB, 0)
+	a.HeartbeatInterval = time.Duration(interval) * time.Second
+	a.CreatedAt = time.Unix(createdAt, 0)
+	a.UpdatedAt = time.Unix(updatedAt, 0)
+	return &a, nil
 }
 
 // GetAllAgents returns all agents for the admin endpoint
 func (db *DB) GetAllAgents() ([]Agent, error) {
 	rows, err := db.Query(`
-		SELECT agent_id, api_key_hash, name, status, last_heartbeat, capabilities, current_load, created_at, updated_at
+		SELECT agent_id, api_key_hash, name, version, status, paused_reason, last_heartbeat, heartbeat_interval, capabilities, current_load, created_at, updated_at
 		FROM agents
 		ORDER BY status DESC, last_heartbeat DESC
 	`)
@@ -194,12 +389,13 @@ func (db *DB) GetAllAgents() ([]Agent, error) {
 	var agents []Agent
 	for rows.Next() {
 		var a Agent
-		var lastHB, createdAt, updatedAt int64
-		err := rows.Scan(&a.ID, &a.APIKeyHash, &a.Name, &a.Status, &lastHB, &a.Capabilities, &a.CurrentLoad, &createdAt, &updatedAt)
+		var lastHB, interval, createdAt, updatedAt int64
+		err := rows.Scan(&a.ID, &a.APIKeyHash, &a.Name, &a.Version, &a.Status, &a.PausedReason, &lastHB, &interval, &a.Capabilities, &a.CurrentLoad, &createdAt, &updatedAt)
 		if err != nil {
 			return nil, fmt.Errorf("scan agent: %w", err)
 		}
 		a.LastHeartbeat = time.Unix(lastHB, 0)
+		a.HeartbeatInterval = time.Duration(interval) * time.Second
 		a.CreatedAt = time.Unix(createdAt, 0)
 		a.UpdatedAt = time.Unix(updatedAt, 0)
 		agents = append(agents, a)
@@ -211,7 +407,7 @@ func (db *DB) GetAllAgents() ([]Agent, error) {
 // GetOnlineAgents returns only online agents
 func (db *DB) GetOnlineAgents() ([]Agent, error) {
 	rows, err := db.Query(`
-		SELECT agent_id, api_key_hash, name, status, last_heartbeat, capabilities, current_load, created_at, updated_at
+		SELECT agent_id, api_key_hash, name, version, status, paused_reason, last_heartbeat, heartbeat_interval, capabilities, current_load, created_at, updated_at
 		FROM agents
 		WHERE status = 'online'
 		ORDER BY current_load ASC
@@ -224,12 +420,13 @@ func (db *DB) GetOnlineAgents() ([]Agent, error) {
 	var agents []Agent
 	for rows.Next() {
 		var a Agent
-		var lastHB, createdAt, updatedAt int64
-		err := rows.Scan(&a.ID, &a.APIKeyHash, &a.Name, &a.Status, &lastHB, &a.Capabilities, &a.CurrentLoad, &createdAt, &updatedAt)
+		var lastHB, interval, createdAt, updatedAt int64
+		err := rows.Scan(&a.ID, &a.APIKeyHash, &a.Name, &a.Version, &a.Status, &a.PausedReason, &lastHB, &interval, &a.Capabilities, &a.CurrentLoad, &createdAt, &updatedAt)
 		if err != nil {
 			return nil, fmt.Errorf("scan agent: %w", err)
 		}
 		a.LastHeartbeat = time.Unix(lastHB, 0)
+		a.HeartbeatInterval = time.Duration(interval) * time.Second
 		a.CreatedAt = time.Unix(createdAt, 0)
 		a.UpdatedAt = time.Unix(updatedAt, 0)
 		agents = append(agents, a)
@@ -241,7 +438,7 @@ func (db *DB) GetOnlineAgents() ([]Agent, error) {
 // GetAgentModels returns all models for an agent
 func (db *DB) GetAgentModels(agentID string) ([]AgentModel, error) {
 	rows, err := db.Query(`
-		SELECT agent_id, model_name, quantization, max_context
+		SELECT agent_id, model_name, quantization, max_context, kind
 		FROM agent_models
 		WHERE agent_id = ?
 	`, agentID)
@@ -253,7 +450,7 @@ func (db *DB) GetAgentModels(agentID string) ([]AgentModel, error) {
 	var models []AgentModel
 	for rows.Next() {
 		var m AgentModel
-		err := rows.Scan(&m.AgentID, &m.ModelName, &m.Quantization, &m.MaxContext)
+		err := rows.Scan(&m.AgentID, &m.ModelName, &m.Quantization, &m.MaxContext, &m.Kind)
 		if err != nil {
 			return nil, fmt.Errorf("scan model: %w", err)
 		}
@@ -263,6 +460,34 @@ func (db *DB) GetAgentModels(agentID string) ([]AgentModel, error) {
 	return models, rows.Err()
 }
 
+// CountOnlineAgentsForModel returns how many online agents serve a model
+// of the given kind. Agents below minimumVersion are refused work, so they
+// are not counted; an empty minimum counts every agent.
+func (db *DB) CountOnlineAgentsForModel(model, kind, minimumVersion string) (int, error) {
+	rows, err := db.Query(`
+		SELECT a.version
+		FROM agents a
+		JOIN agent_models m ON m.agent_id = a.agent_id
+		WHERE a.status = 'online' AND m.model_name = ? AND m.kind = ?
+	`, model, kind)
+	if err != nil {
+		return 0, fmt.Errorf("count agents for model: %w", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return 0, fmt.Errorf("scan agent version: %w", err)
+		}
+		if !shared.BelowMinimum(version, minimumVersion) {
+			count++
+		}
+	}
+	return count, rows.Err()
+}
+
 // AgentExists checks if an agent exists by ID
 func (db *DB) AgentExists(agentID string) (bool, error) {
 	var count int
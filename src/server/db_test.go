@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a fresh database in a temporary directory
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMarkStaleAgentsOffline(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+
+	// Each agent last heartbeat ago with the given interval; suspended ones
+	// are due back at wake, relative to now
+	agents := []struct {
+		id       string
+		status   string
+		ago      time.Duration
+		interval time.Duration
+		wake     time.Duration
+		stale    bool
+	}{
+		{"online-fresh", "online", time.Minute, 30 * time.Second, 0, false},
+		{"online-stale", "online", 100 * time.Second, 30 * time.Second, 0, true},
+		{"paused-stale", "paused", 100 * time.Second, 30 * time.Second, 0, true},
+		{"no-interval-fresh", "online", time.Minute, 0, 0, false},
+		{"no-interval-stale", "online", 3 * time.Minute, 0, 0, true},
+		{"asleep", "suspended", 2 * time.Hour, 30 * time.Second, time.Hour, false},
+		{"overslept-in-grace", "suspended", 2 * time.Hour, 30 * time.Second, -time.Minute, false},
+		{"never-woke", "suspended", 2 * time.Hour, 30 * time.Second, -100 * time.Second, true},
+		{"already-offline", "offline", 24 * time.Hour, 30 * time.Second, 0, false},
+	}
+	for _, a := range agents {
+		if err := db.RegisterAgent(&Agent{ID: a.id, APIKeyHash: "hash-" + a.id, Status: "online", Capabilities: "{}"}, nil); err != nil {
+			t.Fatalf("RegisterAgent %s: %v", a.id, err)
+		}
+		if err := db.UpdateHeartbeat(a.id, a.status, "", "{}", a.interval, now.Add(a.wake)); err != nil {
+			t.Fatalf("UpdateHeartbeat %s: %v", a.id, err)
+		}
+		if _, err := db.Exec(`UPDATE agents SET last_heartbeat = ? WHERE agent_id = ?`, now.Add(-a.ago).Unix(), a.id); err != nil {
+			t.Fatalf("backdating %s: %v", a.id, err)
+		}
+	}
+
+	ids, err := db.MarkStaleAgentsOffline(90 * time.Second)
+	if err != nil {
+		t.Fatalf("MarkStaleAgentsOffline: %v", err)
+	}
+	sort.Strings(ids)
+	var want []string
+	for _, a := range agents {
+		if a.stale {
+			want = append(want, a.id)
+		}
+	}
+	sort.Strings(want)
+	if len(ids) != len(want) {
+		t.Fatalf("marked %v offline, want %v", ids, want)
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			t.Fatalf("marked %v offline, want %v", ids, want)
+		}
+	}
+
+	for _, a := range agents {
+		agent, err := db.GetAgent(a.id)
+		if err != nil {
+			t.Fatalf("GetAgent %s: %v", a.id, err)
+		}
+		wantStatus := a.status
+		if a.stale {
+			wantStatus = "offline"
+		}
+		if agent.Status != wantStatus {
+			t.Errorf("%s is %s, want %s", a.id, agent.Status, wantStatus)
+		}
+	}
+
+	// A suspended agent that wakes up is online again and goes stale as usual
+	if err := db.UpdateHeartbeat("never-woke", "online", "", "{}", 30*time.Second, time.Time{}); err != nil {
+		t.Fatalf("UpdateHeartbeat: %v", err)
+	}
+	if ids, err := db.MarkStaleAgentsOffline(90 * time.Second); err != nil || len(ids) != 0 {
+		t.Errorf("second pass marked %v offline (err %v), want none", ids, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Embedding request limits
+const (
+	maxEmbeddingInputs = 2048 // per request, as in the OpenAI API
+	embeddingBatchSize = 32   // inputs per job
+)
+
+// HandleEmbeddings handles POST /v1/embeddings
+// Inputs are split into batches, each run as a job on an agent serving the
+// model as an embedding model, and the vectors are returned in input order.
+func (h *Handlers) HandleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	f := openAIErrorFormat{}
+	if r.Method != http.MethodPost {
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("only POST is allowed"))
+		return
+	}
+
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	req, err := shared.ParseJSON[shared.EmbeddingRequest](r)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	if req.Model == "" || len(req.Input) == 0 {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("model and input are required"))
+		return
+	}
+	if len(req.Input) > maxEmbeddingInputs {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(fmt.Sprintf("at most %d inputs are allowed", maxEmbeddingInputs)))
+		return
+	}
+	for i, in := range req.Input {
+		if in == "" {
+			h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(fmt.Sprintf("input[%d] must not be empty", i)))
+			return
+		}
+	}
+	switch req.EncodingFormat {
+	case "", "float", "base64":
+	default:
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("encoding_format must be float or base64"))
+		return
+	}
+
+	model := h.models.Resolve(req.Model)
+	if !key.AllowsModel(model) {
+		h.writeFormatError(w, f, http.StatusForbidden, shared.ErrForbidden.WithDetails("model "+model+" is not allowed for this key"))
+		return
+	}
+	if err := h.models.CheckKind(model, shared.ModelKindEmbed); err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+
+	priority, err := requestPriority(r)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+
+	estimate := 0
+	for _, in := range req.Input {
+		estimate += estimateTokens(in, 0)
+	}
+	if !h.schedule(w, r, key, model, shared.ModelKindEmbed, estimate, f) {
+		return
+	}
+
+	id := "emb-" + uuid.New().String()
+	var jobs []*Job
+	for start := 0; start < len(req.Input); start += embeddingBatchSize {
+		end := min(start+embeddingBatchSize, len(req.Input))
+		job := NewEmbeddingJob(fmt.Sprintf("%s-%d", id, len(jobs)), key.ID, model, req.Input[start:end])
+		job.Priority = priority
+		job.Weight = key.Weight
+		for _, in := range job.Input {
+			job.Cost += estimateTokens(in, 0)
+		}
+		job.CorrelationID = requestIDFrom(r.Context())
+		job.Trace = shared.SpanContextFromContext(r.Context())
+		h.queue.Submit(job)
+		defer h.queue.Finish(job.ID)
+		jobs = append(jobs, job)
+	}
+
+	ctx, stop := withJobCancel(r.Context(), jobs)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, h.requestTimeout)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(h.requestTimeout + 10*time.Second)); err != nil {
+		requestLogger(r).Warn("Error extending write deadline", "err", err)
+	}
+
+	finals := h.collectEmbeddings(ctx, w, id, req.Model, req.EncodingFormat, jobs, f)
+	h.settleJobs(requestLogger(r), key, estimate, jobs, finals, errors.Is(ctx.Err(), context.DeadlineExceeded))
+}
+
+// collectEmbeddings waits for every batch and writes the vectors in input
+// order. It returns each job's final result post, nil where a job never
+// finished.
+func (h *Handlers) collectEmbeddings(ctx context.Context, w http.ResponseWriter, id, model, encoding string, jobs []*Job, f errorFormat) []*shared.ResultRequest {
+	finals := make([]*shared.ResultRequest, len(jobs))
+	results := mergeResults(ctx, jobs)
+	for remaining := len(jobs); remaining > 0; {
+		select {
+		case <-ctx.Done():
+			status, perr := doneError(ctx, id)
+			h.writeFormatError(w, f, status, perr)
+			return finals
+
+		case jr := <-results:
+			job, res := jobs[jr.index], jr.res
+			if res.Error == nil && res.Finished && len(res.Embeddings) != len(job.Input) {
+				msg := fmt.Sprintf("agent returned %d embeddings for %d inputs", len(res.Embeddings), len(job.Input))
+				res.Error = &msg
+			}
+			if res.Error != nil {
+				jobLogger(job).Warn("Job failed on agent", "agent_id", h.queue.AgentOf(job), "error", *res.Error)
+				h.writeFormatError(w, f, http.StatusBadGateway, shared.ErrInternalServer.WithDetails(*res.Error))
+				finals[jr.index] = &res
+				return finals
+			}
+			if res.Finished {
+				finals[jr.index] = &res
+				remaining--
+			}
+		}
+	}
+
+	resp := shared.EmbeddingResponse{Object: "list", Model: model}
+	for i, final := range finals {
+		for j, vec := range final.Embeddings {
+			resp.Data = append(resp.Data, shared.EmbeddingData{
+				Object:    "embedding",
+				Index:     i*embeddingBatchSize + j,
+				Embedding: encodeEmbedding(vec, encoding),
+			})
+		}
+		resp.Usage.PromptTokens += usageOf(*final).PromptTokens
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	shared.WriteJSON(w, http.StatusOK, resp)
+	return finals
+}
+
+// encodeEmbedding returns a vector as floats, or as base64 of little-endian
+// float32s, which the OpenAI SDKs request by default
+func encodeEmbedding(vec []float32, encoding string) any {
+	if encoding != "base64" {
+		return vec
+	}
+	buf := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// embeddingDims is the vector size the fake agent returns
+const embeddingDims = 4
+
+// fakeEmbedder answers embedding jobs with vectors that say which input
+// they belong to: the input's number, then fixed values
+type fakeEmbedder struct {
+	mu      sync.Mutex
+	batches []int // inputs per leased job
+}
+
+func (e *fakeEmbedder) handle(work shared.WorkResponse) shared.ResultRequest {
+	e.mu.Lock()
+	e.batches = append(e.batches, len(work.Input))
+	e.mu.Unlock()
+
+	if work.Type != shared.JobTypeEmbedding {
+		msg := "not an embedding job: " + work.Type
+		return shared.ResultRequest{Error: &msg}
+	}
+	res := shared.ResultRequest{Finished: true, Usage: &shared.CompletionUsage{PromptTokens: len(work.Input)}}
+	for _, in := range work.Input {
+		var n int
+		fmt.Sscanf(in, "input %d", &n)
+		res.Embeddings = append(res.Embeddings, []float32{float32(n), 0.5, -1, 2})
+	}
+	return res
+}
+
+func TestEmbeddingsEndToEnd(t *testing.T) {
+	h := newTestHandlers(t, shared.ModelConfig{Name: "embedder", Kind: shared.ModelKindEmbed})
+	srv := newTestServer(t, h)
+	embedder := &fakeEmbedder{}
+	startFakeAgent(t, h, srv, []shared.ModelInfo{{Name: "embedder", MaxContext: 512, Kind: shared.ModelKindEmbed}}, embedder.handle)
+	client := newTestKey(t, h, ScopeClientComplete)
+
+	inputs := make([]string, 2*embeddingBatchSize+6)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("input %d", i)
+	}
+	var resp shared.EmbeddingResponse
+	status := doJSON(t, http.MethodPost, srv.URL+"/v1/embeddings", client, map[string]any{"model": "embedder", "input": inputs}, &resp)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+
+	embedder.mu.Lock()
+	batches := append([]int(nil), embedder.batches...)
+	embedder.mu.Unlock()
+	sort.Ints(batches)
+	if want := []int{6, embeddingBatchSize, embeddingBatchSize}; fmt.Sprint(batches) != fmt.Sprint(want) {
+		t.Errorf("agent got batches of %v, want %v", batches, want)
+	}
+	if resp.Object != "list" || resp.Model != "embedder" {
+		t.Errorf("response object %q model %q, want list embedder", resp.Object, resp.Model)
+	}
+	if resp.Usage.PromptTokens != len(inputs) || resp.Usage.TotalTokens != len(inputs) {
+		t.Errorf("usage = %+v, want %d prompt and total tokens", resp.Usage, len(inputs))
+	}
+	if len(resp.Data) != len(inputs) {
+		t.Fatalf("got %d embeddings, want %d", len(resp.Data), len(inputs))
+	}
+	for i, d := range resp.Data {
+		vec, _ := d.Embedding.([]any)
+		if d.Object != "embedding" || d.Index != i || len(vec) != embeddingDims {
+			t.Fatalf("data[%d] = %+v, want embedding %d of %d dims", i, d, i, embeddingDims)
+		}
+		if vec[0] != float64(i) {
+			t.Errorf("data[%d] holds the vector of input %v", i, vec[0])
+		}
+	}
+}
+
+func TestEmbeddingsBase64(t *testing.T) {
+	h := newTestHandlers(t, shared.ModelConfig{Name: "embedder", Kind: shared.ModelKindEmbed})
+	srv := newTestServer(t, h)
+	startFakeAgent(t, h, srv, []shared.ModelInfo{{Name: "embedder", MaxContext: 512, Kind: shared.ModelKindEmbed}}, (&fakeEmbedder{}).handle)
+	client := newTestKey(t, h, ScopeClientComplete)
+
+	var resp shared.EmbeddingResponse
+	status := doJSON(t, http.MethodPost, srv.URL+"/v1/embeddings", client, map[string]any{"model": "embedder", "input": "input 7", "encoding_format": "base64"}, &resp)
+	if status != http.StatusOK || len(resp.Data) != 1 {
+		t.Fatalf("status = %d with %d embeddings, want 200 with 1", status, len(resp.Data))
+	}
+	s, _ := resp.Data[0].Embedding.(string)
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != 4*embeddingDims {
+		t.Fatalf("embedding %q is not %d base64 float32s: %v", s, embeddingDims, err)
+	}
+	var vec []float32
+	for i := 0; i < len(raw); i += 4 {
+		vec = append(vec, math.Float32frombits(binary.LittleEndian.Uint32(raw[i:])))
+	}
+	if want := []float32{7, 0.5, -1, 2}; fmt.Sprint(vec) != fmt.Sprint(want) {
+		t.Errorf("decoded vector %v, want %v", vec, want)
+	}
+}
+
+func TestEmbeddingsErrors(t *testing.T) {
+	h := newTestHandlers(t,
+		shared.ModelConfig{Name: "embedder", Kind: shared.ModelKindEmbed},
+		shared.ModelConfig{Name: "chat"},
+	)
+	srv := newTestServer(t, h)
+	client := newTestKey(t, h, ScopeClientComplete)
+	url := srv.URL + "/v1/embeddings"
+
+	tests := []struct {
+		name   string
+		body   map[string]any
+		status int
+	}{
+		{"no agents", map[string]any{"model": "embedder", "input": "hi"}, http.StatusServiceUnavailable},
+		{"generate model", map[string]any{"model": "chat", "input": "hi"}, http.StatusBadRequest},
+		{"empty input", map[string]any{"model": "embedder", "input": []string{"a", ""}}, http.StatusBadRequest},
+		{"bad encoding", map[string]any{"model": "embedder", "input": "hi", "encoding_format": "int8"}, http.StatusBadRequest},
+		{"too many inputs", map[string]any{"model": "embedder", "input": make([]string, maxEmbeddingInputs+1)}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := doJSON(t, http.MethodPost, url, client, tt.body, nil); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	if status := doJSON(t, http.MethodPost, url, "wrong-key", map[string]any{"model": "embedder", "input": "hi"}, nil); status != http.StatusUnauthorized {
+		t.Errorf("bad key: status = %d, want 401", status)
+	}
+}
+
+func TestEmbeddingsWrongVectorCount(t *testing.T) {
+	h := newTestHandlers(t, shared.ModelConfig{Name: "embedder", Kind: shared.ModelKindEmbed})
+	srv := newTestServer(t, h)
+	startFakeAgent(t, h, srv, []shared.ModelInfo{{Name: "embedder", MaxContext: 512, Kind: shared.ModelKindEmbed}}, func(work shared.WorkResponse) shared.ResultRequest {
+		return shared.ResultRequest{Finished: true, Embeddings: [][]float32{{1, 2}}}
+	})
+	client := newTestKey(t, h, ScopeClientComplete)
+
+	status := doJSON(t, http.MethodPost, srv.URL+"/v1/embeddings", client, map[string]any{"model": "embedder", "input": []string{"a", "b"}}, nil)
+	if status != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 when the agent returns too few vectors", status)
+	}
+}
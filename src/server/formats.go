@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// errorFormat writes errors in one client API's wire format
+type errorFormat interface {
+	writeError(w http.ResponseWriter, status int, err *shared.ProtocolError)
+}
+
+// apiFormat writes completion output and errors in one client API's wire
+// format. The job pipeline behind every client endpoint is the same; only
+// the request parsing and these writers differ.
+type apiFormat interface {
+	errorFormat
+
+	// responseID is the ID reported to the client; jobs are named after it
+	responseID() string
+
+	writeResponse(w http.ResponseWriter, choices []completedChoice, usage shared.CompletionUsage)
+
+	// Streaming: startStream is called once headers are sent, then deltas
+	// and finishes per choice, then endStream or writeStreamError
+	startStream(w http.ResponseWriter, n int)
+	writeDelta(w http.ResponseWriter, index int, text string)
+	writeFinish(w http.ResponseWriter, index int, reason string)
+	endStream(w http.ResponseWriter, usage shared.CompletionUsage)
+	writeStreamError(w http.ResponseWriter, err *shared.ProtocolError)
+}
+
+// completedChoice is the full output of one job
+type completedChoice struct {
+	Text         string
+	FinishReason string
+}
+
+// legacyFormat is the native /v1/completions format
+type legacyFormat struct {
+	id    string
+	model string
+}
+
+func (f *legacyFormat) responseID() string { return f.id }
+
+func (f *legacyFormat) writeError(w http.ResponseWriter, status int, err *shared.ProtocolError) {
+	shared.WriteError(w, status, err)
+}
+
+func (f *legacyFormat) writeResponse(w http.ResponseWriter, choices []completedChoice, usage shared.CompletionUsage) {
+	resp := shared.CompletionResponse{ID: f.id, Model: f.model, Usage: usage}
+	for _, c := range choices {
+		resp.Choices = append(resp.Choices, shared.CompletionChoice{Text: c.Text, FinishReason: c.FinishReason})
+	}
+	shared.WriteJSON(w, http.StatusOK, resp)
+}
+
+func (f *legacyFormat) startStream(w http.ResponseWriter, n int) {}
+
+func (f *legacyFormat) writeDelta(w http.ResponseWriter, index int, text string) {
+	shared.WriteSSEEvent(w, shared.StreamChunk{
+		Choices: []shared.CompletionChoice{{Text: text}},
+	})
+}
+
+func (f *legacyFormat) writeFinish(w http.ResponseWriter, index int, reason string) {
+	shared.WriteSSEEvent(w, shared.StreamChunk{
+		Choices: []shared.CompletionChoice{{FinishReason: reason}},
+	})
+}
+
+func (f *legacyFormat) endStream(w http.ResponseWriter, usage shared.CompletionUsage) {
+	shared.WriteSSEDone(w)
+}
+
+func (f *legacyFormat) writeStreamError(w http.ResponseWriter, err *shared.ProtocolError) {
+	shared.WriteSSEEvent(w, shared.ErrorResponse{Error: *err})
+	shared.WriteSSEDone(w)
+}
@@ -1,68 +1,87 @@
 package main
 
 import (
-	"crypto/subtle"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/janvanoekelen/metalyard/src/shared"
 )
 
-// RegisterRequest is the request body for agent registration
+// RegisterRequest is the request body for agent registration.
+// New agents present a single-use enrollment token; agents that already hold
+// an issued key authenticate with it instead and keep their agent ID.
 type RegisterRequest struct {
-	Name         string        `json:"name"`
-	APIKey       string        `json:"api_key"`
-	Capabilities Capabilities  `json:"capabilities"`
-	Models       []ModelInfo   `json:"models"`
+	Name            string              `json:"name"`
+	EnrollmentToken string              `json:"enrollment_token,omitempty"`
+	Version         string              `json:"version,omitempty"` // agent binary version; empty for agents that predate versioning
+	Capabilities    shared.Capabilities `json:"capabilities"`
+	Models          []shared.ModelInfo  `json:"models"`
 }
 
-// Capabilities describes the agent's hardware
-type Capabilities struct {
-	GPUVendor   string `json:"gpu_vendor"`
-	GPUModel    string `json:"gpu_model"`
-	VRAM_MB     int    `json:"vram_mb"`
-	Platform    string `json:"platform"`
+// RegisterResponse is the response for successful registration.
+// APIKey is only set when a new key was issued and is never shown again.
+type RegisterResponse struct {
+	AgentID           string `json:"agent_id"`
+	APIKey            string `json:"api_key,omitempty"`
+	HeartbeatInterval int    `json:"heartbeat_interval_sec"`
+	AgentVersions
 }
 
-// ModelInfo describes a model the agent can serve
-type ModelInfo struct {
-	Name         string `json:"name"`
-	Quantization string `json:"quantization,omitempty"`
-	MaxContext   int    `json:"max_context"`
+// AgentVersions advertises the update channel's agent versions. Both are
+// empty if the server has no update channel.
+type AgentVersions struct {
+	MinimumAgentVersion string `json:"minimum_agent_version,omitempty"` // older agents get no work
+	LatestAgentVersion  string `json:"latest_agent_version,omitempty"`  // older agents update themselves
 }
 
-// RegisterResponse is the response for successful registration
-type RegisterResponse struct {
-	AgentID          string `json:"agent_id"`
-	HeartbeatInterval int    `json:"heartbeat_interval_sec"`
+// AgentInfoResponse is what an agent can read about itself
+type AgentInfoResponse struct {
+	AgentID      string `json:"agent_id"`
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	PausedReason string `json:"paused_reason,omitempty"`
 }
 
-// HeartbeatRequest is the request body for heartbeat
+// HeartbeatRequest is the request body for heartbeat. An agent whose host
+// is about to sleep sends a last heartbeat with Status "suspending"; one
+// whose contribution policy keeps it from taking work sends Status "paused"
+// and says why in PausedReason.
 type HeartbeatRequest struct {
-	Status         string       `json:"status"`
-	CurrentLoad    int          `json:"current_load"`
-	Capabilities   Capabilities `json:"capabilities"`
+	Status        string              `json:"status"`
+	CurrentLoad   int                 `json:"current_load"`
+	LoadedModel   string              `json:"loaded_model"`
+	Capabilities  shared.Capabilities `json:"capabilities"`
+	PrefixCache   *shared.PrefixCache `json:"prefix_cache,omitempty"`
+	OfflineSec    int                 `json:"offline_sec,omitempty"`     // set on the first heartbeat after the agent lost the server
+	SuspendedSec  int                 `json:"suspended_sec,omitempty"`   // set on the first heartbeat after the agent's host slept
+	WakeWithinSec int                 `json:"wake_within_sec,omitempty"` // with "suspending": how long the host may sleep before the agent counts as gone
+	PausedReason  string              `json:"paused_reason,omitempty"`   // e.g. "outside_window", "process_running:steam"
 }
 
 // HeartbeatResponse is the response for successful heartbeat
 type HeartbeatResponse struct {
-	Acknowledged bool `json:"acknowledged"`
-	NextInterval int  `json:"next_interval_sec"`
+	Acknowledged bool     `json:"acknowledged"`
+	NextInterval int      `json:"next_interval_sec"`
+	Commands     []string `json:"commands,omitempty"` // e.g. ["cancel_job:cmpl-..."], ["load_model:llama-7b-q4"]
+	AgentVersions
 }
 
 // AdminAgentInfo is the agent info returned by the admin endpoint
 type AdminAgentInfo struct {
-	AgentID       string    `json:"agent_id"`
-	Name          string    `json:"name"`
-	Status        string    `json:"status"`
-	LastHeartbeat time.Time `json:"last_heartbeat"`
-	CurrentLoad   int       `json:"current_load"`
-	Capabilities  Capabilities `json:"capabilities"`
-	Models        []ModelInfo  `json:"models"`
+	AgentID           string              `json:"agent_id"`
+	Name              string              `json:"name"`
+	Status            string              `json:"status"`
+	Version           string              `json:"version,omitempty"`
+	LastHeartbeat     time.Time           `json:"last_heartbeat"`
+	HeartbeatInterval int                 `json:"heartbeat_interval_sec"` // last interval the agent was given
+	PausedReason      string              `json:"paused_reason,omitempty"`
+	CurrentLoad       int                 `json:"current_load"`
+	Capabilities      shared.Capabilities `json:"capabilities"`
+	Models            []shared.ModelInfo  `json:"models"`
 }
 
 // AdminResponse is the response for the admin agents endpoint
@@ -72,6 +91,13 @@ type AdminResponse struct {
 	Online int              `json:"online"`
 }
 
+// StatsResponse is the response for the admin stats endpoint
+type StatsResponse struct {
+	QueueDepth map[string]int   `json:"queue_depth"` // pending jobs by priority
+	Affinity   AffinityStats    `json:"affinity"`
+	WarmPool   []WarmModelStats `json:"warm_pool"`
+}
+
 // ErrorResponse is a standard error response
 type ErrorResponse struct {
 	Error   string `json:"error"`
@@ -80,18 +106,43 @@ type ErrorResponse struct {
 
 // Handlers holds the HTTP handlers and their dependencies
 type Handlers struct {
-	db               *DB
-	adminAPIKey      string
-	heartbeatInterval int
+	db             *DB
+	queue          *JobQueue
+	prefixes       *PrefixIndex
+	demand         *DemandTracker
+	warm           *WarmPool
+	limiter        *RateLimiter
+	metrics        *Metrics
+	tracer         *shared.Tracer
+	models         *ModelRegistry
+	updates        *UpdateChannel // nil without an agent update channel
+	batches        *BatchRunner
+	cadence        *Cadence
+	adminAPIKey    string
+	requestTimeout time.Duration
+	maxSuspend     time.Duration
 }
 
 // NewHandlers creates a new Handlers instance
-func NewHandlers(db *DB, adminAPIKey string, heartbeatInterval int) *Handlers {
-	return &Handlers{
-		db:                db,
-		adminAPIKey:       adminAPIKey,
-		heartbeatInterval: heartbeatInterval,
+func NewHandlers(db *DB, queue *JobQueue, prefixes *PrefixIndex, metrics *Metrics, tracer *shared.Tracer, models *ModelRegistry, updates *UpdateChannel, config Config) *Handlers {
+	h := &Handlers{
+		db:             db,
+		queue:          queue,
+		prefixes:       prefixes,
+		limiter:        NewRateLimiter(config.DefaultLimits),
+		metrics:        metrics,
+		tracer:         tracer,
+		models:         models,
+		updates:        updates,
+		cadence:        NewCadence(time.Duration(config.HeartbeatInterval) * time.Second),
+		adminAPIKey:    config.AdminAPIKey,
+		requestTimeout: config.RequestTimeout,
+		maxSuspend:     config.MaxSuspend,
 	}
+	h.batches = NewBatchRunner(h, config.BatchConcurrency)
+	h.demand = NewDemandTracker()
+	h.warm = NewWarmPool(db, models, h.demand, metrics, config.WarmReplicaRPM)
+	return h
 }
 
 // HandleRegister handles POST /v1/agents/register
@@ -108,41 +159,76 @@ func (h *Handlers) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.APIKey == "" {
-		h.writeError(w, http.StatusBadRequest, "missing_api_key", "api_key is required")
-		return
-	}
 	if len(req.Models) == 0 {
 		h.writeError(w, http.StatusBadRequest, "missing_models", "At least one model is required")
 		return
 	}
+	for i, m := range req.Models {
+		switch m.Kind {
+		case "":
+			req.Models[i].Kind = shared.ModelKindGenerate
+		case shared.ModelKindGenerate, shared.ModelKindEmbed:
+		default:
+			h.writeError(w, http.StatusBadRequest, "invalid_model_kind", "Model kind must be generate or embed")
+			return
+		}
+	}
 
-	// Generate agent ID
-	agentID := uuid.New().String()
+	// Authenticate: an enrollment token, a fleet key with agent:register, or
+	// the key previously issued to this agent. The token is used up along
+	// with the registration below, so a failed registration doesn't cost it.
+	var existing *APIKey
+	var tokenHash string
+	if req.EnrollmentToken != "" {
+		tokenHash = hashSecret(req.EnrollmentToken)
+	} else {
+		key, ok := h.requireScope(w, r, ScopeAgentRegister)
+		if !ok {
+			return
+		}
+		if key.AgentID != "" {
+			existing = key
+		}
+	}
 
-	// Hash the API key
-	apiKeyHash, err := bcrypt.GenerateFromPassword([]byte(req.APIKey), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Error hashing API key: %v", err)
-		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to process registration")
-		return
+	// Agents re-registering with their issued key keep their ID; everyone
+	// else gets a fresh ID and a key bound to it
+	agentID := uuid.New().String()
+	var apiKeyHash, issuedKey string
+	var newKey *APIKey
+	if existing != nil {
+		agentID = existing.AgentID
+		apiKeyHash = existing.KeyHash
+	} else {
+		key, secret, err := NewAPIKey(req.Name, []string{ScopeAgentRegister}, nil, agentID, nil)
+		if err != nil {
+			requestLogger(r).Error("Error generating agent key", "err", err)
+			h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to process registration")
+			return
+		}
+		newKey = key
+		apiKeyHash = key.KeyHash
+		issuedKey = secret
 	}
 
 	// Serialize capabilities
 	capJSON, err := json.Marshal(req.Capabilities)
 	if err != nil {
-		log.Printf("Error marshaling capabilities: %v", err)
+		requestLogger(r).Error("Error marshaling capabilities", "err", err)
 		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to process registration")
 		return
 	}
 
 	// Build agent and models
+	interval := h.cadence.Registered(agentID)
 	agent := &Agent{
-		ID:           agentID,
-		APIKeyHash:   string(apiKeyHash),
-		Name:         req.Name,
-		Status:       "online",
-		Capabilities: string(capJSON),
+		ID:                agentID,
+		APIKeyHash:        apiKeyHash,
+		Name:              req.Name,
+		Version:           req.Version,
+		Status:            "online",
+		HeartbeatInterval: interval,
+		Capabilities:      string(capJSON),
 	}
 
 	var models []AgentModel
@@ -152,46 +238,111 @@ func (h *Handlers) HandleRegister(w http.ResponseWriter, r *http.Request) {
 			ModelName:    m.Name,
 			Quantization: m.Quantization,
 			MaxContext:   m.MaxContext,
+			Kind:         m.Kind,
 		})
 	}
 
-	// Register in database
-	if err := h.db.RegisterAgent(agent, models); err != nil {
-		log.Printf("Error registering agent: %v", err)
+	// Register in database, with the token and key it enrolled with
+	err = h.db.EnrollAgent(tokenHash, newKey, agent, models)
+	if errors.Is(err, errNotFound) {
+		h.writeError(w, http.StatusUnauthorized, "invalid_enrollment_token", "Enrollment token is invalid, expired or used up")
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error registering agent", "err", err)
 		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to register agent")
 		return
 	}
 
-	log.Printf("Agent registered: %s (%s)", agentID, req.Name)
+	requestLogger(r).Info("Agent registered", "agent_id", agentID, "name", req.Name, "version", req.Version)
 
 	// Send response
 	resp := RegisterResponse{
-		AgentID:          agentID,
-		HeartbeatInterval: h.heartbeatInterval,
+		AgentID:           agentID,
+		APIKey:            issuedKey,
+		HeartbeatInterval: int(interval.Seconds()),
+		AgentVersions:     h.agentVersions(),
 	}
 	h.writeJSON(w, http.StatusCreated, resp)
 }
 
+// HandleAgent routes /v1/agents/{id}/{heartbeat,work,result}
+func (h *Handlers) HandleAgent(w http.ResponseWriter, r *http.Request) {
+	// Extract agent ID from path: /v1/agents/{id}[/{action}]
+	path := strings.TrimPrefix(r.URL.Path, "/v1/agents/")
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || parts[0] == "" {
+		h.writeError(w, http.StatusBadRequest, "invalid_path", "Invalid path format")
+		return
+	}
+	agentID := parts[0]
+	if len(parts) == 1 {
+		h.HandleAgentInfo(w, r, agentID)
+		return
+	}
+
+	switch parts[1] {
+	case "heartbeat":
+		h.HandleHeartbeat(w, r, agentID)
+	case "work":
+		h.HandleWork(w, r, agentID)
+	case "result":
+		h.HandleResult(w, r, agentID)
+	default:
+		h.writeError(w, http.StatusNotFound, "not_found", "Unknown agent endpoint")
+	}
+}
+
+// HandleAgentInfo handles GET /v1/agents/{id}
+// It lets an agent check its key and registration without side effects.
+func (h *Handlers) HandleAgentInfo(w http.ResponseWriter, r *http.Request, agentID string) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+	if !h.requireAgent(w, r, agentID) {
+		return
+	}
+
+	agent, err := h.db.GetAgent(agentID)
+	if errors.Is(err, errNotFound) {
+		h.writeError(w, http.StatusNotFound, "agent_not_found", "Agent not found")
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error getting agent", "agent_id", agentID, "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to get agent")
+		return
+	}
+	h.writeJSON(w, http.StatusOK, AgentInfoResponse{
+		AgentID:      agent.ID,
+		Name:         agent.Name,
+		Status:       agent.Status,
+		PausedReason: agent.PausedReason,
+	})
+}
+
 // HandleHeartbeat handles POST /v1/agents/{id}/heartbeat
-func (h *Handlers) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) HandleHeartbeat(w http.ResponseWriter, r *http.Request, agentID string) {
 	if r.Method != http.MethodPost {
 		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is allowed")
 		return
 	}
-
-	// Extract agent ID from path: /v1/agents/{id}/heartbeat
-	path := strings.TrimPrefix(r.URL.Path, "/v1/agents/")
-	parts := strings.Split(path, "/")
-	if len(parts) != 2 || parts[1] != "heartbeat" {
-		h.writeError(w, http.StatusBadRequest, "invalid_path", "Invalid path format")
+	if !h.requireAgent(w, r, agentID) {
 		return
 	}
-	agentID := parts[0]
+
+	start := time.Now()
+	result := "error"
+	defer func() {
+		h.metrics.Heartbeats.Inc(result)
+		h.metrics.HeartbeatLatency.ObserveDuration(time.Since(start))
+	}()
 
 	// Verify agent exists
 	exists, err := h.db.AgentExists(agentID)
 	if err != nil {
-		log.Printf("Error checking agent: %v", err)
+		requestLogger(r).Error("Error checking agent", "agent_id", agentID, "err", err)
 		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to process heartbeat")
 		return
 	}
@@ -213,18 +364,52 @@ func (h *Handlers) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		capJSON = []byte("{}")
 	}
 
-	// Update heartbeat
-	if err := h.db.UpdateHeartbeat(agentID, string(capJSON)); err != nil {
-		log.Printf("Error updating heartbeat: %v", err)
+	// Update heartbeat. A suspending agent is not marked stale while it
+	// sleeps, and a resumed one is not treated as having failed.
+	status, pausedReason := "online", ""
+	switch req.Status {
+	case "suspending":
+		status = "suspended"
+	case "paused":
+		status, pausedReason = "paused", req.PausedReason
+	}
+	interval := h.cadence.Next(agentID, req.CurrentLoad > 0, req.OfflineSec > 0, req.SuspendedSec > 0)
+	wakeWithin := time.Duration(req.WakeWithinSec) * time.Second
+	if wakeWithin <= 0 || wakeWithin > h.maxSuspend {
+		wakeWithin = h.maxSuspend
+	}
+	if err := h.db.UpdateHeartbeat(agentID, status, pausedReason, string(capJSON), interval, time.Now().Add(wakeWithin)); err != nil {
+		requestLogger(r).Error("Error updating heartbeat", "agent_id", agentID, "err", err)
 		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to update heartbeat")
 		return
 	}
 
+	if req.OfflineSec > 0 {
+		requestLogger(r).Info("Agent reconnected", "agent_id", agentID, "offline_sec", req.OfflineSec)
+	}
+	if req.SuspendedSec > 0 {
+		requestLogger(r).Info("Agent resumed from sleep", "agent_id", agentID, "suspended_sec", req.SuspendedSec)
+	}
+	if status == "suspended" {
+		released := h.queue.ReleaseAgent(agentID, "agent host going to sleep")
+		h.metrics.AgentSuspends.Inc()
+		requestLogger(r).Info("Agent suspending", "agent_id", agentID, "released_jobs", released)
+	}
+	h.prefixes.Report(agentID, req.PrefixCache)
+	h.warm.Observe(agentID, req.LoadedModel, req.CurrentLoad > 0)
+
 	// Send response
+	result = "ok"
 	resp := HeartbeatResponse{
-		Acknowledged: true,
-		NextInterval: h.heartbeatInterval,
+		Acknowledged:  true,
+		NextInterval:  int(interval.Seconds()),
+		AgentVersions: h.agentVersions(),
 	}
+	// Jobs the agent may still be generating for a client that is gone
+	for _, jobID := range h.queue.AbortedJobs(agentID) {
+		resp.Commands = append(resp.Commands, "cancel_job:"+jobID)
+	}
+	resp.Commands = append(resp.Commands, h.warm.Commands(agentID)...)
 	h.writeJSON(w, http.StatusOK, resp)
 }
 
@@ -235,22 +420,14 @@ func (h *Handlers) HandleAdminAgents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check admin API key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		h.writeError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid Authorization header")
-		return
-	}
-	providedKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if subtle.ConstantTimeCompare([]byte(providedKey), []byte(h.adminAPIKey)) != 1 {
-		h.writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid admin API key")
+	if _, ok := h.requireScope(w, r, ScopeAdminRead); !ok {
 		return
 	}
 
 	// Get all agents
 	agents, err := h.db.GetAllAgents()
 	if err != nil {
-		log.Printf("Error getting agents: %v", err)
+		requestLogger(r).Error("Error getting agents", "err", err)
 		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to get agents")
 		return
 	}
@@ -264,33 +441,37 @@ func (h *Handlers) HandleAdminAgents(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Parse capabilities
-		var caps Capabilities
+		var caps shared.Capabilities
 		json.Unmarshal([]byte(a.Capabilities), &caps)
 
 		// Get models
 		models, err := h.db.GetAgentModels(a.ID)
 		if err != nil {
-			log.Printf("Error getting models for agent %s: %v", a.ID, err)
+			requestLogger(r).Error("Error getting models for agent", "agent_id", a.ID, "err", err)
 			continue
 		}
 
-		var modelInfos []ModelInfo
+		var modelInfos []shared.ModelInfo
 		for _, m := range models {
-			modelInfos = append(modelInfos, ModelInfo{
+			modelInfos = append(modelInfos, shared.ModelInfo{
 				Name:         m.ModelName,
 				Quantization: m.Quantization,
 				MaxContext:   m.MaxContext,
+				Kind:         m.Kind,
 			})
 		}
 
 		adminAgents = append(adminAgents, AdminAgentInfo{
-			AgentID:       a.ID,
-			Name:          a.Name,
-			Status:        a.Status,
-			LastHeartbeat: a.LastHeartbeat,
-			CurrentLoad:   a.CurrentLoad,
-			Capabilities:  caps,
-			Models:        modelInfos,
+			AgentID:           a.ID,
+			Name:              a.Name,
+			Status:            a.Status,
+			Version:           a.Version,
+			LastHeartbeat:     a.LastHeartbeat,
+			HeartbeatInterval: int(a.HeartbeatInterval.Seconds()),
+			PausedReason:      a.PausedReason,
+			CurrentLoad:       a.CurrentLoad,
+			Capabilities:      caps,
+			Models:            modelInfos,
 		})
 	}
 
@@ -302,6 +483,33 @@ func (h *Handlers) HandleAdminAgents(w http.ResponseWriter, r *http.Request) {
 	h.writeJSON(w, http.StatusOK, resp)
 }
 
+// agentVersions returns the versions the update channel advertises
+func (h *Handlers) agentVersions() AgentVersions {
+	if h.updates == nil {
+		return AgentVersions{}
+	}
+	minimum, latest := h.updates.Versions()
+	return AgentVersions{MinimumAgentVersion: minimum, LatestAgentVersion: latest}
+}
+
+// HandleAdminStats handles GET /v1/admin/stats
+func (h *Handlers) HandleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+
+	if _, ok := h.requireScope(w, r, ScopeAdminRead); !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, StatsResponse{
+		QueueDepth: h.queue.Depth(),
+		Affinity:   h.prefixes.Stats(),
+		WarmPool:   h.warm.Stats(),
+	})
+}
+
 // HandleHealth handles GET /health
 func (h *Handlers) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
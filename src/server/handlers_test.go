@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+func TestHeartbeatSuspendingSetsWakeDeadline(t *testing.T) {
+	h := newTestHandlers(t)
+	srv := newTestServer(t, h)
+	var reg RegisterResponse
+	req := RegisterRequest{Name: "laptop", Models: []shared.ModelInfo{{Name: "llama", MaxContext: 4096}}}
+	if status := doJSON(t, http.MethodPost, srv.URL+"/v1/agents/register", newTestKey(t, h, ScopeAgentRegister), req, &reg); status != http.StatusCreated {
+		t.Fatalf("register: status %d", status)
+	}
+	url := srv.URL + "/v1/agents/" + reg.AgentID + "/heartbeat"
+
+	tests := []struct {
+		name       string
+		hb         HeartbeatRequest
+		status     string
+		wakeWithin time.Duration // 0 for no deadline
+	}{
+		{"asks for an hour", HeartbeatRequest{Status: "suspending", WakeWithinSec: 3600}, "suspended", time.Hour},
+		{"asks for too long", HeartbeatRequest{Status: "suspending", WakeWithinSec: 7 * 24 * 3600}, "suspended", h.maxSuspend},
+		{"asks for nothing", HeartbeatRequest{Status: "suspending"}, "suspended", h.maxSuspend},
+		{"woke up", HeartbeatRequest{Status: "online", SuspendedSec: 600}, "online", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			if status := doJSON(t, http.MethodPost, url, reg.APIKey, tt.hb, nil); status != http.StatusOK {
+				t.Fatalf("heartbeat: status %d", status)
+			}
+			var status string
+			var deadline int64
+			if err := h.db.QueryRow(`SELECT status, wake_deadline FROM agents WHERE agent_id = ?`, reg.AgentID).Scan(&status, &deadline); err != nil {
+				t.Fatalf("reading agent: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("status = %s, want %s", status, tt.status)
+			}
+			if tt.wakeWithin == 0 {
+				if deadline != 0 {
+					t.Errorf("wake deadline %d left set", deadline)
+				}
+				return
+			}
+			if want := start.Add(tt.wakeWithin).Unix(); deadline < want-1 || deadline > want+1 {
+				t.Errorf("wake deadline %v, want %v", time.Unix(deadline, 0), time.Unix(want, 0))
+			}
+		})
+	}
+}
+
+func TestRegisterFailureKeepsEnrollmentToken(t *testing.T) {
+	h := newTestHandlers(t)
+	srv := newTestServer(t, h)
+	token := newTestEnrollmentToken(t, h, 1)
+
+	// The second model row collides with the first, so the insert fails
+	// after the token and key would have been stored
+	dup := RegisterRequest{Name: "laptop", EnrollmentToken: token, Models: []shared.ModelInfo{{Name: "llama"}, {Name: "llama"}}}
+	if status := doJSON(t, http.MethodPost, srv.URL+"/v1/agents/register", "", dup, nil); status != http.StatusInternalServerError {
+		t.Fatalf("register with clashing models: status %d, want 500", status)
+	}
+	var keys int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM api_keys`).Scan(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if keys != 0 {
+		t.Errorf("%d keys left behind by the failed registration", keys)
+	}
+
+	req := RegisterRequest{Name: "laptop", EnrollmentToken: token, Models: []shared.ModelInfo{{Name: "llama"}}}
+	if status := doJSON(t, http.MethodPost, srv.URL+"/v1/agents/register", "", req, nil); status != http.StatusCreated {
+		t.Errorf("register after the failure: status %d, want the token still usable", status)
+	}
+}
+
+func TestRegisterUsedEnrollmentToken(t *testing.T) {
+	h := newTestHandlers(t)
+	srv := newTestServer(t, h)
+	req := RegisterRequest{Name: "laptop", EnrollmentToken: newTestEnrollmentToken(t, h, 1), Models: []shared.ModelInfo{{Name: "llama"}}}
+	if status := doJSON(t, http.MethodPost, srv.URL+"/v1/agents/register", "", req, nil); status != http.StatusCreated {
+		t.Fatalf("first register: status %d", status)
+	}
+	if status := doJSON(t, http.MethodPost, srv.URL+"/v1/agents/register", "", req, nil); status != http.StatusUnauthorized {
+		t.Errorf("register with a used token: status %d, want 401", status)
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// errJobNotFound is returned when an agent reports on a job the queue no
+// longer tracks, e.g. because the client gave up
+var errJobNotFound = errors.New("job not found")
+
+// errJobNotLeased is returned when an agent reports on a job leased to another agent
+var errJobNotLeased = errors.New("job not leased to this agent")
+
+// errJobCancelled is returned when an agent reports on a cancelled job, and
+// is the cancellation cause of requests whose jobs were cancelled
+var errJobCancelled = errors.New("job cancelled")
+
+// maxCancelledPerAgent bounds the cancelled jobs remembered for an agent
+// that has not yet been told about them
+const maxCancelledPerAgent = 64
+
+// Priority classes. Interactive jobs are dispatched ahead of batch jobs,
+// except that batch jobs waiting longer than the queue's aging threshold
+// go first so that a steady interactive load cannot starve them.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// validPriorities lists every priority class a request can ask for
+var validPriorities = map[string]bool{
+	PriorityInteractive: true,
+	PriorityBatch:       true,
+}
+
+// Job is a single inference request waiting for or running on an agent
+type Job struct {
+	ID            string
+	KeyID         string
+	CorrelationID string             // X-Request-ID of the client request, passed on to the agent
+	Trace         shared.SpanContext // span of the client request, parent of the job's spans
+	Type          string             // shared.JobTypeCompletion or shared.JobTypeEmbedding
+	Request       shared.CompletionRequest
+	Input         []string // embedding jobs: texts to embed
+	Priority      string   // PriorityInteractive or PriorityBatch; empty means interactive
+	Cost          int      // estimated tokens, charged against the key's fair share
+	Weight        float64  // the key's fair-share weight; 0 means 1
+	AgentID       string   // set once leased
+	CreatedAt     time.Time
+	LeasedAt      time.Time
+	FirstTokenAt  time.Time // set through FirstToken when output first arrives
+
+	results   chan shared.ResultRequest
+	done      chan struct{}
+	cancelled chan struct{} // closed by Cancel
+	finished  bool          // a final or failed result was delivered
+	started   bool          // output was delivered, so the job can't move to another agent
+	seq       uint64        // submission order, breaks ties between equal tags
+	queuedAt  time.Time     // on the queue's clock, for aging
+	startTag  float64       // virtual start time within the job's priority class
+	waitSpan  *shared.Span  // from submit until leased
+	leaseSpan *shared.Span  // from lease until finished
+
+	prefix         []string // hash chain of the prompt, if affinity routing is on
+	affinity       string   // agent holding the longest cached prefix of the prompt
+	affinityBlocks int      // prefix blocks that agent holds
+}
+
+// NewJob creates a job for a completion request
+func NewJob(id, keyID string, req shared.CompletionRequest) *Job {
+	return &Job{
+		ID:        id,
+		KeyID:     keyID,
+		Type:      shared.JobTypeCompletion,
+		Request:   req,
+		CreatedAt: time.Now(),
+		results:   make(chan shared.ResultRequest, 16),
+		done:      make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+}
+
+// NewEmbeddingJob creates a job embedding a batch of inputs
+func NewEmbeddingJob(id, keyID, model string, input []string) *Job {
+	job := NewJob(id, keyID, shared.CompletionRequest{Model: model})
+	job.Type = shared.JobTypeEmbedding
+	job.Input = input
+	return job
+}
+
+// ModelKind returns the kind of model the job needs
+func (j *Job) ModelKind() string {
+	if j.Type == shared.JobTypeEmbedding {
+		return shared.ModelKindEmbed
+	}
+	return shared.ModelKindGenerate
+}
+
+// Results returns the channel on which agent result posts are delivered
+func (j *Job) Results() <-chan shared.ResultRequest {
+	return j.results
+}
+
+// Cancelled returns a channel that is closed when the job is cancelled
+func (j *Job) Cancelled() <-chan struct{} {
+	return j.cancelled
+}
+
+// withJobCancel returns a context that is cancelled with errJobCancelled
+// as soon as any of the jobs is cancelled
+func withJobCancel(parent context.Context, jobs []*Job) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	for _, job := range jobs {
+		go func(job *Job) {
+			select {
+			case <-job.Cancelled():
+				cancel(errJobCancelled)
+			case <-ctx.Done():
+			}
+		}(job)
+	}
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// jobLogger returns the default logger tagged with a job's IDs
+func jobLogger(job *Job) *slog.Logger {
+	return slog.With("job_id", job.ID, "request_id", job.CorrelationID)
+}
+
+// fairClass is the start-time fair queuing state of one priority class.
+// A job's start tag is the later of the class's virtual time and the finish
+// tag of its key's previous job, and its finish tag adds cost/weight. Jobs
+// are dispatched lowest start tag first, so keys with queued work share
+// agents in proportion to their weights, and a key that was idle cannot
+// bank credit to burst with later.
+type fairClass struct {
+	vtime  float64
+	finish map[string]float64 // last finish tag by key ID
+}
+
+// JobQueue holds pending jobs until an agent leases them and routes the
+// agent's result posts back to the waiting client handler
+type JobQueue struct {
+	tracer     *shared.Tracer
+	agingAfter time.Duration    // batch jobs waiting this long jump the queue; 0 disables aging
+	now        func() time.Time // replaceable for deterministic simulation
+
+	mu      sync.Mutex
+	pending []*Job                // in submission order
+	jobs    map[string]*Job       // every job not yet finished, by ID
+	wake    chan struct{}         // closed and replaced whenever a job is submitted
+	aborted map[string][]string   // leased jobs finished without a result, by agent ID
+	seq     uint64                // last submission sequence number
+	classes map[string]*fairClass // by priority
+
+	prefixes *PrefixIndex // where prompt prefixes are cached, for affinity routing
+}
+
+// NewJobQueue creates an empty job queue. Jobs whose prompt prefix is
+// cached on an agent are held for that agent as long as prefixes says.
+func NewJobQueue(tracer *shared.Tracer, agingAfter time.Duration, prefixes *PrefixIndex) *JobQueue {
+	q := &JobQueue{
+		tracer:     tracer,
+		prefixes:   prefixes,
+		agingAfter: agingAfter,
+		now:        time.Now,
+		jobs:       make(map[string]*Job),
+		wake:       make(chan struct{}),
+		aborted:    make(map[string][]string),
+		classes:    make(map[string]*fairClass),
+	}
+	for p := range validPriorities {
+		q.classes[p] = &fairClass{finish: make(map[string]float64)}
+	}
+	return q
+}
+
+// Submit adds a job to the queue, tagging it for fair dispatch within its
+// priority class
+func (q *JobQueue) Submit(job *Job) {
+	if q.prefixes.wait > 0 && job.Type == shared.JobTypeCompletion {
+		job.prefix = shared.PrefixHashes(job.Request.Prompt)
+		job.affinity, job.affinityBlocks = q.prefixes.Best(job.Request.Model, job.prefix)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.Priority == "" {
+		job.Priority = PriorityInteractive
+	}
+	class := q.classes[job.Priority]
+	q.seq++
+	job.seq = q.seq
+	job.queuedAt = q.now()
+	job.startTag = max(class.vtime, class.finish[job.KeyID])
+	weight := job.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	class.finish[job.KeyID] = job.startTag + float64(max(job.Cost, 1))/weight
+
+	job.waitSpan = q.tracer.StartWithParent(job.Trace, "queue.wait")
+	job.waitSpan.SetAttr("job_id", job.ID)
+	job.waitSpan.SetAttr("model", job.Request.Model)
+	job.waitSpan.SetAttr("priority", job.Priority)
+	job.waitSpan.SetAttr("queue_depth", len(q.pending))
+	if job.affinity != "" {
+		job.waitSpan.SetAttr("affinity_agent_id", job.affinity)
+		job.waitSpan.SetAttr("affinity_blocks", job.affinityBlocks)
+	}
+
+	q.pending = append(q.pending, job)
+	q.jobs[job.ID] = job
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// Lease hands the next pending job the agent can serve to that agent,
+// waiting up to wait for one to arrive. It returns nil if none did.
+func (q *JobQueue) Lease(ctx context.Context, agentID string, serves func(job *Job) bool, wait time.Duration) *Job {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		job, held := q.popLocked(agentID, serves)
+		if job != nil {
+			job.AgentID = agentID
+			job.LeasedAt = time.Now()
+			job.waitSpan.End()
+			job.leaseSpan = q.tracer.StartWithParent(job.Trace, "agent.lease")
+			job.leaseSpan.SetAttr("job_id", job.ID)
+			job.leaseSpan.SetAttr("agent_id", agentID)
+			q.mu.Unlock()
+			return job
+		}
+		wake := q.wake
+		q.mu.Unlock()
+
+		// A job held for another agent may be released before anything
+		// else wakes us
+		var release <-chan time.Time
+		if held > 0 {
+			release = time.After(held)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		case <-wake:
+		case <-release:
+		}
+	}
+}
+
+// popLocked removes and returns the next pending job for the agent
+// matching serves: the oldest aged batch job if there is one, otherwise the
+// first by dispatchesFirst. Jobs held for the agent caching their prompt
+// are skipped; if any were, held is how long until the first is released.
+func (q *JobQueue) popLocked(agentID string, serves func(job *Job) bool) (*Job, time.Duration) {
+	now := q.now()
+	next, aged := -1, -1
+	var held time.Duration
+	busy := make(map[string]bool)
+	for i, job := range q.pending {
+		if !serves(job) {
+			continue
+		}
+		if wait := q.heldLocked(job, agentID, now, busy); wait > 0 {
+			if held == 0 || wait < held {
+				held = wait
+			}
+			continue
+		}
+		if job.Priority == PriorityBatch && q.agingAfter > 0 && now.Sub(job.queuedAt) >= q.agingAfter {
+			// Pending is in submission order, so the first aged job is the oldest
+			aged = i
+			break
+		}
+		if next < 0 || dispatchesFirst(job, q.pending[next]) {
+			next = i
+		}
+	}
+	if aged >= 0 {
+		next = aged
+	}
+	if next < 0 {
+		return nil, held
+	}
+
+	job := q.pending[next]
+	q.pending = append(q.pending[:next], q.pending[next+1:]...)
+
+	// Advance the class's virtual time and forget keys whose last finish
+	// tag it has passed; their next job starts at the virtual time anyway
+	class := q.classes[job.Priority]
+	class.vtime = max(class.vtime, job.startTag)
+	for keyID, finish := range class.finish {
+		if finish <= class.vtime {
+			delete(class.finish, keyID)
+		}
+	}
+	return job, 0
+}
+
+// heldLocked returns how much longer a job is held for the agent caching
+// its prompt prefix before agentID may take it, or 0 if it may take it
+// now. Jobs are not held for an agent that is busy with as many jobs as it
+// has slots; busy memoizes that per agent.
+func (q *JobQueue) heldLocked(job *Job, agentID string, now time.Time, busy map[string]bool) time.Duration {
+	if job.affinity == "" || job.affinity == agentID {
+		return 0
+	}
+	left := q.prefixes.wait - now.Sub(job.queuedAt)
+	if left <= 0 {
+		return 0
+	}
+	isBusy, ok := busy[job.affinity]
+	if !ok {
+		running := 0
+		for _, j := range q.jobs {
+			if j.AgentID == job.affinity && !j.finished {
+				running++
+			}
+		}
+		isBusy = running >= q.prefixes.Slots(job.affinity)
+		busy[job.affinity] = isBusy
+	}
+	if isBusy {
+		return 0
+	}
+	return left
+}
+
+// dispatchesFirst reports whether a goes ahead of b, ignoring aging:
+// interactive before batch, then by start tag, then in submission order
+func dispatchesFirst(a, b *Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority == PriorityInteractive
+	}
+	if a.startTag != b.startTag {
+		return a.startTag < b.startTag
+	}
+	return a.seq < b.seq
+}
+
+// Deliver routes a result post from an agent to the job's waiting handler.
+// It blocks while the handler catches up, so slow clients slow the agent
+// down rather than buffering unbounded output on the server.
+func (q *JobQueue) Deliver(ctx context.Context, agentID string, result shared.ResultRequest) error {
+	q.mu.Lock()
+	job, ok := q.jobs[result.RequestID]
+	leased := ok && job.AgentID == agentID
+	cancelled := ok && isClosed(job.cancelled)
+	if leased && !cancelled && !job.finished && result.Released {
+		q.releaseLocked(job, "released by agent")
+		q.mu.Unlock()
+		return nil
+	}
+	if leased && !cancelled && (len(result.Tokens) > 0 || len(result.Embeddings) > 0) {
+		job.started = true
+	}
+	if leased && !cancelled && (result.Finished || result.Error != nil) {
+		job.finished = true
+	}
+	aborted := !ok && q.forgetAbortedLocked(agentID, result.RequestID)
+	q.mu.Unlock()
+
+	if aborted {
+		return errJobCancelled
+	}
+	if !ok {
+		return errJobNotFound
+	}
+	if !leased {
+		return errJobNotLeased
+	}
+	if cancelled {
+		return errJobCancelled
+	}
+
+	select {
+	case job.results <- result:
+		return nil
+	case <-job.done:
+		return errJobNotFound
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Finish removes a job from the queue, whether or not it was leased.
+// Later result posts for the job are rejected. If an agent is still
+// running the job, it is told to stop with its next heartbeat.
+func (q *JobQueue) Finish(jobID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[jobID]
+	if !ok {
+		return
+	}
+	delete(q.jobs, jobID)
+	q.removePendingLocked(job)
+	if job.AgentID != "" && !job.finished {
+		aborted := append(q.aborted[job.AgentID], job.ID)
+		if len(aborted) > maxCancelledPerAgent {
+			aborted = aborted[len(aborted)-maxCancelledPerAgent:]
+		}
+		q.aborted[job.AgentID] = aborted
+		job.leaseSpan.SetAttr("aborted", true)
+	}
+	job.waitSpan.End()
+	job.leaseSpan.End()
+	close(job.done)
+}
+
+// Cancel cancels a client's jobs: the job with the given ID, or every job
+// of the request if the ID is a request's response ID. Waiting handlers
+// see the jobs' Cancelled channels close and give up on them. It returns
+// the number of jobs cancelled.
+func (q *JobQueue) Cancel(keyID, id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for jobID, job := range q.jobs {
+		if job.KeyID != keyID || isClosed(job.cancelled) || job.finished {
+			continue
+		}
+		if !isJobOf(jobID, id) {
+			continue
+		}
+		q.removePendingLocked(job)
+		close(job.cancelled)
+		n++
+	}
+	return n
+}
+
+// isJobOf reports whether jobID is the job named id, or one of the numbered
+// jobs, id-0, id-1 and so on, of the request whose response ID is id
+func isJobOf(jobID, id string) bool {
+	if jobID == id {
+		return true
+	}
+	n, ok := strings.CutPrefix(jobID, id+"-")
+	if !ok || n == "" {
+		return false
+	}
+	for _, c := range n {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ReleaseAgent takes back every unfinished job leased to an agent, e.g.
+// because it went to sleep or stopped sending heartbeats. It returns the
+// number of jobs released.
+func (q *JobQueue) ReleaseAgent(agentID, reason string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, job := range q.jobs {
+		if job.AgentID != agentID || job.finished || isClosed(job.cancelled) {
+			continue
+		}
+		q.releaseLocked(job, reason)
+		n++
+	}
+	return n
+}
+
+// releaseLocked takes a job back from the agent it is leased to. A job
+// that has not produced output goes back on the queue for another agent;
+// one that has is failed, since its client already has part of the answer.
+func (q *JobQueue) releaseLocked(job *Job, reason string) {
+	agentID := job.AgentID
+	jobLogger(job).Info("Job released", "agent_id", agentID, "reason", reason, "requeued", !job.started)
+	job.leaseSpan.SetAttr("released", reason)
+
+	if job.started {
+		job.finished = true
+		msg := "agent stopped running the job: " + reason
+		go func() {
+			select {
+			case job.results <- shared.ResultRequest{RequestID: job.ID, Finished: true, Error: &msg}:
+			case <-job.done:
+			}
+		}()
+		return
+	}
+
+	job.leaseSpan.End()
+	job.leaseSpan = nil
+	job.AgentID = ""
+	job.LeasedAt = time.Time{}
+	if job.affinity == agentID {
+		job.affinity = ""
+	}
+	job.waitSpan = q.tracer.StartWithParent(job.Trace, "queue.wait")
+	job.waitSpan.SetAttr("job_id", job.ID)
+	job.waitSpan.SetAttr("model", job.Request.Model)
+	job.waitSpan.SetAttr("requeued_from", agentID)
+
+	// The job keeps its start tag, so it goes ahead of work submitted since
+	q.pending = append(q.pending, job)
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// AbortedJobs returns and forgets the jobs the agent is still running
+// although nobody waits for their results any more
+func (q *JobQueue) AbortedJobs(agentID string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	aborted := q.aborted[agentID]
+	delete(q.aborted, agentID)
+	return aborted
+}
+
+// forgetAbortedLocked reports whether the job was aborted on the agent and,
+// if so, forgets it; the agent learns from the rejected result post instead
+func (q *JobQueue) forgetAbortedLocked(agentID, jobID string) bool {
+	aborted := q.aborted[agentID]
+	for i, id := range aborted {
+		if id == jobID {
+			q.aborted[agentID] = append(aborted[:i], aborted[i+1:]...)
+			if len(q.aborted[agentID]) == 0 {
+				delete(q.aborted, agentID)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// removePendingLocked takes a job off the pending list if it was never leased
+func (q *JobQueue) removePendingLocked(job *Job) {
+	for i, p := range q.pending {
+		if p == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			job.waitSpan.SetAttr("abandoned", true)
+			return
+		}
+	}
+}
+
+// isClosed reports whether a signal channel has been closed
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// AgentOf returns the agent a job is leased to, or "" if it never was
+func (q *JobQueue) AgentOf(job *Job) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return job.AgentID
+}
+
+// LeasedAt returns when a job was leased, or the zero time if it wasn't yet
+func (q *JobQueue) LeasedAt(job *Job) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return job.LeasedAt
+}
+
+// LeaseContext returns the span context of the job's lease, which the agent
+// continues when it runs the job
+func (q *JobQueue) LeaseContext(job *Job) shared.SpanContext {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return job.leaseSpan.SpanContext()
+}
+
+// FirstToken records that a job produced its first output and returns the
+// time to first token. It returns false if output had already arrived.
+func (q *JobQueue) FirstToken(job *Job) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !job.FirstTokenAt.IsZero() {
+		return 0, false
+	}
+	job.FirstTokenAt = time.Now()
+	ttft := job.FirstTokenAt.Sub(job.CreatedAt)
+	job.leaseSpan.SetAttr("time_to_first_token_ms", ttft.Milliseconds())
+	return ttft, true
+}
+
+// Depth returns the number of jobs waiting for an agent, by priority
+func (q *JobQueue) Depth() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	depth := make(map[string]int, len(q.classes))
+	for p := range q.classes {
+		depth[p] = 0
+	}
+	for _, job := range q.pending {
+		depth[job.Priority]++
+	}
+	return depth
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// fakeClock is a clock for the job queue that only moves when told to
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// newTestQueue returns a queue without prefix affinity on a fake clock
+func newTestQueue(agingAfter time.Duration) (*JobQueue, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	q := NewJobQueue(shared.NewTracer(nil), agingAfter, NewPrefixIndex(0))
+	q.now = clock.now
+	return q, clock
+}
+
+// submitJob queues a job for a key
+func submitJob(q *JobQueue, id, keyID, priority string, weight float64, cost int) *Job {
+	job := NewJob(id, keyID, shared.CompletionRequest{Model: "llama", Prompt: id})
+	job.Priority, job.Weight, job.Cost = priority, weight, cost
+	q.Submit(job)
+	return job
+}
+
+// leaseIDs leases up to n jobs without waiting and returns their IDs
+func leaseIDs(q *JobQueue, n int) []string {
+	serves := func(*Job) bool { return true }
+	var ids []string
+	for i := 0; i < n; i++ {
+		job := q.Lease(context.Background(), "agent-1", serves, 0)
+		if job == nil {
+			break
+		}
+		ids = append(ids, job.ID)
+	}
+	return ids
+}
+
+func TestJobQueueWeightedShares(t *testing.T) {
+	q, _ := newTestQueue(0)
+	for i := 0; i < 20; i++ {
+		submitJob(q, fmt.Sprintf("heavy-%d", i), "heavy", PriorityInteractive, 3, 100)
+	}
+	for i := 0; i < 20; i++ {
+		submitJob(q, fmt.Sprintf("light-%d", i), "light", PriorityInteractive, 1, 100)
+	}
+
+	// While both keys have work queued, a key with three times the weight
+	// gets three times the agent time
+	counts := make(map[string]int)
+	for _, id := range leaseIDs(q, 20) {
+		key, _, _ := strings.Cut(id, "-")
+		counts[key]++
+	}
+	if counts["heavy"] != 15 || counts["light"] != 5 {
+		t.Errorf("leased %d heavy and %d light jobs of the first 20, want 15 and 5", counts["heavy"], counts["light"])
+	}
+}
+
+func TestJobQueueCostCountsAgainstShare(t *testing.T) {
+	q, _ := newTestQueue(0)
+	submitJob(q, "big-0", "big", PriorityInteractive, 1, 1000)
+	submitJob(q, "big-1", "big", PriorityInteractive, 1, 1000)
+	for i := 0; i < 3; i++ {
+		submitJob(q, fmt.Sprintf("small-%d", i), "small", PriorityInteractive, 1, 100)
+	}
+
+	// The big key's second job starts after its first one's cost is paid
+	// for, so the small key's cheap jobs go in between
+	got := fmt.Sprint(leaseIDs(q, 5))
+	if want := "[big-0 small-0 small-1 small-2 big-1]"; got != want {
+		t.Errorf("lease order %s, want %s", got, want)
+	}
+}
+
+func TestJobQueueIdleKeyGetsNoBurst(t *testing.T) {
+	q, _ := newTestQueue(0)
+	for i := 0; i < 4; i++ {
+		submitJob(q, fmt.Sprintf("busy-%d", i), "busy", PriorityInteractive, 1, 100)
+	}
+	leaseIDs(q, 2)
+
+	// A key that was idle starts at the class's virtual time, level with
+	// the busy key, so the two alternate rather than the idle key draining
+	// its queue first
+	for i := 0; i < 3; i++ {
+		submitJob(q, fmt.Sprintf("idle-%d", i), "idle", PriorityInteractive, 1, 100)
+	}
+	got := fmt.Sprint(leaseIDs(q, 5))
+	if want := "[idle-0 busy-2 idle-1 busy-3 idle-2]"; got != want {
+		t.Errorf("lease order %s, want %s", got, want)
+	}
+}
+
+func TestJobQueueInteractiveBeforeBatch(t *testing.T) {
+	q, clock := newTestQueue(30 * time.Second)
+	submitJob(q, "batch-0", "key", PriorityBatch, 1, 10)
+	submitJob(q, "batch-1", "key", PriorityBatch, 1, 10)
+	clock.advance(time.Second)
+	submitJob(q, "chat-0", "key", PriorityInteractive, 1, 10)
+	submitJob(q, "chat-1", "other", PriorityInteractive, 1, 10)
+	submitJob(q, "chat-2", "key", "", 1, 10) // no priority means interactive
+
+	if depth := q.Depth(); depth[PriorityInteractive] != 3 || depth[PriorityBatch] != 2 {
+		t.Errorf("depth = %v, want 3 interactive and 2 batch", depth)
+	}
+	got := fmt.Sprint(leaseIDs(q, 6))
+	if want := "[chat-0 chat-1 chat-2 batch-0 batch-1]"; got != want {
+		t.Errorf("lease order %s, want %s", got, want)
+	}
+}
+
+func TestJobQueueAging(t *testing.T) {
+	q, clock := newTestQueue(30 * time.Second)
+	submitJob(q, "batch-0", "key", PriorityBatch, 1, 10)
+	clock.advance(10 * time.Second)
+	submitJob(q, "batch-1", "key", PriorityBatch, 1, 10)
+	for i := 0; i < 4; i++ {
+		submitJob(q, fmt.Sprintf("chat-%d", i), "key", PriorityInteractive, 1, 10)
+	}
+
+	// Nothing has waited long enough yet
+	if got := fmt.Sprint(leaseIDs(q, 1)); got != "[chat-0]" {
+		t.Fatalf("before aging leased %s, want [chat-0]", got)
+	}
+
+	// batch-0 has now waited 30s and goes ahead of interactive work
+	clock.advance(20 * time.Second)
+	if got := fmt.Sprint(leaseIDs(q, 2)); got != "[batch-0 chat-1]" {
+		t.Fatalf("after batch-0 aged leased %s, want [batch-0 chat-1]", got)
+	}
+
+	// Once batch-1 has too, it goes next
+	clock.advance(10 * time.Second)
+	if got := fmt.Sprint(leaseIDs(q, 3)); got != "[batch-1 chat-2 chat-3]" {
+		t.Errorf("after batch-1 aged leased %s, want [batch-1 chat-2 chat-3]", got)
+	}
+}
+
+func TestJobQueueAgingOldestFirst(t *testing.T) {
+	q, clock := newTestQueue(30 * time.Second)
+
+	// A heavier key's later job has the lower start tag, but aged jobs go
+	// in the order they were queued
+	submitJob(q, "batch-0", "light", PriorityBatch, 1, 1000)
+	submitJob(q, "batch-1", "light", PriorityBatch, 1, 1000)
+	clock.advance(time.Second)
+	submitJob(q, "batch-2", "heavy", PriorityBatch, 10, 10)
+	submitJob(q, "chat-0", "key", PriorityInteractive, 1, 10)
+	clock.advance(time.Minute)
+
+	got := fmt.Sprint(leaseIDs(q, 4))
+	if want := "[batch-0 batch-1 batch-2 chat-0]"; got != want {
+		t.Errorf("lease order %s, want %s", got, want)
+	}
+}
+
+func TestJobQueueAgingDisabled(t *testing.T) {
+	q, clock := newTestQueue(0)
+	submitJob(q, "batch-0", "key", PriorityBatch, 1, 10)
+	clock.advance(time.Hour)
+	submitJob(q, "chat-0", "key", PriorityInteractive, 1, 10)
+
+	if got := fmt.Sprint(leaseIDs(q, 2)); got != "[chat-0 batch-0]" {
+		t.Errorf("lease order %s, want [chat-0 batch-0]", got)
+	}
+}
+
+func TestJobQueueLeaseWaits(t *testing.T) {
+	q, _ := newTestQueue(0)
+	serves := func(job *Job) bool { return job.Request.Model == "llama" }
+
+	// Jobs for other models are left for other agents
+	other := NewJob("other", "key", shared.CompletionRequest{Model: "mistral"})
+	q.Submit(other)
+	if job := q.Lease(context.Background(), "agent-1", serves, 10*time.Millisecond); job != nil {
+		t.Fatalf("leased %s for a model the agent doesn't serve", job.ID)
+	}
+
+	// A job submitted while the agent waits is handed to it
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		submitJob(q, "late", "key", PriorityInteractive, 1, 10)
+	}()
+	job := q.Lease(context.Background(), "agent-1", serves, 5*time.Second)
+	if job == nil || job.ID != "late" {
+		t.Fatalf("leased %v, want the late job", job)
+	}
+	if q.AgentOf(job) != "agent-1" || q.LeasedAt(job).IsZero() {
+		t.Errorf("job leased to %q at %v, want agent-1 and a lease time", q.AgentOf(job), q.LeasedAt(job))
+	}
+}
+
+func TestJobQueueFirstToken(t *testing.T) {
+	q, _ := newTestQueue(0)
+	job := submitJob(q, "job", "key", PriorityInteractive, 1, 10)
+	leaseIDs(q, 1)
+
+	// Releasing the job clears its lease span while the client handler
+	// records the first token; run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.ReleaseAgent("agent-1", "test")
+	}()
+	_, first := q.FirstToken(job)
+	<-done
+	if !first {
+		t.Error("first token not recorded")
+	}
+	if _, again := q.FirstToken(job); again {
+		t.Error("second token recorded as the first")
+	}
+	if sc := q.LeaseContext(job); sc.IsValid() {
+		t.Errorf("released job still has lease context %v", sc)
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	q, _ := newTestQueue(0)
+	single := submitJob(q, "chatcmpl-abc", "key", PriorityInteractive, 1, 1)
+	choices := []*Job{
+		submitJob(q, "cmpl-def-0", "key", PriorityInteractive, 1, 1),
+		submitJob(q, "cmpl-def-1", "key", PriorityInteractive, 1, 1),
+	}
+	other := submitJob(q, "cmpl-ghi", "other-key", PriorityInteractive, 1, 1)
+
+	if n := q.Cancel("key", "cmpl-def"); n != 2 || !isClosed(choices[0].cancelled) || !isClosed(choices[1].cancelled) {
+		t.Errorf("cancelling a request with two choices cancelled %d jobs, want both", n)
+	}
+	if n := q.Cancel("key", "chatcmpl-abc"); n != 1 || !isClosed(single.cancelled) {
+		t.Errorf("cancelling a single job cancelled %d jobs, want it", n)
+	}
+	if n := q.Cancel("key", "cmpl-ghi"); n != 0 || isClosed(other.cancelled) {
+		t.Errorf("cancelled %d jobs of another key", n)
+	}
+}
+
+func TestJobQueueCancelPrefixCancelsNothing(t *testing.T) {
+	q, _ := newTestQueue(0)
+	jobs := []*Job{
+		submitJob(q, "chatcmpl-abc", "key", PriorityInteractive, 1, 1),
+		submitJob(q, "cmpl-def-0", "key", PriorityInteractive, 1, 1),
+		submitJob(q, "cmpl-def-1", "key", PriorityInteractive, 1, 1),
+	}
+	for _, id := range []string{"chatcmpl", "cmpl", "cmpl-d", "cmpl-def-", ""} {
+		if n := q.Cancel("key", id); n != 0 {
+			t.Errorf("Cancel(%q) cancelled %d jobs, want none", id, n)
+		}
+	}
+	for _, job := range jobs {
+		if isClosed(job.cancelled) {
+			t.Errorf("job %s was cancelled", job.ID)
+		}
+	}
+}
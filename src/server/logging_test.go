@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// captureLogs sends the default logger to a buffer until the test ends
+func captureLogs(t *testing.T, level, format string) *bytes.Buffer {
+	t.Helper()
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, level, format); err != nil {
+		t.Fatalf("setupLogging: %v", err)
+	}
+	return &buf
+}
+
+func TestSetupLoggingLevel(t *testing.T) {
+	logs := captureLogs(t, "warn", "text")
+	slog.Info("quiet")
+	slog.Warn("loud")
+	if got := logs.String(); strings.Contains(got, "quiet") || !strings.Contains(got, "loud") {
+		t.Errorf("logged %q, want only the warning", got)
+	}
+}
+
+func TestSetupLoggingJSON(t *testing.T) {
+	logs := captureLogs(t, "info", "json")
+	slog.Info("hello", "request_id", "req-1")
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", logs, err)
+	}
+	if line["msg"] != "hello" || line["request_id"] != "req-1" {
+		t.Errorf("log line %v", line)
+	}
+}
+
+func TestSetupLoggingRejectsUnknownLevel(t *testing.T) {
+	if err := setupLogging(&bytes.Buffer{}, "verbose", "text"); err == nil {
+		t.Error("accepted log level verbose")
+	}
+}
+
+// getWithRequestID sends a GET with the X-Request-ID header and returns the
+// response's
+func getWithRequestID(t *testing.T, url, id string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(requestIDHeader, id)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get(requestIDHeader)
+}
+
+func TestRequestIDEchoed(t *testing.T) {
+	srv := newTestServer(t, newTestHandlers(t))
+	if got := getWithRequestID(t, srv.URL+"/health", "client-req-7"); got != "client-req-7" {
+		t.Errorf("response request ID %q, want the client's", got)
+	}
+}
+
+func TestRequestIDReplacedWhenUnsafe(t *testing.T) {
+	srv := newTestServer(t, newTestHandlers(t))
+	if got := getWithRequestID(t, srv.URL+"/health", "two words"); got == "" || got == "two words" {
+		t.Errorf("response request ID %q, want a generated one", got)
+	}
+}
+
+func TestRequestIDReachesAgent(t *testing.T) {
+	seen := make(chan string, 1)
+	p := newTestPool(t, func(work shared.WorkResponse) shared.ResultRequest {
+		seen <- work.CorrelationID
+		return reply("ok")(work)
+	})
+
+	body, _ := json.Marshal(shared.CompletionRequest{Model: testModel, Prompt: "Hello"})
+	req, err := http.NewRequest(http.MethodPost, p.srv.URL+"/v1/completions", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.client)
+	req.Header.Set(requestIDHeader, "client-req-9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := <-seen; got != "client-req-9" {
+		t.Errorf("agent got correlation ID %q, want the client's request ID", got)
+	}
+}
@@ -4,22 +4,36 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
 )
 
 // Config holds the server configuration
 type Config struct {
 	Addr              string
 	DBPath            string
-	AdminAPIKey       string
-	HeartbeatInterval int           // seconds
-	StaleTimeout      time.Duration // how long before agent is marked offline
+	AdminAPIKey       string        // bootstrap key with admin scopes, used to mint real keys
+	HeartbeatInterval int           // seconds; the base each agent's interval is adapted from
+	RequestTimeout    time.Duration // max time a completion may take end to end
+	BatchAging        time.Duration // how long batch jobs wait before they jump ahead of interactive ones
+	BatchConcurrency  int           // requests of one batch in flight at a time
+	AffinityWait      time.Duration // how long a job waits for the agent caching its prompt prefix; 0 disables
+	WarmReplicaRPM    float64       // demand one warm model replica is planned for; 0 keeps only pinned replicas warm
+	DefaultLimits     RateLimits    // per-key limits for keys that don't set their own
+	StaleTimeout      time.Duration // how long before an agent with no recorded heartbeat interval is marked offline
+	MaxSuspend        time.Duration // how long a sleeping agent is kept suspended, at most, before its stale timeout starts
 	CleanupInterval   time.Duration // how often to check for stale agents
+	LogLevel          string        // debug, info, warn or error
+	LogFormat         string        // text or json
+	OTLPEndpoint      string        // OTLP/HTTP collector base URL; empty disables span export
+	ConfigPath        string        // optional JSON/YAML file with the model registry
+	AgentChannel      string        // optional JSON/YAML update channel manifest; agent binaries live next to it
 }
 
 func main() {
@@ -27,12 +41,57 @@ func main() {
 	config := Config{}
 	flag.StringVar(&config.Addr, "addr", ":8080", "Server listen address")
 	flag.StringVar(&config.DBPath, "db", "gpupool.db", "SQLite database path")
-	flag.StringVar(&config.AdminAPIKey, "admin-key", "", "Admin API key (required)")
-	flag.IntVar(&config.HeartbeatInterval, "heartbeat-interval", 30, "Heartbeat interval in seconds")
-	flag.DurationVar(&config.StaleTimeout, "stale-timeout", 90*time.Second, "Time before agent is marked offline")
+	flag.StringVar(&config.AdminAPIKey, "admin-key", "", "Bootstrap admin API key used to mint scoped keys (required)")
+	flag.IntVar(&config.HeartbeatInterval, "heartbeat-interval", 30, "Base heartbeat interval in seconds; agents are given shorter or longer intervals by load and fleet size")
+	flag.DurationVar(&config.StaleTimeout, "stale-timeout", 90*time.Second, "Time before an agent with no recorded heartbeat interval is marked offline (others get interval x 3)")
+	flag.DurationVar(&config.MaxSuspend, "max-suspend", 24*time.Hour, "Longest an agent whose host went to sleep is waited for before it can go stale; agents may ask for less")
 	flag.DurationVar(&config.CleanupInterval, "cleanup-interval", 30*time.Second, "Stale agent cleanup interval")
+	flag.DurationVar(&config.RequestTimeout, "request-timeout", 5*time.Minute, "Maximum duration of a completion request")
+	flag.IntVar(&config.BatchConcurrency, "batch-concurrency", 8, "Requests of one batch submitted to the queue at a time")
+	flag.DurationVar(&config.AffinityWait, "affinity-wait", 2*time.Second, "How long a job is held for an idle agent caching its prompt prefix (0 = no prefix affinity)")
+	flag.Float64Var(&config.WarmReplicaRPM, "warm-replica-rpm", 30, "Requests per minute one preloaded model replica is planned for (0 = only registry min_replicas)")
+	flag.DurationVar(&config.BatchAging, "batch-aging", 30*time.Second, "Queue wait after which batch jobs go ahead of interactive ones (0 = never)")
+	flag.IntVar(&config.DefaultLimits.RequestsPerMinute, "rate-rpm", 60, "Default requests per minute per API key (0 = unlimited)")
+	flag.IntVar(&config.DefaultLimits.TokensPerMinute, "rate-tpm", 100000, "Default tokens per minute per API key (0 = unlimited)")
+	flag.IntVar(&config.DefaultLimits.DailyTokens, "quota-daily-tokens", 0, "Default daily token quota per API key (0 = unlimited)")
+	flag.IntVar(&config.DefaultLimits.MonthlyTokens, "quota-monthly-tokens", 0, "Default monthly token quota per API key (0 = unlimited)")
+	flag.StringVar(&config.LogLevel, "log-level", "info", "Log level: debug, info, warn, error")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "Log format: text, json")
+	flag.StringVar(&config.OTLPEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector URL for trace export (empty = disabled)")
+	flag.StringVar(&config.ConfigPath, "config", "", "Server config file (JSON or YAML) with the model registry")
+	flag.StringVar(&config.AgentChannel, "agent-channel", "", "Agent update channel manifest (JSON or YAML) with the minimum and latest agent versions; signed binaries live next to it (empty = no updates)")
 	flag.Parse()
 
+	if err := setupLogging(os.Stderr, config.LogLevel, config.LogFormat); err != nil {
+		fatal("Invalid logging flags", "err", err)
+	}
+
+	// Load the config file; explicit flags win over its values
+	var models []shared.ModelConfig
+	var aliases map[string]string
+	if config.ConfigPath != "" {
+		file, err := shared.LoadServerConfig(config.ConfigPath)
+		if err != nil {
+			fatal("Failed to load config file", "path", config.ConfigPath, "err", err)
+		}
+		applyConfigFile(&config, file)
+		models, aliases = file.ModelRegistry, file.ModelAliases
+	}
+	registry, err := NewModelRegistry(models, aliases)
+	if err != nil {
+		fatal("Invalid model registry", "err", err)
+	}
+
+	var updates *UpdateChannel
+	if config.AgentChannel != "" {
+		updates, err = NewUpdateChannel(config.AgentChannel)
+		if err != nil {
+			fatal("Failed to open agent update channel", "err", err)
+		}
+		minimum, latest := updates.Versions()
+		slog.Info("Serving agent updates", "channel", config.AgentChannel, "minimum_version", minimum, "latest_version", latest)
+	}
+
 	// Allow env var override
 	if envKey := os.Getenv("GPUPOOL_ADMIN_KEY"); envKey != "" {
 		config.AdminAPIKey = envKey
@@ -46,41 +105,48 @@ func main() {
 
 	// Validate config
 	if config.AdminAPIKey == "" {
-		log.Fatal("Admin API key is required (use -admin-key or GPUPOOL_ADMIN_KEY)")
+		fatal("Admin API key is required (use -admin-key or GPUPOOL_ADMIN_KEY)")
 	}
 
 	// Open database
 	db, err := OpenDB(config.DBPath)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		fatal("Failed to open database", "err", err)
 	}
 	defer db.Close()
 
-	// Create handlers
-	handlers := NewHandlers(db, config.AdminAPIKey, config.HeartbeatInterval)
+	// Set up tracing; without an endpoint spans are still propagated to
+	// agents but not exported
+	var exporter shared.SpanExporter
+	if config.OTLPEndpoint != "" {
+		exporter = shared.NewOTLPExporter(config.OTLPEndpoint, "gpupool-server")
+		slog.Info("Exporting traces", "endpoint", config.OTLPEndpoint)
+	}
+	tracer := shared.NewTracer(exporter)
 
-	// Set up routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/agents/register", handlers.HandleRegister)
-	mux.HandleFunc("/v1/agents/", handlers.HandleHeartbeat) // Matches /v1/agents/{id}/heartbeat
-	mux.HandleFunc("/v1/admin/agents", handlers.HandleAdminAgents)
-	mux.HandleFunc("/health", handlers.HandleHealth)
+	// Create handlers
+	prefixes := NewPrefixIndex(config.AffinityWait)
+	queue := NewJobQueue(tracer, config.BatchAging, prefixes)
+	metrics := NewMetrics()
+	handlers := NewHandlers(db, queue, prefixes, metrics, tracer, registry, updates, config)
 
 	// Create server
 	server := &http.Server{
 		Addr:         config.Addr,
-		Handler:      mux,
+		Handler:      newRouter(handlers, tracer),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	// Start scheduler
+	// Start scheduler, batch runner and warm pool planner
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	scheduler := NewScheduler(db, config.StaleTimeout, config.CleanupInterval)
+	scheduler := NewScheduler(db, queue, metrics, config.StaleTimeout, config.CleanupInterval)
 	go scheduler.Run(ctx)
+	go handlers.batches.Run(ctx)
+	go handlers.warm.Run(ctx)
 
 	// Handle shutdown
 	done := make(chan bool)
@@ -89,27 +155,83 @@ func main() {
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		<-sigChan
 
-		log.Println("Shutting down...")
-		cancel() // Stop scheduler
+		slog.Info("Shutting down")
+		cancel() // Stop background tasks
 
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutdownCancel()
 
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			log.Printf("Error during shutdown: %v", err)
+			slog.Error("Error during shutdown", "err", err)
+		}
+		if exporter != nil {
+			if err := exporter.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Error flushing traces", "err", err)
+			}
 		}
 		done <- true
 	}()
 
 	// Start server
-	log.Printf("Server starting on %s", config.Addr)
-	log.Printf("Database: %s", config.DBPath)
-	log.Printf("Heartbeat interval: %ds, stale timeout: %v", config.HeartbeatInterval, config.StaleTimeout)
+	slog.Info("Server starting", "addr", config.Addr, "db", config.DBPath,
+		"heartbeat_interval_sec", config.HeartbeatInterval, "stale_timeout", config.StaleTimeout.String())
 
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+		fatal("Server error", "err", err)
 	}
 
 	<-done
-	log.Println("Server stopped")
+	slog.Info("Server stopped")
+}
+
+// newRouter routes the API to the handlers, wrapped in request IDs and tracing
+func newRouter(h *Handlers, tracer *shared.Tracer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agents/register", h.HandleRegister)
+	mux.HandleFunc("/v1/agents/", h.HandleAgent)              // Matches /v1/agents/{id}[/{heartbeat,work,result}]
+	mux.HandleFunc("/v1/agent-updates/", h.HandleAgentUpdate) // Matches /v1/agent-updates/{version}/{binary}
+	mux.HandleFunc("/v1/completions", h.HandleCompletions)
+	mux.HandleFunc("/v1/chat/completions", h.HandleChatCompletions)
+	mux.HandleFunc("/v1/messages", h.HandleMessages)
+	mux.HandleFunc("/v1/embeddings", h.HandleEmbeddings)
+	mux.HandleFunc("/v1/batches", h.HandleBatches)
+	mux.HandleFunc("/v1/batches/", h.HandleBatch) // Matches /v1/batches/{id}[/cancel|/results]
+	mux.HandleFunc("/v1/jobs/", h.HandleJob)      // Matches /v1/jobs/{id}
+	mux.HandleFunc("/v1/admin/agents", h.HandleAdminAgents)
+	mux.HandleFunc("/v1/admin/keys", h.HandleAdminKeys)
+	mux.HandleFunc("/v1/admin/keys/", h.HandleAdminKey) // Matches /v1/admin/keys/{id}
+	mux.HandleFunc("/v1/admin/enrollment-tokens", h.HandleAdminEnrollment)
+	mux.HandleFunc("/v1/admin/usage", h.HandleAdminUsage)
+	mux.HandleFunc("/v1/admin/usage/export", h.HandleAdminUsageExport)
+	mux.HandleFunc("/v1/admin/stats", h.HandleAdminStats)
+	mux.HandleFunc("/health", h.HandleHealth)
+	mux.HandleFunc("/metrics", h.HandleMetrics)
+
+	return withRequestID(withTracing(tracer, mux))
+}
+
+// applyConfigFile copies settings from the config file into config unless
+// the matching flag was given on the command line
+func applyConfigFile(config *Config, file *shared.ServerConfig) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if !set["addr"] {
+		config.Addr = file.ListenAddr
+	}
+	if !set["db"] {
+		config.DBPath = file.DatabasePath
+	}
+	if !set["stale-timeout"] {
+		config.StaleTimeout = file.StaleAgentThreshold
+	}
+	if !set["request-timeout"] {
+		config.RequestTimeout = file.RequestTimeout
+	}
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
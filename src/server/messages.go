@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// HandleMessages handles POST /v1/messages
+// It serves Anthropic Messages API clients: the system prompt and messages
+// are rendered with the model's chat template and run as a single job.
+func (h *Handlers) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	f := &messagesFormat{}
+	if r.Method != http.MethodPost {
+		h.writeFormatError(w, f, http.StatusMethodNotAllowed, shared.ErrInvalidRequest.WithDetails("only POST is allowed"))
+		return
+	}
+
+	key, ok := h.requireClient(w, r, f)
+	if !ok {
+		return
+	}
+
+	req, err := shared.ParseJSON[shared.MessagesRequest](r)
+	if err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+	if req.Model == "" || len(req.Messages) == 0 {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("model and messages are required"))
+		return
+	}
+	if req.MaxTokens <= 0 {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("max_tokens must be positive"))
+		return
+	}
+	if len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]" {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("tool use is not supported"))
+		return
+	}
+	for _, m := range req.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("message role must be user or assistant, got "+m.Role))
+			return
+		}
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 1) {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails("temperature must be between 0 and 1"))
+		return
+	}
+	sampling := shared.SamplingParams{Temperature: req.Temperature, TopP: req.TopP, TopK: req.TopK, Stop: req.StopSequences}
+	if err := validateSampling(sampling); err != nil {
+		h.writeFormatError(w, f, http.StatusBadRequest, shared.ErrInvalidRequest.WithDetails(err.Error()))
+		return
+	}
+
+	model := h.models.Resolve(req.Model)
+	if !key.AllowsModel(model) {
+		h.writeFormatError(w, f, http.StatusForbidden, shared.ErrForbidden.WithDetails("model "+model+" is not allowed for this key"))
+		return
+	}
+
+	// A trailing assistant message prefills the reply: generation continues
+	// from its text rather than starting a new turn
+	messages := req.Messages
+	var prefill string
+	if last := messages[len(messages)-1]; last.Role == "assistant" {
+		prefill = string(last.Content)
+		messages = messages[:len(messages)-1]
+	}
+	if req.System != "" {
+		messages = append([]shared.ChatMessage{{Role: "system", Content: req.System}}, messages...)
+	}
+
+	tmpl := h.models.ChatTemplate(model)
+	prompt, err := tmpl.Render(messages)
+	if err != nil {
+		requestLogger(r).Error("Error rendering chat template", "model", model, "err", err)
+		h.writeFormatError(w, f, http.StatusInternalServerError, shared.ErrInternalServer.WithDetails(err.Error()))
+		return
+	}
+	sampling.Stop = append(append(shared.StopSequences{}, sampling.Stop...), tmpl.Stop()...)
+
+	f.id = "msg_" + uuid.New().String()
+	f.model = req.Model
+
+	h.serveCompletion(w, r, key, &shared.CompletionRequest{
+		Model:          model,
+		Prompt:         prompt + prefill,
+		MaxTokens:      req.MaxTokens,
+		Stream:         req.Stream,
+		SamplingParams: sampling,
+	}, 1, f)
+}
+
+// messagesFormat is the Anthropic Messages API format
+type messagesFormat struct {
+	id         string
+	model      string
+	stopReason string // set by writeFinish, sent in message_delta
+}
+
+// anthropicError is the Anthropic error envelope. XPoolError carries the
+// pool's own error code, which has no Anthropic equivalent.
+type anthropicError struct {
+	Type  string             `json:"type"` // "error"
+	Error anthropicErrorBody `json:"error"`
+}
+
+type anthropicErrorBody struct {
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+	XPoolError string `json:"x_pool_error,omitempty"`
+}
+
+// anthropicErrorTypes maps protocol error codes to Anthropic error types.
+// Capacity problems are overloaded_error so that clients retry with backoff.
+var anthropicErrorTypes = map[string]string{
+	shared.ErrInvalidRequest.Code:    "invalid_request_error",
+	shared.ErrUnauthorized.Code:      "authentication_error",
+	shared.ErrForbidden.Code:         "permission_error",
+	shared.ErrModelNotFound.Code:     "not_found_error",
+	shared.ErrRateLimited.Code:       "rate_limit_error",
+	shared.ErrCancelled.Code:         "invalid_request_error",
+	shared.ErrNoCapableAgents.Code:   "overloaded_error",
+	shared.ErrNoAvailableAgents.Code: "overloaded_error",
+}
+
+// toAnthropicError converts a protocol error to the Anthropic error envelope
+func toAnthropicError(err *shared.ProtocolError) anthropicError {
+	typ, ok := anthropicErrorTypes[err.Code]
+	if !ok {
+		typ = "api_error"
+	}
+	msg := err.Message
+	if err.Details != "" {
+		msg += ": " + err.Details
+	}
+	return anthropicError{Type: "error", Error: anthropicErrorBody{Type: typ, Message: msg, XPoolError: err.Code}}
+}
+
+// anthropicStopReason maps a finish reason to an Anthropic stop_reason.
+// Agents don't report which stop sequence matched, so stops are end_turn.
+func anthropicStopReason(reason string) string {
+	if reason == "length" {
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+func (f *messagesFormat) responseID() string { return f.id }
+
+func (f *messagesFormat) writeError(w http.ResponseWriter, status int, err *shared.ProtocolError) {
+	shared.WriteJSON(w, status, toAnthropicError(err))
+}
+
+func (f *messagesFormat) message(content []shared.MessagesContentBlock, stopReason *string, usage shared.MessagesUsage) shared.MessagesResponse {
+	return shared.MessagesResponse{
+		ID:         f.id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      f.model,
+		Content:    content,
+		StopReason: stopReason,
+		Usage:      usage,
+	}
+}
+
+func (f *messagesFormat) writeResponse(w http.ResponseWriter, choices []completedChoice, usage shared.CompletionUsage) {
+	stopReason := anthropicStopReason(choices[0].FinishReason)
+	shared.WriteJSON(w, http.StatusOK, f.message(
+		[]shared.MessagesContentBlock{{Type: "text", Text: choices[0].Text}},
+		&stopReason,
+		shared.MessagesUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens},
+	))
+}
+
+// startStream opens the message and its single text block. Input tokens
+// are only known once the agent finishes, so they are reported in
+// message_delta.
+func (f *messagesFormat) startStream(w http.ResponseWriter, n int) {
+	shared.WriteSSENamedEvent(w, "message_start", shared.MessageStartEvent{
+		Type:    "message_start",
+		Message: f.message([]shared.MessagesContentBlock{}, nil, shared.MessagesUsage{}),
+	})
+	shared.WriteSSENamedEvent(w, "content_block_start", shared.ContentBlockStartEvent{
+		Type:         "content_block_start",
+		ContentBlock: shared.MessagesContentBlock{Type: "text"},
+	})
+}
+
+func (f *messagesFormat) writeDelta(w http.ResponseWriter, index int, text string) {
+	shared.WriteSSENamedEvent(w, "content_block_delta", shared.ContentBlockDeltaEvent{
+		Type:  "content_block_delta",
+		Index: index,
+		Delta: shared.TextDelta{Type: "text_delta", Text: text},
+	})
+}
+
+func (f *messagesFormat) writeFinish(w http.ResponseWriter, index int, reason string) {
+	f.stopReason = anthropicStopReason(reason)
+	shared.WriteSSENamedEvent(w, "content_block_stop", shared.ContentBlockStopEvent{
+		Type:  "content_block_stop",
+		Index: index,
+	})
+}
+
+func (f *messagesFormat) endStream(w http.ResponseWriter, usage shared.CompletionUsage) {
+	shared.WriteSSENamedEvent(w, "message_delta", shared.MessageDeltaEvent{
+		Type:  "message_delta",
+		Delta: shared.MessageDelta{StopReason: f.stopReason},
+		Usage: shared.MessagesUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens},
+	})
+	shared.WriteSSENamedEvent(w, "message_stop", shared.MessageStopEvent{Type: "message_stop"})
+}
+
+func (f *messagesFormat) writeStreamError(w http.ResponseWriter, err *shared.ProtocolError) {
+	shared.WriteSSENamedEvent(w, "error", toAnthropicError(err))
+}
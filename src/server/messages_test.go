@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// messagesRequest is a Messages API request for testModel, with extra
+// fields merged in
+func messagesRequest(extra map[string]any) map[string]any {
+	req := map[string]any{
+		"model":      testModel,
+		"max_tokens": 64,
+		"messages":   []map[string]string{{"role": "user", "content": "Hi"}},
+	}
+	for k, v := range extra {
+		req[k] = v
+	}
+	return req
+}
+
+func TestMessagesResponse(t *testing.T) {
+	p := newTestPool(t, reply("Hel", "lo"))
+	var resp shared.MessagesResponse
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/messages", p.client, messagesRequest(nil), &resp); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	if resp.Type != "message" || resp.Role != "assistant" || !strings.HasPrefix(resp.ID, "msg_") {
+		t.Errorf("response %q %q %q", resp.ID, resp.Type, resp.Role)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Type != "text" || resp.Content[0].Text != "Hello" {
+		t.Errorf("content %+v, want one text block", resp.Content)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "end_turn" {
+		t.Errorf("stop_reason %v, want end_turn", resp.StopReason)
+	}
+	if resp.Usage.InputTokens != 5 || resp.Usage.OutputTokens != 2 {
+		t.Errorf("usage %+v", resp.Usage)
+	}
+}
+
+func TestMessagesMaxTokensStopReason(t *testing.T) {
+	p := newTestPool(t, func(work shared.WorkResponse) shared.ResultRequest {
+		res := reply("cut")(work)
+		res.FinishReason = "length"
+		return res
+	})
+	var resp shared.MessagesResponse
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/messages", p.client, messagesRequest(nil), &resp); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "max_tokens" {
+		t.Errorf("stop_reason %v, want max_tokens", resp.StopReason)
+	}
+}
+
+func TestMessagesSystemPrefillAndStop(t *testing.T) {
+	handle, jobs := recordJobs(reply("ok"))
+	p := newTestPool(t, handle)
+	req := messagesRequest(map[string]any{
+		"system":         "Be brief.",
+		"stop_sequences": []string{"END"},
+		"messages": []map[string]string{
+			{"role": "user", "content": "Hi"},
+			{"role": "assistant", "content": "Well,"},
+		},
+	})
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/messages", p.client, req, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	work := <-jobs
+	want := "<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\nWell,"
+	if work.Prompt != want {
+		t.Errorf("prompt %q, want %q", work.Prompt, want)
+	}
+	if strings.Join(work.Stop, ",") != "END,<|im_end|>" {
+		t.Errorf("stop %q, want the client's and the template's", work.Stop)
+	}
+}
+
+func TestMessagesStreamEvents(t *testing.T) {
+	p := newTestPool(t, reply("Hel", "lo"))
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/messages", p.client, messagesRequest(map[string]any{"stream": true}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	var names []string
+	var text string
+	var delta shared.MessageDeltaEvent
+	for _, e := range readSSE(t, body) {
+		if len(names) == 0 || names[len(names)-1] != e.Event {
+			names = append(names, e.Event)
+		}
+		switch e.Event {
+		case "content_block_delta":
+			var d shared.ContentBlockDeltaEvent
+			json.Unmarshal([]byte(e.Data), &d)
+			text += d.Delta.Text
+		case "message_delta":
+			json.Unmarshal([]byte(e.Data), &delta)
+		}
+	}
+	want := "message_start content_block_start content_block_delta content_block_stop message_delta message_stop"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("events %s, want %s", got, want)
+	}
+	if text != "Hello" || delta.Delta.StopReason != "end_turn" || delta.Usage.OutputTokens != 2 {
+		t.Errorf("streamed %q, message_delta %+v", text, delta)
+	}
+}
+
+func TestMessagesErrorEnvelope(t *testing.T) {
+	p := newTestPool(t, reply("ok"))
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/messages", p.client, messagesRequest(map[string]any{"max_tokens": 0}))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	var e anthropicError
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	if e.Type != "error" || e.Error.Type != "invalid_request_error" || e.Error.XPoolError != shared.ErrInvalidRequest.Code {
+		t.Errorf("error %+v", e)
+	}
+}
+
+func TestModelAliasResolves(t *testing.T) {
+	reg, err := NewModelRegistry(nil, map[string]string{"claude-3-5-sonnet": testModel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reg.Resolve("claude-3-5-sonnet"); got != testModel {
+		t.Errorf("alias resolved to %q", got)
+	}
+	if got := reg.Resolve(testModel); got != testModel {
+		t.Errorf("pool model resolved to %q", got)
+	}
+}
+
+func TestModelAliasChainRejected(t *testing.T) {
+	if _, err := NewModelRegistry(nil, map[string]string{"a": "b", "b": testModel}); err == nil {
+		t.Error("accepted an alias of an alias")
+	}
+}
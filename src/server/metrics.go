@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Histogram buckets, in seconds
+var (
+	heartbeatBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+	jobBuckets       = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	ttftBuckets      = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// Metrics holds the server's Prometheus metrics.
+// It is a small hand-rolled implementation of the text exposition format so
+// the server needs no client library.
+type Metrics struct {
+	Heartbeats       *Counter
+	HeartbeatLatency *Histogram
+	StaleTransitions *Counter
+	AgentSuspends    *Counter
+	JobLatency       *Histogram
+	TimeToFirstToken *Histogram
+	TokensGenerated  *Counter
+	ProtocolErrors   *Counter
+	PrefixAffinity   *Counter
+	WarmPoolCommands *Counter
+}
+
+// NewMetrics creates the server's metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Heartbeats:       NewCounter("gpupool_heartbeats_total", "Heartbeats received from agents, by result.", "result"),
+		HeartbeatLatency: NewHistogram("gpupool_heartbeat_duration_seconds", "Time spent handling agent heartbeats.", heartbeatBuckets),
+		StaleTransitions: NewCounter("gpupool_stale_agent_transitions_total", "Agents marked offline after missing heartbeats."),
+		AgentSuspends:    NewCounter("gpupool_agent_suspends_total", "Agents that went offline because their host went to sleep."),
+		JobLatency:       NewHistogram("gpupool_job_duration_seconds", "End-to-end completion job latency, by model and outcome.", jobBuckets, "model", "outcome"),
+		TimeToFirstToken: NewHistogram("gpupool_time_to_first_token_seconds", "Time from job submission to the first generated token, by model.", ttftBuckets, "model"),
+		TokensGenerated:  NewCounter("gpupool_tokens_generated_total", "Completion tokens generated, by model.", "model"),
+		ProtocolErrors:   NewCounter("gpupool_protocol_errors_total", "Protocol errors returned to clients, by code.", "code"),
+		WarmPoolCommands: NewCounter("gpupool_warm_pool_commands_total", "Model load and unload commands sent to agents by the warm pool planner.", "command"),
+		PrefixAffinity:   NewCounter("gpupool_prefix_affinity_total", "Leased jobs whose prompt prefix was cached on an agent, by whether that agent got them.", "result"),
+	}
+}
+
+// Write writes all metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.Heartbeats.write(w)
+	m.HeartbeatLatency.write(w)
+	m.StaleTransitions.write(w)
+	m.AgentSuspends.write(w)
+	m.JobLatency.write(w)
+	m.TimeToFirstToken.write(w)
+	m.TokensGenerated.write(w)
+	m.ProtocolErrors.write(w)
+	m.PrefixAffinity.write(w)
+	m.WarmPoolCommands.write(w)
+}
+
+// metricDesc is the name, help text and label names shared by every metric type
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key joins label values into a map key
+func (d *metricDesc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", d.name, len(values), len(d.labels)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Escaping in the text exposition format. Label values escape backslash,
+// double quote and line feed, help text only backslash and line feed; all
+// else, non-ASCII included, is written as UTF-8.
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// escapeLabel renders a label value, quoted. Invalid UTF-8, which would
+// make the whole scrape fail, is replaced.
+func escapeLabel(v string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(v, "\uFFFD")) + `"`
+}
+
+// header writes the HELP and TYPE lines
+func (d *metricDesc) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, helpEscaper.Replace(d.help), d.name, typ)
+}
+
+// labelString renders label pairs, e.g. {model="x",le="0.5"}
+func (d *metricDesc) labelString(values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range d.labels {
+		pairs = append(pairs, name+"="+escapeLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+escapeLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a monotonically increasing value per label set
+type Counter struct {
+	metricDesc
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+// Gauge is a value per label set that can go up and down
+type Gauge struct {
+	Counter
+}
+
+// sample is one labelled value
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter creates a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		values:     make(map[string]*sample),
+	}
+}
+
+// NewGauge creates a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{Counter: *NewCounter(name, help, labels...)}
+}
+
+// Inc adds one to the counter for the given label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds v to the counter for the given label values
+func (c *Counter) Add(v float64, labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampleLocked(labels).value += v
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sampleLocked(labels).value = v
+}
+
+// sampleLocked returns the sample for a label set, creating it if needed
+func (c *Counter) sampleLocked(labels []string) *sample {
+	k := c.key(labels)
+	s, ok := c.values[k]
+	if !ok {
+		s = &sample{labels: append([]string(nil), labels...)}
+		c.values[k] = s
+	}
+	return s
+}
+
+// write renders the counter
+func (c *Counter) write(w io.Writer) {
+	c.writeAs(w, "counter")
+}
+
+// write renders the gauge
+func (g *Gauge) write(w io.Writer) {
+	g.writeAs(w, "gauge")
+}
+
+// writeAs renders the samples under the given metric type
+func (c *Counter) writeAs(w io.Writer, typ string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w, typ)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, k := range sortedKeys(c.values) {
+		s := c.values[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(s.labels), formatFloat(s.value))
+	}
+}
+
+// Histogram counts observations into cumulative buckets per label set
+type Histogram struct {
+	metricDesc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histSeries
+}
+
+// histSeries is one labelled histogram
+type histSeries struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the given upper bounds and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		buckets:    buckets,
+		series:     make(map[string]*histSeries),
+	}
+}
+
+// Observe records a value for the given label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := h.key(labels)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histSeries{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveDuration records a duration in seconds
+func (h *Histogram) ObserveDuration(d time.Duration, labels ...string) {
+	h.Observe(d.Seconds(), labels...)
+}
+
+// write renders the histogram
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w, "histogram")
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.labels), s.count)
+	}
+}
+
+// formatFloat renders a sample value the way Prometheus expects
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns a map's keys in order so output is stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HandleMetrics handles GET /metrics
+func (h *Handlers) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+
+	// Point-in-time gauges are computed on each scrape
+	agentsGauge := NewGauge("gpupool_agents", "Registered agents, by status and GPU vendor.", "status", "vendor")
+	agents, err := h.db.GetAllAgents()
+	if err != nil {
+		requestLogger(r).Error("Error getting agents for metrics", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to collect metrics")
+		return
+	}
+	counts := make(map[[2]string]int)
+	for _, a := range agents {
+		var caps shared.Capabilities
+		json.Unmarshal([]byte(a.Capabilities), &caps)
+		counts[[2]string{a.Status, caps.GPUVendor}]++
+	}
+	for k, n := range counts {
+		agentsGauge.Set(float64(n), k[0], k[1])
+	}
+
+	queueGauge := NewGauge("gpupool_queue_depth", "Jobs waiting for an agent, by priority.", "priority")
+	for priority, n := range h.queue.Depth() {
+		queueGauge.Set(float64(n), priority)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	agentsGauge.write(bw)
+	queueGauge.write(bw)
+	h.metrics.Write(bw)
+	bw.Flush()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEscapeLabel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"llama-3-8b", `"llama-3-8b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\models`, `"C:\\models"`},
+		{"two\nlines", `"two\nlines"`},
+		{"modèle-日本語", `"modèle-日本語"`},
+		{"tab\there", "\"tab\there\""},
+		{"bad\xffutf8", "\"bad\uFFFDutf8\""},
+	}
+	for _, tt := range tests {
+		if got := escapeLabel(tt.in); got != tt.want {
+			t.Errorf("escapeLabel(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCounterWrite(t *testing.T) {
+	c := NewCounter("test_total", "Things counted.\nBy \\ model.", "model")
+	c.Inc("modèle")
+	c.Add(2.5, `a"b`)
+
+	var b strings.Builder
+	c.write(&b)
+	want := `# HELP test_total Things counted.\nBy \\ model.
+# TYPE test_total counter
+test_total{model="a\"b"} 2.5
+test_total{model="modèle"} 1
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := NewHistogram("test_seconds", "Durations.", []float64{0.5, 1}, "model")
+	for _, v := range []float64{0.1, 0.7, 0.9, 3} {
+		h.Observe(v, "m")
+	}
+
+	var b strings.Builder
+	h.write(&b)
+	want := `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{model="m",le="0.5"} 1
+test_seconds_bucket{model="m",le="1"} 3
+test_seconds_bucket{model="m",le="+Inf"} 4
+test_seconds_sum{model="m"} 4.7
+test_seconds_count{model="m"} 4
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	h := newTestHandlers(t)
+	h.metrics.TokensGenerated.Add(7, "qwen-ü")
+
+	rec := httptest.NewRecorder()
+	h.HandleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE gpupool_agents gauge\n",
+		"# TYPE gpupool_queue_depth gauge\n",
+		`gpupool_tokens_generated_total{model="qwen-ü"} 7` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape lacks %q", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleMetrics(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", rec.Code)
+	}
+}
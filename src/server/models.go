@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// ModelRegistry holds the models and aliases declared in the server config
+// file. Models served by agents but not declared here still work with defaults.
+type ModelRegistry struct {
+	models    map[string]shared.ModelConfig
+	templates map[string]*ChatTemplate
+	aliases   map[string]string
+	fallback  *ChatTemplate
+}
+
+// NewModelRegistry validates the configured models, their chat templates
+// and the alias table
+func NewModelRegistry(models []shared.ModelConfig, aliases map[string]string) (*ModelRegistry, error) {
+	fallback, err := ParseChatTemplate("")
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &ModelRegistry{
+		models:    make(map[string]shared.ModelConfig, len(models)),
+		templates: make(map[string]*ChatTemplate, len(models)),
+		fallback:  fallback,
+	}
+	for _, m := range models {
+		if m.Name == "" {
+			return nil, fmt.Errorf("model without a name in registry")
+		}
+		if _, dup := reg.models[m.Name]; dup {
+			return nil, fmt.Errorf("model %s declared twice", m.Name)
+		}
+		switch m.Kind {
+		case "":
+			m.Kind = shared.ModelKindGenerate
+		case shared.ModelKindGenerate, shared.ModelKindEmbed:
+		default:
+			return nil, fmt.Errorf("model %s: unknown kind %q", m.Name, m.Kind)
+		}
+		if m.MinReplicas < 0 {
+			return nil, fmt.Errorf("model %s: min_replicas must not be negative", m.Name)
+		}
+		tmpl, err := ParseChatTemplate(m.ChatTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("model %s: %w", m.Name, err)
+		}
+		reg.models[m.Name] = m
+		reg.templates[m.Name] = tmpl
+	}
+
+	reg.aliases = make(map[string]string, len(aliases))
+	for alias, target := range aliases {
+		if target == "" {
+			return nil, fmt.Errorf("model alias %s has no target", alias)
+		}
+		if _, chained := aliases[target]; chained {
+			return nil, fmt.Errorf("model alias %s points at another alias %s", alias, target)
+		}
+		reg.aliases[alias] = target
+	}
+	return reg, nil
+}
+
+// Resolve maps a requested model name through the alias table
+func (r *ModelRegistry) Resolve(name string) string {
+	if target, ok := r.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// Get returns a declared model's config
+func (r *ModelRegistry) Get(name string) (shared.ModelConfig, bool) {
+	m, ok := r.models[name]
+	return m, ok
+}
+
+// CheckKind reports an error if a declared model is of another kind.
+// Undeclared models pass; scheduling only matches agents of the right kind.
+func (r *ModelRegistry) CheckKind(name, kind string) error {
+	m, ok := r.models[name]
+	if ok && m.Kind != kind {
+		return fmt.Errorf("model %s is a %s model", name, m.Kind)
+	}
+	return nil
+}
+
+// ChatTemplate returns the chat template for a model, or the default
+func (r *ModelRegistry) ChatTemplate(name string) *ChatTemplate {
+	if t, ok := r.templates[name]; ok {
+		return t
+	}
+	return r.fallback
+}
+
+// MinReplicas returns the pinned replica count of every model that has one
+func (r *ModelRegistry) MinReplicas() map[string]int {
+	pinned := make(map[string]int)
+	for name, m := range r.models {
+		if m.MinReplicas > 0 {
+			pinned[name] = m.MinReplicas
+		}
+	}
+	return pinned
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// prefixCacheTTL is how long an agent's cache contents are trusted without
+// a new report or lease; agents that stop reporting drop out of routing
+const prefixCacheTTL = 10 * time.Minute
+
+// PrefixIndex tracks the prompt prefixes agents hold in their KV caches so
+// that a request can be routed to the agent that can skip re-evaluating
+// the longest part of its prompt. Agents report their caches with their
+// heartbeats; between heartbeats each lease is taken to replace the
+// contents of one slot with the job's prompt.
+type PrefixIndex struct {
+	wait time.Duration // how long a job is held for its preferred agent; 0 disables affinity
+
+	mu          sync.Mutex
+	agents      map[string]*agentCache // by agent ID
+	routed      int64                  // leased jobs that had a preferred agent
+	hits        int64                  // of those, leased by that agent
+	reusedBytes int64                  // prompt bytes the hits found cached
+}
+
+// agentCache is the last known cache state of one agent
+type agentCache struct {
+	model   string
+	slots   []cacheSlot
+	updated time.Time
+}
+
+// cacheSlot is the cached text of one inference slot
+type cacheSlot struct {
+	blocks map[string]bool // hash chain of the cached text
+	used   time.Time
+}
+
+// AffinityStats summarises prefix affinity routing for the admin stats
+type AffinityStats struct {
+	Enabled       bool    `json:"enabled"`
+	Routed        int64   `json:"routed"`   // leased jobs whose prefix was cached on some agent
+	Hits          int64   `json:"hits"`     // of those, leased by that agent
+	HitRate       float64 `json:"hit_rate"` // hits / routed
+	ReusedBytes   int64   `json:"reused_bytes"`
+	CachingAgents int     `json:"caching_agents"` // agents with a known cache
+}
+
+// NewPrefixIndex creates an empty index. Jobs wait up to wait for the agent
+// holding their prefix while it is free; a zero wait disables affinity.
+func NewPrefixIndex(wait time.Duration) *PrefixIndex {
+	return &PrefixIndex{
+		wait:   wait,
+		agents: make(map[string]*agentCache),
+	}
+}
+
+// Report replaces an agent's cache state with the one it reported
+func (p *PrefixIndex) Report(agentID string, pc *shared.PrefixCache) {
+	if pc == nil {
+		return
+	}
+	cache := &agentCache{model: pc.Model, updated: time.Now()}
+	for _, s := range pc.Slots {
+		cache.slots = append(cache.slots, cacheSlot{blocks: chainBlocks(s.Prefix), used: cache.updated})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.agents[agentID] = cache
+}
+
+// Best returns the agent holding the longest prefix of a prompt's hash
+// chain for the model, and the number of blocks it holds. It returns ""
+// if no agent holds even the first block.
+func (p *PrefixIndex) Best(model string, prefix []string) (string, int) {
+	if p.wait <= 0 || len(prefix) == 0 {
+		return "", 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	best, bestBlocks := "", 0
+	for agentID, cache := range p.agents {
+		if now.Sub(cache.updated) > prefixCacheTTL {
+			delete(p.agents, agentID)
+			continue
+		}
+		if cache.model != model {
+			continue
+		}
+		for _, slot := range cache.slots {
+			if n := matchBlocks(slot.blocks, prefix); n > bestBlocks {
+				best, bestBlocks = agentID, n
+			}
+		}
+	}
+	return best, bestBlocks
+}
+
+// Slots returns the number of inference slots an agent reported, which is
+// how many jobs it runs before it counts as busy
+func (p *PrefixIndex) Slots(agentID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cache, ok := p.agents[agentID]; ok && len(cache.slots) > 0 {
+		return len(cache.slots)
+	}
+	return 1
+}
+
+// Leased records a job handed to an agent: the affinity outcome, if the job
+// had a preferred agent, and the job's prompt as the new contents of the
+// slot that already shared most of it, or of the least recently used one.
+// It returns "hit" or "miss" for jobs with a preferred agent, "" otherwise.
+func (p *PrefixIndex) Leased(agentID string, job *Job) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := ""
+	if job.affinity != "" {
+		p.routed++
+		result = "miss"
+		if job.affinity == agentID {
+			p.hits++
+			p.reusedBytes += int64(job.affinityBlocks * shared.PrefixBlockSize)
+			result = "hit"
+		}
+	}
+	if p.wait <= 0 {
+		return result
+	}
+
+	now := time.Now()
+	cache, ok := p.agents[agentID]
+	if !ok || cache.model != job.Request.Model {
+		// Serving another model means llama-server was restarted with this one
+		slots := 1
+		if ok {
+			slots = max(len(cache.slots), 1)
+		}
+		cache = &agentCache{model: job.Request.Model, slots: make([]cacheSlot, slots)}
+		p.agents[agentID] = cache
+	}
+	cache.updated = now
+	if len(job.prefix) == 0 {
+		return result
+	}
+
+	slot, slotBlocks := 0, -1
+	for i, s := range cache.slots {
+		n := matchBlocks(s.blocks, job.prefix)
+		if n > slotBlocks || (n == slotBlocks && s.used.Before(cache.slots[slot].used)) {
+			slot, slotBlocks = i, n
+		}
+	}
+	cache.slots[slot] = cacheSlot{blocks: chainBlocks(job.prefix), used: now}
+	return result
+}
+
+// Stats returns affinity routing counters
+func (p *PrefixIndex) Stats() AffinityStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := AffinityStats{
+		Enabled:       p.wait > 0,
+		Routed:        p.routed,
+		Hits:          p.hits,
+		ReusedBytes:   p.reusedBytes,
+		CachingAgents: len(p.agents),
+	}
+	if p.routed > 0 {
+		stats.HitRate = float64(p.hits) / float64(p.routed)
+	}
+	return stats
+}
+
+// chainBlocks returns the set of hashes in a chain
+func chainBlocks(chain []string) map[string]bool {
+	blocks := make(map[string]bool, len(chain))
+	for _, h := range chain {
+		blocks[h] = true
+	}
+	return blocks
+}
+
+// matchBlocks returns the number of leading blocks of prefix held in a
+// slot. Hashes are chained, so the last one present gives the length.
+func matchBlocks(blocks map[string]bool, prefix []string) int {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if blocks[prefix[i]] {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// blockPrompt returns a prompt of n complete blocks of c, then a tail
+func blockPrompt(c string, n int) string {
+	return strings.Repeat(c, n*shared.PrefixBlockSize) + "tail"
+}
+
+// reportCache reports an agent caching the prompts, one per slot
+func reportCache(p *PrefixIndex, agentID, model string, prompts ...string) {
+	pc := &shared.PrefixCache{Model: model}
+	for _, prompt := range prompts {
+		pc.Slots = append(pc.Slots, shared.CacheSlot{Prefix: shared.PrefixHashes(prompt)})
+	}
+	p.Report(agentID, pc)
+}
+
+func TestPrefixIndexBestLongestMatch(t *testing.T) {
+	p := NewPrefixIndex(time.Second)
+	reportCache(p, "short", "llama", blockPrompt("a", 1))
+	reportCache(p, "long", "llama", blockPrompt("b", 1), blockPrompt("a", 3))
+
+	agent, blocks := p.Best("llama", shared.PrefixHashes(blockPrompt("a", 4)))
+	if agent != "long" || blocks != 3 {
+		t.Errorf("best %q with %d blocks, want long with 3", agent, blocks)
+	}
+}
+
+func TestPrefixIndexBestMatchesModel(t *testing.T) {
+	p := NewPrefixIndex(time.Second)
+	reportCache(p, "agent-1", "mistral", blockPrompt("a", 2))
+	if agent, _ := p.Best("llama", shared.PrefixHashes(blockPrompt("a", 2))); agent != "" {
+		t.Errorf("routed to %q, which caches another model", agent)
+	}
+}
+
+func TestPrefixIndexDisabled(t *testing.T) {
+	p := NewPrefixIndex(0)
+	reportCache(p, "agent-1", "llama", blockPrompt("a", 2))
+	if agent, _ := p.Best("llama", shared.PrefixHashes(blockPrompt("a", 2))); agent != "" {
+		t.Errorf("routed to %q with affinity disabled", agent)
+	}
+}
+
+func TestPrefixIndexLeasedTakesSlot(t *testing.T) {
+	p := NewPrefixIndex(time.Second)
+	prompt := blockPrompt("a", 2)
+	job := NewJob("job", "key", shared.CompletionRequest{Model: "llama", Prompt: prompt})
+	job.prefix = shared.PrefixHashes(prompt)
+	p.Leased("agent-1", job)
+
+	if agent, blocks := p.Best("llama", job.prefix); agent != "agent-1" || blocks != 2 {
+		t.Errorf("best %q with %d blocks, want the agent that leased the prompt", agent, blocks)
+	}
+}
+
+func TestPrefixIndexLeasedCountsHits(t *testing.T) {
+	p := NewPrefixIndex(time.Second)
+	hit := NewJob("hit", "key", shared.CompletionRequest{Model: "llama"})
+	hit.affinity, hit.affinityBlocks = "agent-1", 2
+	miss := NewJob("miss", "key", shared.CompletionRequest{Model: "llama"})
+	miss.affinity = "agent-1"
+
+	if got := p.Leased("agent-1", hit); got != "hit" {
+		t.Errorf("preferred agent leased: %q, want hit", got)
+	}
+	if got := p.Leased("agent-2", miss); got != "miss" {
+		t.Errorf("other agent leased: %q, want miss", got)
+	}
+	stats := p.Stats()
+	if stats.Routed != 2 || stats.Hits != 1 || stats.HitRate != 0.5 || stats.ReusedBytes != 2*shared.PrefixBlockSize {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// newAffinityQueue returns a queue holding jobs for up to a second for
+// agent-2, which caches prompt
+func newAffinityQueue(prompt string) (*JobQueue, *fakeClock) {
+	q, clock := newTestQueue(0)
+	q.prefixes = NewPrefixIndex(time.Second)
+	reportCache(q.prefixes, "agent-2", "llama", prompt)
+	return q, clock
+}
+
+func TestJobQueueHoldsJobForCachingAgent(t *testing.T) {
+	prompt := blockPrompt("a", 2)
+	q, _ := newAffinityQueue(prompt)
+	q.Submit(NewJob("job", "key", shared.CompletionRequest{Model: "llama", Prompt: prompt}))
+	serves := func(*Job) bool { return true }
+
+	if job := q.Lease(context.Background(), "agent-1", serves, 0); job != nil {
+		t.Fatal("another agent leased a job held for agent-2")
+	}
+	if job := q.Lease(context.Background(), "agent-2", serves, 0); job == nil {
+		t.Error("agent-2 couldn't lease the job held for it")
+	}
+}
+
+func TestJobQueueReleasesHeldJob(t *testing.T) {
+	prompt := blockPrompt("a", 2)
+	q, clock := newAffinityQueue(prompt)
+	q.Submit(NewJob("job", "key", shared.CompletionRequest{Model: "llama", Prompt: prompt}))
+
+	clock.advance(time.Second)
+	if job := q.Lease(context.Background(), "agent-1", func(*Job) bool { return true }, 0); job == nil {
+		t.Error("job still held once the affinity wait passed")
+	}
+}
+
+func TestJobQueueSkipsBusyCachingAgent(t *testing.T) {
+	prompt := blockPrompt("a", 2)
+	q, _ := newAffinityQueue(prompt)
+	serves := func(*Job) bool { return true }
+	q.Submit(NewJob("running", "key", shared.CompletionRequest{Model: "llama", Prompt: "x"}))
+	q.Lease(context.Background(), "agent-2", serves, 0)
+
+	q.Submit(NewJob("job", "key", shared.CompletionRequest{Model: "llama", Prompt: prompt}))
+	if job := q.Lease(context.Background(), "agent-1", serves, 0); job == nil {
+		t.Error("job held for an agent whose only slot is busy")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimits are the request and token limits applied to one API key.
+// On a key, 0 inherits the server default and a negative value means
+// unlimited; once resolved against the defaults, 0 means unlimited.
+type RateLimits struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute"`
+	DailyTokens       int `json:"daily_tokens"`
+	MonthlyTokens     int `json:"monthly_tokens"`
+}
+
+// resolve fills unset limits from the defaults and maps "unlimited" to 0
+func (l RateLimits) resolve(defaults RateLimits) RateLimits {
+	pick := func(v, d int) int {
+		switch {
+		case v < 0:
+			return 0
+		case v == 0:
+			return d
+		default:
+			return v
+		}
+	}
+	return RateLimits{
+		RequestsPerMinute: pick(l.RequestsPerMinute, defaults.RequestsPerMinute),
+		TokensPerMinute:   pick(l.TokensPerMinute, defaults.TokensPerMinute),
+		DailyTokens:       pick(l.DailyTokens, defaults.DailyTokens),
+		MonthlyTokens:     pick(l.MonthlyTokens, defaults.MonthlyTokens),
+	}
+}
+
+// tokenBucket refills continuously up to a per-minute capacity
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket creates a full bucket holding perMinute tokens
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		tokens:   float64(perMinute),
+		last:     now,
+	}
+}
+
+// refill adds the tokens accrued since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Minutes()
+	if elapsed > 0 {
+		b.tokens = min(b.capacity, b.tokens+elapsed*b.capacity)
+		b.last = now
+	}
+}
+
+// wait returns how long until n tokens are available (0 if they are now).
+// Requests larger than the bucket only need a full bucket.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	n = min(n, b.capacity)
+	if b.tokens >= n {
+		return 0
+	}
+	minutes := (n - b.tokens) / b.capacity
+	return time.Duration(minutes * float64(time.Minute))
+}
+
+// untilFull returns how long until the bucket is back at capacity
+func (b *tokenBucket) untilFull() time.Duration {
+	return b.wait(b.capacity)
+}
+
+// keyBuckets are the buckets for one API key
+type keyBuckets struct {
+	limits   RateLimits
+	requests *tokenBucket // nil when unlimited
+	tokens   *tokenBucket // nil when unlimited
+}
+
+// RateDecision is the outcome of a rate limit check
+type RateDecision struct {
+	Allowed           bool
+	RetryAfter        time.Duration
+	Limits            RateLimits
+	RemainingRequests int
+	RemainingTokens   int
+	ResetRequests     time.Duration
+	ResetTokens       time.Duration
+}
+
+// RateLimiter enforces per-key requests-per-minute and tokens-per-minute
+// limits with in-memory token buckets
+type RateLimiter struct {
+	mu       sync.Mutex
+	defaults RateLimits
+	buckets  map[string]*keyBuckets
+	now      func() time.Time
+}
+
+// NewRateLimiter creates a rate limiter with server-wide default limits
+func NewRateLimiter(defaults RateLimits) *RateLimiter {
+	return &RateLimiter{
+		defaults: defaults,
+		buckets:  make(map[string]*keyBuckets),
+		now:      time.Now,
+	}
+}
+
+// LimitsFor returns the effective limits for a key
+func (l *RateLimiter) LimitsFor(key *APIKey) RateLimits {
+	return key.Limits.resolve(l.defaults)
+}
+
+// Allow checks whether a request estimated to use estTokens may proceed and,
+// if so, charges it against the key's buckets
+func (l *RateLimiter) Allow(key *APIKey, estTokens int) RateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	kb := l.bucketsLocked(key, now)
+	d := RateDecision{Allowed: true, Limits: kb.limits}
+
+	if kb.requests != nil {
+		kb.requests.refill(now)
+		if w := kb.requests.wait(1); w > 0 {
+			d.Allowed = false
+			d.RetryAfter = max(d.RetryAfter, w)
+		}
+	}
+	if kb.tokens != nil {
+		kb.tokens.refill(now)
+		if w := kb.tokens.wait(float64(estTokens)); w > 0 {
+			d.Allowed = false
+			d.RetryAfter = max(d.RetryAfter, w)
+		}
+	}
+
+	if d.Allowed {
+		if kb.requests != nil {
+			kb.requests.tokens--
+		}
+		if kb.tokens != nil {
+			kb.tokens.tokens -= min(float64(estTokens), kb.tokens.capacity)
+		}
+	}
+
+	if kb.requests != nil {
+		d.RemainingRequests = int(max(0, kb.requests.tokens))
+		d.ResetRequests = kb.requests.untilFull()
+	}
+	if kb.tokens != nil {
+		d.RemainingTokens = int(max(0, kb.tokens.tokens))
+		d.ResetTokens = kb.tokens.untilFull()
+	}
+	return d
+}
+
+// Adjust corrects a key's token bucket once the actual usage is known.
+// A positive delta charges more tokens, a negative one refunds the estimate.
+func (l *RateLimiter) Adjust(key *APIKey, delta int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kb := l.bucketsLocked(key, l.now())
+	if kb.tokens == nil {
+		return
+	}
+	kb.tokens.refill(l.now())
+	kb.tokens.tokens = min(kb.tokens.capacity, kb.tokens.tokens-float64(delta))
+}
+
+// bucketsLocked returns the key's buckets, rebuilding them if its limits changed
+func (l *RateLimiter) bucketsLocked(key *APIKey, now time.Time) *keyBuckets {
+	limits := l.LimitsFor(key)
+	kb, ok := l.buckets[key.ID]
+	if ok && kb.limits == limits {
+		return kb
+	}
+
+	kb = &keyBuckets{limits: limits}
+	if limits.RequestsPerMinute > 0 {
+		kb.requests = newTokenBucket(limits.RequestsPerMinute, now)
+	}
+	if limits.TokensPerMinute > 0 {
+		kb.tokens = newTokenBucket(limits.TokensPerMinute, now)
+	}
+	l.buckets[key.ID] = kb
+	return kb
+}
+
+// estimateTokens guesses the tokens a request will use before it runs:
+// roughly four characters per prompt token plus the full completion budget
+func estimateTokens(prompt string, maxTokens int) int {
+	return len(prompt)/4 + maxTokens
+}
+
+// setRateLimitHeaders reports the key's limits and remaining budget
+func setRateLimitHeaders(w http.ResponseWriter, d RateDecision) {
+	h := w.Header()
+	if d.Limits.RequestsPerMinute > 0 {
+		h.Set("X-RateLimit-Limit-Requests", strconv.Itoa(d.Limits.RequestsPerMinute))
+		h.Set("X-RateLimit-Remaining-Requests", strconv.Itoa(d.RemainingRequests))
+		h.Set("X-RateLimit-Reset-Requests", formatSeconds(d.ResetRequests))
+	}
+	if d.Limits.TokensPerMinute > 0 {
+		h.Set("X-RateLimit-Limit-Tokens", strconv.Itoa(d.Limits.TokensPerMinute))
+		h.Set("X-RateLimit-Remaining-Tokens", strconv.Itoa(d.RemainingTokens))
+		h.Set("X-RateLimit-Reset-Tokens", formatSeconds(d.ResetTokens))
+	}
+}
+
+// setRetryAfter sets the Retry-After header, rounding up to whole seconds
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+}
+
+// formatSeconds renders a duration as fractional seconds, e.g. "1.5s"
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+// quotaPeriods returns the daily and monthly usage periods containing t (UTC)
+func quotaPeriods(t time.Time) (day, month string) {
+	t = t.UTC()
+	return t.Format("2006-01-02"), t.Format("2006-01")
+}
+
+// untilNextDay returns the time until the next UTC midnight
+func untilNextDay(t time.Time) time.Duration {
+	t = t.UTC()
+	next := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	return next.Sub(t)
+}
+
+// untilNextMonth returns the time until the first of the next UTC month
+func untilNextMonth(t time.Time) time.Duration {
+	t = t.UTC()
+	next := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return next.Sub(t)
+}
+
+// AddTokenUsage adds tokens to a key's daily and monthly usage counters
+func (db *DB) AddTokenUsage(keyID string, tokens int, at time.Time) error {
+	day, month := quotaPeriods(at)
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, period := range []string{day, month} {
+		_, err := tx.Exec(`
+			INSERT INTO token_usage (key_id, period, tokens) VALUES (?, ?, ?)
+			ON CONFLICT(key_id, period) DO UPDATE SET tokens = tokens + excluded.tokens
+		`, keyID, period, tokens)
+		if err != nil {
+			return fmt.Errorf("add token usage: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// GetTokenUsage returns a key's token usage for the day and month containing at
+func (db *DB) GetTokenUsage(keyID string, at time.Time) (daily, monthly int, err error) {
+	day, month := quotaPeriods(at)
+	rows, err := db.Query(`
+		SELECT period, tokens FROM token_usage WHERE key_id = ? AND period IN (?, ?)
+	`, keyID, day, month)
+	if err != nil {
+		return 0, 0, fmt.Errorf("query token usage: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var period string
+		var tokens int
+		if err := rows.Scan(&period, &tokens); err != nil {
+			return 0, 0, fmt.Errorf("scan token usage: %w", err)
+		}
+		if period == day {
+			daily = tokens
+		} else {
+			monthly = tokens
+		}
+	}
+	return daily, monthly, rows.Err()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// newTestLimiter returns a limiter without defaults on a clock the test
+// moves with advance
+func newTestLimiter() (l *RateLimiter, advance func(time.Duration)) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l = NewRateLimiter(RateLimits{})
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimitsResolve(t *testing.T) {
+	defaults := RateLimits{RequestsPerMinute: 60, TokensPerMinute: 1000, DailyTokens: 5000, MonthlyTokens: 90000}
+	got := RateLimits{RequestsPerMinute: 10, TokensPerMinute: -1}.resolve(defaults)
+	want := RateLimits{RequestsPerMinute: 10, TokensPerMinute: 0, DailyTokens: 5000, MonthlyTokens: 90000}
+	if got != want {
+		t.Errorf("resolved %+v, want %+v", got, want)
+	}
+}
+
+func TestRateLimiterRequestsPerMinute(t *testing.T) {
+	l, _ := newTestLimiter()
+	key := &APIKey{ID: "k", Limits: RateLimits{RequestsPerMinute: 2}}
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow(key, 0); !d.Allowed {
+			t.Fatalf("request %d refused", i+1)
+		}
+	}
+	d := l.Allow(key, 0)
+	if d.Allowed || d.RetryAfter != 30*time.Second {
+		t.Errorf("third request: allowed %v, retry after %v; want refused for 30s", d.Allowed, d.RetryAfter)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l, advance := newTestLimiter()
+	key := &APIKey{ID: "k", Limits: RateLimits{RequestsPerMinute: 2}}
+	l.Allow(key, 0)
+	l.Allow(key, 0)
+
+	advance(30 * time.Second)
+	if d := l.Allow(key, 0); !d.Allowed {
+		t.Errorf("refused after refilling for 30s, retry after %v", d.RetryAfter)
+	}
+}
+
+func TestRateLimiterAdjustRefundsEstimate(t *testing.T) {
+	l, _ := newTestLimiter()
+	key := &APIKey{ID: "k", Limits: RateLimits{TokensPerMinute: 100}}
+	if d := l.Allow(key, 80); !d.Allowed || d.RemainingTokens != 20 {
+		t.Fatalf("allowed %v with %d tokens left, want 20", d.Allowed, d.RemainingTokens)
+	}
+
+	// The request only used 20 of its 80 estimated tokens
+	l.Adjust(key, -60)
+	if d := l.Allow(key, 70); !d.Allowed {
+		t.Errorf("refund not applied: refused 70 tokens, retry after %v", d.RetryAfter)
+	}
+}
+
+func TestRateLimiterOversizedRequestNeedsFullBucket(t *testing.T) {
+	l, _ := newTestLimiter()
+	key := &APIKey{ID: "k", Limits: RateLimits{TokensPerMinute: 100}}
+	if d := l.Allow(key, 500); !d.Allowed {
+		t.Errorf("a request larger than the bucket was refused with the bucket full")
+	}
+}
+
+func TestCompletionsRateLimitHeaders(t *testing.T) {
+	p := newTestPool(t, reply("hi"))
+	_, secret := newLimitedKey(t, p.h, RateLimits{RequestsPerMinute: 5, TokensPerMinute: 1000})
+
+	req := shared.CompletionRequest{Model: testModel, Prompt: "Hello", MaxTokens: 16}
+	resp, _ := doRequest(t, http.MethodPost, p.srv.URL+"/v1/completions", secret, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	want := map[string]string{
+		"X-RateLimit-Limit-Requests":     "5",
+		"X-RateLimit-Remaining-Requests": "4",
+		"X-RateLimit-Limit-Tokens":       "1000",
+		"X-RateLimit-Remaining-Tokens":   "983", // the estimate: 5/4 prompt tokens plus 16
+	}
+	for name, value := range want {
+		if got := resp.Header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestCompletionsRateLimitedRetryAfter(t *testing.T) {
+	p := newTestPool(t, reply("hi"))
+	_, secret := newLimitedKey(t, p.h, RateLimits{RequestsPerMinute: 1})
+	req := shared.CompletionRequest{Model: testModel, Prompt: "Hello"}
+	doRequest(t, http.MethodPost, p.srv.URL+"/v1/completions", secret, req)
+
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/completions", secret, req)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	if code := errorCode(t, body); code != shared.ErrRateLimited.Code {
+		t.Errorf("error code %q, want %s", code, shared.ErrRateLimited.Code)
+	}
+}
+
+func TestCompletionsDailyQuotaExhausted(t *testing.T) {
+	p := newTestPool(t, reply("hi"))
+	key, secret := newLimitedKey(t, p.h, RateLimits{DailyTokens: 100})
+	if err := p.h.db.AddTokenUsage(key.ID, 100, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := shared.CompletionRequest{Model: testModel, Prompt: "Hello"}
+	resp, body := doRequest(t, http.MethodPost, p.srv.URL+"/v1/completions", secret, req)
+	if resp.StatusCode != http.StatusTooManyRequests || errorCode(t, body) != shared.ErrRateLimited.Code {
+		t.Fatalf("status %d, body %s; want 429 RATE_LIMITED", resp.StatusCode, body)
+	}
+	if retry := resp.Header.Get("Retry-After"); retry == "" || retry == "0" {
+		t.Errorf("Retry-After = %q, want the time until midnight", retry)
+	}
+}
+
+func TestCompletionsChargeActualUsage(t *testing.T) {
+	p := newTestPool(t, reply("a", "b", "c"))
+	key, secret := newLimitedKey(t, p.h, RateLimits{DailyTokens: 1000})
+
+	req := shared.CompletionRequest{Model: testModel, Prompt: "Hello", MaxTokens: 64}
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/completions", secret, req, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	daily, monthly, err := p.h.db.GetTokenUsage(key.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if daily != 8 || monthly != 8 {
+		t.Errorf("recorded %d daily and %d monthly tokens, want the 8 used", daily, monthly)
+	}
+}
+
+// errorCode returns the code of a native error response
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp shared.ErrorResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decoding error %s: %v", body, err)
+	}
+	return resp.Error.Code
+}
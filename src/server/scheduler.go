@@ -2,21 +2,25 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"time"
 )
 
 // Scheduler handles background tasks like stale agent cleanup
 type Scheduler struct {
 	db              *DB
-	staleTimeout    time.Duration
+	queue           *JobQueue
+	metrics         *Metrics
+	staleTimeout    time.Duration // for agents without a recorded heartbeat interval
 	cleanupInterval time.Duration
 }
 
 // NewScheduler creates a new Scheduler
-func NewScheduler(db *DB, staleTimeout, cleanupInterval time.Duration) *Scheduler {
+func NewScheduler(db *DB, queue *JobQueue, metrics *Metrics, staleTimeout, cleanupInterval time.Duration) *Scheduler {
 	return &Scheduler{
 		db:              db,
+		queue:           queue,
+		metrics:         metrics,
 		staleTimeout:    staleTimeout,
 		cleanupInterval: cleanupInterval,
 	}
@@ -28,7 +32,7 @@ func (s *Scheduler) Run(ctx context.Context) {
 	ticker := time.NewTicker(s.cleanupInterval)
 	defer ticker.Stop()
 
-	log.Printf("Scheduler started: cleanup every %v, stale timeout %v", s.cleanupInterval, s.staleTimeout)
+	slog.Info("Scheduler started", "cleanup_interval", s.cleanupInterval.String(), "stale_timeout", s.staleTimeout.String())
 
 	// Run immediately on start
 	s.cleanupStaleAgents()
@@ -36,7 +40,7 @@ func (s *Scheduler) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Scheduler stopped")
+			slog.Info("Scheduler stopped")
 			return
 		case <-ticker.C:
 			s.cleanupStaleAgents()
@@ -44,15 +48,22 @@ func (s *Scheduler) Run(ctx context.Context) {
 	}
 }
 
-// cleanupStaleAgents marks agents as offline if they haven't sent a heartbeat
+// cleanupStaleAgents marks agents as offline if they have missed too many
+// of their heartbeats, and takes back the jobs they were running
 func (s *Scheduler) cleanupStaleAgents() {
-	count, err := s.db.MarkStaleAgentsOffline(s.staleTimeout)
+	agentIDs, err := s.db.MarkStaleAgentsOffline(s.staleTimeout)
 	if err != nil {
-		log.Printf("Error cleaning up stale agents: %v", err)
+		slog.Error("Error cleaning up stale agents", "err", err)
 		return
 	}
 
-	if count > 0 {
-		log.Printf("Marked %d stale agents as offline", count)
+	if len(agentIDs) > 0 {
+		s.metrics.StaleTransitions.Add(float64(len(agentIDs)))
+		slog.Info("Marked stale agents as offline", "count", len(agentIDs))
+	}
+	for _, agentID := range agentIDs {
+		if n := s.queue.ReleaseAgent(agentID, "agent went offline"); n > 0 {
+			slog.Info("Released jobs of offline agent", "agent_id", agentID, "jobs", n)
+		}
 	}
 }
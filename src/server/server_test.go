@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// testAdminKey is the bootstrap admin key of test servers
+const testAdminKey = "test-admin-key"
+
+// newTestHandlers returns handlers on a fresh database in a temporary
+// directory, serving the given models
+func newTestHandlers(t *testing.T, models ...shared.ModelConfig) *Handlers {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	registry, err := NewModelRegistry(models, nil)
+	if err != nil {
+		t.Fatalf("NewModelRegistry: %v", err)
+	}
+	tracer := shared.NewTracer(nil)
+	prefixes := NewPrefixIndex(0)
+	queue := NewJobQueue(tracer, 30*time.Second, prefixes)
+	return NewHandlers(db, queue, prefixes, NewMetrics(), tracer, registry, nil, Config{
+		AdminAPIKey:       testAdminKey,
+		HeartbeatInterval: 30,
+		RequestTimeout:    10 * time.Second,
+		MaxSuspend:        24 * time.Hour,
+		BatchConcurrency:  8,
+	})
+}
+
+// newTestServer serves the full API from the handlers
+func newTestServer(t *testing.T, h *Handlers) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newRouter(h, h.tracer))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestKey stores an API key with the given scopes and returns its secret
+func newTestKey(t *testing.T, h *Handlers, scopes ...string) string {
+	t.Helper()
+	key, secret, err := NewAPIKey("test", scopes, nil, "", nil)
+	if err != nil {
+		t.Fatalf("NewAPIKey: %v", err)
+	}
+	if err := h.db.CreateAPIKey(key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	return secret
+}
+
+// newTestEnrollmentToken stores an enrollment token good for uses
+// registrations and returns its secret
+func newTestEnrollmentToken(t *testing.T, h *Handlers, uses int) string {
+	t.Helper()
+	token, secret, err := NewEnrollmentToken("test", uses, nil)
+	if err != nil {
+		t.Fatalf("NewEnrollmentToken: %v", err)
+	}
+	if err := h.db.CreateEnrollmentToken(token); err != nil {
+		t.Fatalf("CreateEnrollmentToken: %v", err)
+	}
+	return secret
+}
+
+// doJSON sends a request with a JSON body and bearer key, decoding a JSON
+// response into out if it is non-nil, and returns the status
+func doJSON(t *testing.T, method, url, key string, body, out any) int {
+	t.Helper()
+	resp, data := doRequest(t, method, url, key, body)
+	if out != nil && resp.StatusCode < 300 && resp.StatusCode != http.StatusNoContent {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("decoding %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// doRequest sends a request with a JSON body and bearer key and returns
+// the response, for its status and headers, with the body read
+func doRequest(t *testing.T, method, url, key string, body any) (*http.Response, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("encoding request: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s %s: %v", method, url, err)
+	}
+	return resp, data
+}
+
+// fakeAgent registers with a test server and answers the jobs it leases
+// with whatever handle returns, until the test ends
+type fakeAgent struct {
+	ID  string
+	key string
+	url string
+}
+
+// startFakeAgent registers an agent serving the models and starts polling
+// for work
+func startFakeAgent(t *testing.T, h *Handlers, srv *httptest.Server, models []shared.ModelInfo, handle func(shared.WorkResponse) shared.ResultRequest) *fakeAgent {
+	t.Helper()
+	fleetKey := newTestKey(t, h, ScopeAgentRegister)
+	var reg RegisterResponse
+	status := doJSON(t, http.MethodPost, srv.URL+"/v1/agents/register", fleetKey, RegisterRequest{Name: "fake", Models: models}, &reg)
+	if status != http.StatusCreated {
+		t.Fatalf("registering fake agent: status %d", status)
+	}
+	a := &fakeAgent{ID: reg.AgentID, key: reg.APIKey, url: srv.URL + "/v1/agents/" + reg.AgentID}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			work, ok := a.poll(ctx)
+			if !ok {
+				continue
+			}
+			res := handle(work)
+			res.RequestID = work.RequestID
+			body, _ := json.Marshal(res)
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, a.url+"/result", bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+a.key)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	return a
+}
+
+// poll long-polls for one job
+func (a *fakeAgent) poll(ctx context.Context) (shared.WorkResponse, bool) {
+	var work shared.WorkResponse
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, a.url+"/work?timeout=1", nil)
+	req.Header.Set("Authorization", "Bearer "+a.key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return work, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return work, false
+	}
+	return work, json.NewDecoder(resp.Body).Decode(&work) == nil
+}
+
+// testModel is the model test pools serve
+const testModel = "llama"
+
+// testPool is a test server with one fake agent serving testModel
+type testPool struct {
+	h      *Handlers
+	srv    *httptest.Server
+	client string // key with client:complete
+}
+
+// newTestPool starts a server whose fake agent answers every job with
+// handle
+func newTestPool(t *testing.T, handle func(shared.WorkResponse) shared.ResultRequest) *testPool {
+	t.Helper()
+	h := newTestHandlers(t, shared.ModelConfig{Name: testModel})
+	srv := newTestServer(t, h)
+	startFakeAgent(t, h, srv, []shared.ModelInfo{{Name: testModel, MaxContext: 4096}}, handle)
+	return &testPool{h: h, srv: srv, client: newTestKey(t, h, ScopeClientComplete)}
+}
+
+// reply returns a fake agent handler finishing every job with the tokens,
+// reporting 5 prompt tokens and one completion token per token
+func reply(tokens ...string) func(shared.WorkResponse) shared.ResultRequest {
+	return func(shared.WorkResponse) shared.ResultRequest {
+		return shared.ResultRequest{
+			Tokens:       tokens,
+			Finished:     true,
+			FinishReason: "stop",
+			Usage:        &shared.CompletionUsage{PromptTokens: 5, CompletionTokens: len(tokens)},
+		}
+	}
+}
+
+// newLimitedKey stores a client key with the given limits and returns it
+// with its secret
+func newLimitedKey(t *testing.T, h *Handlers, limits RateLimits) (*APIKey, string) {
+	t.Helper()
+	key, secret, err := NewAPIKey("limited", []string{ScopeClientComplete}, nil, "", nil)
+	if err != nil {
+		t.Fatalf("NewAPIKey: %v", err)
+	}
+	key.Limits = limits
+	if err := h.db.CreateAPIKey(key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	return key, secret
+}
+
+// recordJobs wraps a fake agent handler, sending every job it is given to
+// the returned channel
+func recordJobs(handle func(shared.WorkResponse) shared.ResultRequest) (func(shared.WorkResponse) shared.ResultRequest, <-chan shared.WorkResponse) {
+	jobs := make(chan shared.WorkResponse, 16)
+	return func(work shared.WorkResponse) shared.ResultRequest {
+		jobs <- work
+		return handle(work)
+	}, jobs
+}
+
+// sseEvent is one server-sent event of a streamed response
+type sseEvent struct {
+	Event string // empty for unnamed events
+	Data  string
+}
+
+// readSSE splits a streamed response body into its events
+func readSSE(t *testing.T, body []byte) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		var e sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				e.Event = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				e.Data = v
+			} else {
+				t.Fatalf("unexpected line %q in stream", line)
+			}
+		}
+		events = append(events, e)
+	}
+	return events
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// withTracing wraps each request in a server span, continuing the caller's
+// trace when it sent a traceparent header. Agents send one on result posts,
+// so their spans and the server's end up in the same trace.
+func withTracing(tracer *shared.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := shared.ParseTraceparent(r.Header.Get(shared.TraceparentHeader)); ok {
+			ctx = shared.ContextWithRemoteSpan(ctx, sc)
+		}
+
+		route := routeName(r.URL.Path)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route)
+		span.Kind = shared.SpanKindServer
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.route", route)
+		span.SetAttr("request_id", requestIDFrom(ctx))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttr("http.status_code", rec.status)
+	})
+}
+
+// routeName collapses IDs in a path so span names stay low-cardinality
+func routeName(path string) string {
+	switch {
+	case path == "/v1/agents/register":
+		return path
+	case strings.HasPrefix(path, "/v1/agents/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/v1/agents/"), "/")
+		if len(parts) == 2 {
+			return "/v1/agents/{id}/" + parts[1]
+		}
+	case strings.HasPrefix(path, "/v1/admin/keys/"):
+		return "/v1/admin/keys/{id}"
+	case strings.HasPrefix(path, "/v1/jobs/"):
+		return "/v1/jobs/{id}"
+	case strings.HasPrefix(path, "/v1/batches/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/v1/batches/"), "/")
+		if len(parts) == 2 {
+			return "/v1/batches/{id}/" + parts[1]
+		}
+		return "/v1/batches/{id}"
+	}
+	return path
+}
+
+// statusRecorder captures the response status for the request span
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps SSE streaming working through the wrapper
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+func TestWithTracing(t *testing.T) {
+	exporter := shared.NewMemoryExporter()
+	tracer := shared.NewTracer(exporter)
+	var inner shared.SpanContext
+	handler := withTracing(tracer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner = shared.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name      string
+		header    string
+		continues bool
+	}{
+		{"no header", "", false},
+		{"caller's trace", traceparent, true},
+		{"overlong trace id", "00-" + strings.Repeat("a", 64) + "-00f067aa0ba902b7-01", false},
+		{"overlong span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-" + strings.Repeat("b", 64) + "-01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.Reset()
+			req := httptest.NewRequest(http.MethodPost, "/v1/agents/agent-1/result", nil)
+			if tt.header != "" {
+				req.Header.Set(shared.TraceparentHeader, tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := exporter.Spans()
+			if len(spans) != 1 {
+				t.Fatalf("exported %d spans, want 1", len(spans))
+			}
+			span := spans[0]
+			if span.Name != "POST /v1/agents/{id}/result" || span.Kind != shared.SpanKindServer {
+				t.Errorf("span = %q kind %d, want POST /v1/agents/{id}/result kind server", span.Name, span.Kind)
+			}
+			if got := span.Attrs()["http.status_code"]; got != http.StatusAccepted {
+				t.Errorf("http.status_code = %v, want %d", got, http.StatusAccepted)
+			}
+			if inner != span.Context {
+				t.Errorf("handler saw span %v, want the server span %v", inner, span.Context)
+			}
+			remote, _ := shared.ParseTraceparent(traceparent)
+			continued := span.Context.TraceID == remote.TraceID && span.Parent == remote.SpanID
+			if continued != tt.continues {
+				t.Errorf("continued caller's trace = %v, want %v", continued, tt.continues)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// channelManifest is the update channel file, JSON or YAML:
+//
+//	{"minimum_version": "1.2.0", "latest_version": "1.3.0"}
+//
+// The binaries of each version sit next to it, named like the Makefile's
+// cross-compiled agents, each with a detached signature:
+//
+//	1.3.0/gpu-agent-linux-amd64
+//	1.3.0/gpu-agent-linux-amd64.sig
+//
+// Binaries are signed offline with the release key agents are built with;
+// the server only hosts them, so it can't hand agents a binary of its own.
+type channelManifest struct {
+	MinimumVersion string `json:"minimum_version" yaml:"minimum_version"` // agents below it get no work
+	LatestVersion  string `json:"latest_version" yaml:"latest_version"`   // agents below it update themselves
+}
+
+// UpdateChannel advertises agent versions and serves their binaries. The
+// manifest is read again whenever it changes, so a release is published
+// by copying its binaries in and then editing the manifest.
+type UpdateChannel struct {
+	path string
+
+	mu       sync.Mutex
+	modTime  time.Time
+	manifest channelManifest
+}
+
+// NewUpdateChannel opens the update channel whose manifest is at path
+func NewUpdateChannel(path string) (*UpdateChannel, error) {
+	c := &UpdateChannel{path: path}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the manifest if it changed since it was last read
+func (c *UpdateChannel) reload() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("stat update channel: %w", err)
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+	c.modTime = info.ModTime() // a bad manifest is reported once, not on every read
+
+	m, err := shared.LoadConfig[channelManifest](c.path)
+	if err != nil {
+		return fmt.Errorf("load update channel: %w", err)
+	}
+	for _, v := range []string{m.MinimumVersion, m.LatestVersion} {
+		if _, ok := shared.ParseVersion(v); v != "" && !ok {
+			return fmt.Errorf("update channel: invalid version %q, want major.minor.patch", v)
+		}
+	}
+	if m.MinimumVersion != "" && m.LatestVersion != "" && shared.CompareVersions(m.LatestVersion, m.MinimumVersion) < 0 {
+		return errors.New("update channel: latest_version is below minimum_version")
+	}
+	c.manifest = *m
+	return nil
+}
+
+// Versions returns the minimum and latest agent versions. A manifest that
+// fails to load is logged and the versions from the last good one are kept.
+func (c *UpdateChannel) Versions() (minimum, latest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		slog.Error("Error reloading update channel", "path", c.path, "err", err)
+	}
+	return c.manifest.MinimumVersion, c.manifest.LatestVersion
+}
+
+// Outdated reports whether an agent of the version is below the minimum
+func (c *UpdateChannel) Outdated(version string) bool {
+	minimum, _ := c.Versions()
+	return shared.BelowMinimum(version, minimum)
+}
+
+// HandleAgentUpdate handles GET /v1/agent-updates/{version}/{binary}
+// Any agent key may download; the signature, not the server, vouches for
+// the binary.
+func (h *Handlers) HandleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+	if _, ok := h.requireScope(w, r, ScopeAgentRegister); !ok {
+		return
+	}
+	if h.updates == nil {
+		h.writeError(w, http.StatusNotFound, "updates_disabled", "This server has no agent update channel")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/agent-updates/"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "gpu-agent-") || strings.ContainsAny(parts[1], `\:`) {
+		h.writeError(w, http.StatusBadRequest, "invalid_path", "Path must be /v1/agent-updates/{version}/gpu-agent-{os}-{arch}[.sig]")
+		return
+	}
+	if _, ok := shared.ParseVersion(parts[0]); !ok {
+		h.writeError(w, http.StatusBadRequest, "invalid_version", "Version must be major.minor.patch")
+		return
+	}
+
+	path := filepath.Join(filepath.Dir(h.updates.path), parts[0], parts[1])
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		h.writeError(w, http.StatusNotFound, "binary_not_found", "No agent binary of that version for that platform")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
+}
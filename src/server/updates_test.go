@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// writeChannel writes an update channel manifest and opens it
+func writeChannel(t *testing.T, manifest string) (*UpdateChannel, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "channel.json")
+	if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewUpdateChannel(path)
+}
+
+func TestUpdateChannelManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		ok       bool
+	}{
+		{"both", `{"minimum_version": "1.2.0", "latest_version": "1.3.0"}`, true},
+		{"equal", `{"minimum_version": "1.2.0", "latest_version": "1.2.0"}`, true},
+		{"minimum only", `{"minimum_version": "1.2.0"}`, true},
+		{"latest only", `{"latest_version": "1.3.0"}`, true},
+		{"neither", `{}`, true},
+		{"latest below minimum", `{"minimum_version": "1.3.0", "latest_version": "1.2.9"}`, false},
+		{"invalid version", `{"minimum_version": "1.2"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := writeChannel(t, tt.manifest)
+			if (err == nil) != tt.ok {
+				t.Errorf("NewUpdateChannel error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOutdatedAgentsAreNotCapacity(t *testing.T) {
+	h := newTestHandlers(t)
+	channel, err := writeChannel(t, `{"minimum_version": "1.2.0"}`)
+	if err != nil {
+		t.Fatalf("NewUpdateChannel: %v", err)
+	}
+	h.updates = channel
+
+	for id, version := range map[string]string{"old": "1.1.9", "dev": "dev", "embedder": "1.2.0"} {
+		kind := shared.ModelKindGenerate
+		if id == "embedder" {
+			kind = shared.ModelKindEmbed
+		}
+		agent := &Agent{ID: id, APIKeyHash: "hash-" + id, Version: version, Status: "online", Capabilities: "{}"}
+		if err := h.db.RegisterAgent(agent, []AgentModel{{AgentID: id, ModelName: "llama", MaxContext: 4096, Kind: kind}}); err != nil {
+			t.Fatalf("RegisterAgent: %v", err)
+		}
+	}
+
+	for minimum, want := range map[string]int{"": 2, "1.1.0": 1, "1.2.0": 0} {
+		if n, err := h.db.CountOnlineAgentsForModel("llama", shared.ModelKindGenerate, minimum); err != nil || n != want {
+			t.Errorf("with minimum %q counted %d agents (err %v), want %d", minimum, n, err, want)
+		}
+	}
+
+	// Only outdated agents serve the model, so the request fails at once
+	// rather than waiting for an agent that will never take it
+	srv := newTestServer(t, h)
+	body := shared.CompletionRequest{Model: "llama", Prompt: "hi", MaxTokens: 4}
+	if status := doJSON(t, http.MethodPost, srv.URL+"/v1/completions", newTestKey(t, h, ScopeClientComplete), body, nil); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", status)
+	}
+}
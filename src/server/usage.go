@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Job outcomes recorded in the usage ledger
+const (
+	OutcomeCompleted = "completed"
+	OutcomeFailed    = "failed"
+	OutcomeTimeout   = "timeout"
+	OutcomeCancelled = "cancelled"
+)
+
+// usageGroups maps a group_by value to the SQL expression it groups on and
+// the expression used as a human-readable label
+var usageGroups = map[string]struct{ key, label string }{
+	"day":    {key: `strftime('%Y-%m-%d', u.created_at, 'unixepoch')`, label: `''`},
+	"client": {key: `u.key_id`, label: `COALESCE(MAX(k.name), '')`},
+	"agent":  {key: `COALESCE(u.agent_id, '')`, label: `COALESCE(MAX(a.name), '')`},
+	"model":  {key: `u.model`, label: `''`},
+}
+
+// UsageRecord is one ledger entry for a finished job
+type UsageRecord struct {
+	JobID            string
+	KeyID            string
+	Model            string
+	AgentID          string
+	PromptTokens     int
+	CompletionTokens int
+	WallTime         time.Duration
+	Outcome          string
+	CreatedAt        time.Time
+}
+
+// UsageRollup aggregates ledger entries for one group
+type UsageRollup struct {
+	Key              string  `json:"key"`
+	Label            string  `json:"label,omitempty"`
+	Requests         int     `json:"requests"`
+	Completed        int     `json:"completed"`
+	Failed           int     `json:"failed"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	WallTimeSec      float64 `json:"wall_time_sec"`
+}
+
+// UsageResponse is the response for the admin usage endpoint
+type UsageResponse struct {
+	GroupBy string        `json:"group_by"`
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Rows    []UsageRollup `json:"rows"`
+}
+
+// RecordUsage appends a finished job to the usage ledger
+func (db *DB) RecordUsage(rec UsageRecord) error {
+	_, err := db.Exec(`
+		INSERT INTO usage (job_id, key_id, model, agent_id, prompt_tokens, completion_tokens, wall_ms, outcome, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rec.JobID, rec.KeyID, rec.Model, nullString(rec.AgentID), rec.PromptTokens, rec.CompletionTokens,
+		rec.WallTime.Milliseconds(), rec.Outcome, rec.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert usage: %w", err)
+	}
+	return nil
+}
+
+// UsageRollups aggregates the ledger between from (inclusive) and to
+// (exclusive) by one of the usageGroups
+func (db *DB) UsageRollups(groupBy string, from, to time.Time) ([]UsageRollup, error) {
+	group, ok := usageGroups[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown group: %s", groupBy)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT %s AS grp, %s,
+			COUNT(*),
+			SUM(CASE WHEN u.outcome = 'completed' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN u.outcome = 'failed' THEN 1 ELSE 0 END),
+			SUM(u.prompt_tokens),
+			SUM(u.completion_tokens),
+			SUM(u.wall_ms)
+		FROM usage u
+		LEFT JOIN api_keys k ON k.key_id = u.key_id
+		LEFT JOIN agents a ON a.agent_id = u.agent_id
+		WHERE u.created_at >= ? AND u.created_at < ?
+		GROUP BY grp
+		ORDER BY grp
+	`, group.key, group.label), from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query usage: %w", err)
+	}
+	defer rows.Close()
+
+	var rollups []UsageRollup
+	for rows.Next() {
+		var r UsageRollup
+		var wallMS int64
+		err := rows.Scan(&r.Key, &r.Label, &r.Requests, &r.Completed, &r.Failed, &r.PromptTokens, &r.CompletionTokens, &wallMS)
+		if err != nil {
+			return nil, fmt.Errorf("scan usage: %w", err)
+		}
+		r.TotalTokens = r.PromptTokens + r.CompletionTokens
+		r.WallTimeSec = float64(wallMS) / 1000
+		rollups = append(rollups, r)
+	}
+
+	return rollups, rows.Err()
+}
+
+// EachUsageRecord calls fn for every ledger entry between from and to, oldest first
+func (db *DB) EachUsageRecord(from, to time.Time, fn func(UsageRecord) error) error {
+	rows, err := db.Query(`
+		SELECT job_id, key_id, model, agent_id, prompt_tokens, completion_tokens, wall_ms, outcome, created_at
+		FROM usage
+		WHERE created_at >= ? AND created_at < ?
+		ORDER BY created_at, id
+	`, from.Unix(), to.Unix())
+	if err != nil {
+		return fmt.Errorf("query usage: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec UsageRecord
+		var agentID sql.NullString
+		var wallMS, createdAt int64
+		err := rows.Scan(&rec.JobID, &rec.KeyID, &rec.Model, &agentID, &rec.PromptTokens, &rec.CompletionTokens, &wallMS, &rec.Outcome, &createdAt)
+		if err != nil {
+			return fmt.Errorf("scan usage: %w", err)
+		}
+		rec.AgentID = agentID.String
+		rec.WallTime = time.Duration(wallMS) * time.Millisecond
+		rec.CreatedAt = time.Unix(createdAt, 0)
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// HandleAdminUsage handles GET /v1/admin/usage?group_by=day|client|agent|model&from=&to=
+func (h *Handlers) HandleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+	if _, ok := h.requireScope(w, r, ScopeAdminRead); !ok {
+		return
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy == "" {
+		groupBy = "day"
+	}
+	if _, ok := usageGroups[groupBy]; !ok {
+		h.writeError(w, http.StatusBadRequest, "invalid_group_by", "group_by must be one of day, client, agent, model")
+		return
+	}
+
+	from, to, ok := h.usageRange(w, r)
+	if !ok {
+		return
+	}
+
+	rollups, err := h.db.UsageRollups(groupBy, from, to)
+	if err != nil {
+		requestLogger(r).Error("Error aggregating usage", "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to aggregate usage")
+		return
+	}
+	if rollups == nil {
+		rollups = []UsageRollup{}
+	}
+
+	h.writeJSON(w, http.StatusOK, UsageResponse{
+		GroupBy: groupBy,
+		From:    from.Format(time.DateOnly),
+		To:      to.AddDate(0, 0, -1).Format(time.DateOnly),
+		Rows:    rollups,
+	})
+}
+
+// HandleAdminUsageExport handles GET /v1/admin/usage/export?from=&to=
+// It streams the raw ledger as CSV.
+func (h *Handlers) HandleAdminUsageExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+	if _, ok := h.requireScope(w, r, ScopeAdminRead); !ok {
+		return
+	}
+
+	from, to, ok := h.usageRange(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`,
+		from.Format(time.DateOnly), to.AddDate(0, 0, -1).Format(time.DateOnly)))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"created_at", "job_id", "key_id", "model", "agent_id",
+		"prompt_tokens", "completion_tokens", "wall_ms", "outcome"})
+
+	err := h.db.EachUsageRecord(from, to, func(rec UsageRecord) error {
+		return cw.Write([]string{
+			rec.CreatedAt.UTC().Format(time.RFC3339),
+			rec.JobID,
+			rec.KeyID,
+			rec.Model,
+			rec.AgentID,
+			strconv.Itoa(rec.PromptTokens),
+			strconv.Itoa(rec.CompletionTokens),
+			strconv.FormatInt(rec.WallTime.Milliseconds(), 10),
+			rec.Outcome,
+		})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// Headers are already sent; the truncated CSV is all we can do
+		requestLogger(r).Error("Error exporting usage", "err", err)
+	}
+}
+
+// usageRange parses the from and to dates (YYYY-MM-DD, UTC). The range
+// includes both days and defaults to the last 30 days.
+func (h *Handlers) usageRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -29)
+	to := today
+
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			h.writeError(w, http.StatusBadRequest, "invalid_from", "from must be a date like 2006-01-02")
+			return time.Time{}, time.Time{}, false
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			h.writeError(w, http.StatusBadRequest, "invalid_to", "to must be a date like 2006-01-02")
+			return time.Time{}, time.Time{}, false
+		}
+		to = t
+	}
+	if to.Before(from) {
+		h.writeError(w, http.StatusBadRequest, "invalid_range", "to must not be before from")
+		return time.Time{}, time.Time{}, false
+	}
+
+	return from, to.AddDate(0, 0, 1), true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// usageDay is the day the ledger entries of these tests are recorded on
+var usageDay = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+// recordTestUsage writes ledger entries, dated usageDay unless they say
+func recordTestUsage(t *testing.T, db *DB, recs ...UsageRecord) {
+	t.Helper()
+	for _, rec := range recs {
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = usageDay
+		}
+		if rec.Outcome == "" {
+			rec.Outcome = OutcomeCompleted
+		}
+		if err := db.RecordUsage(rec); err != nil {
+			t.Fatalf("RecordUsage: %v", err)
+		}
+	}
+}
+
+// usageRollups aggregates the ledger for usageDay
+func usageRollups(t *testing.T, db *DB, groupBy string) []UsageRollup {
+	t.Helper()
+	day := usageDay.Truncate(24 * time.Hour)
+	rollups, err := db.UsageRollups(groupBy, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("UsageRollups: %v", err)
+	}
+	return rollups
+}
+
+func TestUsageRollupsByModel(t *testing.T) {
+	db := newTestDB(t)
+	recordTestUsage(t, db,
+		UsageRecord{JobID: "1", KeyID: "k", Model: "llama", PromptTokens: 10, CompletionTokens: 5, WallTime: time.Second},
+		UsageRecord{JobID: "2", KeyID: "k", Model: "llama", PromptTokens: 20, CompletionTokens: 7, WallTime: 500 * time.Millisecond},
+		UsageRecord{JobID: "3", KeyID: "k", Model: "mistral", PromptTokens: 1, CompletionTokens: 1},
+	)
+
+	rollups := usageRollups(t, db, "model")
+	if len(rollups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(rollups))
+	}
+	llama := rollups[0]
+	if llama.Key != "llama" || llama.Requests != 2 || llama.PromptTokens != 30 || llama.CompletionTokens != 12 || llama.TotalTokens != 42 || llama.WallTimeSec != 1.5 {
+		t.Errorf("llama rollup %+v", llama)
+	}
+}
+
+func TestUsageRollupsCountOutcomes(t *testing.T) {
+	db := newTestDB(t)
+	recordTestUsage(t, db,
+		UsageRecord{JobID: "1", KeyID: "k", Model: "llama"},
+		UsageRecord{JobID: "2", KeyID: "k", Model: "llama", Outcome: OutcomeFailed},
+		UsageRecord{JobID: "3", KeyID: "k", Model: "llama", Outcome: OutcomeTimeout},
+	)
+
+	r := usageRollups(t, db, "client")[0]
+	if r.Requests != 3 || r.Completed != 1 || r.Failed != 1 {
+		t.Errorf("rollup counts %d requests, %d completed, %d failed; want 3, 1, 1", r.Requests, r.Completed, r.Failed)
+	}
+}
+
+func TestUsageRollupsExcludeOtherDays(t *testing.T) {
+	db := newTestDB(t)
+	recordTestUsage(t, db,
+		UsageRecord{JobID: "1", KeyID: "k", Model: "llama"},
+		UsageRecord{JobID: "2", KeyID: "k", Model: "llama", CreatedAt: usageDay.AddDate(0, 0, 1)},
+	)
+
+	if rollups := usageRollups(t, db, "day"); len(rollups) != 1 || rollups[0].Key != "2026-03-10" || rollups[0].Requests != 1 {
+		t.Errorf("rollups %+v, want one request on 2026-03-10", rollups)
+	}
+}
+
+func TestCompletionRecordsUsage(t *testing.T) {
+	p := newTestPool(t, reply("a", "b"))
+	req := shared.CompletionRequest{Model: testModel, Prompt: "Hello"}
+	if status := doJSON(t, http.MethodPost, p.srv.URL+"/v1/completions", p.client, req, nil); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	var recs []UsageRecord
+	p.h.db.EachUsageRecord(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), func(rec UsageRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if len(recs) != 1 {
+		t.Fatalf("%d ledger entries, want 1", len(recs))
+	}
+	rec := recs[0]
+	if rec.Outcome != OutcomeCompleted || rec.Model != testModel || rec.AgentID == "" || rec.PromptTokens != 5 || rec.CompletionTokens != 2 {
+		t.Errorf("ledger entry %+v", rec)
+	}
+}
+
+func TestAdminUsageRejectsUnknownGroup(t *testing.T) {
+	h := newTestHandlers(t)
+	srv := newTestServer(t, h)
+	if status := doJSON(t, http.MethodGet, srv.URL+"/v1/admin/usage?group_by=week", testAdminKey, nil, nil); status != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", status)
+	}
+}
+
+func TestAdminUsageExportCSV(t *testing.T) {
+	h := newTestHandlers(t)
+	srv := newTestServer(t, h)
+	recordTestUsage(t, h.db, UsageRecord{JobID: "job-1", KeyID: "k", Model: "llama", AgentID: "agent-1", PromptTokens: 3, CompletionTokens: 4, WallTime: 250 * time.Millisecond})
+
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/v1/admin/usage/export?from=2026-03-10&to=2026-03-10", testAdminKey, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	want := "2026-03-10T12:00:00Z,job-1,k,llama,agent-1,3,4,250,completed"
+	if len(rows) != 2 || strings.Join(rows[1], ",") != want {
+		t.Errorf("CSV rows %q, want a header and %q", rows, want)
+	}
+}
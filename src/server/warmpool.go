@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// Warm pool tuning
+const (
+	demandHalfLife   = 5 * time.Minute  // a model's request rate halves after this long without traffic
+	warmPlanInterval = 30 * time.Second // how often the planner runs
+	warmMinHold      = 5 * time.Minute  // an agent keeps a model at least this long before the planner moves it
+	warmLoadTimeout  = 10 * time.Minute // a load not reflected in heartbeats by then is given up on
+	warmPopularRPM   = 1.0              // demand at which a model gets its first warm replica
+	warmKeepFactor   = 2.0              // replicas are kept until demand falls to 1/factor of what warranted them
+)
+
+// demandLambda is the decay rate of request rates, per minute
+var demandLambda = math.Ln2 / demandHalfLife.Minutes()
+
+// DemandTracker keeps an exponentially decaying request rate per model
+type DemandTracker struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	rates map[string]*demandRate
+}
+
+// demandRate is a model's request rate as of a point in time
+type demandRate struct {
+	perMinute float64
+	at        time.Time
+}
+
+// NewDemandTracker creates a tracker with no demand recorded
+func NewDemandTracker() *DemandTracker {
+	return &DemandTracker{now: time.Now, rates: make(map[string]*demandRate)}
+}
+
+// Record counts one request for a model
+func (d *DemandTracker) Record(model string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	r, ok := d.rates[model]
+	if !ok {
+		r = &demandRate{at: now}
+		d.rates[model] = r
+	}
+	r.decay(now)
+	r.perMinute += demandLambda
+}
+
+// Rates returns every model's current request rate, per minute. Models
+// without meaningful demand left are forgotten.
+func (d *DemandTracker) Rates() map[string]float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	rates := make(map[string]float64, len(d.rates))
+	for model, r := range d.rates {
+		r.decay(now)
+		if r.perMinute < 0.001 {
+			delete(d.rates, model)
+			continue
+		}
+		rates[model] = r.perMinute
+	}
+	return rates
+}
+
+// decay brings the rate forward to now
+func (r *demandRate) decay(now time.Time) {
+	r.perMinute *= math.Exp(-demandLambda * now.Sub(r.at).Minutes())
+	r.at = now
+}
+
+// WarmPool plans which models agents keep loaded so that requests rarely
+// wait for a cold load. Each model gets enough replicas for its recent
+// demand and at least the replicas pinned in the registry, within the VRAM
+// agents report. Decisions reach agents as load_model and unload_model
+// heartbeat commands. Replica counts only change once demand leaves a
+// band around them, and agents keep a model for a while before they are
+// moved, so that models don't thrash.
+type WarmPool struct {
+	db         *DB
+	models     *ModelRegistry
+	demand     *DemandTracker
+	metrics    *Metrics
+	replicaRPM float64 // demand one warm replica is planned for; 0 warms pinned replicas only
+
+	mu       sync.Mutex
+	agents   map[string]*warmAgent // by agent ID
+	commands map[string][]string   // not yet delivered, by agent ID
+	plan     []WarmModelStats      // as of the last run, for the admin stats
+}
+
+// warmAgent is what the planner knows of an agent's loaded model
+type warmAgent struct {
+	loaded    string
+	since     time.Time // when loaded last changed
+	busy      bool
+	loading   string // model a load command was sent for
+	loadingAt time.Time
+}
+
+// target is the model the agent has or is about to have loaded
+func (a *warmAgent) target() string {
+	if a.loading != "" {
+		return a.loading
+	}
+	return a.loaded
+}
+
+// WarmModelStats is one model's warm pool state in the admin stats
+type WarmModelStats struct {
+	Model     string  `json:"model"`
+	DemandRPM float64 `json:"demand_rpm"`
+	Replicas  int     `json:"replicas"` // agents with the model loaded or loading
+	Min       int     `json:"min"`      // replicas are added below this
+	Max       int     `json:"max"`      // and removed above this
+}
+
+// warmCandidate is an online agent the planner may give a model
+type warmCandidate struct {
+	id     string
+	vramMB int
+	serves map[string]bool
+	state  *warmAgent
+}
+
+// NewWarmPool creates a planner for the given demand
+func NewWarmPool(db *DB, models *ModelRegistry, demand *DemandTracker, metrics *Metrics, replicaRPM float64) *WarmPool {
+	return &WarmPool{
+		db:         db,
+		models:     models,
+		demand:     demand,
+		metrics:    metrics,
+		replicaRPM: replicaRPM,
+		agents:     make(map[string]*warmAgent),
+		commands:   make(map[string][]string),
+	}
+}
+
+// Run plans the pool periodically
+// It blocks until the context is cancelled
+func (p *WarmPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(warmPlanInterval)
+	defer ticker.Stop()
+
+	slog.Info("Warm pool planner started", "interval", warmPlanInterval.String(), "replica_rpm", p.replicaRPM)
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Warm pool planner stopped")
+			return
+		case <-ticker.C:
+			p.planOnce(time.Now())
+		}
+	}
+}
+
+// Observe records the model an agent reported in its heartbeat
+func (p *WarmPool) Observe(agentID, loaded string, busy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := p.agentLocked(agentID)
+	p.setLoadedLocked(a, loaded)
+	a.busy = busy
+	if a.loading != "" && (a.loading == loaded || time.Since(a.loadingAt) > warmLoadTimeout) {
+		a.loading = ""
+	}
+}
+
+// Leased records that an agent took a job, which makes it load the job's model
+func (p *WarmPool) Leased(agentID, model string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := p.agentLocked(agentID)
+	p.setLoadedLocked(a, model)
+	a.busy = true
+	a.loading = ""
+}
+
+// Commands returns and forgets the commands planned for an agent
+func (p *WarmPool) Commands(agentID string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cmds := p.commands[agentID]
+	delete(p.commands, agentID)
+	return cmds
+}
+
+// Stats returns the pool state as of the last plan
+func (p *WarmPool) Stats() []WarmModelStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]WarmModelStats{}, p.plan...)
+}
+
+// agentLocked returns the planner's state for an agent, creating it if needed
+func (p *WarmPool) agentLocked(agentID string) *warmAgent {
+	a, ok := p.agents[agentID]
+	if !ok {
+		a = &warmAgent{since: time.Now()}
+		p.agents[agentID] = a
+	}
+	return a
+}
+
+// setLoadedLocked records the agent's loaded model, restarting its hold
+// time if the model changed
+func (p *WarmPool) setLoadedLocked(a *warmAgent, model string) {
+	if a.loaded != model {
+		a.loaded = model
+		a.since = time.Now()
+	}
+}
+
+// bounds returns the replica band of a model: replicas are added while
+// there are fewer than lower and removed while there are more than upper
+func (p *WarmPool) bounds(rate float64, pinned int) (lower, upper int) {
+	var needed, kept int
+	if p.replicaRPM > 0 {
+		if rate >= warmPopularRPM {
+			needed = int(math.Ceil(rate / p.replicaRPM))
+		}
+		if rate >= warmPopularRPM/warmKeepFactor {
+			kept = max(1, int(math.Ceil(rate*warmKeepFactor/p.replicaRPM)))
+		}
+	}
+	lower = max(needed, pinned)
+	return lower, max(kept, lower)
+}
+
+// planOnce compares the replicas of every model with its band and sends
+// the load and unload commands that bring them back inside it
+func (p *WarmPool) planOnce(now time.Time) {
+	online, err := p.db.GetOnlineAgents()
+	if err != nil {
+		slog.Error("Error listing agents for warm pool", "err", err)
+		return
+	}
+	var candidates []*warmCandidate
+	for _, agent := range online {
+		models, err := p.db.GetAgentModels(agent.ID)
+		if err != nil {
+			slog.Error("Error getting models for agent", "agent_id", agent.ID, "err", err)
+			continue
+		}
+		var caps shared.Capabilities
+		json.Unmarshal([]byte(agent.Capabilities), &caps)
+		c := &warmCandidate{id: agent.ID, vramMB: caps.VRAM_MB, serves: make(map[string]bool, len(models))}
+		for _, m := range models {
+			c.serves[m.ModelName] = true
+		}
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+	rates := p.demand.Rates()
+	pinned := p.models.MinReplicas()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Only agents that are online and have reported what they hold count
+	known := candidates[:0]
+	seen := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		seen[c.id] = true
+		if c.state = p.agents[c.id]; c.state != nil {
+			known = append(known, c)
+		}
+	}
+	candidates = known
+	for id := range p.agents {
+		if !seen[id] {
+			delete(p.agents, id)
+			delete(p.commands, id)
+		}
+	}
+
+	replicas := make(map[string]int)
+	for _, c := range candidates {
+		if m := c.state.target(); m != "" {
+			replicas[m]++
+		}
+	}
+	names := make(map[string]bool)
+	for m := range replicas {
+		names[m] = true
+	}
+	for m := range pinned {
+		names[m] = true
+	}
+	for m := range rates {
+		names[m] = true
+	}
+	var models []string
+	lower, upper := make(map[string]int), make(map[string]int)
+	for m := range names {
+		models = append(models, m)
+		lower[m], upper[m] = p.bounds(rates[m], pinned[m])
+	}
+	// Most demanded first, so popular models get agents when there are too few
+	sort.Slice(models, func(i, j int) bool {
+		if rates[models[i]] != rates[models[j]] {
+			return rates[models[i]] > rates[models[j]]
+		}
+		return models[i] < models[j]
+	})
+
+	for _, m := range models {
+		for replicas[m] < lower[m] {
+			c := p.pickLocked(candidates, m, replicas, lower, now)
+			if c == nil {
+				break
+			}
+			if old := c.state.target(); old != "" {
+				replicas[old]--
+			}
+			replicas[m]++
+			c.state.loading, c.state.loadingAt = m, now
+			p.sendLocked(c.id, "load_model", m)
+			slog.Info("Warm pool loading model", "agent_id", c.id, "model", m, "demand_rpm", rates[m], "replicas", replicas[m])
+		}
+	}
+
+	for _, c := range candidates {
+		m := c.state.loaded
+		if m == "" || c.state.loading != "" || c.state.busy || now.Sub(c.state.since) < warmMinHold {
+			continue
+		}
+		if replicas[m] > upper[m] {
+			replicas[m]--
+			p.setLoadedLocked(c.state, "")
+			p.sendLocked(c.id, "unload_model", m)
+			slog.Info("Warm pool unloading model", "agent_id", c.id, "model", m, "demand_rpm", rates[m], "replicas", replicas[m])
+		}
+	}
+
+	p.plan = p.plan[:0]
+	for _, m := range models {
+		p.plan = append(p.plan, WarmModelStats{Model: m, DemandRPM: rates[m], Replicas: replicas[m], Min: lower[m], Max: upper[m]})
+	}
+	sort.Slice(p.plan, func(i, j int) bool { return p.plan[i].Model < p.plan[j].Model })
+}
+
+// pickLocked chooses the agent to load a model on: an idle agent that
+// serves it and has the VRAM for it, holding nothing or a model that can
+// spare a replica and that it has held long enough. Agents with nothing
+// loaded go first, then those with the least VRAM, leaving large GPUs for
+// large models.
+func (p *WarmPool) pickLocked(candidates []*warmCandidate, model string, replicas, lower map[string]int, now time.Time) *warmCandidate {
+	required := 0
+	if cfg, ok := p.models.Get(model); ok {
+		required = cfg.VRAMRequired
+	}
+
+	var best *warmCandidate
+	for _, c := range candidates {
+		s := c.state
+		if !c.serves[model] || s.busy || s.loading != "" || s.loaded == model {
+			continue
+		}
+		if required > 0 && c.vramMB > 0 && c.vramMB < required {
+			continue
+		}
+		if s.loaded != "" && (replicas[s.loaded] <= lower[s.loaded] || now.Sub(s.since) < warmMinHold) {
+			continue
+		}
+		if best == nil {
+			best = c
+			continue
+		}
+		if (s.loaded == "") != (best.state.loaded == "") {
+			if s.loaded == "" {
+				best = c
+			}
+			continue
+		}
+		if c.vramMB < best.vramMB {
+			best = c
+		}
+	}
+	return best
+}
+
+// sendLocked queues a command for the agent's next heartbeat
+func (p *WarmPool) sendLocked(agentID, command, model string) {
+	p.commands[agentID] = append(p.commands[agentID], command+":"+model)
+	p.metrics.WarmPoolCommands.Inc(command)
+}
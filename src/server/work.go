@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/janvanoekelen/metalyard/src/shared"
+)
+
+// maxWorkPollWait caps how long a work poll is held open; it must stay
+// below the server's WriteTimeout
+const maxWorkPollWait = 25 * time.Second
+
+// HandleWork handles GET /v1/agents/{id}/work?timeout=N
+// It long-polls for a job the agent can serve and returns 204 if none arrives.
+func (h *Handlers) HandleWork(w http.ResponseWriter, r *http.Request, agentID string) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is allowed")
+		return
+	}
+	if !h.requireAgent(w, r, agentID) {
+		return
+	}
+	if h.updates != nil {
+		agent, err := h.db.GetAgent(agentID)
+		if err != nil && !errors.Is(err, errNotFound) {
+			requestLogger(r).Error("Error getting agent", "agent_id", agentID, "err", err)
+			h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to poll for work")
+			return
+		}
+		if agent != nil && h.updates.Outdated(agent.Version) {
+			minimum, _ := h.updates.Versions()
+			h.writeError(w, http.StatusForbidden, "agent_outdated", fmt.Sprintf("Agent version %q is below the minimum %s; update gpu-agent", agent.Version, minimum))
+			return
+		}
+	}
+
+	wait := maxWorkPollWait
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			h.writeError(w, http.StatusBadRequest, "invalid_timeout", "timeout must be a non-negative number of seconds")
+			return
+		}
+		if d := time.Duration(sec) * time.Second; d < wait {
+			wait = d
+		}
+	}
+
+	models, err := h.db.GetAgentModels(agentID)
+	if err != nil {
+		requestLogger(r).Error("Error getting models for agent", "agent_id", agentID, "err", err)
+		h.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to poll for work")
+		return
+	}
+	kinds := make(map[string]string, len(models))
+	for _, m := range models {
+		kinds[m.ModelName] = m.Kind
+	}
+	serves := func(job *Job) bool { return kinds[job.Request.Model] == job.ModelKind() }
+
+	job := h.queue.Lease(r.Context(), agentID, serves, wait)
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	jobLogger(job).Info("Job leased", "agent_id", agentID, "model", job.Request.Model, "type", job.Type)
+	h.warm.Leased(agentID, job.Request.Model)
+	if affinity := h.prefixes.Leased(agentID, job); affinity != "" {
+		h.metrics.PrefixAffinity.Inc(affinity)
+	}
+	w.Header().Set(shared.TraceparentHeader, h.queue.LeaseContext(job).Traceparent())
+	h.writeJSON(w, http.StatusOK, shared.WorkResponse{
+		RequestID:      job.ID,
+		CorrelationID:  job.CorrelationID,
+		Type:           job.Type,
+		Model:          job.Request.Model,
+		Prompt:         job.Request.Prompt,
+		MaxTokens:      job.Request.MaxTokens,
+		Input:          job.Input,
+		SamplingParams: job.Request.SamplingParams,
+	})
+}
+
+// HandleResult handles POST /v1/agents/{id}/result
+func (h *Handlers) HandleResult(w http.ResponseWriter, r *http.Request, agentID string) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is allowed")
+		return
+	}
+	if !h.requireAgent(w, r, agentID) {
+		return
+	}
+
+	var req shared.ResultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, "invalid_json", "Failed to parse request body")
+		return
+	}
+	if req.RequestID == "" {
+		h.writeError(w, http.StatusBadRequest, "missing_request_id", "request_id is required")
+		return
+	}
+
+	if err := h.queue.Deliver(r.Context(), agentID, req); err != nil {
+		switch {
+		case errors.Is(err, errJobNotFound):
+			// The client is gone; tell the agent to stop generating
+			h.writeError(w, http.StatusGone, "job_not_found", "Job is no longer active")
+		case errors.Is(err, errJobCancelled):
+			h.writeError(w, http.StatusGone, "job_cancelled", "Job was cancelled")
+		case errors.Is(err, errJobNotLeased):
+			h.writeError(w, http.StatusForbidden, "job_not_leased", "Job is not leased to this agent")
+		default:
+			h.writeError(w, http.StatusServiceUnavailable, "delivery_failed", "Failed to deliver result")
+		}
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, shared.ResultResponse{Ack: true})
+}
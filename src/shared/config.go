@@ -10,14 +10,23 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-// AgentConfig holds configuration for the GPU agent.
+// AgentConfig holds the GPU agent's connection settings: the server it
+// joins, how it authenticates there and the llama-server it runs. The
+// agent's configuration embeds it next to its models and local settings.
 type AgentConfig struct {
-	ServerURL         string        `json:"server_url" yaml:"server_url"`
-	APIKey            string        `json:"api_key" yaml:"api_key"`
-	HeartbeatInterval time.Duration `json:"heartbeat_interval" yaml:"heartbeat_interval"`
-	ModelCacheDir     string        `json:"model_cache_dir" yaml:"model_cache_dir"`
-	LlamaServerPath   string        `json:"llama_server_path" yaml:"llama_server_path"`
-	LocalPort         int           `json:"local_port" yaml:"local_port"`
+	ServerURL       string `json:"server_url" yaml:"server_url"`
+	APIKey          string `json:"api_key,omitempty" yaml:"api_key,omitempty"`                   // Issued by server on first registration
+	EnrollmentToken string `json:"enrollment_token,omitempty" yaml:"enrollment_token,omitempty"` // Single-use, cleared once an API key is issued
+	AgentID         string `json:"agent_id,omitempty" yaml:"agent_id,omitempty"`                 // Assigned by server on first registration
+	LlamaServerPath string `json:"llama_server_path,omitempty" yaml:"llama_server_path,omitempty"`
+	LocalPort       int    `json:"local_port,omitempty" yaml:"local_port,omitempty"` // llama-server port on 127.0.0.1
+
+	// HeartbeatInterval is the time between heartbeats until the server
+	// sets one.
+	HeartbeatInterval time.Duration `json:"heartbeat_interval,omitempty" yaml:"heartbeat_interval,omitempty"`
+	// ModelCacheDir is where model files are kept; relative model paths
+	// are resolved against it. Empty means the working directory.
+	ModelCacheDir string `json:"model_cache_dir,omitempty" yaml:"model_cache_dir,omitempty"`
 }
 
 // ServerConfig holds configuration for the GPU pooling server.
@@ -27,14 +36,31 @@ type ServerConfig struct {
 	StaleAgentThreshold time.Duration `json:"stale_agent_threshold" yaml:"stale_agent_threshold"`
 	RequestTimeout      time.Duration `json:"request_timeout" yaml:"request_timeout"`
 	ModelRegistry       []ModelConfig `json:"models" yaml:"models"`
+	// ModelAliases maps model names clients ask for (e.g. "claude-3-5-sonnet")
+	// to models served by the pool.
+	ModelAliases map[string]string `json:"model_aliases,omitempty" yaml:"model_aliases,omitempty"`
 }
 
+// Model kinds: what a model is used for.
+const (
+	ModelKindGenerate = "generate" // text generation (completions and chat)
+	ModelKindEmbed    = "embed"    // embedding vectors
+)
+
 // ModelConfig describes a model available in the system.
 type ModelConfig struct {
 	Name          string `json:"name" yaml:"name"`
+	Kind          string `json:"kind,omitempty" yaml:"kind,omitempty"` // ModelKindGenerate (default) or ModelKindEmbed
 	VRAMRequired  int    `json:"vram_required_mb" yaml:"vram_required_mb"`
 	MinComputeCap string `json:"min_compute_cap" yaml:"min_compute_cap"`
 	DownloadURL   string `json:"download_url" yaml:"download_url"`
+	// ChatTemplate turns chat messages into a prompt: a built-in name
+	// ("chatml", "llama3", "mistral", "gemma", "phi3") or a Go text/template
+	// over .Messages. Empty means chatml.
+	ChatTemplate string `json:"chat_template,omitempty" yaml:"chat_template,omitempty"`
+	// MinReplicas is how many agents the server keeps the model loaded on,
+	// however little it is requested.
+	MinReplicas int `json:"min_replicas,omitempty" yaml:"min_replicas,omitempty"`
 }
 
 // LoadConfig reads configuration from a file (JSON or YAML based on extension).
@@ -69,19 +95,21 @@ func LoadAgentConfig(path string) (*AgentConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.SetDefaults()
+	return config, nil
+}
 
-	// Apply defaults
-	if config.HeartbeatInterval == 0 {
-		config.HeartbeatInterval = 30 * time.Second
+// SetDefaults fills in the agent settings left unset.
+func (c *AgentConfig) SetDefaults() {
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = 30 * time.Second
 	}
-	if config.LocalPort == 0 {
-		config.LocalPort = 8081
+	if c.LlamaServerPath == "" {
+		c.LlamaServerPath = "llama-server"
 	}
-	if config.LlamaServerPath == "" {
-		config.LlamaServerPath = "llama-server"
+	if c.LocalPort == 0 {
+		c.LocalPort = 8081
 	}
-
-	return config, nil
 }
 
 // LoadServerConfig loads server configuration from a file.
@@ -127,7 +155,8 @@ func SaveConfig[T any](path string, config *T) error {
 		return fmt.Errorf("marshaling config: %w", err)
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	// Config files can hold API keys
+	if err := os.WriteFile(path, data, 0600); err != nil {
 		return fmt.Errorf("writing config file: %w", err)
 	}
 
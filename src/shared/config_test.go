@@ -0,0 +1,27 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadAgentConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	data := "server_url: https://pool.example.com\nmodel_cache_dir: /var/lib/models\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("LoadAgentConfig: %v", err)
+	}
+	if cfg.ModelCacheDir != "/var/lib/models" {
+		t.Errorf("model_cache_dir %q", cfg.ModelCacheDir)
+	}
+	if cfg.HeartbeatInterval != 30*time.Second || cfg.LocalPort != 8081 || cfg.LlamaServerPath != "llama-server" {
+		t.Errorf("defaults not applied: heartbeat_interval %v, local_port %d, llama_server_path %q", cfg.HeartbeatInterval, cfg.LocalPort, cfg.LlamaServerPath)
+	}
+}
@@ -0,0 +1,32 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Prompt prefixes are matched in fixed-size blocks. Each block's hash
+// covers the block and the hash before it, so equal hashes at position i
+// mean the first i+1 blocks are equal and the longest common prefix of two
+// chains is found by membership alone.
+const (
+	PrefixBlockSize = 256  // bytes of prompt text per block
+	MaxPrefixBlocks = 1024 // longer texts are matched on their first blocks only
+)
+
+// PrefixHashes returns the hash chain of text's complete blocks. Agents
+// report it for the text in their KV caches; the server computes it for
+// prompts to find the agent already holding the longest prefix.
+func PrefixHashes(text string) []string {
+	n := min(len(text)/PrefixBlockSize, MaxPrefixBlocks)
+	hashes := make([]string, n)
+	buf := make([]byte, 0, 8+PrefixBlockSize)
+	var prev [8]byte
+	for i := range hashes {
+		buf = append(append(buf[:0], prev[:]...), text[i*PrefixBlockSize:(i+1)*PrefixBlockSize]...)
+		sum := sha256.Sum256(buf)
+		copy(prev[:], sum[:8])
+		hashes[i] = hex.EncodeToString(prev[:])
+	}
+	return hashes
+}
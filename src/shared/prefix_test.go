@@ -0,0 +1,35 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrefixHashesSharedPrefix(t *testing.T) {
+	common := strings.Repeat("a", 2*PrefixBlockSize)
+	a := PrefixHashes(common + strings.Repeat("b", PrefixBlockSize))
+	b := PrefixHashes(common + strings.Repeat("c", PrefixBlockSize))
+
+	if len(a) != 3 || len(b) != 3 {
+		t.Fatalf("got %d and %d blocks, want 3", len(a), len(b))
+	}
+	if a[0] != b[0] || a[1] != b[1] || a[2] == b[2] {
+		t.Errorf("chains %q and %q should agree on exactly the first 2 blocks", a, b)
+	}
+}
+
+func TestPrefixHashesChainsBlocks(t *testing.T) {
+	// The same block after a different one hashes differently
+	block := strings.Repeat("x", PrefixBlockSize)
+	a := PrefixHashes(strings.Repeat("a", PrefixBlockSize) + block)
+	b := PrefixHashes(strings.Repeat("b", PrefixBlockSize) + block)
+	if a[1] == b[1] {
+		t.Error("a block's hash doesn't depend on the blocks before it")
+	}
+}
+
+func TestPrefixHashesIgnorePartialBlock(t *testing.T) {
+	if n := len(PrefixHashes(strings.Repeat("a", 2*PrefixBlockSize-1))); n != 1 {
+		t.Errorf("got %d blocks, want only the complete one", n)
+	}
+}
@@ -12,13 +12,22 @@ import (
 
 // API endpoint paths
 const (
-	PathAgentRegister  = "/api/v1/agents/register"
-	PathAgentHeartbeat = "/api/v1/agents/%s/heartbeat" // %s = agent_id
-	PathAgentWork      = "/api/v1/agents/%s/work"      // %s = agent_id
-	PathAgentResult    = "/api/v1/agents/%s/result"    // %s = agent_id
-	PathCompletions    = "/v1/completions"
+	PathAgentRegister   = "/v1/agents/register"
+	PathAgentHeartbeat  = "/v1/agents/%s/heartbeat" // %s = agent_id
+	PathAgentWork       = "/v1/agents/%s/work"      // %s = agent_id
+	PathAgentResult     = "/v1/agents/%s/result"    // %s = agent_id
+	PathCompletions     = "/v1/completions"
+	PathChatCompletions = "/v1/chat/completions"
+	PathMessages        = "/v1/messages"
+	PathEmbeddings      = "/v1/embeddings"
+	PathBatches         = "/v1/batches"
+	PathJobs            = "/v1/jobs"
 )
 
+// MaxMissedHeartbeats is how many heartbeat intervals an agent may stay
+// silent before the server marks it offline.
+const MaxMissedHeartbeats = 3
+
 // Error types for the protocol.
 var (
 	ErrNoCapableAgents   = &ProtocolError{Code: "NO_CAPABLE_AGENTS", Message: "no agents capable of running the requested model"}
@@ -26,7 +35,11 @@ var (
 	ErrAgentOffline      = &ProtocolError{Code: "AGENT_OFFLINE", Message: "agent is offline"}
 	ErrModelNotFound     = &ProtocolError{Code: "MODEL_NOT_FOUND", Message: "requested model not found"}
 	ErrUnauthorized      = &ProtocolError{Code: "UNAUTHORIZED", Message: "invalid or missing API key"}
+	ErrForbidden         = &ProtocolError{Code: "FORBIDDEN", Message: "API key is not allowed to perform this request"}
+	ErrInvalidRequest    = &ProtocolError{Code: "INVALID_REQUEST", Message: "invalid request"}
 	ErrTimeout           = &ProtocolError{Code: "TIMEOUT", Message: "request timed out"}
+	ErrCancelled         = &ProtocolError{Code: "CANCELLED", Message: "request was cancelled"}
+	ErrRateLimited       = &ProtocolError{Code: "RATE_LIMITED", Message: "rate limit or quota exceeded"}
 	ErrInternalServer    = &ProtocolError{Code: "INTERNAL_ERROR", Message: "internal server error"}
 )
 
@@ -181,6 +194,20 @@ func WriteSSEEvent(w http.ResponseWriter, data any) error {
 	return nil
 }
 
+// WriteSSENamedEvent writes a single SSE event with an event type, as used
+// by the Anthropic streaming format.
+func WriteSSENamedEvent(w http.ResponseWriter, event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
 // WriteSSEDone writes the final [DONE] marker for SSE streams.
 func WriteSSEDone(w http.ResponseWriter) {
 	fmt.Fprintf(w, "data: [DONE]\n\n")
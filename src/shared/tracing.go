@@ -0,0 +1,489 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries W3C trace context between server and agent.
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the trace ID as lowercase hex.
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// String returns the span ID as lowercase hex.
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether the span context has non-zero IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Lengths first: hex.Decode writes past the IDs given longer input
+	if len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	return sc, sc.IsValid()
+}
+
+// SpanKind describes a span's role, using the OTLP numbering.
+type SpanKind int
+
+// Span kinds.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is a timed operation within a trace. All methods are safe for
+// concurrent use and on a nil span.
+type Span struct {
+	Name      string
+	Kind      SpanKind
+	Context   SpanContext
+	Parent    SpanID // zero for root spans
+	StartTime time.Time
+
+	tracer *Tracer
+
+	mu      sync.Mutex
+	endTime time.Time
+	attrs   map[string]any
+	errMsg  string
+	ended   bool
+}
+
+// SpanContext returns the span's identity for propagation.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// SetAttr records an attribute on the span.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and hands it to the tracer's exporter. Only the
+// first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.endTime = time.Now()
+	s.mu.Unlock()
+
+	if s.tracer != nil && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(s)
+	}
+}
+
+// EndTime returns when the span ended, or the zero time if it hasn't.
+func (s *Span) EndTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.endTime
+}
+
+// Attrs returns a copy of the span's attributes.
+func (s *Span) Attrs() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := make(map[string]any, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// Err returns the span's error message, if any.
+func (s *Span) Err() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errMsg
+}
+
+// SpanExporter receives finished spans. ExportSpan must not block.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer creates spans and passes finished ones to an exporter.
+// A tracer with a nil exporter still propagates trace context but drops spans.
+type Tracer struct {
+	exporter SpanExporter
+}
+
+// NewTracer creates a tracer that exports to the given exporter.
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+type remoteSpanKey struct{}
+
+// ContextWithSpan returns a context carrying the span as the current span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// ContextWithRemoteSpan returns a context whose next span continues a
+// trace started in another process.
+func ContextWithRemoteSpan(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteSpanKey{}, sc)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the context of the current span, falling
+// back to a remote parent.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context
+	}
+	sc, _ := ctx.Value(remoteSpanKey{}).(SpanContext)
+	return sc
+}
+
+// Start begins a span that is a child of the context's span and returns a
+// context carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := t.StartWithParent(SpanContextFromContext(ctx), name)
+	return ContextWithSpan(ctx, span), span
+}
+
+// StartWithParent begins a span under an explicit parent. A zero parent
+// starts a new trace.
+func (t *Tracer) StartWithParent(parent SpanContext, name string) *Span {
+	span := &Span{
+		Name:      name,
+		Kind:      SpanKindInternal,
+		StartTime: time.Now(),
+		tracer:    t,
+	}
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Parent = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+	}
+	rand.Read(span.Context.SpanID[:])
+	return span
+}
+
+// InjectTraceparent sets the traceparent header from the context's span.
+func InjectTraceparent(ctx context.Context, h http.Header) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// MemoryExporter keeps finished spans in memory, for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewMemoryExporter creates an empty in-memory exporter.
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// ExportSpan records a finished span.
+func (e *MemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset discards all recorded spans.
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// Shutdown is a no-op.
+func (e *MemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// OTLP exporter tuning.
+const (
+	otlpFlushInterval = 5 * time.Second
+	otlpMaxQueue      = 2048 // spans beyond this are dropped until the next flush
+	otlpMaxBatch      = 512
+)
+
+// OTLPExporter batches spans and sends them to an OTLP/HTTP collector
+// using the JSON encoding.
+type OTLPExporter struct {
+	url        string
+	service    string
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+
+	flushNow chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewOTLPExporter creates an exporter posting to endpoint + "/v1/traces"
+// and starts its background flush loop.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		url:        strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:    service,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		flushNow:   make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// ExportSpan queues a finished span for the next flush.
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= otlpMaxQueue {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, span)
+	if len(e.queue) >= otlpMaxBatch {
+		select {
+		case e.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Shutdown stops the flush loop and sends any queued spans.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.flush(ctx)
+}
+
+// loop flushes queued spans periodically until Shutdown
+func (e *OTLPExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		case <-e.flushNow:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), e.httpClient.Timeout)
+		if err := e.flush(ctx); err != nil {
+			slog.Warn("OTLP span export failed", "err", err)
+		}
+		cancel()
+	}
+}
+
+// flush sends all queued spans in batches
+func (e *OTLPExporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	spans := e.queue
+	dropped := e.dropped
+	e.queue = nil
+	e.dropped = 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("OTLP export queue full, spans dropped", "count", dropped)
+	}
+	for len(spans) > 0 {
+		n := min(len(spans), otlpMaxBatch)
+		if err := e.send(ctx, spans[:n]); err != nil {
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+// send posts one batch of spans
+func (e *OTLPExporter) send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil {
+		return fmt.Errorf("encoding spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending spans: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpKeyValue is an OTLP attribute
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// otlpRequest builds an OTLP/JSON ExportTraceServiceRequest
+func otlpRequest(service string, spans []*Span) map[string]any {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           s.Context.TraceID.String(),
+			"spanId":            s.Context.SpanID.String(),
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attrs()),
+		}
+		if s.Parent != (SpanID{}) {
+			span["parentSpanId"] = s.Parent.String()
+		}
+		if msg := s.Err(); msg != "" {
+			span["status"] = map[string]any{"code": 2, "message": msg}
+		}
+		encoded = append(encoded, span)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/janvanoekelen/metalyard"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key/value pairs
+func otlpAttributes(attrs map[string]any) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]any
+		switch v := v.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", "00-" + traceID + "-" + spanID + "-01", true},
+		{"surrounding space", " 00-" + traceID + "-" + spanID + "-00 ", true},
+		{"empty", "", false},
+		{"too few parts", "00-" + traceID + "-" + spanID, false},
+		{"forbidden version", "ff-" + traceID + "-" + spanID + "-01", false},
+		{"long version", "000-" + traceID + "-" + spanID + "-01", false},
+		{"short trace id", "00-" + traceID[:30] + "-" + spanID + "-01", false},
+		{"long trace id", "00-" + traceID + "00-" + spanID + "-01", false},
+		{"very long trace id", "00-" + strings.Repeat("a", 4096) + "-" + spanID + "-01", false},
+		{"short span id", "00-" + traceID + "-" + spanID[:14] + "-01", false},
+		{"long span id", "00-" + traceID + "-" + spanID + "00-01", false},
+		{"very long span id", "00-" + traceID + "-" + strings.Repeat("b", 4096) + "-01", false},
+		{"non-hex trace id", "00-" + strings.Repeat("z", 32) + "-" + spanID + "-01", false},
+		{"non-hex span id", "00-" + traceID + "-" + strings.Repeat("z", 16) + "-01", false},
+		{"zero trace id", "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01", false},
+		{"zero span id", "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("ParseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if ok && (sc.TraceID.String() != traceID || sc.SpanID.String() != spanID) {
+				t.Errorf("ParseTraceparent(%q) = %s/%s, want %s/%s", tt.header, sc.TraceID, sc.SpanID, traceID, spanID)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	span := NewTracer(nil).StartWithParent(SpanContext{}, "root")
+	sc, ok := ParseTraceparent(span.SpanContext().Traceparent())
+	if !ok || sc != span.SpanContext() {
+		t.Fatalf("round trip = %v, %v; want %v", sc, ok, span.SpanContext())
+	}
+}
+
+func TestTracerExportsSpans(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemoteSpan(context.Background(), remote)
+	ctx, parent := tracer.Start(ctx, "parent")
+	parent.Kind = SpanKindServer
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttr("model", "llama")
+	child.SetError(errors.New("agent went away"))
+	child.End()
+	child.End() // only the first End exports
+	parent.End()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	if spans[0] != child || spans[1] != parent {
+		t.Fatalf("spans exported as %s, %s; want child, parent", spans[0].Name, spans[1].Name)
+	}
+	for _, s := range spans {
+		if s.Context.TraceID != remote.TraceID {
+			t.Errorf("%s trace ID = %s, want %s", s.Name, s.Context.TraceID, remote.TraceID)
+		}
+		if s.EndTime().Before(s.StartTime) {
+			t.Errorf("%s ended before it started", s.Name)
+		}
+	}
+	if parent.Parent != remote.SpanID {
+		t.Errorf("parent's parent = %s, want remote %s", parent.Parent, remote.SpanID)
+	}
+	if child.Parent != parent.Context.SpanID {
+		t.Errorf("child's parent = %s, want %s", child.Parent, parent.Context.SpanID)
+	}
+	if parent.Kind != SpanKindServer || child.Kind != SpanKindInternal {
+		t.Errorf("kinds = %d, %d; want server, internal", parent.Kind, child.Kind)
+	}
+	if child.Attrs()["model"] != "llama" || child.Err() != "agent went away" {
+		t.Errorf("child attrs = %v, err = %q", child.Attrs(), child.Err())
+	}
+
+	h := make(http.Header)
+	InjectTraceparent(ContextWithSpan(context.Background(), child), h)
+	if sc, ok := ParseTraceparent(h.Get(TraceparentHeader)); !ok || sc != child.Context {
+		t.Errorf("injected traceparent %q, want child's context", h.Get(TraceparentHeader))
+	}
+
+	exporter.Reset()
+	if n := len(exporter.Spans()); n != 0 {
+		t.Errorf("%d spans left after Reset", n)
+	}
+}
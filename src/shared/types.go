@@ -2,7 +2,12 @@
 // agent and server components.
 package shared
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 // GPUInfo describes a GPU's capabilities for scheduling purposes.
 type GPUInfo struct {
@@ -66,20 +71,55 @@ type HeartbeatResponse struct {
 	Commands []string `json:"commands"` // e.g., ["load_model:mistral-7b-q4"], ["shutdown"]
 }
 
+// Capabilities describes an agent's hardware, as it reports it when
+// registering and in heartbeats.
+type Capabilities struct {
+	GPUVendor string `json:"gpu_vendor"`
+	GPUModel  string `json:"gpu_model"`
+	VRAM_MB   int    `json:"vram_mb"`
+	Platform  string `json:"platform"`
+}
+
+// ModelInfo describes a model an agent can serve.
+type ModelInfo struct {
+	Name         string `json:"name"`
+	Quantization string `json:"quantization,omitempty"`
+	MaxContext   int    `json:"max_context"`
+	Kind         string `json:"kind,omitempty"` // ModelKindGenerate (default) or ModelKindEmbed
+}
+
+// Job types handed to agents.
+const (
+	JobTypeCompletion = "completion" // generate text from Prompt
+	JobTypeEmbedding  = "embedding"  // embed each string in Input
+)
+
 // WorkResponse is returned when an agent polls for work.
 type WorkResponse struct {
-	RequestID string `json:"request_id"`
-	Model     string `json:"model"`
-	Prompt    string `json:"prompt"`
-	MaxTokens int    `json:"max_tokens"`
+	RequestID     string   `json:"request_id"`
+	CorrelationID string   `json:"correlation_id,omitempty"` // client's X-Request-ID, for log correlation
+	Type          string   `json:"type,omitempty"`           // JobTypeCompletion if empty
+	Model         string   `json:"model"`
+	Prompt        string   `json:"prompt"`
+	MaxTokens     int      `json:"max_tokens"`
+	Input         []string `json:"input,omitempty"` // embedding jobs only
+	SamplingParams
 }
 
 // ResultRequest is sent by agents when submitting inference results.
+// Agents may post several times per request; Usage and FinishReason are
+// only meaningful on the final post (Finished == true). An agent that has
+// to stop, e.g. because its host is going to sleep, posts Released to hand
+// the job back; it is then run elsewhere unless output was already sent.
 type ResultRequest struct {
-	RequestID string   `json:"request_id"`
-	Tokens    []string `json:"tokens"`
-	Finished  bool     `json:"finished"`
-	Error     *string  `json:"error"` // nil if no error
+	RequestID    string           `json:"request_id"`
+	Tokens       []string         `json:"tokens"`
+	Finished     bool             `json:"finished"`
+	Error        *string          `json:"error"`                   // nil if no error
+	FinishReason string           `json:"finish_reason,omitempty"` // "stop", "length"
+	Usage        *CompletionUsage `json:"usage,omitempty"`
+	Embeddings   [][]float32      `json:"embeddings,omitempty"` // embedding jobs: one vector per input, in order
+	Released     bool             `json:"released,omitempty"`
 }
 
 // ResultResponse acknowledges receipt of inference results.
@@ -93,6 +133,47 @@ type CompletionRequest struct {
 	Prompt    string `json:"prompt"`
 	MaxTokens int    `json:"max_tokens"`
 	Stream    bool   `json:"stream"`
+	SamplingParams
+}
+
+// SamplingParams controls token sampling. Unset fields use the runner's
+// defaults. Names follow the OpenAI API where it has the parameter and
+// llama.cpp otherwise.
+type SamplingParams struct {
+	Temperature   *float64      `json:"temperature,omitempty"`
+	TopP          *float64      `json:"top_p,omitempty"`
+	TopK          *int          `json:"top_k,omitempty"`
+	MinP          *float64      `json:"min_p,omitempty"`
+	RepeatPenalty *float64      `json:"repeat_penalty,omitempty"`
+	Seed          *int64        `json:"seed,omitempty"`
+	Stop          StopSequences `json:"stop,omitempty"`
+
+	// Grammar (GBNF) and JSONSchema constrain the output; at most one may be set
+	Grammar    string          `json:"grammar,omitempty"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	// LogitBias adjusts the likelihood of tokens, keyed by token ID, by
+	// -100 (ban) to 100 (force)
+	LogitBias map[string]float64 `json:"logit_bias,omitempty"`
+}
+
+// StopSequences is a list of strings that end generation. In JSON it may
+// be a single string or an array, as in the OpenAI API.
+type StopSequences []string
+
+// UnmarshalJSON accepts a string or an array of strings.
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = StopSequences{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = many
+	return nil
 }
 
 // CompletionChoice represents a single completion result.
@@ -120,3 +201,309 @@ type CompletionResponse struct {
 type StreamChunk struct {
 	Choices []CompletionChoice `json:"choices"`
 }
+
+// ChatMessage is one message in an OpenAI-style chat.
+type ChatMessage struct {
+	Role    string      `json:"role"` // "system", "user", "assistant"
+	Content ChatContent `json:"content"`
+	Name    string      `json:"name,omitempty"`
+}
+
+// ChatContent is message text. In JSON it may be a string or an array of
+// content parts; only text parts are supported.
+type ChatContent string
+
+// UnmarshalJSON accepts a string, null, or an array of text parts.
+func (c *ChatContent) UnmarshalJSON(data []byte) error {
+	var text *string
+	if err := json.Unmarshal(data, &text); err == nil {
+		if text != nil {
+			*c = ChatContent(*text)
+		}
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		if p.Type != "text" {
+			return fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+		b.WriteString(p.Text)
+	}
+	*c = ChatContent(b.String())
+	return nil
+}
+
+// ChatCompletionRequest is an OpenAI-compatible chat completion request.
+type ChatCompletionRequest struct {
+	Model               string          `json:"model"`
+	Messages            []ChatMessage   `json:"messages"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"` // newer name for max_tokens
+	N                   int             `json:"n,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+	User                string          `json:"user,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	SamplingParams
+}
+
+// ResponseFormat asks for JSON output in a chat completion.
+type ResponseFormat struct {
+	Type       string `json:"type"` // "text", "json_object", "json_schema"
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema,omitempty"`
+}
+
+// StreamOptions configures streamed chat completions.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ChatCompletionResponse is an OpenAI-compatible chat completion.
+type ChatCompletionResponse struct {
+	ID      string          `json:"id"`
+	Object  string          `json:"object"` // "chat.completion"
+	Created int64           `json:"created"`
+	Model   string          `json:"model"`
+	Choices []ChatChoice    `json:"choices"`
+	Usage   CompletionUsage `json:"usage"`
+}
+
+// ChatChoice is one generated message.
+type ChatChoice struct {
+	Index        int              `json:"index"`
+	Message      ChatReplyMessage `json:"message"`
+	Logprobs     *struct{}        `json:"logprobs"` // always null
+	FinishReason string           `json:"finish_reason"`
+}
+
+// ChatReplyMessage is the assistant message in a chat choice.
+type ChatReplyMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ChatCompletionChunk is one streamed chat completion event.
+type ChatCompletionChunk struct {
+	ID      string            `json:"id"`
+	Object  string            `json:"object"` // "chat.completion.chunk"
+	Created int64             `json:"created"`
+	Model   string            `json:"model"`
+	Choices []ChatChunkChoice `json:"choices"`
+	Usage   *CompletionUsage  `json:"usage,omitempty"` // only on the final chunk with include_usage
+}
+
+// ChatChunkChoice is the delta for one choice in a streamed chunk.
+type ChatChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        ChatDelta `json:"delta"`
+	Logprobs     *struct{} `json:"logprobs"`      // always null
+	FinishReason *string   `json:"finish_reason"` // null until the choice ends
+}
+
+// ChatDelta is the incremental part of an assistant message.
+type ChatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// MessagesRequest is an Anthropic Messages API request. Messages use the
+// chat message shape; system is a top-level field rather than a role.
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	System        ChatContent     `json:"system,omitempty"`
+	Messages      []ChatMessage   `json:"messages"`
+	MaxTokens     int             `json:"max_tokens"`
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	TopK          *int            `json:"top_k,omitempty"`
+	Tools         json.RawMessage `json:"tools,omitempty"` // not supported; rejected when set
+}
+
+// MessagesResponse is an Anthropic Messages API response.
+type MessagesResponse struct {
+	ID           string                 `json:"id"`
+	Type         string                 `json:"type"` // "message"
+	Role         string                 `json:"role"` // "assistant"
+	Model        string                 `json:"model"`
+	Content      []MessagesContentBlock `json:"content"`
+	StopReason   *string                `json:"stop_reason"` // "end_turn", "max_tokens"; null while streaming
+	StopSequence *string                `json:"stop_sequence"`
+	Usage        MessagesUsage          `json:"usage"`
+}
+
+// MessagesContentBlock is a block of generated content; only text is produced.
+type MessagesContentBlock struct {
+	Type string `json:"type"` // "text"
+	Text string `json:"text"`
+}
+
+// MessagesUsage tracks token usage in the Anthropic format.
+type MessagesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Anthropic streaming events, sent in this order: message_start,
+// content_block_start, content_block_delta..., content_block_stop,
+// message_delta, message_stop.
+type (
+	MessageStartEvent struct {
+		Type    string           `json:"type"`
+		Message MessagesResponse `json:"message"`
+	}
+	ContentBlockStartEvent struct {
+		Type         string               `json:"type"`
+		Index        int                  `json:"index"`
+		ContentBlock MessagesContentBlock `json:"content_block"`
+	}
+	ContentBlockDeltaEvent struct {
+		Type  string    `json:"type"`
+		Index int       `json:"index"`
+		Delta TextDelta `json:"delta"`
+	}
+	ContentBlockStopEvent struct {
+		Type  string `json:"type"`
+		Index int    `json:"index"`
+	}
+	MessageDeltaEvent struct {
+		Type  string        `json:"type"`
+		Delta MessageDelta  `json:"delta"`
+		Usage MessagesUsage `json:"usage"`
+	}
+	MessageStopEvent struct {
+		Type string `json:"type"`
+	}
+)
+
+// TextDelta is the payload of a content_block_delta event.
+type TextDelta struct {
+	Type string `json:"type"` // "text_delta"
+	Text string `json:"text"`
+}
+
+// MessageDelta carries the final stop reason of a streamed message.
+type MessageDelta struct {
+	StopReason   string  `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+// EmbeddingRequest is an OpenAI-compatible embeddings request.
+type EmbeddingRequest struct {
+	Model          string         `json:"model"`
+	Input          EmbeddingInput `json:"input"`
+	EncodingFormat string         `json:"encoding_format,omitempty"` // "float" (default) or "base64"
+	User           string         `json:"user,omitempty"`
+}
+
+// EmbeddingInput is the text to embed. In JSON it may be a single string or
+// an array of strings; pre-tokenized input is not supported.
+type EmbeddingInput []string
+
+// UnmarshalJSON accepts a string or an array of strings.
+func (in *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*in = EmbeddingInput{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("input must be a string or an array of strings")
+	}
+	*in = many
+	return nil
+}
+
+// EmbeddingResponse is an OpenAI-compatible embeddings response.
+type EmbeddingResponse struct {
+	Object string          `json:"object"` // "list"
+	Data   []EmbeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  EmbeddingUsage  `json:"usage"`
+}
+
+// EmbeddingData is the vector for one input. Embedding is a []float32, or
+// a base64 string of little-endian float32s when that encoding was requested.
+type EmbeddingData struct {
+	Object    string `json:"object"` // "embedding"
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"`
+}
+
+// EmbeddingUsage tracks token usage for an embeddings request.
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// Batch statuses. A batch is queued until the server starts feeding it to
+// agents and ends completed or, after a cancel request, cancelled.
+const (
+	BatchStatusQueued     = "queued"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+	BatchStatusCompleted  = "completed"
+)
+
+// Batch is the state of an offline batch of completion requests, created
+// by uploading a JSONL file with one CompletionRequest per line.
+type Batch struct {
+	ID          string `json:"id"`
+	Object      string `json:"object"` // "batch"
+	Status      string `json:"status"`
+	Total       int    `json:"total"`
+	Completed   int    `json:"completed"`
+	Failed      int    `json:"failed"`
+	CreatedAt   int64  `json:"created_at"`
+	FinishedAt  *int64 `json:"finished_at,omitempty"`
+	CancelledAt *int64 `json:"cancelled_at,omitempty"`
+}
+
+// BatchList is the response for listing batches.
+type BatchList struct {
+	Object string  `json:"object"` // "list"
+	Data   []Batch `json:"data"`
+}
+
+// BatchResult is one line of a batch's results file. Index is the line of
+// the request in the uploaded file, counting from 0. Exactly one of
+// Response and Error is set.
+type BatchResult struct {
+	Index    int                 `json:"index"`
+	Response *CompletionResponse `json:"response,omitempty"`
+	Error    *ProtocolError      `json:"error,omitempty"`
+}
+
+// JobCancelResponse reports how many running jobs a cancel request stopped.
+type JobCancelResponse struct {
+	ID        string `json:"id"`
+	Cancelled int    `json:"cancelled"`
+}
+
+// PrefixCache is an agent's report of the text held in the KV caches of
+// its inference slots, which later requests sharing a prefix can reuse.
+type PrefixCache struct {
+	Model string      `json:"model"`
+	Slots []CacheSlot `json:"slots"`
+}
+
+// CacheSlot is one inference slot. Prefix is the PrefixHashes chain of the
+// text in its cache.
+type CacheSlot struct {
+	Busy   bool     `json:"busy"`
+	Prefix []string `json:"prefix,omitempty"`
+}
@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseVersion parses a major.minor.patch version, with an optional "v".
+func ParseVersion(s string) ([3]int, bool) {
+	var v [3]int
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// CompareVersions returns -1, 0 or 1 as a is below, equal to or above b.
+// Versions that don't parse, such as those of development builds, are
+// below every release.
+func CompareVersions(a, b string) int {
+	va, okA := ParseVersion(a)
+	vb, okB := ParseVersion(b)
+	switch {
+	case !okA && !okB:
+		return 0
+	case !okA:
+		return -1
+	case !okB:
+		return 1
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// BelowMinimum reports whether an agent of the version is below the
+// minimum version. Nothing is below an empty minimum.
+func BelowMinimum(version, minimum string) bool {
+	return minimum != "" && CompareVersions(version, minimum) < 0
+}
@@ -0,0 +1,42 @@
+package shared
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"dev", "0.0.1", -1},
+		{"1.0.0", "dev", 1},
+		{"dev", "", 0},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestBelowMinimum(t *testing.T) {
+	tests := []struct {
+		version, minimum string
+		want             bool
+	}{
+		{"1.2.0", "1.2.0", false},
+		{"1.1.9", "1.2.0", true},
+		{"1.3.0", "1.2.0", false},
+		{"dev", "1.2.0", true},
+		{"dev", "", false},
+		{"0.0.1", "", false},
+	}
+	for _, tt := range tests {
+		if got := BelowMinimum(tt.version, tt.minimum); got != tt.want {
+			t.Errorf("BelowMinimum(%q, %q) = %v, want %v", tt.version, tt.minimum, got, tt.want)
+		}
+	}
+}